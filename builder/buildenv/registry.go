@@ -0,0 +1,213 @@
+package buildenv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/hari134/comet/builder/container"
+)
+
+// ErrUnknownBuildType is returned for build types that have no environment in the registry.
+var ErrUnknownBuildType = errors.New("no build environment for build type")
+
+// Environment describes how builds of one build type run.
+type Environment struct {
+	// Image is the image reference, e.g. "node:20"
+	Image string `json:"image"`
+	// Digest pins the image, e.g. "sha256:...", so a moved tag cannot change the build
+	Digest     string            `json:"digest"`
+	Env        map[string]string `json:"env"`
+	WorkingDir string            `json:"workingDir"`
+	User       string            `json:"user"`
+	// ResourceProfile names an entry of Config.ResourceProfiles, empty uses the builder defaults
+	ResourceProfile string `json:"resourceProfile"`
+	// Pipeline names the pipeline that builds projects of this build type
+	Pipeline string `json:"pipeline"`
+}
+
+// ImageRef returns the image reference containers are created from.
+func (e Environment) ImageRef() string {
+	if e.Digest == "" {
+		return e.Image
+	}
+	return e.Image + "@" + e.Digest
+}
+
+// Config is the content of a build environment file.
+type Config struct {
+	ResourceProfiles map[string]container.ResourceProfile `json:"resourceProfiles"`
+	// Environments is keyed by build type, the BuildEnvType of project.uploaded events
+	Environments map[string]Environment `json:"environments"`
+}
+
+// Validate checks that every environment is complete and references existing resource profiles.
+func (c *Config) Validate() error {
+	if len(c.Environments) == 0 {
+		return errors.New("no build environments defined")
+	}
+	var errs []error
+	for buildType, env := range c.Environments {
+		if env.Image == "" {
+			errs = append(errs, fmt.Errorf("%s: image is required", buildType))
+		}
+		if env.Pipeline == "" {
+			errs = append(errs, fmt.Errorf("%s: pipeline is required", buildType))
+		}
+		if env.Digest != "" && !strings.HasPrefix(env.Digest, "sha256:") {
+			errs = append(errs, fmt.Errorf("%s: digest %q is not a sha256 digest", buildType, env.Digest))
+		}
+		if _, ok := c.ResourceProfiles[env.ResourceProfile]; env.ResourceProfile != "" && !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown resource profile %q", buildType, env.ResourceProfile))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LoadConfig reads and validates a build environment file.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse build environments %s: %w", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid build environments %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// PinImages resolves the digest of every environment in the file at path that has none with resolve
+// and writes it to the file, so a moved tag cannot change the builds. It returns the pinned build types.
+func PinImages(path string, resolve func(image string) (string, error)) ([]string, error) {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	// Edit the file as a document, so fields the builder does not know about are kept
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var document map[string]any
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("failed to parse build environments %s: %w", path, err)
+	}
+	environments, _ := document["environments"].(map[string]any)
+
+	var pinned []string
+	for buildType, env := range config.Environments {
+		entry, ok := environments[buildType].(map[string]any)
+		if env.Digest != "" || !ok {
+			continue
+		}
+		digest, err := resolve(env.Image)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to resolve %s: %w", buildType, env.Image, err)
+		}
+		entry["digest"] = digest
+		pinned = append(pinned, buildType)
+	}
+	sort.Strings(pinned)
+	if len(pinned) == 0 {
+		return nil, nil
+	}
+
+	data, err = json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	return pinned, nil
+}
+
+// Registry holds the build environments loaded from a file. Reload swaps in a new version of the
+// file atomically, builds already running keep the environment they started with.
+type Registry struct {
+	path   string
+	config atomic.Pointer[Config]
+}
+
+// NewRegistry loads the build environments in path.
+func NewRegistry(path string) (*Registry, error) {
+	registry := &Registry{path: path}
+	if err := registry.Reload(); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// Reload reads the file again. An invalid file is rejected and the current environments are kept.
+func (r *Registry) Reload() error {
+	config, err := LoadConfig(r.path)
+	if err != nil {
+		return err
+	}
+	r.config.Store(config)
+	return nil
+}
+
+// Lookup returns the environment of a build type.
+func (r *Registry) Lookup(buildType string) (Environment, error) {
+	env, ok := r.config.Load().Environments[buildType]
+	if !ok {
+		return Environment{}, fmt.Errorf("%w %q", ErrUnknownBuildType, buildType)
+	}
+	return env, nil
+}
+
+// Unpinned returns the build types whose image is referenced by tag only, in sorted order.
+func (r *Registry) Unpinned() []string {
+	var buildTypes []string
+	for buildType, env := range r.config.Load().Environments {
+		if env.Digest == "" {
+			buildTypes = append(buildTypes, buildType)
+		}
+	}
+	sort.Strings(buildTypes)
+	return buildTypes
+}
+
+// BuildTypes returns the configured build types in sorted order.
+func (r *Registry) BuildTypes() []string {
+	environments := r.config.Load().Environments
+	buildTypes := make([]string, 0, len(environments))
+	for buildType := range environments {
+		buildTypes = append(buildTypes, buildType)
+	}
+	sort.Strings(buildTypes)
+	return buildTypes
+}
+
+// BuildEnvironment implements container.EnvironmentResolver.
+func (r *Registry) BuildEnvironment(buildType string) (container.BuildEnvironment, error) {
+	config := r.config.Load()
+	env, ok := config.Environments[buildType]
+	if !ok {
+		return container.BuildEnvironment{}, fmt.Errorf("%w %q", ErrUnknownBuildType, buildType)
+	}
+
+	buildEnv := container.BuildEnvironment{
+		Image:      container.Image(env.ImageRef()),
+		WorkingDir: env.WorkingDir,
+		User:       env.User,
+	}
+	for key, value := range env.Env {
+		buildEnv.Env = append(buildEnv.Env, key+"="+value)
+	}
+	sort.Strings(buildEnv.Env)
+	if env.ResourceProfile != "" {
+		profile := config.ResourceProfiles[env.ResourceProfile]
+		buildEnv.Resources = &profile
+	}
+	return buildEnv, nil
+}
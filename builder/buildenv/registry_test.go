@@ -0,0 +1,79 @@
+package buildenv
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConfig = `{
+  "environments": {
+    "ReactViteNode20": {"image": "node:20", "workingDir": "/app", "pipeline": "react-vite", "owner": "web"},
+    "Pinned": {"image": "node:22", "digest": "sha256:22", "pipeline": "react-vite"}
+  }
+}`
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "buildenv.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPinImagesPinsTagOnlyEnvironments(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	registry, err := NewRegistry(path)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	if unpinned := registry.Unpinned(); len(unpinned) != 1 || unpinned[0] != "ReactViteNode20" {
+		t.Fatalf("Unpinned = %v", unpinned)
+	}
+
+	var resolved []string
+	pinned, err := PinImages(path, func(image string) (string, error) {
+		resolved = append(resolved, image)
+		return "sha256:20", nil
+	})
+	if err != nil {
+		t.Fatalf("PinImages: %v", err)
+	}
+	if len(pinned) != 1 || pinned[0] != "ReactViteNode20" || len(resolved) != 1 || resolved[0] != "node:20" {
+		t.Fatalf("pinned %v after resolving %v", pinned, resolved)
+	}
+
+	if err := registry.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if unpinned := registry.Unpinned(); len(unpinned) != 0 {
+		t.Errorf("Unpinned after PinImages = %v", unpinned)
+	}
+	env, err := registry.BuildEnvironment("ReactViteNode20")
+	if err != nil || env.Image != "node:20@sha256:20" {
+		t.Errorf("BuildEnvironment = %+v, %v", env, err)
+	}
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), `"owner": "web"`) {
+		t.Errorf("PinImages dropped unknown fields:\n%s", data)
+	}
+}
+
+func TestReloadKeepsEnvironmentsOfInvalidFile(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	registry, err := NewRegistry(path)
+	if err != nil {
+		t.Fatalf("NewRegistry: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(`{"environments": {"Broken": {"image": "node:20"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Reload(); err == nil {
+		t.Fatal("Reload accepted an environment without pipeline")
+	}
+	if _, err := registry.Lookup("ReactViteNode20"); err != nil {
+		t.Errorf("Lookup after rejected reload: %v", err)
+	}
+}
@@ -0,0 +1,354 @@
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hari134/comet/builder/container"
+	"github.com/hari134/comet/core/storage"
+)
+
+// CacheOutput is the source of dependency cache lines sent with build output
+const CacheOutput = "cache"
+
+const (
+	keyPrefix     = "dependencies/"
+	archiveSuffix = ".tar.gz"
+
+	DefaultMaxSize       = int64(20 << 30)
+	DefaultMaxAge        = 7 * 24 * time.Hour
+	defaultEvictInterval = time.Hour
+)
+
+// Spec describes the dependencies of a kind of project.
+type Spec struct {
+	// ProjectDir is the directory holding the lockfiles
+	ProjectDir string
+	// Lockfiles are the lockfiles of ProjectDir that key the cache, a project without any is not cached
+	Lockfiles []string
+	// Paths are the absolute paths saved and restored, missing paths are skipped
+	Paths []string
+}
+
+// NodeDependencies caches node_modules and the stores of npm, yarn and pnpm. The stores are only
+// found when the build environment points the package managers to /tmp/comet-cache, through
+// NPM_CONFIG_CACHE, YARN_CACHE_FOLDER and NPM_CONFIG_STORE_DIR.
+var NodeDependencies = Spec{
+	ProjectDir: "/app",
+	Lockfiles:  []string{"package-lock.json", "npm-shrinkwrap.json", "yarn.lock", "pnpm-lock.yaml"},
+	Paths:      []string{"/app/node_modules", "/tmp/comet-cache"},
+}
+
+// DependencyCache keeps the installed dependencies of projects as gzipped tarballs in a Store, keyed
+// by the lockfiles of the project and the digest of the build image. Unlike docker volumes, tarballs
+// work with every container backend and are shared by every builder using the store. Entries are
+// scoped to their project, so a build cannot plant dependencies in the builds of another project.
+type DependencyCache struct {
+	store    storage.Store
+	bucket   string
+	maxSize  int64
+	maxAge   time.Duration
+	interval time.Duration
+}
+
+func NewDependencyCache(store storage.Store, bucket string) *DependencyCache {
+	return &DependencyCache{
+		store:    store,
+		bucket:   bucket,
+		maxSize:  DefaultMaxSize,
+		maxAge:   DefaultMaxAge,
+		interval: defaultEvictInterval,
+	}
+}
+
+// WithMaxSize bounds the total size of the cache, Evict removes the oldest entries beyond it.
+func (dc *DependencyCache) WithMaxSize(maxSize int64) *DependencyCache {
+	dc.maxSize = maxSize
+	return dc
+}
+
+// WithMaxAge makes Evict remove entries saved longer than maxAge ago. Entries restored after half
+// of maxAge are saved again by their build, so entries in use do not expire.
+func (dc *DependencyCache) WithMaxAge(maxAge time.Duration) *DependencyCache {
+	dc.maxAge = maxAge
+	return dc
+}
+
+func (dc *DependencyCache) WithInterval(interval time.Duration) *DependencyCache {
+	dc.interval = interval
+	return dc
+}
+
+// Key returns the key of the dependencies of the project in buildContainer, or an empty key when
+// they cannot be cached because the project has no lockfile or the container cannot tell its image.
+func (dc *DependencyCache) Key(ctx context.Context, buildContainer container.BuildContainer, spec Spec, projectID string) (string, error) {
+	digester, ok := buildContainer.(container.ImageDigester)
+	if !ok || projectID == "" {
+		return "", nil
+	}
+	lockfiles := make([]string, len(spec.Lockfiles))
+	for i, lockfile := range spec.Lockfiles {
+		lockfiles[i] = path.Join(spec.ProjectDir, lockfile)
+	}
+	lockfiles, err := existingPaths(ctx, buildContainer, lockfiles)
+	if err != nil || len(lockfiles) == 0 {
+		return "", err
+	}
+	imageDigest, err := digester.ImageDigest(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\n", imageDigest)
+	for _, lockfile := range lockfiles {
+		fmt.Fprintf(hash, "%s\n", path.Base(lockfile))
+		if err := hashFile(ctx, buildContainer, lockfile, hash); err != nil {
+			return "", err
+		}
+	}
+	return keyPrefix + url.PathEscape(projectID) + "/" + hex.EncodeToString(hash.Sum(nil)) + archiveSuffix, nil
+}
+
+// Restore extracts the entry into buildContainer and reports whether it is fresh, a missing entry
+// or one due to expire should be saved again once the build succeeded. A failed restore removes
+// what it extracted, so the install starts from scratch.
+func (dc *DependencyCache) Restore(ctx context.Context, buildContainer container.BuildContainer, spec Spec, key string) (bool, error) {
+	info, err := dc.store.Stat(ctx, dc.bucket, key)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := dc.extract(ctx, buildContainer, key); err != nil {
+		removeCommand := "rm -rf " + shellQuote(spec.Paths...)
+		if result, removeErr := buildContainer.ExecCmd(context.WithoutCancel(ctx), removeCommand); removeErr != nil || result.ExitCode != 0 {
+			log.Printf("dependency cache: failed to remove partially restored %s", key)
+		}
+		return false, err
+	}
+	return time.Since(info.LastModified) < dc.maxAge/2, nil
+}
+
+func (dc *DependencyCache) extract(ctx context.Context, buildContainer container.BuildContainer, key string) error {
+	var archive io.ReadCloser
+	if streamStore, ok := dc.store.(storage.StreamStore); ok {
+		var err error
+		if archive, err = streamStore.Open(ctx, dc.bucket, key); err != nil {
+			return err
+		}
+	} else {
+		data, err := dc.store.Get(ctx, dc.bucket, key)
+		if err != nil {
+			return err
+		}
+		archive = io.NopCloser(data)
+	}
+	defer archive.Close()
+	gz, err := gzip.NewReader(archive)
+	if err != nil {
+		return fmt.Errorf("corrupt dependency cache entry %s: %w", key, err)
+	}
+	defer gz.Close()
+	// Entries are named relative to the root, which every backend extracts the same way
+	return buildContainer.CopyToContainer(ctx, gz, "/")
+}
+
+// Save archives the paths of spec in buildContainer under key, replacing an existing entry.
+func (dc *DependencyCache) Save(ctx context.Context, buildContainer container.BuildContainer, spec Spec, key string) error {
+	paths, err := existingPaths(ctx, buildContainer, spec.Paths)
+	if err != nil || len(paths) == 0 {
+		return err
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeArchive(ctx, buildContainer, paths, writer))
+	}()
+	defer reader.Close()
+	if streamStore, ok := dc.store.(storage.StreamStore); ok {
+		return streamStore.PutStream(ctx, reader, -1, dc.bucket, key)
+	}
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, reader); err != nil {
+		return err
+	}
+	return dc.store.Put(ctx, &buf, dc.bucket, key)
+}
+
+// writeArchive writes a gzipped tar of paths to w. The container names entries relative to the
+// parent of each path, they are renamed relative to the root.
+func writeArchive(ctx context.Context, buildContainer container.BuildContainer, paths []string, w io.Writer) error {
+	gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(gz)
+	for _, containerPath := range paths {
+		if err := copyEntries(ctx, buildContainer, containerPath, tw); err != nil {
+			return fmt.Errorf("failed to archive %s: %w", containerPath, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func copyEntries(ctx context.Context, buildContainer container.BuildContainer, containerPath string, tw *tar.Writer) error {
+	archive, err := buildContainer.CopyFromContainer(ctx, containerPath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	parent := strings.TrimPrefix(path.Dir(path.Clean(containerPath)), "/")
+	tr := tar.NewReader(archive)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(parent, header.Name)
+		if header.Typeflag == tar.TypeLink {
+			header.Linkname = path.Join(parent, header.Linkname)
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// hashFile writes the content of the file at containerPath to hash.
+func hashFile(ctx context.Context, buildContainer container.BuildContainer, containerPath string, hash io.Writer) error {
+	archive, err := buildContainer.CopyFromContainer(ctx, containerPath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	tr := tar.NewReader(archive)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%s is not a regular file", containerPath)
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeReg {
+			_, err := io.Copy(hash, tr)
+			return err
+		}
+	}
+}
+
+// existingPaths returns the paths that exist in buildContainer, asking the container itself since
+// a failed copy does not tell a missing path from other errors.
+func existingPaths(ctx context.Context, buildContainer container.BuildContainer, paths []string) ([]string, error) {
+	cmd := fmt.Sprintf(`for p in %s; do if [ -e "$p" ]; then echo "$p"; fi; done`, shellQuote(paths...))
+	result, err := buildContainer.ExecCmd(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if result.ExitCode != 0 {
+		return nil, fmt.Errorf("failed to look up %s: %s", strings.Join(paths, ", "), result.StderrTail(5))
+	}
+	var existing []string
+	for _, line := range strings.Split(result.Stdout, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			existing = append(existing, line)
+		}
+	}
+	return existing, nil
+}
+
+func shellQuote(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// EvictionReport summarises an eviction run.
+type EvictionReport struct {
+	Entries      int
+	Bytes        int64
+	DeletedKeys  []string
+	DeletedBytes int64
+}
+
+// Evict removes the entries older than the maximum age, then the oldest entries until the cache
+// fits its maximum size.
+func (dc *DependencyCache) Evict(ctx context.Context) (EvictionReport, error) {
+	var entries []storage.ObjectInfo
+	err := storage.WalkPrefix(ctx, dc.store, dc.bucket, keyPrefix, func(object storage.ObjectInfo) error {
+		if strings.HasSuffix(object.Key, archiveSuffix) {
+			entries = append(entries, object)
+		}
+		return nil
+	})
+	if err != nil {
+		return EvictionReport{}, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastModified.Before(entries[j].LastModified)
+	})
+
+	report := EvictionReport{Entries: len(entries)}
+	for _, entry := range entries {
+		report.Bytes += entry.Size
+	}
+	cutoff := time.Now().Add(-dc.maxAge)
+	remaining := report.Bytes
+	for _, entry := range entries {
+		expired := dc.maxAge > 0 && entry.LastModified.Before(cutoff)
+		oversize := dc.maxSize > 0 && remaining > dc.maxSize
+		if !expired && !oversize {
+			break
+		}
+		if err := dc.store.Delete(ctx, dc.bucket, entry.Key); err != nil {
+			return report, err
+		}
+		remaining -= entry.Size
+		report.DeletedKeys = append(report.DeletedKeys, entry.Key)
+		report.DeletedBytes += entry.Size
+	}
+	return report, nil
+}
+
+// Run evicts every interval until ctx is done.
+func (dc *DependencyCache) Run(ctx context.Context) {
+	ticker := time.NewTicker(dc.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if report, err := dc.Evict(ctx); err != nil {
+			log.Printf("dependency cache: eviction failed: %v", err)
+		} else if len(report.DeletedKeys) > 0 {
+			log.Printf("dependency cache: evicted %d entries, %d bytes", len(report.DeletedKeys), report.DeletedBytes)
+		}
+	}
+}
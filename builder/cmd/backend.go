@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+	units "github.com/docker/go-units"
+	"github.com/hari134/comet/builder/buildenv"
+	"github.com/hari134/comet/builder/cache"
+	"github.com/hari134/comet/builder/container"
+	"github.com/hari134/comet/builder/pipeline"
+	"github.com/hari134/comet/core/storage"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// resourceProfiles gives every billing plan its share of the host. PLAN_PROFILES points to the JSON
+// file of plan profiles and defaults to the plans.json next to the builder binary, BUILD_STORAGE_SIZE
+// caps the writable layer of every build on storage drivers that support it.
+func resourceProfiles() *container.ResourceProfiles {
+	path := os.Getenv("PLAN_PROFILES")
+	if path == "" {
+		path = besideBinary("plans.json")
+	}
+	profiles, err := container.LoadPlanProfiles(path)
+	if err != nil {
+		log.Fatalf("Failed to load plan profiles: %v", err)
+	}
+	if storageSize := os.Getenv("BUILD_STORAGE_SIZE"); storageSize != "" {
+		defaultProfile := container.DefaultResourceProfile
+		defaultProfile.StorageSize = storageSize
+		profiles.WithDefault(defaultProfile)
+	}
+	return profiles
+}
+
+// imageLock pins tags to the digest they had when first pulled, delete an entry of IMAGE_LOCK to move it.
+func imageLock() *container.ImageLock {
+	imageLockPath := os.Getenv("IMAGE_LOCK")
+	if imageLockPath == "" {
+		imageLockPath = "images.lock.json"
+	}
+	lock, err := container.NewImageLock(imageLockPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return lock
+}
+
+// sandboxProfiles isolates builds by the trust level of their project. SANDBOX_PROFILES points to a
+// JSON file overriding the profile of a level, e.g. to run untrusted builds under gVisor, and
+// DEFAULT_TRUST_LEVEL applies to projects without a trust level.
+func sandboxProfiles() *container.SandboxProfiles {
+	profiles := container.NewSandboxProfiles()
+	if path := os.Getenv("SANDBOX_PROFILES"); path != "" {
+		loaded, err := container.LoadSandboxProfiles(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		profiles = loaded
+	}
+	if levelName := os.Getenv("DEFAULT_TRUST_LEVEL"); levelName != "" {
+		level, err := container.ParseTrustLevel(levelName)
+		if err != nil {
+			log.Fatalf("invalid DEFAULT_TRUST_LEVEL: %v", err)
+		}
+		profiles.WithDefaultTrustLevel(level)
+	}
+	return profiles
+}
+
+// dependencyCache keeps the dependencies of builds in DEPENDENCY_CACHE_BUCKET of the store, caching is
+// off when it is not set. DEPENDENCY_CACHE_MAX_SIZE, e.g. "20g", and DEPENDENCY_CACHE_MAX_AGE, e.g.
+// "168h", bound the cache.
+func dependencyCache(store storage.Store) *cache.DependencyCache {
+	bucket := os.Getenv("DEPENDENCY_CACHE_BUCKET")
+	if bucket == "" {
+		return nil
+	}
+	dependencyCache := cache.NewDependencyCache(store, bucket)
+	if maxSize := os.Getenv("DEPENDENCY_CACHE_MAX_SIZE"); maxSize != "" {
+		size, err := units.RAMInBytes(maxSize)
+		if err != nil {
+			log.Fatalf("invalid DEPENDENCY_CACHE_MAX_SIZE: %v", err)
+		}
+		dependencyCache.WithMaxSize(size)
+	}
+	if maxAge := os.Getenv("DEPENDENCY_CACHE_MAX_AGE"); maxAge != "" {
+		age, err := time.ParseDuration(maxAge)
+		if err != nil {
+			log.Fatalf("invalid DEPENDENCY_CACHE_MAX_AGE: %v", err)
+		}
+		dependencyCache.WithMaxAge(age)
+	}
+	return dependencyCache
+}
+
+// dockerBackend runs every build in a docker container. It also removes the containers builds
+// leave behind and keeps the warm pool filled.
+func dockerBackend(capacity int, environments container.EnvironmentResolver, networkPolicy container.NetworkPolicy, pipelineManager *pipeline.PipelineManager) *container.DockerContainerManager {
+	dockerClient, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	imagePuller := container.NewImagePuller().WithClient(dockerClient).WithLock(imageLock())
+
+	containerManager := container.NewDockerContainerManager().
+		WithCapacity(capacity).
+		WithClient(dockerClient).
+		WithResourceProfiles(resourceProfiles()).
+		WithSandboxProfiles(sandboxProfiles()).
+		WithEnvironments(environments).
+		WithImagePuller(imagePuller)
+
+	// "builder prewarm" pulls every build image and exits, PREWARM_IMAGES=true does the same before serving
+	prewarmOnly := len(os.Args) > 1 && os.Args[1] == "prewarm"
+	if prewarmOnly || os.Getenv("PREWARM_IMAGES") == "true" {
+		err := containerManager.PullImages(context.Background(), func(buildType string, line string) {
+			log.Printf("%s: %s", buildType, line)
+		})
+		if err != nil {
+			log.Fatalf("Failed to pull build images: %v", err)
+		}
+		log.Println("Build images are ready")
+		if prewarmOnly {
+			os.Exit(0)
+		}
+	}
+
+	containerManager.WithNetworkPolicy(networkPolicy)
+	if proxyNetwork := os.Getenv("REGISTRY_PROXY_NETWORK"); proxyNetwork != "" {
+		containerManager.WithRegistryProxy(&container.RegistryProxy{
+			Network:     proxyNetwork,
+			RegistryURL: os.Getenv("REGISTRY_PROXY_URL"),
+			HTTPProxy:   os.Getenv("REGISTRY_HTTP_PROXY"),
+		})
+	}
+
+	// Containers left behind by a previous run are removed before the warm pool fills up, the
+	// reaper then keeps removing containers whose build is gone or exceeds MAX_BUILD_DURATION
+	reaper := container.NewReaper(containerManager).WithBuildTracker(func(correlationID string) bool {
+		for _, running := range pipelineManager.Running() {
+			if running.ToString() == correlationID {
+				return true
+			}
+		}
+		return false
+	})
+	if maxBuildDuration := os.Getenv("MAX_BUILD_DURATION"); maxBuildDuration != "" {
+		duration, err := time.ParseDuration(maxBuildDuration)
+		if err != nil {
+			log.Fatalf("invalid MAX_BUILD_DURATION: %v", err)
+		}
+		reaper.WithMaxBuildDuration(duration)
+	}
+	if removed, err := reaper.Sweep(context.Background()); err != nil {
+		log.Printf("Startup sweep failed: %v", err)
+	} else {
+		log.Printf("Startup sweep removed %d build containers", removed)
+	}
+	go reaper.Run(context.Background())
+
+	// WARM_POOL keeps started containers ready per build type, e.g. "ReactViteNode20=2". The pool
+	// starts last so its containers get the network policy and registry proxy set above.
+	if warmPool := os.Getenv("WARM_POOL"); warmPool != "" {
+		for _, entry := range strings.Split(warmPool, ",") {
+			buildType, sizeRaw, _ := strings.Cut(strings.TrimSpace(entry), "=")
+			size, err := strconv.Atoi(sizeRaw)
+			if err != nil {
+				log.Fatalf("invalid WARM_POOL entry %q: %v", entry, err)
+			}
+			containerManager.WithWarmPool(buildType, size)
+		}
+		containerManager.StartWarmPool(context.Background())
+	}
+
+	return containerManager
+}
+
+// namespaceBackend runs every build as local processes isolated in Linux namespaces, for developers
+// without docker. BUILD_IMAGE_DIR holds the OCI image tarballs, BUILD_WORK_DIR the extracted rootfs.
+func namespaceBackend(capacity int, environments container.EnvironmentResolver, networkPolicy container.NetworkPolicy) *container.NamespaceContainerManager {
+	containerManager := container.NewNamespaceContainerManager().
+		WithCapacity(capacity).
+		WithEnvironments(environments).
+		WithNetworkPolicy(networkPolicy)
+	if imageDir := os.Getenv("BUILD_IMAGE_DIR"); imageDir != "" {
+		containerManager.WithImageDir(imageDir)
+	}
+	if workDir := os.Getenv("BUILD_WORK_DIR"); workDir != "" {
+		containerManager.WithWorkDir(workDir)
+	}
+	return containerManager
+}
+
+// kubernetesBackend runs every build in a pod of its own in BUILD_NAMESPACE. The builder uses its
+// service account in the cluster, or KUBECONFIG when it runs outside of it.
+func kubernetesBackend(capacity int, environments container.EnvironmentResolver, networkPolicy container.NetworkPolicy) *container.KubernetesContainerManager {
+	var config *rest.Config
+	var err error
+	if kubeconfig := os.Getenv("KUBECONFIG"); kubeconfig != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	containerManager := container.NewKubernetesContainerManager().
+		WithCapacity(capacity).
+		WithClient(clientset).
+		WithExecutor(container.NewSPDYPodExecutor(config, clientset)).
+		WithResourceProfiles(resourceProfiles()).
+		WithSandboxProfiles(sandboxProfiles()).
+		WithEnvironments(environments).
+		WithImageLock(imageLock()).
+		WithNetworkPolicy(networkPolicy)
+	if namespace := os.Getenv("BUILD_NAMESPACE"); namespace != "" {
+		containerManager.WithNamespace(namespace)
+	}
+	if maxBuildDuration := os.Getenv("MAX_BUILD_DURATION"); maxBuildDuration != "" {
+		duration, err := time.ParseDuration(maxBuildDuration)
+		if err != nil {
+			log.Fatalf("invalid MAX_BUILD_DURATION: %v", err)
+		}
+		containerManager.WithMaxBuildDuration(duration)
+	}
+	return containerManager
+}
+
+// besideBinary returns the path of a config file shipped next to the builder binary, wherever the
+// builder is started from.
+func besideBinary(name string) string {
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatalf("failed to locate builder binary for %s: %v", name, err)
+	}
+	return filepath.Join(filepath.Dir(executable), name)
+}
+
+// pinBuildImages pins every tag-only image in the build environment file to the digest the registry
+// currently serves for it.
+func pinBuildImages(path string) {
+	dockerClient, err := client.NewClientWithOpts(client.FromEnv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pinned, err := buildenv.PinImages(path, func(image string) (string, error) {
+		inspect, err := dockerClient.DistributionInspect(context.Background(), image, "")
+		if err != nil {
+			return "", err
+		}
+		return inspect.Descriptor.Digest.String(), nil
+	})
+	if err != nil {
+		log.Fatalf("Failed to pin build images: %v", err)
+	}
+	if len(pinned) == 0 {
+		log.Printf("Build images in %s are already pinned", path)
+		return
+	}
+	log.Printf("Pinned build images of %s in %s", strings.Join(pinned, ", "), path)
+}
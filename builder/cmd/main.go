@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/docker/docker/client"
+	"github.com/hari134/comet/builder/buildenv"
 	"github.com/hari134/comet/builder/container"
+	"github.com/hari134/comet/builder/pipeline"
 	"github.com/hari134/comet/builder/pipeline/pipelines"
+	"github.com/hari134/comet/builder/stream"
 	"github.com/hari134/comet/core/storage"
 	"github.com/hari134/comet/builder/transport"
 	"github.com/joho/godotenv"
@@ -27,32 +34,109 @@ func main() {
 	if err != nil{
 		log.Fatal(err)
 	}
-	dockerClient, err := client.NewClientWithOpts(client.FromEnv)
+	// Build environments are reloaded on SIGHUP, an invalid file keeps the current environments.
+	// BUILD_ENV_CONFIG defaults to the buildenv.json next to the builder binary.
+	buildEnvPath := os.Getenv("BUILD_ENV_CONFIG")
+	if buildEnvPath == "" {
+		buildEnvPath = besideBinary("buildenv.json")
+	}
+	// "builder pin-images" writes the current digest of every tag-only build image to the file and exits
+	if len(os.Args) > 1 && os.Args[1] == "pin-images" {
+		pinBuildImages(buildEnvPath)
+		os.Exit(0)
+	}
+	environments, err := buildenv.NewRegistry(buildEnvPath)
 	if err != nil {
 		log.Fatal(err)
 	}
-	containerManager := container.NewDockerContainerManager().WithCapacity(capacity).WithClient(dockerClient)
+	if unpinned := environments.Unpinned(); len(unpinned) > 0 {
+		log.Printf("Build images of %s are not pinned to a digest, run \"builder pin-images\" to pin them", strings.Join(unpinned, ", "))
+	}
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			if err := environments.Reload(); err != nil {
+				log.Printf("Failed to reload build environments: %v", err)
+				continue
+			}
+			log.Printf("Reloaded build environments: %s", strings.Join(environments.BuildTypes(), ", "))
+		}
+	}()
 
-	// Create AWS credentials from environment variables
-	awsCreds := storage.AWSCredentials{
-		AccessKey:       os.Getenv("AWS_ACCESS_KEY_ID"),
-		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
-		Region:          os.Getenv("AWS_REGION"),
+	// BUILD_TIMEOUT bounds a whole build, e.g. "30m", builds are unbounded when it is not set
+	pipelineManager := pipeline.NewPipelineManager()
+	if buildTimeout := os.Getenv("BUILD_TIMEOUT"); buildTimeout != "" {
+		timeout, err := time.ParseDuration(buildTimeout)
+		if err != nil {
+			log.Fatalf("invalid BUILD_TIMEOUT: %v", err)
+		}
+		pipelineManager.WithBuildTimeout(timeout)
 	}
-	store ,err:= storage.NewS3Store(awsCreds)
-	if err != nil{
+
+	// BUILD_NETWORK_POLICY is one of full, registry-proxy or none-after-install
+	networkPolicy := container.NetworkFull
+	if policyName := os.Getenv("BUILD_NETWORK_POLICY"); policyName != "" {
+		networkPolicy, err = container.ParseNetworkPolicy(policyName)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// CONTAINER_BACKEND=namespace runs builds as local processes without a docker daemon,
+	// CONTAINER_BACKEND=kubernetes runs them as pods
+	var containerManager container.ContainerManager
+	switch backend := os.Getenv("CONTAINER_BACKEND"); backend {
+	case "", "docker":
+		containerManager = dockerBackend(capacity, environments, networkPolicy, pipelineManager)
+	case "namespace":
+		containerManager = namespaceBackend(capacity, environments, networkPolicy)
+	case "kubernetes":
+		containerManager = kubernetesBackend(capacity, environments, networkPolicy)
+	default:
+		log.Fatalf("unknown CONTAINER_BACKEND %q", backend)
+	}
+
+	store, err := storage.NewStoreFromEnv("")
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Start the receiver in a goroutine
-	receiver := transport.NewRestReceiver().WithEndpoint("127.0.0.1:8080")
+	// Start the receiver in a goroutine, BUILDER_LISTEN_ADDR lets the server reach it from another host
+	listenAddr := os.Getenv("BUILDER_LISTEN_ADDR")
+	if listenAddr == "" {
+		listenAddr = "127.0.0.1:8080"
+	}
+	// BUILDER_TOKEN is shared with the server, which sends it with every event and expects it back
+	builderToken := os.Getenv("BUILDER_TOKEN")
+	if builderToken == "" {
+		log.Println("BUILDER_TOKEN is not set, events are accepted without authentication")
+	}
+	receiver := transport.NewRestReceiver().WithEndpoint(listenAddr).WithToken(builderToken)
 
 	eventHandler := transport.NewRestReceiverEventHandler().
 		WithContainerManager(containerManager).
-		WithStorage(store)
+		WithStorage(store).
+		WithPipelineManager(pipelineManager).
+		WithEnvironments(environments)
+	// Build events and output, as builder.stream events, are sent to STREAM_ENDPOINT.
+	// Builds run without reporting anything when it is not set.
+	if streamEndpoint := os.Getenv("STREAM_ENDPOINT"); streamEndpoint != "" {
+		eventSender := &transport.RestSender{Endpoint: streamEndpoint, Token: builderToken}
+		eventHandler.
+			WithEventSender(eventSender).
+			WithStreamManager(stream.NewStreamManager(eventSender))
+	} else {
+		log.Println("STREAM_ENDPOINT is not set, build events and output are not sent")
+	}
+	// Eviction runs here rather than in a backend, so it applies to docker, namespace and kubernetes builds alike
+	if dependencyCache := dependencyCache(store); dependencyCache != nil {
+		go dependencyCache.Run(context.Background())
+		eventHandler.WithDependencyCache(dependencyCache)
+	}
 
 	go func() {
-		log.Println("Starting receiver on port 8080...")
+		log.Printf("Starting receiver on %s...", listenAddr)
 		err := receiver.StartReceiving(eventHandler)
 		if err != nil {
 			log.Fatalf("Receiver failed to start: %v", err)
@@ -60,3 +144,4 @@ func main() {
 	}()
 	select{}
 }
+
@@ -1,8 +1,10 @@
 package container
 
 import (
-	"bytes"
+	"context"
 	"io"
+	"strings"
+	"time"
 )
 
 /*
@@ -16,11 +18,57 @@ import (
    5. Execute commands in the container
 */
 
+// Every method honours ctx. A command whose ctx is cancelled returns ctx.Err() without waiting for
+// it to finish, callers tear the container down to make sure it no longer runs.
 type BuildContainer interface {
-	CopyToContainer(tarFile *bytes.Buffer, containerPath string) error
-	CopyFromContainer(containerPath string) (io.ReadCloser, error)
-	Start() error
-	Stop() error
-	Remove() error
-	ExecCmd(cmd string) (string, error)
-}
\ No newline at end of file
+	CopyToContainer(ctx context.Context, tarFile io.Reader, containerPath string) error
+	CopyFromContainer(ctx context.Context, containerPath string) (io.ReadCloser, error)
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+	Remove(ctx context.Context) error
+	ExecCmd(ctx context.Context, cmd string) (ExecResult, error)
+	// ExecCmdStream runs cmd like ExecCmd and additionally sends every line of output to
+	// output as it is produced. The channel is not closed when the command finishes.
+	ExecCmdStream(ctx context.Context, cmd string, output chan<- OutputLine) (ExecResult, error)
+	// RestrictNetwork cuts the network access the container keeps after its dependencies are installed,
+	// what is cut depends on the network policy the container was created with
+	RestrictNetwork(ctx context.Context) error
+	// OOMKilled reports whether a process of the container was killed for exceeding its memory limit
+	OOMKilled(ctx context.Context) (bool, error)
+}
+
+// ImageDigester is implemented by build containers that can tell which image they run exactly,
+// caches whose content depends on the image are keyed by it.
+type ImageDigester interface {
+	ImageDigest(ctx context.Context) (string, error)
+}
+
+const (
+	Stdout = "stdout"
+	Stderr = "stderr"
+)
+
+// OutputLine is a single line of command output, Source is either Stdout or Stderr.
+type OutputLine struct {
+	Source string
+	Text   string
+}
+
+// ExecResult is the outcome of a command executed in a build container.
+// A command that ran but exited with a non-zero code is not an error of ExecCmd,
+// callers decide how to treat the exit code.
+type ExecResult struct {
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	Duration time.Duration
+}
+
+// StderrTail returns the last n lines of stderr, which usually hold the reason a build failed.
+func (r ExecResult) StderrTail(n int) string {
+	lines := strings.Split(strings.TrimRight(r.Stderr, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
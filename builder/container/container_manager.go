@@ -1,47 +1,337 @@
 package container
 
 import (
+	"context"
 	"errors"
-
-	"github.com/docker/docker/client"
+	"fmt"
+	"log"
+	"reflect"
+	"sync"
+	"time"
 )
 
+// BuildRequest describes the build a container is created for.
+type BuildRequest struct {
+	// BuildID and CorrelationID identify the build, they label its container
+	BuildID       string
+	CorrelationID string
+	BuildType     string
+	// Plan is the billing plan of the project owner, it selects the resource profile together with BuildType
+	Plan string
+	// NetworkPolicy tightens the network policy of the build type when set, it cannot loosen it
+	NetworkPolicy NetworkPolicy
+	// UserID identifies the account the build belongs to, capacity is shared fairly between accounts
+	UserID string
+	// OnQueued is called with the queue position of the build while it waits for capacity
+	OnQueued func(position int)
+	// OnAcquired is called with the func releasing the capacity of the build once it is admitted. The
+	// container releases it when removed, the holder of the build releases it when the build ends, so
+	// a container that is dropped without Remove does not keep its capacity.
+	OnAcquired func(release func())
+	// OnPullProgress receives the progress of the image pull when the image of the build is missing
+	OnPullProgress PullProgress
+	// TrustLevel is the trust level of the project, it selects the sandbox of the build
+	TrustLevel TrustLevel
+	// OnSandbox is called with the effective sandbox of the build once its container exists
+	OnSandbox func(sandbox Sandbox)
+}
+
 type ContainerManager interface {
-	NewBuildContainer(buildType string) (BuildContainer,error)
+	NewBuildContainer(ctx context.Context, req BuildRequest) (BuildContainer,error)
 }
 
 type DockerContainerManager struct {
-	capacity int // concurrency limit the number of container to run concurrently
-	client   *client.Client
+	capacity  int // concurrency limit the number of container to run concurrently
+	scheduler *Scheduler
+	client    DockerAPI
+	profiles  *ResourceProfiles
+
+	networkPolicy            NetworkPolicy
+	buildTypeNetworkPolicies map[string]NetworkPolicy
+	registryProxy            *RegistryProxy
+
+	environments EnvironmentResolver
+	puller       *ImagePuller
+	pool         *warmPool
+	sandboxes    *SandboxProfiles
+
+	mu   sync.Mutex
+	live map[string]liveContainer
+}
+
+// liveContainer is a container handed to a build that has not been removed yet.
+type liveContainer struct {
+	container     *DockerBuildContainer
+	buildID       string
+	correlationID string
+	assignedAt    time.Time
 }
 
 func NewDockerContainerManager() *DockerContainerManager{
-	return &DockerContainerManager{}
+	dcm := &DockerContainerManager{
+		scheduler:                NewScheduler(0),
+		networkPolicy:            NetworkFull,
+		buildTypeNetworkPolicies: make(map[string]NetworkPolicy),
+		live:                     make(map[string]liveContainer),
+	}
+	dcm.pool = newWarmPool(func(ctx context.Context, buildType string) (*DockerBuildContainer, error) {
+		env, err := dcm.environment(buildType)
+		if err != nil {
+			return nil, err
+		}
+		return dcm.createContainer(ctx, BuildRequest{BuildType: buildType}, env)
+	})
+	return dcm
 }
 
+// WithCapacity limits the number of builds that run at once, further builds are queued until one
+// ends. Idle warm pool containers do not count, the host has to fit the warm pool on top of capacity.
 func (dcm *DockerContainerManager) WithCapacity(capacity int) *DockerContainerManager{
 	dcm.capacity = capacity
+	dcm.scheduler = NewScheduler(capacity)
 	return dcm
 }
 
-func (dcm *DockerContainerManager) WithClient(client *client.Client) *DockerContainerManager{
+func (dcm *DockerContainerManager) Scheduler() *Scheduler{
+	return dcm.scheduler
+}
+
+func (dcm *DockerContainerManager) WithClient(client DockerAPI) *DockerContainerManager{
 	dcm.client = client
 	return dcm
 }
 
-func (cm *DockerContainerManager) NewBuildContainer(buildType string) (BuildContainer,error) {
-	switch buildType {
-	case "ReactViteNode20":
-		dockerContainer,err := NewDockerBuildContainer().
-			WithImage("node:20").
-			WithClient(cm.client).
-			Create()
+func (dcm *DockerContainerManager) WithResourceProfiles(profiles *ResourceProfiles) *DockerContainerManager{
+	dcm.profiles = profiles
+	return dcm
+}
+
+// WithNetworkPolicy sets the network policy of builds whose build type has none of its own.
+func (dcm *DockerContainerManager) WithNetworkPolicy(policy NetworkPolicy) *DockerContainerManager{
+	dcm.networkPolicy = policy
+	return dcm
+}
+
+func (dcm *DockerContainerManager) WithBuildTypeNetworkPolicy(buildType string, policy NetworkPolicy) *DockerContainerManager{
+	dcm.buildTypeNetworkPolicies[buildType] = policy
+	return dcm
+}
+
+func (dcm *DockerContainerManager) WithRegistryProxy(proxy *RegistryProxy) *DockerContainerManager{
+	dcm.registryProxy = proxy
+	return dcm
+}
+
+// WithSandboxProfiles isolates builds by the trust level of their project. Without profiles
+// builds run with the docker defaults.
+func (dcm *DockerContainerManager) WithSandboxProfiles(sandboxes *SandboxProfiles) *DockerContainerManager{
+	dcm.sandboxes = sandboxes
+	return dcm
+}
+
+// WithEnvironments sets where the image and defaults of each build type come from.
+func (dcm *DockerContainerManager) WithEnvironments(environments EnvironmentResolver) *DockerContainerManager{
+	dcm.environments = environments
+	return dcm
+}
+
+// WithImagePuller pulls missing images before containers are created from them.
+// Without a puller images must already be present on the docker host.
+func (dcm *DockerContainerManager) WithImagePuller(puller *ImagePuller) *DockerContainerManager{
+	dcm.puller = puller
+	return dcm
+}
+
+// PullImages pulls the images of every build environment, so no build waits for a pull.
+func (dcm *DockerContainerManager) PullImages(ctx context.Context, progress func(buildType string, line string)) error {
+	if dcm.environments == nil || dcm.puller == nil {
+		return errors.New("pulling images requires build environments and an image puller")
+	}
+	var errs []error
+	for _, buildType := range dcm.environments.BuildTypes() {
+		env, err := dcm.environments.BuildEnvironment(buildType)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		_, err = dcm.puller.Ensure(ctx, env.Image, func(line string) {
+			if progress != nil {
+				progress(buildType, line)
+			}
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", buildType, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WithWarmPool keeps size started containers of the build type ready for builds, see StartWarmPool.
+// Only builds using the default resource profile, network policy and sandbox of their build type
+// are served from the pool.
+func (dcm *DockerContainerManager) WithWarmPool(buildType string, size int) *DockerContainerManager{
+	dcm.pool.sizes[buildType] = size
+	return dcm
+}
+
+// StartWarmPool fills the warm pool and replenishes it in the background until ctx is done,
+// when the idle containers are removed. Call it once the manager is configured, pool containers
+// are created with the network policy, registry proxy and sandbox set at that time.
+func (dcm *DockerContainerManager) StartWarmPool(ctx context.Context) {
+	go dcm.pool.run(ctx)
+}
+
+func (cm *DockerContainerManager) networkPolicyFor(req BuildRequest) NetworkPolicy {
+	policy := cm.networkPolicy
+	if buildTypePolicy, ok := cm.buildTypeNetworkPolicies[req.BuildType]; ok {
+		policy = buildTypePolicy
+	}
+	return policy.restrict(req.NetworkPolicy)
+}
+
+func (cm *DockerContainerManager) resourceProfile(req BuildRequest, env BuildEnvironment) ResourceProfile {
+	if cm.profiles == nil {
+		return DefaultResourceProfile.merge(derefProfile(env.Resources))
+	}
+	return cm.profiles.resolve(req.BuildType, env.Resources, req.Plan)
+}
+
+func (cm *DockerContainerManager) sandboxFor(req BuildRequest) Sandbox {
+	if cm.sandboxes == nil {
+		return Sandbox{}
+	}
+	return cm.sandboxes.Resolve(req.TrustLevel)
+}
+
+func derefProfile(profile *ResourceProfile) ResourceProfile {
+	if profile == nil {
+		return ResourceProfile{}
+	}
+	return *profile
+}
+
+func (cm *DockerContainerManager) environment(buildType string) (BuildEnvironment, error) {
+	if cm.environments == nil {
+		return BuildEnvironment{}, errors.New("no build environments configured")
+	}
+	return cm.environments.BuildEnvironment(buildType)
+}
 
-		if err != nil{
-			return nil,err
+// NewBuildContainer waits for capacity and returns a started container for the build, taken from
+// the warm pool when possible. The capacity is held until the container is removed or the build
+// releases it through BuildRequest.OnAcquired.
+func (cm *DockerContainerManager) NewBuildContainer(ctx context.Context, req BuildRequest) (BuildContainer,error) {
+	env, err := cm.environment(req.BuildType)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := cm.scheduler.acquire(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if dockerContainer := cm.takeFromPool(ctx, req, env); dockerContainer != nil {
+		defer cm.pool.endLease(dockerContainer.id)
+		cm.reportSandbox(req)
+		return cm.track(dockerContainer, req, release), nil
+	}
+
+	dockerContainer, err := cm.createContainer(ctx, req, env)
+	if err != nil{
+		release()
+		return nil,err
+	}
+	cm.reportSandbox(req)
+	return cm.track(dockerContainer, req, release), nil
+}
+
+func (cm *DockerContainerManager) reportSandbox(req BuildRequest) {
+	if req.OnSandbox != nil {
+		req.OnSandbox(cm.sandboxFor(req))
+	}
+}
+
+// track records the container as owned by the build until it is removed, when its capacity is released.
+func (cm *DockerContainerManager) track(dockerContainer *DockerBuildContainer, req BuildRequest, release func()) *DockerBuildContainer {
+	cm.mu.Lock()
+	cm.live[dockerContainer.id] = liveContainer{
+		container:     dockerContainer,
+		buildID:       req.BuildID,
+		correlationID: req.CorrelationID,
+		assignedAt:    time.Now(),
+	}
+	cm.mu.Unlock()
+	return dockerContainer.WithOnRemove(func() {
+		cm.mu.Lock()
+		delete(cm.live, dockerContainer.id)
+		cm.mu.Unlock()
+		release()
+	})
+}
+
+func (cm *DockerContainerManager) liveContainer(containerID string) (liveContainer, bool) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	live, ok := cm.live[containerID]
+	return live, ok
+}
+
+// takeFromPool returns a warm container matching the build, skipping containers that died while
+// idle or were created from an environment that has since been reloaded.
+func (cm *DockerContainerManager) takeFromPool(ctx context.Context, req BuildRequest, env BuildEnvironment) *DockerBuildContainer {
+	defaults := BuildRequest{BuildType: req.BuildType}
+	if cm.networkPolicyFor(req) != cm.networkPolicyFor(defaults) || !reflect.DeepEqual(cm.resourceProfile(req, env), cm.resourceProfile(defaults, env)) {
+		return nil
+	}
+	if !reflect.DeepEqual(cm.sandboxFor(req).SandboxProfile, cm.sandboxFor(defaults).SandboxProfile) {
+		return nil
+	}
+	for {
+		dockerContainer := cm.pool.take(req.BuildType)
+		if dockerContainer == nil {
+			return nil
+		}
+		if reflect.DeepEqual(dockerContainer.environment, env) {
+			running, err := dockerContainer.running(ctx)
+			if err == nil && running {
+				return dockerContainer
+			}
+		}
+		log.Printf("warm pool: discarding stale container %s", dockerContainer.id)
+		if err := dockerContainer.Remove(context.WithoutCancel(ctx)); err != nil {
+			log.Printf("warm pool: failed to remove container %s: %v", dockerContainer.id, err)
+		}
+		cm.pool.endLease(dockerContainer.id)
+	}
+}
+
+// createContainer creates and starts a container for the build.
+func (cm *DockerContainerManager) createContainer(ctx context.Context, req BuildRequest, env BuildEnvironment) (*DockerBuildContainer, error) {
+	image := env.Image
+	if cm.puller != nil {
+		pinned, err := cm.puller.Ensure(ctx, env.Image, req.OnPullProgress)
+		if err != nil {
+			return nil, err
+		}
+		image = pinned
+	}
+	dockerContainer,err := NewDockerBuildContainer().
+		WithEnvironment(env).
+		WithImage(image).
+		WithClient(cm.client).
+		WithResources(cm.resourceProfile(req, env)).
+		WithNetworkPolicy(cm.networkPolicyFor(req), cm.registryProxy).
+		WithLabels(buildLabels(req)).
+		WithSandbox(cm.sandboxFor(req).SandboxProfile).
+		Create(ctx)
+	if err != nil{
+		return nil,err
+	}
+	if err := dockerContainer.Start(ctx); err != nil {
+		if removeErr := dockerContainer.Remove(context.WithoutCancel(ctx)); removeErr != nil {
+			log.Printf("failed to remove container %s after start failure: %v", dockerContainer.id, removeErr)
 		}
-		return dockerContainer, nil
-	default:
-		return nil,errors.New("container for given build type not found")
+		return nil, err
 	}
+	return dockerContainer, nil
 }
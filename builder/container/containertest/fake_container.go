@@ -0,0 +1,387 @@
+// Package containertest provides an in-memory build container and container manager for testing
+// stages, pipelines and event handlers without a container runtime.
+package containertest
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hari134/comet/builder/container"
+)
+
+// ExecHandler scripts the outcome of a command run in a BuildContainer. It may read and write
+// the virtual filesystem of the container and should return ctx.Err() once ctx is done if it blocks.
+type ExecHandler func(ctx context.Context, fc *BuildContainer, cmd string) (container.ExecResult, error)
+
+type execRule struct {
+	match   func(cmd string) bool
+	handler ExecHandler
+}
+
+// BuildContainer is an in-memory container.BuildContainer with a virtual filesystem and scripted
+// command results. Commands without a matching rule succeed with an empty output.
+type BuildContainer struct {
+	mu                sync.Mutex
+	files             map[string][]byte
+	rules             []execRule
+	commands          []string
+	started           bool
+	stopped           bool
+	removed           bool
+	networkRestricted bool
+	oomKilled         bool
+	imageDigest       string
+}
+
+func NewBuildContainer() *BuildContainer {
+	return &BuildContainer{files: make(map[string][]byte)}
+}
+
+// OnExec runs handler for every command starting with prefix. Rules are matched in the order they were added.
+func (fc *BuildContainer) OnExec(prefix string, handler ExecHandler) *BuildContainer {
+	return fc.OnExecMatch(func(cmd string) bool { return strings.HasPrefix(cmd, prefix) }, handler)
+}
+
+// OnExecMatch runs handler for every command match returns true for.
+func (fc *BuildContainer) OnExecMatch(match func(cmd string) bool, handler ExecHandler) *BuildContainer {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.rules = append(fc.rules, execRule{match: match, handler: handler})
+	return fc
+}
+
+// WithExecResult makes commands starting with prefix return result.
+func (fc *BuildContainer) WithExecResult(prefix string, result container.ExecResult) *BuildContainer {
+	return fc.OnExec(prefix, func(ctx context.Context, fc *BuildContainer, cmd string) (container.ExecResult, error) {
+		return result, nil
+	})
+}
+
+// WithOOMKilled makes OOMKilled report oomKilled, as if the memory limit had been exceeded.
+func (fc *BuildContainer) WithOOMKilled(oomKilled bool) *BuildContainer {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.oomKilled = oomKilled
+	return fc
+}
+
+// WriteFile stores a file in the virtual filesystem.
+func (fc *BuildContainer) WriteFile(filePath string, data []byte) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.files[cleanFakePath(filePath)] = append([]byte(nil), data...)
+}
+
+// ReadFile returns a file of the virtual filesystem.
+func (fc *BuildContainer) ReadFile(filePath string) ([]byte, bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	data, ok := fc.files[cleanFakePath(filePath)]
+	return append([]byte(nil), data...), ok
+}
+
+// Files returns the paths of every file in the virtual filesystem in sorted order.
+func (fc *BuildContainer) Files() []string {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	paths := make([]string, 0, len(fc.files))
+	for filePath := range fc.files {
+		paths = append(paths, filePath)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Commands returns the commands executed so far, in order.
+func (fc *BuildContainer) Commands() []string {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return append([]string(nil), fc.commands...)
+}
+
+func (fc *BuildContainer) Started() bool {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.started
+}
+
+func (fc *BuildContainer) Stopped() bool {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.stopped
+}
+
+func (fc *BuildContainer) Removed() bool {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.removed
+}
+
+func (fc *BuildContainer) NetworkRestricted() bool {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.networkRestricted
+}
+
+// WithImageDigest makes the container report digest as the digest of its image, containers without
+// one report an error like a container whose image cannot be inspected.
+func (fc *BuildContainer) WithImageDigest(digest string) *BuildContainer {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.imageDigest = digest
+	return fc
+}
+
+func (fc *BuildContainer) ImageDigest(ctx context.Context) (string, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.imageDigest == "" {
+		return "", errors.New("fake container has no image digest")
+	}
+	return fc.imageDigest, nil
+}
+
+// container.BuildContainer interface functions
+
+// CopyToContainer extracts the tar archive into containerPath.
+func (fc *BuildContainer) CopyToContainer(ctx context.Context, tarFile io.Reader, containerPath string) error {
+	if err := fc.checkUsable(ctx); err != nil {
+		return err
+	}
+	tr := tar.NewReader(tarFile)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		fc.WriteFile(path.Join(containerPath, header.Name), data)
+	}
+}
+
+// CopyFromContainer returns a tar archive of containerPath. Like docker, entries are named
+// relative to the parent of containerPath.
+func (fc *BuildContainer) CopyFromContainer(ctx context.Context, containerPath string) (io.ReadCloser, error) {
+	if err := fc.checkUsable(ctx); err != nil {
+		return nil, err
+	}
+	root := cleanFakePath(containerPath)
+	parent := path.Dir(root)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	found := false
+	for _, filePath := range fc.Files() {
+		if filePath != root && !strings.HasPrefix(filePath, root+"/") {
+			continue
+		}
+		found = true
+		data, _ := fc.ReadFile(filePath)
+		name := strings.TrimPrefix(strings.TrimPrefix(filePath, parent), "/")
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no such file or directory: %s", containerPath)
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(&buf), nil
+}
+
+func (fc *BuildContainer) Start(ctx context.Context) error {
+	if err := fc.checkUsable(ctx); err != nil {
+		return err
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.started = true
+	return nil
+}
+
+func (fc *BuildContainer) Stop(ctx context.Context) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.stopped = true
+	return nil
+}
+
+func (fc *BuildContainer) Remove(ctx context.Context) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.removed = true
+	return nil
+}
+
+func (fc *BuildContainer) ExecCmd(ctx context.Context, cmd string) (container.ExecResult, error) {
+	return fc.ExecCmdStream(ctx, cmd, nil)
+}
+
+func (fc *BuildContainer) ExecCmdStream(ctx context.Context, cmd string, output chan<- container.OutputLine) (container.ExecResult, error) {
+	if err := fc.checkUsable(ctx); err != nil {
+		return container.ExecResult{}, err
+	}
+	fc.mu.Lock()
+	fc.commands = append(fc.commands, cmd)
+	var handler ExecHandler
+	for _, rule := range fc.rules {
+		if rule.match(cmd) {
+			handler = rule.handler
+			break
+		}
+	}
+	fc.mu.Unlock()
+
+	startedAt := time.Now()
+	result := container.ExecResult{}
+	if handler != nil {
+		var err error
+		result, err = handler(ctx, fc, cmd)
+		if err != nil {
+			return container.ExecResult{}, err
+		}
+	}
+	if result.Duration == 0 {
+		result.Duration = time.Since(startedAt)
+	}
+	if output != nil {
+		sendLines(output, container.Stdout, result.Stdout)
+		sendLines(output, container.Stderr, result.Stderr)
+	}
+	return result, nil
+}
+
+// sendLines streams text line by line like the real containers do.
+func sendLines(output chan<- container.OutputLine, source string, text string) {
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if line != "" {
+			output <- container.OutputLine{Source: source, Text: strings.TrimRight(line, "\r\n")}
+		}
+	}
+}
+
+func (fc *BuildContainer) RestrictNetwork(ctx context.Context) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.networkRestricted = true
+	return nil
+}
+
+func (fc *BuildContainer) OOMKilled(ctx context.Context) (bool, error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.oomKilled, nil
+}
+
+// checkUsable fails like docker does for a cancelled request or a removed container.
+func (fc *BuildContainer) checkUsable(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.removed {
+		return errors.New("container has been removed")
+	}
+	return nil
+}
+
+func cleanFakePath(filePath string) string {
+	return path.Clean("/" + filePath)
+}
+
+// ContainerManager is a container.ContainerManager handing out BuildContainers.
+type ContainerManager struct {
+	newContainer func(req container.BuildRequest) (*BuildContainer, error)
+	scheduler    *container.Scheduler
+
+	mu         sync.Mutex
+	requests   []container.BuildRequest
+	containers []*BuildContainer
+}
+
+// NewContainerManager hands out containers created by newContainer, a nil newContainer hands
+// out empty BuildContainers.
+func NewContainerManager(newContainer func(req container.BuildRequest) (*BuildContainer, error)) *ContainerManager {
+	if newContainer == nil {
+		newContainer = func(req container.BuildRequest) (*BuildContainer, error) {
+			return NewBuildContainer(), nil
+		}
+	}
+	return &ContainerManager{newContainer: newContainer}
+}
+
+// WithScheduler makes builds wait for capacity of scheduler. Unlike the real backends the fake
+// containers do not release it on Remove, only container.BuildRequest.OnAcquired does.
+func (fm *ContainerManager) WithScheduler(scheduler *container.Scheduler) *ContainerManager {
+	fm.scheduler = scheduler
+	return fm
+}
+
+func (fm *ContainerManager) NewBuildContainer(ctx context.Context, req container.BuildRequest) (container.BuildContainer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	release := func() {}
+	if fm.scheduler != nil {
+		var err error
+		release, err = fm.scheduler.Acquire(ctx, req.UserID, req.OnQueued)
+		if err != nil {
+			return nil, err
+		}
+		if req.OnAcquired != nil {
+			req.OnAcquired(release)
+		}
+	}
+	fakeContainer, err := fm.newContainer(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if err := fakeContainer.Start(ctx); err != nil {
+		release()
+		return nil, err
+	}
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.requests = append(fm.requests, req)
+	fm.containers = append(fm.containers, fakeContainer)
+	return fakeContainer, nil
+}
+
+// Requests returns the build requests received so far, in order.
+func (fm *ContainerManager) Requests() []container.BuildRequest {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	return append([]container.BuildRequest(nil), fm.requests...)
+}
+
+// Containers returns the containers handed out so far, in order.
+func (fm *ContainerManager) Containers() []*BuildContainer {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	return append([]*BuildContainer(nil), fm.containers...)
+}
@@ -7,20 +7,35 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"path"
 	"path/filepath"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 )
 
 type Image string
 
+// keepAliveCmd keeps a build container running between the commands executed in it
+var keepAliveCmd = []string{"sleep", "infinity"}
+
 // Implements the BuildContainer interface
 type DockerBuildContainer struct {
-	id     string
-	image  Image
-	client *client.Client
+	id          string
+	image       Image
+	environment BuildEnvironment
+	client      ContainerAPI
+	resources   ResourceProfile
+
+	networkPolicy NetworkPolicy
+	registryProxy *RegistryProxy
+	network       string
+	sandbox       SandboxProfile
+
+	labels   map[string]string
+	onRemove func()
 }
 
 func NewDockerBuildContainer() *DockerBuildContainer {
@@ -34,107 +49,303 @@ func (c *DockerBuildContainer) WithImage(image Image) *DockerBuildContainer {
 	return c
 }
 
-func (c *DockerBuildContainer) WithClient(client *client.Client) *DockerBuildContainer {
+// WithEnvironment sets the image and container defaults of the build environment.
+func (c *DockerBuildContainer) WithEnvironment(environment BuildEnvironment) *DockerBuildContainer {
+	c.environment = environment
+	c.image = environment.Image
+	return c
+}
+
+func (c *DockerBuildContainer) WithClient(client ContainerAPI) *DockerBuildContainer {
 	c.client = client
 	return c
 }
 
-func (c *DockerBuildContainer) Create() (*DockerBuildContainer, error) {
-	ctx := context.Background()
+// WithResources sets the limits applied to the container when it is created.
+func (c *DockerBuildContainer) WithResources(resources ResourceProfile) *DockerBuildContainer {
+	c.resources = resources
+	return c
+}
+
+// WithNetworkPolicy sets what the container can reach, proxy is only used by NetworkRegistryProxy.
+func (c *DockerBuildContainer) WithNetworkPolicy(policy NetworkPolicy, proxy *RegistryProxy) *DockerBuildContainer {
+	c.networkPolicy = policy
+	c.registryProxy = proxy
+	return c
+}
+
+func (c *DockerBuildContainer) WithLabels(labels map[string]string) *DockerBuildContainer {
+	c.labels = labels
+	return c
+}
+
+// WithSandbox isolates the container from its host beyond the docker defaults.
+func (c *DockerBuildContainer) WithSandbox(sandbox SandboxProfile) *DockerBuildContainer {
+	c.sandbox = sandbox
+	return c
+}
+
+// WithOnRemove sets a func called once the container has been removed, or removal was attempted.
+func (c *DockerBuildContainer) WithOnRemove(onRemove func()) *DockerBuildContainer {
+	c.onRemove = onRemove
+	return c
+}
+
+func (c *DockerBuildContainer) Create(ctx context.Context) (*DockerBuildContainer, error) {
+	networkMode, env, network, err := networkConfig(c.networkPolicy, c.registryProxy)
+	if err != nil {
+		return nil, err
+	}
+	user := c.environment.User
+	if c.sandbox.User != "" {
+		user = c.sandbox.User
+	}
 	containerConfig := &container.Config{
-		Image: string(c.image),
+		Image:      string(c.image),
+		Cmd:        keepAliveCmd,
+		Env:        append(append(append([]string{}, c.environment.Env...), env...), c.sandbox.env()...),
+		WorkingDir: c.environment.WorkingDir,
+		User:       user,
+		Labels:     c.labels,
+	}
+	hostConfig := c.resources.hostConfig()
+	hostConfig.NetworkMode = networkMode
+	if err := c.sandbox.apply(hostConfig, c.environment.WorkingDir); err != nil {
+		return nil, err
 	}
+	// An init process forwards stop signals, which the keep-alive command would ignore as pid 1
+	init := true
+	hostConfig.Init = &init
 
-	resp, err := c.client.ContainerCreate(ctx, containerConfig, nil, nil, nil, "")
+	resp, err := c.client.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, "")
 	if err != nil {
 		return nil, err
 	}
 	c.id = resp.ID
+	c.network = network
 	return c, nil
 }
 
 // BuildContainer interface functions
 
-func (c *DockerBuildContainer) CopyToContainer(content *bytes.Buffer, containerPath string) error {
-	ctx := context.Background()
-	if err := c.client.CopyToContainer(ctx, c.id, "/", content, types.CopyToContainerOptions{}); err != nil {
+// CopyToContainer extracts the tar archive into containerPath.
+func (c *DockerBuildContainer) CopyToContainer(ctx context.Context, content io.Reader, containerPath string) error {
+	if c.sandbox.isolated() {
+		// Extracted by the build user, docker cannot copy into a read-only root and copies as root
+		result, err := c.exec(ctx, []string{"tar", "-x", "-f", "-", "-C", containerPath}, content, nil, nil)
+		if err != nil {
+			return err
+		}
+		if result.ExitCode != 0 {
+			return fmt.Errorf("tar extraction failed with exit code %d: %s", result.ExitCode, result.StderrTail(5))
+		}
+		return nil
+	}
+	if err := c.client.CopyToContainer(ctx, c.id, containerPath, content, types.CopyToContainerOptions{}); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (c *DockerBuildContainer) CopyFromContainer(containerPath string) (io.ReadCloser, error) {
-	distData, _, err := c.client.CopyFromContainer(context.Background(), c.id, containerPath)
+func (c *DockerBuildContainer) CopyFromContainer(ctx context.Context, containerPath string) (io.ReadCloser, error) {
+	if c.sandbox.isolated() {
+		// Docker cannot copy out of the tmpfs scratch mounts either, the archive is streamed by tar
+		dir, base := path.Split(path.Clean(containerPath))
+		reader, writer := io.Pipe()
+		go func() {
+			result, err := c.exec(ctx, []string{"tar", "-c", "-f", "-", "-C", dir, base}, nil, writer, nil)
+			if err == nil && result.ExitCode != 0 {
+				err = fmt.Errorf("tar archive of %s failed with exit code %d: %s", containerPath, result.ExitCode, result.StderrTail(5))
+			}
+			writer.CloseWithError(err)
+		}()
+		return reader, nil
+	}
+	distData, _, err := c.client.CopyFromContainer(ctx, c.id, containerPath)
 	if err != nil {
 		return nil, err
 	}
 	return distData, nil
 }
 
-func (c *DockerBuildContainer) Start() error {
-	return c.client.ContainerStart(context.Background(), c.id, container.StartOptions{})
+func (c *DockerBuildContainer) Start(ctx context.Context) error {
+	return c.client.ContainerStart(ctx, c.id, container.StartOptions{})
 }
 
-func (c *DockerBuildContainer) Stop() error {
-	err := c.client.ContainerStop(context.Background(), c.id, container.StopOptions{})
+func (c *DockerBuildContainer) Stop(ctx context.Context) error {
+	err := c.client.ContainerStop(ctx, c.id, container.StopOptions{})
 	if err != nil {
 		return fmt.Errorf("container stop error: %v", err)
 	}
 	return nil
 }
 
-func (c *DockerBuildContainer) Remove() error {
-	return c.client.ContainerRemove(context.Background(), c.id, container.RemoveOptions{})
+func (c *DockerBuildContainer) Remove(ctx context.Context) error {
+	if c.onRemove != nil {
+		defer c.onRemove()
+	}
+	// Forced so a container that failed to stop is still removed
+	return c.client.ContainerRemove(ctx, c.id, container.RemoveOptions{Force: true})
+}
+
+
+// RestrictNetwork disconnects the container from every network under NetworkNoneAfterInstall,
+// other policies keep their network for the whole build.
+func (c *DockerBuildContainer) RestrictNetwork(ctx context.Context) error {
+	if c.networkPolicy != NetworkNoneAfterInstall || c.network == "" {
+		return nil
+	}
+	if err := c.client.NetworkDisconnect(ctx, c.network, c.id, true); err != nil {
+		return fmt.Errorf("failed to disconnect container from network %s: %w", c.network, err)
+	}
+	c.network = ""
+	return nil
+}
+
+func (c *DockerBuildContainer) running(ctx context.Context) (bool, error) {
+	inspect, err := c.client.ContainerInspect(ctx, c.id)
+	if err != nil {
+		return false, err
+	}
+	return inspect.State != nil && inspect.State.Running, nil
 }
 
+// OOMKilled reports whether the kernel killed a process of the container for exceeding its memory limit.
+func (c *DockerBuildContainer) OOMKilled(ctx context.Context) (bool, error) {
+	inspect, err := c.client.ContainerInspect(ctx, c.id)
+	if err != nil {
+		return false, err
+	}
+	return inspect.State != nil && inspect.State.OOMKilled, nil
+}
 
-func (c *DockerBuildContainer) ExecCmd(cmd string) (string, error) {
-	execResp, err := c.client.ContainerExecCreate(context.Background(), c.id, types.ExecConfig{
-		Cmd:          []string{"sh", "-c", cmd},
+func (c *DockerBuildContainer) ExecCmd(ctx context.Context, cmd string) (ExecResult, error) {
+	return c.ExecCmdStream(ctx, cmd, nil)
+}
+
+func (c *DockerBuildContainer) ExecCmdStream(ctx context.Context, cmd string, output chan<- OutputLine) (ExecResult, error) {
+	return c.exec(ctx, []string{"sh", "-c", cmd}, nil, nil, output)
+}
+
+// ImageDigest returns the ID of the image the container was created from, which is the digest of its config.
+func (c *DockerBuildContainer) ImageDigest(ctx context.Context) (string, error) {
+	inspect, err := c.client.ContainerInspect(ctx, c.id)
+	if err != nil {
+		return "", err
+	}
+	if inspect.ContainerJSONBase == nil || inspect.Image == "" {
+		return "", fmt.Errorf("container %s has no image", c.id)
+	}
+	return inspect.Image, nil
+}
+
+// exec runs cmd in the container, stdin is written to the command when it is not nil. Stdout is
+// written to stdout instead of the result when it is not nil.
+func (c *DockerBuildContainer) exec(ctx context.Context, cmd []string, stdin io.Reader, stdout io.Writer, output chan<- OutputLine) (ExecResult, error) {
+	startedAt := time.Now()
+	execResp, err := c.client.ContainerExecCreate(ctx, c.id, types.ExecConfig{
+		Cmd:          cmd,
+		AttachStdin:  stdin != nil,
 		AttachStdout: true,
 		AttachStderr: true,
 	})
 	if err != nil {
-		return "", err
+		return ExecResult{}, err
 	}
 
-	execAttachResp, err := c.client.ContainerExecAttach(context.Background(), execResp.ID, types.ExecStartCheck{})
+	execAttachResp, err := c.client.ContainerExecAttach(ctx, execResp.ID, types.ExecStartCheck{})
 	if err != nil {
-		return "", err
+		return ExecResult{}, err
 	}
 	defer execAttachResp.Close()
 
-	var outputBuf bytes.Buffer
-	if _, err := io.Copy(&outputBuf, execAttachResp.Reader); err != nil {
-		return "", err
+	// The attach connection is hijacked and ignores ctx, closing it on cancellation unblocks the copy below.
+	// Docker cannot kill a single exec, the process keeps running until the container is stopped.
+	copyDone := make(chan struct{})
+	defer close(copyDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			execAttachResp.Close()
+		case <-copyDone:
+		}
+	}()
+	if stdin != nil {
+		// Closing the write side tells the command its input ended, a failed copy leaves it truncated
+		go func() {
+			io.Copy(execAttachResp.Conn, stdin)
+			execAttachResp.CloseWrite()
+		}()
+	}
+
+	// Without a TTY docker multiplexes stdout and stderr into a single stream
+	var stdoutBuf, stderrBuf bytes.Buffer
+	var stderr io.Writer = &stderrBuf
+	if stdout == nil {
+		stdout = &stdoutBuf
+	}
+	if output != nil {
+		stdoutLines := newLineWriter(Stdout, output)
+		stderrLines := newLineWriter(Stderr, output)
+		defer stdoutLines.Flush()
+		defer stderrLines.Flush()
+		stdout = io.MultiWriter(stdout, stdoutLines)
+		stderr = io.MultiWriter(&stderrBuf, stderrLines)
+	}
+	if _, err := stdcopy.StdCopy(stdout, stderr, execAttachResp.Reader); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ExecResult{}, ctxErr
+		}
+		return ExecResult{}, err
+	}
+	// A cancelled connection can also end the copy cleanly, which must not be mistaken for the command finishing
+	if err := ctx.Err(); err != nil {
+		return ExecResult{}, err
+	}
+
+	execInspect, err := c.client.ContainerExecInspect(ctx, execResp.ID)
+	if err != nil {
+		return ExecResult{}, err
 	}
 
-	return outputBuf.String(), nil
+	return ExecResult{
+		ExitCode: execInspect.ExitCode,
+		Stdout:   stdoutBuf.String(),
+		Stderr:   stderrBuf.String(),
+		Duration: time.Since(startedAt),
+	}, nil
 }
 
-func (c *DockerBuildContainer) unzipFile(filePath string) (string, error) {
+func (c *DockerBuildContainer) unzipFile(ctx context.Context, filePath string) (string, error) {
 	cmd := fmt.Sprintf("unzip %s -d %s", filePath, filepath.Dir(filePath))
-	return c.ExecCmd(cmd)
+	result, err := c.ExecCmd(ctx, cmd)
+	if err != nil {
+		return "", err
+	}
+	if result.ExitCode != 0 {
+		return "", fmt.Errorf("unzip failed with exit code %d: %s", result.ExitCode, result.StderrTail(5))
+	}
+	return result.Stdout, nil
 }
 
-func (c *DockerBuildContainer) createDirectoryInContainer(directoryPath string) error {
+func (c *DockerBuildContainer) createDirectoryInContainer(ctx context.Context, directoryPath string) error {
 	execOptions := types.ExecConfig{
 		Cmd:          []string{"mkdir", "-p", directoryPath},
 		AttachStdout: true,
 		AttachStderr: true,
 	}
 
-	resp, err := c.client.ContainerExecCreate(context.Background(), c.id, execOptions)
+	resp, err := c.client.ContainerExecCreate(ctx, c.id, execOptions)
 	if err != nil {
 		return err
 	}
 
-	err = c.client.ContainerExecStart(context.Background(), resp.ID, types.ExecStartCheck{})
+	err = c.client.ContainerExecStart(ctx, resp.ID, types.ExecStartCheck{})
 	if err != nil {
 		return err
 	}
 
-	execResult, err := c.client.ContainerExecInspect(context.Background(), resp.ID)
+	execResult, err := c.client.ContainerExecInspect(ctx, resp.ID)
 	if err != nil {
 		return err
 	}
@@ -148,24 +359,24 @@ func (c *DockerBuildContainer) createDirectoryInContainer(directoryPath string)
 
 // Utility functions
 
-func (c *DockerBuildContainer) createFileInContainer(filePath string) error {
+func (c *DockerBuildContainer) createFileInContainer(ctx context.Context, filePath string) error {
 	execOptions := types.ExecConfig{
 		Cmd:          []string{"touch", filePath},
 		AttachStdout: true,
 		AttachStderr: true,
 	}
 
-	resp, err := c.client.ContainerExecCreate(context.Background(), c.id, execOptions)
+	resp, err := c.client.ContainerExecCreate(ctx, c.id, execOptions)
 	if err != nil {
 		return err
 	}
 
-	err = c.client.ContainerExecStart(context.Background(), resp.ID, types.ExecStartCheck{})
+	err = c.client.ContainerExecStart(ctx, resp.ID, types.ExecStartCheck{})
 	if err != nil {
 		return err
 	}
 
-	execResult, err := c.client.ContainerExecInspect(context.Background(), resp.ID)
+	execResult, err := c.client.ContainerExecInspect(ctx, resp.ID)
 	if err != nil {
 		return err
 	}
@@ -177,7 +388,7 @@ func (c *DockerBuildContainer) createFileInContainer(filePath string) error {
 	return nil
 }
 
-func (c *DockerBuildContainer) writeDataToContainer(data []byte, filePath string) error {
+func (c *DockerBuildContainer) writeDataToContainer(ctx context.Context, data []byte, filePath string) error {
 	// Create a reader for the data buffer
 	var buf bytes.Buffer
 
@@ -191,7 +402,7 @@ func (c *DockerBuildContainer) writeDataToContainer(data []byte, filePath string
 	if err := tw.WriteHeader(tarHeader); err != nil {
 		return err
 	}
-	c.createFileInContainer(filePath)
+	c.createFileInContainer(ctx, filePath)
 	// Write the file content to the TAR archive
 	if _, err := tw.Write(data); err != nil {
 		return err
@@ -200,7 +411,7 @@ func (c *DockerBuildContainer) writeDataToContainer(data []byte, filePath string
 	if err := tw.Close(); err != nil {
 		return err
 	}
-	err := c.client.CopyToContainer(context.Background(), c.id, filePath, &buf, types.CopyToContainerOptions{})
+	err := c.client.CopyToContainer(ctx, c.id, filePath, &buf, types.CopyToContainerOptions{})
 	if err != nil {
 		return err
 	}
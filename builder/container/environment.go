@@ -0,0 +1,19 @@
+package container
+
+// BuildEnvironment is what a build container is created from for a build type.
+type BuildEnvironment struct {
+	// Image is the image reference, pinned to a digest when the environment has one
+	Image Image
+	// Env holds default environment variables as KEY=value
+	Env        []string
+	WorkingDir string
+	User       string
+	// Resources overrides the resource profile of the build type when set
+	Resources *ResourceProfile
+}
+
+// EnvironmentResolver maps a build type to its build environment.
+type EnvironmentResolver interface {
+	BuildEnvironment(buildType string) (BuildEnvironment, error)
+	BuildTypes() []string
+}
@@ -0,0 +1,287 @@
+package container
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// PullOutput is the source of image pull progress lines sent with build output
+const PullOutput = "pull"
+
+// PullProgress is called with a human readable line for every progress update of an image pull.
+type PullProgress func(line string)
+
+// ImageLock records the digest every image tag resolved to when it was first pulled, so builds keep
+// using the same image even when the tag is moved in the registry. The lock is stored as JSON.
+type ImageLock struct {
+	path string
+
+	mu      sync.Mutex
+	digests map[string]string
+}
+
+// NewImageLock loads the lock file at path, a missing file is an empty lock.
+func NewImageLock(path string) (*ImageLock, error) {
+	lock := &ImageLock{path: path, digests: make(map[string]string)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return lock, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &lock.digests); err != nil {
+		return nil, fmt.Errorf("failed to parse image lock %s: %w", path, err)
+	}
+	return lock, nil
+}
+
+// Resolve returns the image pinned to its recorded digest. Images that already carry a digest
+// or were never recorded are returned unchanged.
+func (l *ImageLock) Resolve(ref Image) Image {
+	if strings.Contains(string(ref), "@") {
+		return ref
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if digest, ok := l.digests[string(ref)]; ok {
+		return Image(imageRepository(string(ref)) + "@" + digest)
+	}
+	return ref
+}
+
+// Record stores the digest of a tag and writes the lock file.
+func (l *ImageLock) Record(ref Image, digest string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.digests[string(ref)] = digest
+	data, err := json.MarshalIndent(l.digests, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(l.path), ".image-lock-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmpFile.Write(append(data, '\n')); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return os.Rename(tmpFile.Name(), l.path)
+}
+
+// imageRepository strips the tag or digest from an image reference, keeping a registry port.
+func imageRepository(ref string) string {
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref = ref[:i]
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		ref = ref[:i]
+	}
+	return ref
+}
+
+// ImagePuller makes sure images exist on the docker host before containers are created from them.
+// Concurrent requests for the same image share a single pull.
+type ImagePuller struct {
+	client ImageAPI
+	lock   *ImageLock
+
+	mu    sync.Mutex
+	pulls map[Image]*imagePull
+}
+
+type imagePull struct {
+	done      chan struct{}
+	err       error
+	listeners map[int]*pullListener
+	nextID    int
+}
+
+// pullListener is the progress func of a build waiting for a pull. Its own lock lets the pull call
+// it without holding the puller lock, while a removed listener is still never called again.
+type pullListener struct {
+	mu       sync.Mutex
+	progress PullProgress
+	removed  bool
+}
+
+func (l *pullListener) call(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.removed {
+		l.progress(line)
+	}
+}
+
+// remove waits for a running call to return and stops further calls.
+func (l *pullListener) remove() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.removed = true
+}
+
+func NewImagePuller() *ImagePuller {
+	return &ImagePuller{pulls: make(map[Image]*imagePull)}
+}
+
+func (p *ImagePuller) WithClient(client ImageAPI) *ImagePuller {
+	p.client = client
+	return p
+}
+
+// WithLock pins tags to the digest recorded in lock, recording the digest on their first pull.
+func (p *ImagePuller) WithLock(lock *ImageLock) *ImagePuller {
+	p.lock = lock
+	return p
+}
+
+// Resolve returns the reference containers of the image are created from.
+func (p *ImagePuller) Resolve(ref Image) Image {
+	if p.lock == nil {
+		return ref
+	}
+	return p.lock.Resolve(ref)
+}
+
+// Ensure pulls the image unless it is already present and returns the pinned reference to create
+// containers from. progress, if not nil, receives the pull progress.
+func (p *ImagePuller) Ensure(ctx context.Context, ref Image, progress PullProgress) (Image, error) {
+	pinned := p.Resolve(ref)
+	inspect, _, err := p.client.ImageInspectWithRaw(ctx, string(pinned))
+	if client.IsErrNotFound(err) {
+		if err := p.pull(ctx, pinned, progress); err != nil {
+			return "", err
+		}
+		inspect, _, err = p.client.ImageInspectWithRaw(ctx, string(pinned))
+	}
+	if err != nil {
+		return "", err
+	}
+	if pinned != ref || p.lock == nil || strings.Contains(string(ref), "@") {
+		return pinned, nil
+	}
+	return p.record(ref, inspect)
+}
+
+// record stores the digest a tag resolved to on its first use, pulled or found on the host, so
+// later builds use the same image.
+func (p *ImagePuller) record(ref Image, inspect types.ImageInspect) (Image, error) {
+	repository := imageRepository(string(ref))
+	for _, repoDigest := range inspect.RepoDigests {
+		name, digest, ok := strings.Cut(repoDigest, "@")
+		if ok && (name == repository || strings.HasSuffix(name, "/"+repository)) {
+			if err := p.lock.Record(ref, digest); err != nil {
+				return "", fmt.Errorf("failed to record digest of %s: %w", ref, err)
+			}
+			return p.lock.Resolve(ref), nil
+		}
+	}
+	return ref, nil
+}
+
+// pull joins a running pull of the image or starts one.
+func (p *ImagePuller) pull(ctx context.Context, ref Image, progress PullProgress) error {
+	p.mu.Lock()
+	running, ok := p.pulls[ref]
+	if !ok {
+		running = &imagePull{done: make(chan struct{}), listeners: make(map[int]*pullListener)}
+		p.pulls[ref] = running
+		// The pull outlives the caller that started it, other builds may be waiting for it
+		go p.runPull(context.WithoutCancel(ctx), ref, running)
+	}
+	listenerID := running.nextID
+	running.nextID++
+	var listener *pullListener
+	if progress != nil {
+		listener = &pullListener{progress: progress}
+		running.listeners[listenerID] = listener
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-running.done:
+		return running.err
+	case <-ctx.Done():
+		p.mu.Lock()
+		delete(running.listeners, listenerID)
+		p.mu.Unlock()
+		// Once removed progress is never called again, the caller may close what it writes to
+		if listener != nil {
+			listener.remove()
+		}
+		return ctx.Err()
+	}
+}
+
+func (p *ImagePuller) runPull(ctx context.Context, ref Image, running *imagePull) {
+	running.err = p.doPull(ctx, ref, func(line string) {
+		// A slow listener must not block other builds on the puller lock
+		p.mu.Lock()
+		listeners := make([]*pullListener, 0, len(running.listeners))
+		for _, listener := range running.listeners {
+			listeners = append(listeners, listener)
+		}
+		p.mu.Unlock()
+		for _, listener := range listeners {
+			listener.call(line)
+		}
+	})
+	p.mu.Lock()
+	delete(p.pulls, ref)
+	p.mu.Unlock()
+	close(running.done)
+}
+
+func (p *ImagePuller) doPull(ctx context.Context, ref Image, progress PullProgress) error {
+	body, err := p.client.ImagePull(ctx, string(ref), image.PullOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to pull %s: %w", ref, err)
+	}
+	defer body.Close()
+
+	decoder := json.NewDecoder(body)
+	for {
+		var message jsonmessage.JSONMessage
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read pull progress of %s: %w", ref, err)
+		}
+		if message.Error != nil {
+			return fmt.Errorf("failed to pull %s: %s", ref, message.Error.Message)
+		}
+		if line := progressLine(message); line != "" {
+			progress(line)
+		}
+	}
+}
+
+// progressLine formats a pull message like "a1b2c3: Downloading 12.5MB/40.1MB".
+func progressLine(message jsonmessage.JSONMessage) string {
+	line := message.Status
+	if message.ID != "" {
+		line = message.ID + ": " + line
+	}
+	if message.Progress != nil && message.Progress.Total > 0 {
+		line += fmt.Sprintf(" %.1fMB/%.1fMB", float64(message.Progress.Current)/1e6, float64(message.Progress.Total)/1e6)
+	}
+	return line
+}
@@ -0,0 +1,112 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+)
+
+// fakeImageAPI serves images from memory. Pulling an image adds it with the digests in pullDigests,
+// the pull progress is read from pullBodies.
+type fakeImageAPI struct {
+	mu          sync.Mutex
+	images      map[string]types.ImageInspect
+	pullDigests map[string][]string
+	pullBodies  map[string]io.ReadCloser
+	pulled      []string
+}
+
+func (f *fakeImageAPI) ImagePull(ctx context.Context, refStr string, options image.PullOptions) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pulled = append(f.pulled, refStr)
+	f.images[refStr] = types.ImageInspect{RepoDigests: f.pullDigests[refStr]}
+	if body, ok := f.pullBodies[refStr]; ok {
+		return body, nil
+	}
+	return io.NopCloser(strings.NewReader("")), nil
+}
+
+func (f *fakeImageAPI) ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	inspect, ok := f.images[imageID]
+	if !ok {
+		return types.ImageInspect{}, nil, errdefs.NotFound(errors.New("no such image: " + imageID))
+	}
+	return inspect, nil, nil
+}
+
+func TestImagePullerRecordsImagePresentOnHost(t *testing.T) {
+	api := &fakeImageAPI{images: map[string]types.ImageInspect{
+		"node:20": {RepoDigests: []string{"node@sha256:abc"}},
+	}}
+	lockPath := filepath.Join(t.TempDir(), "image-lock.json")
+	lock, err := NewImageLock(lockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	puller := NewImagePuller().WithClient(api).WithLock(lock)
+
+	pinned, err := puller.Ensure(context.Background(), "node:20", nil)
+	if err != nil {
+		t.Fatalf("Ensure: %v", err)
+	}
+	if pinned != "node@sha256:abc" {
+		t.Errorf("Ensure = %s, want the recorded digest", pinned)
+	}
+	if len(api.pulled) != 0 {
+		t.Errorf("image present on the host was pulled: %v", api.pulled)
+	}
+	data, err := os.ReadFile(lockPath)
+	if err != nil || !strings.Contains(string(data), "sha256:abc") {
+		t.Errorf("image lock = %s, %v", data, err)
+	}
+}
+
+func TestImagePullerCallsSlowListenerOutsideLock(t *testing.T) {
+	slowBody, slowWriter := io.Pipe()
+	api := &fakeImageAPI{
+		images: map[string]types.ImageInspect{},
+		pullDigests: map[string][]string{
+			"node:20": {"node@sha256:20"},
+			"node:22": {"node@sha256:22"},
+		},
+		pullBodies: map[string]io.ReadCloser{"node:20": slowBody},
+	}
+	puller := NewImagePuller().WithClient(api)
+
+	called := make(chan struct{})
+	unblock := make(chan struct{})
+	slowDone := make(chan error, 1)
+	go func() {
+		_, err := puller.Ensure(context.Background(), "node:20", func(line string) {
+			close(called)
+			<-unblock
+		})
+		slowDone <- err
+	}()
+	go func() {
+		io.WriteString(slowWriter, `{"status":"Downloading","id":"layer"}`)
+		slowWriter.Close()
+	}()
+	<-called
+
+	// The listener of node:20 hangs, another build can still pull its image
+	if _, err := puller.Ensure(context.Background(), "node:22", nil); err != nil {
+		t.Fatalf("Ensure node:22: %v", err)
+	}
+	close(unblock)
+	if err := <-slowDone; err != nil {
+		t.Fatalf("Ensure node:20: %v", err)
+	}
+}
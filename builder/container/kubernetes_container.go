@@ -0,0 +1,520 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	units "github.com/docker/go-units"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+const (
+	// buildContainerName is the name of the container running the build inside its pod
+	buildContainerName = "build"
+	// LabelPodName selects the pod of a build in the network policies created for it
+	LabelPodName = "comet.pod-name"
+
+	podPollInterval = time.Second
+	podStartTimeout = 5 * time.Minute
+	podStopGrace    = int64(10)
+	oomKilledReason = "OOMKilled"
+	noEgressSuffix  = "-no-egress"
+)
+
+// podKeepAliveCmd keeps the pod running between the commands executed in it. Unlike docker there
+// is no init process, so the shell exits on SIGTERM itself instead of waiting for the grace period.
+var podKeepAliveCmd = []string{"sh", "-c", "trap 'exit 0' TERM; sleep infinity & wait"}
+
+// podStartFailures are waiting reasons a pod does not recover from without a change to its spec.
+var podStartFailures = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+}
+
+// PodExecutor runs a command in a container of a pod, like the exec subresource. A command that
+// exits with a non-zero code returns a utilexec.ExitError. The fake clientset does not serve exec,
+// tests provide their own PodExecutor.
+type PodExecutor interface {
+	Exec(ctx context.Context, namespace string, pod string, container string, cmd []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error
+}
+
+// KubernetesBuildContainer runs a build in a pod of its own, commands and copies go through exec.
+// The pod never restarts, it is deleted when the container is removed.
+type KubernetesBuildContainer struct {
+	name          string
+	namespace     string
+	image         Image
+	environment   BuildEnvironment
+	client        kubernetes.Interface
+	executor      PodExecutor
+	resources     ResourceProfile
+	networkPolicy NetworkPolicy
+	labels        map[string]string
+	deadline      time.Duration
+	sandbox       SandboxProfile
+	onRemove      func()
+	// noEgress is the network policy created by RestrictNetwork
+	noEgress string
+}
+
+func NewKubernetesBuildContainer(name string) *KubernetesBuildContainer {
+	return &KubernetesBuildContainer{
+		name:          name,
+		namespace:     "default",
+		networkPolicy: NetworkFull,
+		resources:     DefaultResourceProfile,
+	}
+}
+
+func (c *KubernetesBuildContainer) WithNamespace(namespace string) *KubernetesBuildContainer {
+	c.namespace = namespace
+	return c
+}
+
+func (c *KubernetesBuildContainer) WithImage(image Image) *KubernetesBuildContainer {
+	c.image = image
+	return c
+}
+
+func (c *KubernetesBuildContainer) WithEnvironment(environment BuildEnvironment) *KubernetesBuildContainer {
+	c.environment = environment
+	return c
+}
+
+func (c *KubernetesBuildContainer) WithClient(client kubernetes.Interface) *KubernetesBuildContainer {
+	c.client = client
+	return c
+}
+
+func (c *KubernetesBuildContainer) WithExecutor(executor PodExecutor) *KubernetesBuildContainer {
+	c.executor = executor
+	return c
+}
+
+func (c *KubernetesBuildContainer) WithResources(resources ResourceProfile) *KubernetesBuildContainer {
+	c.resources = resources
+	return c
+}
+
+// WithNetworkPolicy sets the network policy of the pod, NetworkRegistryProxy is not supported.
+func (c *KubernetesBuildContainer) WithNetworkPolicy(policy NetworkPolicy) *KubernetesBuildContainer {
+	c.networkPolicy = policy
+	return c
+}
+
+func (c *KubernetesBuildContainer) WithLabels(labels map[string]string) *KubernetesBuildContainer {
+	c.labels = labels
+	return c
+}
+
+// WithDeadline makes kubernetes kill the pod once it ran for deadline, even if the builder is gone.
+func (c *KubernetesBuildContainer) WithDeadline(deadline time.Duration) *KubernetesBuildContainer {
+	c.deadline = deadline
+	return c
+}
+
+// WithSandbox sets the RuntimeClass and security context of the pod. SeccompProfile names a
+// Localhost profile relative to the seccomp directory of the kubelet, pods without one get the
+// default profile of the container runtime like docker containers do.
+func (c *KubernetesBuildContainer) WithSandbox(sandbox SandboxProfile) *KubernetesBuildContainer {
+	c.sandbox = sandbox
+	return c
+}
+
+// WithOnRemove sets a func called once the container has been removed, or removal was attempted.
+func (c *KubernetesBuildContainer) WithOnRemove(onRemove func()) *KubernetesBuildContainer {
+	c.onRemove = onRemove
+	return c
+}
+
+// Create creates the pod of the build, Start waits until it runs.
+func (c *KubernetesBuildContainer) Create(ctx context.Context) (*KubernetesBuildContainer, error) {
+	if c.networkPolicy == NetworkRegistryProxy {
+		return nil, fmt.Errorf("network policy %s is not supported by the kubernetes backend", c.networkPolicy)
+	}
+	pod, err := c.podSpec()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.client.CoreV1().Pods(c.namespace).Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		return nil, fmt.Errorf("failed to create pod %s: %w", c.name, err)
+	}
+	return c, nil
+}
+
+func (c *KubernetesBuildContainer) podSpec() (*corev1.Pod, error) {
+	resources, err := c.resources.podResources()
+	if err != nil {
+		return nil, err
+	}
+	labels := map[string]string{LabelPodName: c.name}
+	annotations := map[string]string{}
+	for key, value := range c.labels {
+		// Label values cannot hold the colons of a timestamp
+		if key == LabelCreatedAt {
+			annotations[key] = value
+			continue
+		}
+		labels[key] = value
+	}
+	securityContext, err := c.sandbox.securityContext()
+	if err != nil {
+		return nil, err
+	}
+	volumes, mounts, err := c.sandbox.scratchVolumes(c.environment.WorkingDir)
+	if err != nil {
+		return nil, err
+	}
+	var env []corev1.EnvVar
+	for _, variable := range append(append([]string{}, c.environment.Env...), c.sandbox.env()...) {
+		name, value, _ := strings.Cut(variable, "=")
+		env = append(env, corev1.EnvVar{Name: name, Value: value})
+	}
+
+	disabled := false
+	grace := podStopGrace
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        c.name,
+			Namespace:   c.namespace,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:       buildContainerName,
+				Image:      string(c.image),
+				Command:    podKeepAliveCmd,
+				Env:        env,
+				WorkingDir: c.environment.WorkingDir,
+				Resources:  resources,
+
+				SecurityContext: securityContext,
+				VolumeMounts:    mounts,
+			}},
+			Volumes:       volumes,
+			RestartPolicy: corev1.RestartPolicyNever,
+			// Builds run untrusted code, they get no credentials for the cluster
+			AutomountServiceAccountToken:  &disabled,
+			EnableServiceLinks:            &disabled,
+			TerminationGracePeriodSeconds: &grace,
+		},
+	}
+	if c.deadline > 0 {
+		deadline := int64(c.deadline.Seconds())
+		pod.Spec.ActiveDeadlineSeconds = &deadline
+	}
+	if c.sandbox.RuntimeClass != "" {
+		runtimeClass := c.sandbox.RuntimeClass
+		pod.Spec.RuntimeClassName = &runtimeClass
+	}
+	return pod, nil
+}
+
+// securityContext translates the sandbox into the security context of the build container.
+func (s SandboxProfile) securityContext() (*corev1.SecurityContext, error) {
+	seccomp := &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+	if s.SeccompProfile != "" {
+		profile := s.SeccompProfile
+		seccomp = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeLocalhost, LocalhostProfile: &profile}
+	}
+	securityContext := &corev1.SecurityContext{SeccompProfile: seccomp}
+	if len(s.CapDrop) > 0 || len(s.CapAdd) > 0 {
+		capabilities := &corev1.Capabilities{}
+		for _, capability := range s.CapDrop {
+			capabilities.Drop = append(capabilities.Drop, corev1.Capability(capability))
+		}
+		for _, capability := range s.CapAdd {
+			capabilities.Add = append(capabilities.Add, corev1.Capability(capability))
+		}
+		securityContext.Capabilities = capabilities
+	}
+	if s.NoNewPrivileges {
+		allowEscalation := false
+		securityContext.AllowPrivilegeEscalation = &allowEscalation
+	}
+	if s.ReadOnlyRootfs {
+		readOnly := true
+		securityContext.ReadOnlyRootFilesystem = &readOnly
+	}
+	if s.User != "" {
+		// Kubernetes only takes numeric ids, names are resolved by the image
+		uid, gid, ok := s.userIDs()
+		if !ok {
+			return nil, fmt.Errorf("sandbox user %q must be numeric on kubernetes", s.User)
+		}
+		nonRoot := uid != 0
+		securityContext.RunAsUser = &uid
+		securityContext.RunAsGroup = &gid
+		securityContext.RunAsNonRoot = &nonRoot
+	}
+	return securityContext, nil
+}
+
+// scratchVolumes returns the emptyDir volumes standing in for the tmpfs mounts of docker. They
+// are world writable and count against the ephemeral storage of the pod.
+func (s SandboxProfile) scratchVolumes(workingDir string) ([]corev1.Volume, []corev1.VolumeMount, error) {
+	var sizeLimit *resource.Quantity
+	if s.ScratchSize != "" {
+		size, err := units.RAMInBytes(s.ScratchSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid scratch size %q: %w", s.ScratchSize, err)
+		}
+		sizeLimit = resource.NewQuantity(size, resource.BinarySI)
+	}
+	paths := make([]string, 0, 2)
+	for path := range s.tmpfs(workingDir) {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var volumes []corev1.Volume
+	var mounts []corev1.VolumeMount
+	for i, path := range paths {
+		name := fmt.Sprintf("scratch-%d", i)
+		volumes = append(volumes, corev1.Volume{
+			Name:         name,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{SizeLimit: sizeLimit}},
+		})
+		mounts = append(mounts, corev1.VolumeMount{Name: name, MountPath: path})
+	}
+	return volumes, mounts, nil
+}
+
+// podResources translates the profile into the requests and limits of the build container, both
+// are equal so builds are never throttled below what their profile promises.
+func (p ResourceProfile) podResources() (corev1.ResourceRequirements, error) {
+	limits := corev1.ResourceList{}
+	if p.CPUs > 0 {
+		limits[corev1.ResourceCPU] = *resource.NewMilliQuantity(int64(p.CPUs*1000), resource.DecimalSI)
+	}
+	if p.MemoryBytes > 0 {
+		limits[corev1.ResourceMemory] = *resource.NewQuantity(p.MemoryBytes, resource.BinarySI)
+	}
+	if p.StorageSize != "" {
+		// Docker also accepts sizes with a trailing B such as "10GB", quantities do not
+		storage, err := resource.ParseQuantity(strings.TrimSuffix(p.StorageSize, "B"))
+		if err != nil {
+			return corev1.ResourceRequirements{}, fmt.Errorf("invalid storage size %q: %w", p.StorageSize, err)
+		}
+		limits[corev1.ResourceEphemeralStorage] = storage
+	}
+	requests := corev1.ResourceList{}
+	for name, quantity := range limits {
+		requests[name] = quantity
+	}
+	return corev1.ResourceRequirements{Limits: limits, Requests: requests}, nil
+}
+
+// BuildContainer interface functions
+
+// CopyToContainer extracts the tar archive into containerPath with tar running in the pod.
+func (c *KubernetesBuildContainer) CopyToContainer(ctx context.Context, tarFile io.Reader, containerPath string) error {
+	var stderr bytes.Buffer
+	cmd := []string{"sh", "-c", `mkdir -p "$1" && tar -xf - -C "$1"`, "sh", containerPath}
+	if err := c.exec(ctx, cmd, tarFile, io.Discard, &stderr); err != nil {
+		return fmt.Errorf("failed to copy to %s: %w: %s", containerPath, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// CopyFromContainer returns a tar archive of containerPath. Like docker, entries are named
+// relative to the parent of containerPath.
+func (c *KubernetesBuildContainer) CopyFromContainer(ctx context.Context, containerPath string) (io.ReadCloser, error) {
+	reader, writer := io.Pipe()
+	go func() {
+		var stderr bytes.Buffer
+		cmd := []string{"sh", "-c", `tar -cf - -C "$(dirname "$1")" "$(basename "$1")"`, "sh", containerPath}
+		err := c.exec(ctx, cmd, nil, writer, &stderr)
+		if err != nil {
+			err = fmt.Errorf("failed to copy from %s: %w: %s", containerPath, err, strings.TrimSpace(stderr.String()))
+		}
+		writer.CloseWithError(err)
+	}()
+	return reader, nil
+}
+
+// Start waits until the pod runs, failing early on pods that cannot start such as a missing image.
+func (c *KubernetesBuildContainer) Start(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, podStartTimeout)
+	defer cancel()
+	ticker := time.NewTicker(podPollInterval)
+	defer ticker.Stop()
+	for {
+		pod, err := c.client.CoreV1().Pods(c.namespace).Get(ctx, c.name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get pod %s: %w", c.name, err)
+		}
+		running, err := podRunning(pod)
+		if err != nil || running {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("pod %s did not start: %w", c.name, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+func podRunning(pod *corev1.Pod) (bool, error) {
+	switch pod.Status.Phase {
+	case corev1.PodFailed, corev1.PodSucceeded:
+		return false, fmt.Errorf("pod %s terminated: %s %s", pod.Name, pod.Status.Reason, pod.Status.Message)
+	case corev1.PodRunning:
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name == buildContainerName && status.State.Running != nil {
+				return true, nil
+			}
+		}
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if waiting := status.State.Waiting; waiting != nil && podStartFailures[waiting.Reason] {
+			return false, fmt.Errorf("pod %s cannot start: %s: %s", pod.Name, waiting.Reason, waiting.Message)
+		}
+	}
+	return false, nil
+}
+
+// Stop deletes the pod, there is no way to stop a pod and keep it.
+func (c *KubernetesBuildContainer) Stop(ctx context.Context) error {
+	grace := podStopGrace
+	err := c.client.CoreV1().Pods(c.namespace).Delete(ctx, c.name, metav1.DeleteOptions{GracePeriodSeconds: &grace})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("pod delete error: %v", err)
+	}
+	return nil
+}
+
+// Remove deletes the pod immediately together with the network policy created for it.
+func (c *KubernetesBuildContainer) Remove(ctx context.Context) error {
+	if c.onRemove != nil {
+		defer c.onRemove()
+	}
+	var errs []error
+	if c.noEgress != "" {
+		err := c.client.NetworkingV1().NetworkPolicies(c.namespace).Delete(ctx, c.noEgress, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("failed to delete network policy %s: %w", c.noEgress, err))
+		}
+	}
+	grace := int64(0)
+	err := c.client.CoreV1().Pods(c.namespace).Delete(ctx, c.name, metav1.DeleteOptions{GracePeriodSeconds: &grace})
+	if err != nil && !apierrors.IsNotFound(err) {
+		errs = append(errs, fmt.Errorf("failed to delete pod %s: %w", c.name, err))
+	}
+	return errors.Join(errs...)
+}
+
+// RestrictNetwork denies all egress of the pod under NetworkNoneAfterInstall with a network policy,
+// which only takes effect on clusters whose network plugin enforces network policies.
+func (c *KubernetesBuildContainer) RestrictNetwork(ctx context.Context) error {
+	if c.networkPolicy != NetworkNoneAfterInstall || c.noEgress != "" {
+		return nil
+	}
+	policy := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      c.name + noEgressSuffix,
+			Namespace: c.namespace,
+			Labels:    map[string]string{LabelManaged: "true", LabelPodName: c.name},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{LabelPodName: c.name}},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+		},
+	}
+	if _, err := c.client.NetworkingV1().NetworkPolicies(c.namespace).Create(ctx, policy, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("failed to create network policy for pod %s: %w", c.name, err)
+	}
+	c.noEgress = policy.Name
+	return nil
+}
+
+// OOMKilled reports whether the build container was killed for exceeding its memory limit.
+func (c *KubernetesBuildContainer) OOMKilled(ctx context.Context) (bool, error) {
+	pod, err := c.client.CoreV1().Pods(c.namespace).Get(ctx, c.name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name != buildContainerName {
+			continue
+		}
+		for _, state := range []corev1.ContainerState{status.State, status.LastTerminationState} {
+			if state.Terminated != nil && state.Terminated.Reason == oomKilledReason {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// ImageDigest returns the image ID the kubelet reports for the build container, which holds the
+// digest of the image the node pulled.
+func (c *KubernetesBuildContainer) ImageDigest(ctx context.Context) (string, error) {
+	pod, err := c.client.CoreV1().Pods(c.namespace).Get(ctx, c.name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == buildContainerName && status.ImageID != "" {
+			return status.ImageID, nil
+		}
+	}
+	return "", fmt.Errorf("pod %s reports no image for its build container", c.name)
+}
+
+func (c *KubernetesBuildContainer) ExecCmd(ctx context.Context, cmd string) (ExecResult, error) {
+	return c.ExecCmdStream(ctx, cmd, nil)
+}
+
+func (c *KubernetesBuildContainer) ExecCmdStream(ctx context.Context, cmd string, output chan<- OutputLine) (ExecResult, error) {
+	startedAt := time.Now()
+	var stdoutBuf, stderrBuf bytes.Buffer
+	var stdout, stderr io.Writer = &stdoutBuf, &stderrBuf
+	if output != nil {
+		stdoutLines := newLineWriter(Stdout, output)
+		stderrLines := newLineWriter(Stderr, output)
+		defer stdoutLines.Flush()
+		defer stderrLines.Flush()
+		stdout = io.MultiWriter(&stdoutBuf, stdoutLines)
+		stderr = io.MultiWriter(&stderrBuf, stderrLines)
+	}
+
+	// Like docker, a cancelled exec keeps running in the pod until the pod is deleted
+	err := c.exec(ctx, []string{"sh", "-c", cmd}, nil, stdout, stderr)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ExecResult{}, ctxErr
+	}
+	exitCode := 0
+	var exitErr utilexec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitStatus()
+	} else if err != nil {
+		return ExecResult{}, err
+	}
+	return ExecResult{
+		ExitCode: exitCode,
+		Stdout:   stdoutBuf.String(),
+		Stderr:   stderrBuf.String(),
+		Duration: time.Since(startedAt),
+	}, nil
+}
+
+func (c *KubernetesBuildContainer) exec(ctx context.Context, cmd []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	return c.executor.Exec(ctx, c.namespace, c.name, buildContainerName, cmd, stdin, stdout, stderr)
+}
@@ -0,0 +1,230 @@
+package container
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+const podNamePrefix = "comet-build-"
+
+// KubernetesContainerManager hands out KubernetesBuildContainers, one pod per build. It needs no
+// docker socket, the cluster pulls the images and enforces the resource profiles.
+type KubernetesContainerManager struct {
+	scheduler    *Scheduler
+	client       kubernetes.Interface
+	executor     PodExecutor
+	namespace    string
+	profiles     *ResourceProfiles
+	environments EnvironmentResolver
+	lock         *ImageLock
+	deadline     time.Duration
+	sandboxes    *SandboxProfiles
+
+	networkPolicy            NetworkPolicy
+	buildTypeNetworkPolicies map[string]NetworkPolicy
+}
+
+func NewKubernetesContainerManager() *KubernetesContainerManager {
+	return &KubernetesContainerManager{
+		scheduler:                NewScheduler(0),
+		namespace:                "default",
+		networkPolicy:            NetworkFull,
+		buildTypeNetworkPolicies: make(map[string]NetworkPolicy),
+	}
+}
+
+// WithCapacity limits the number of builds that run at once, further builds are queued until one
+// ends.
+func (km *KubernetesContainerManager) WithCapacity(capacity int) *KubernetesContainerManager {
+	km.scheduler = NewScheduler(capacity)
+	return km
+}
+
+func (km *KubernetesContainerManager) Scheduler() *Scheduler {
+	return km.scheduler
+}
+
+// WithClient sets the clientset pods are managed with, fake.NewSimpleClientset() in tests.
+func (km *KubernetesContainerManager) WithClient(client kubernetes.Interface) *KubernetesContainerManager {
+	km.client = client
+	return km
+}
+
+// WithExecutor sets how commands run in the pods, usually NewSPDYPodExecutor.
+func (km *KubernetesContainerManager) WithExecutor(executor PodExecutor) *KubernetesContainerManager {
+	km.executor = executor
+	return km
+}
+
+// WithNamespace sets the namespace build pods are created in.
+func (km *KubernetesContainerManager) WithNamespace(namespace string) *KubernetesContainerManager {
+	km.namespace = namespace
+	return km
+}
+
+func (km *KubernetesContainerManager) WithResourceProfiles(profiles *ResourceProfiles) *KubernetesContainerManager {
+	km.profiles = profiles
+	return km
+}
+
+func (km *KubernetesContainerManager) WithEnvironments(environments EnvironmentResolver) *KubernetesContainerManager {
+	km.environments = environments
+	return km
+}
+
+// WithImageLock pins image tags to the digests recorded in lock. Nodes pull images themselves,
+// so tags are never recorded by this backend.
+func (km *KubernetesContainerManager) WithImageLock(lock *ImageLock) *KubernetesContainerManager {
+	km.lock = lock
+	return km
+}
+
+// WithMaxBuildDuration makes kubernetes kill build pods older than maxBuildDuration, which also
+// covers pods left behind by a builder that crashed.
+func (km *KubernetesContainerManager) WithMaxBuildDuration(maxBuildDuration time.Duration) *KubernetesContainerManager {
+	km.deadline = maxBuildDuration
+	return km
+}
+
+// WithSandboxProfiles isolates build pods by the trust level of their project.
+func (km *KubernetesContainerManager) WithSandboxProfiles(sandboxes *SandboxProfiles) *KubernetesContainerManager {
+	km.sandboxes = sandboxes
+	return km
+}
+
+// WithNetworkPolicy sets the default network policy, NetworkRegistryProxy is not supported.
+func (km *KubernetesContainerManager) WithNetworkPolicy(policy NetworkPolicy) *KubernetesContainerManager {
+	km.networkPolicy = policy
+	return km
+}
+
+func (km *KubernetesContainerManager) WithBuildTypeNetworkPolicy(buildType string, policy NetworkPolicy) *KubernetesContainerManager {
+	km.buildTypeNetworkPolicies[buildType] = policy
+	return km
+}
+
+func (km *KubernetesContainerManager) networkPolicyFor(req BuildRequest) NetworkPolicy {
+	policy := km.networkPolicy
+	if buildTypePolicy, ok := km.buildTypeNetworkPolicies[req.BuildType]; ok {
+		policy = buildTypePolicy
+	}
+	return policy.restrict(req.NetworkPolicy)
+}
+
+func (km *KubernetesContainerManager) resourceProfile(req BuildRequest, env BuildEnvironment) ResourceProfile {
+	if km.profiles == nil {
+		return DefaultResourceProfile.merge(derefProfile(env.Resources))
+	}
+	return km.profiles.resolve(req.BuildType, env.Resources, req.Plan)
+}
+
+// NewBuildContainer waits for capacity and returns the container of a running pod for the build.
+// The capacity is held until the container is removed.
+func (km *KubernetesContainerManager) NewBuildContainer(ctx context.Context, req BuildRequest) (BuildContainer, error) {
+	if km.environments == nil {
+		return nil, errors.New("no build environments configured")
+	}
+	env, err := km.environments.BuildEnvironment(req.BuildType)
+	if err != nil {
+		return nil, err
+	}
+	image := env.Image
+	if km.lock != nil {
+		image = km.lock.Resolve(image)
+	}
+	name, err := podName()
+	if err != nil {
+		return nil, err
+	}
+	var sandbox Sandbox
+	if km.sandboxes != nil {
+		sandbox = km.sandboxes.Resolve(req.TrustLevel)
+	}
+
+	release, err := km.scheduler.acquire(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	podContainer, err := NewKubernetesBuildContainer(name).
+		WithNamespace(km.namespace).
+		WithEnvironment(env).
+		WithImage(image).
+		WithClient(km.client).
+		WithExecutor(km.executor).
+		WithResources(km.resourceProfile(req, env)).
+		WithNetworkPolicy(km.networkPolicyFor(req)).
+		WithLabels(buildLabels(req)).
+		WithDeadline(km.deadline).
+		WithSandbox(sandbox.SandboxProfile).
+		WithOnRemove(release).
+		Create(ctx)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if err := podContainer.Start(ctx); err != nil {
+		if removeErr := podContainer.Remove(context.WithoutCancel(ctx)); removeErr != nil {
+			log.Printf("failed to remove pod %s after start failure: %v", name, removeErr)
+		}
+		return nil, err
+	}
+	if req.OnSandbox != nil {
+		req.OnSandbox(sandbox)
+	}
+	return podContainer, nil
+}
+
+// podName returns a unique pod name, names are generated here since the fake clientset ignores
+// GenerateName.
+func podName() (string, error) {
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return podNamePrefix + hex.EncodeToString(suffix), nil
+}
+
+// SPDYPodExecutor runs commands through the exec subresource of the API server.
+type SPDYPodExecutor struct {
+	config *rest.Config
+	client kubernetes.Interface
+}
+
+func NewSPDYPodExecutor(config *rest.Config, client kubernetes.Interface) *SPDYPodExecutor {
+	return &SPDYPodExecutor{config: config, client: client}
+}
+
+func (e *SPDYPodExecutor) Exec(ctx context.Context, namespace string, pod string, container string, cmd []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	req := e.client.CoreV1().RESTClient().Post().
+		Namespace(namespace).
+		Resource("pods").
+		Name(pod).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   cmd,
+			Stdin:     stdin != nil,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+	executor, err := remotecommand.NewSPDYExecutor(e.config, "POST", req.URL())
+	if err != nil {
+		return err
+	}
+	return executor.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+}
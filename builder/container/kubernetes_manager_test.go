@@ -0,0 +1,262 @@
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+type staticEnvironments map[string]BuildEnvironment
+
+func (e staticEnvironments) BuildEnvironment(buildType string) (BuildEnvironment, error) {
+	env, ok := e[buildType]
+	if !ok {
+		return BuildEnvironment{}, errors.New("unknown build type")
+	}
+	return env, nil
+}
+
+func (e staticEnvironments) BuildTypes() []string {
+	var buildTypes []string
+	for buildType := range e {
+		buildTypes = append(buildTypes, buildType)
+	}
+	return buildTypes
+}
+
+// fakePodExecutor plays the pods of the fake clientset, it keeps the files copied into every pod
+// and runs "exit N" and "echo" commands.
+type fakePodExecutor struct {
+	mu       sync.Mutex
+	files    map[string]map[string][]byte
+	commands []string
+}
+
+func newFakePodExecutor() *fakePodExecutor {
+	return &fakePodExecutor{files: make(map[string]map[string][]byte)}
+}
+
+func (e *fakePodExecutor) Exec(ctx context.Context, namespace string, pod string, container string, cmd []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.files[pod] == nil {
+		e.files[pod] = make(map[string][]byte)
+	}
+	files := e.files[pod]
+	script := cmd[2]
+	switch {
+	case strings.Contains(script, "tar -xf -"):
+		tr := tar.NewReader(stdin)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			files[path.Join(cmd[4], header.Name)] = data
+		}
+	case strings.Contains(script, "tar -cf -"):
+		root := cmd[4]
+		tw := tar.NewWriter(stdout)
+		found := false
+		for name, data := range files {
+			if name != root && !strings.HasPrefix(name, root+"/") {
+				continue
+			}
+			found = true
+			entry := strings.TrimPrefix(name, path.Dir(root)+"/")
+			if err := tw.WriteHeader(&tar.Header{Name: entry, Mode: 0644, Size: int64(len(data))}); err != nil {
+				return err
+			}
+			tw.Write(data)
+		}
+		if !found {
+			io.WriteString(stderr, "tar: "+root+": No such file or directory")
+			return utilexec.CodeExitError{Err: errors.New("command terminated with exit code 2"), Code: 2}
+		}
+		return tw.Close()
+	}
+	e.commands = append(e.commands, script)
+	if code, ok := strings.CutPrefix(script, "exit "); ok {
+		return utilexec.CodeExitError{Err: errors.New("command terminated"), Code: int(code[0] - '0')}
+	}
+	if text, ok := strings.CutPrefix(script, "echo "); ok {
+		io.WriteString(stdout, text+"\n")
+	}
+	return nil
+}
+
+// newFakeClientset returns a clientset whose pods report the given status once created.
+func newFakeClientset(status corev1.PodStatus) *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.CreateAction).GetObject().(*corev1.Pod)
+		pod.Status = status
+		return false, nil, nil
+	})
+	return client
+}
+
+func runningStatus() corev1.PodStatus {
+	return corev1.PodStatus{
+		Phase: corev1.PodRunning,
+		ContainerStatuses: []corev1.ContainerStatus{{
+			Name:    buildContainerName,
+			State:   corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+			ImageID: "docker.io/library/node@sha256:abc",
+		}},
+	}
+}
+
+func newTestKubernetesManager(client *fake.Clientset, executor PodExecutor) *KubernetesContainerManager {
+	return NewKubernetesContainerManager().
+		WithCapacity(1).
+		WithClient(client).
+		WithExecutor(executor).
+		WithNamespace("builds").
+		WithNetworkPolicy(NetworkNoneAfterInstall).
+		WithEnvironments(staticEnvironments{"node": {Image: "node:20", Env: []string{"CI=true"}, WorkingDir: "/app"}})
+}
+
+func TestKubernetesContainerManagerRunsBuildInPod(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeClientset(runningStatus())
+	executor := newFakePodExecutor()
+	manager := newTestKubernetesManager(client, executor)
+
+	buildContainer, err := manager.NewBuildContainer(ctx, BuildRequest{BuildID: "build-1", BuildType: "node"})
+	if err != nil {
+		t.Fatalf("NewBuildContainer: %v", err)
+	}
+	pods, err := client.CoreV1().Pods("builds").List(ctx, metav1.ListOptions{})
+	if err != nil || len(pods.Items) != 1 {
+		t.Fatalf("expected one pod, got %v: %v", pods, err)
+	}
+	pod := pods.Items[0]
+	if pod.Labels[LabelBuildID] != "build-1" || pod.Labels[LabelPodName] != pod.Name {
+		t.Errorf("pod labels = %v", pod.Labels)
+	}
+	if _, ok := pod.Annotations[LabelCreatedAt]; !ok {
+		t.Errorf("pod annotations = %v, want %s", pod.Annotations, LabelCreatedAt)
+	}
+	if image := pod.Spec.Containers[0].Image; image != "node:20" {
+		t.Errorf("pod image = %s", image)
+	}
+	if manager.Scheduler().Running() != 1 {
+		t.Errorf("running = %d, want 1", manager.Scheduler().Running())
+	}
+
+	result, err := buildContainer.ExecCmd(ctx, "echo hello")
+	if err != nil || result.ExitCode != 0 || result.Stdout != "hello\n" {
+		t.Errorf("ExecCmd(echo) = %+v, %v", result, err)
+	}
+	result, err = buildContainer.ExecCmd(ctx, "exit 4")
+	if err != nil || result.ExitCode != 4 {
+		t.Errorf("ExecCmd(exit 4) = %+v, %v", result, err)
+	}
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Name: "src/index.js", Mode: 0644, Size: 5})
+	tw.Write([]byte("hello"))
+	tw.Close()
+	if err := buildContainer.CopyToContainer(ctx, &archive, "/app"); err != nil {
+		t.Fatalf("CopyToContainer: %v", err)
+	}
+	copied, err := buildContainer.CopyFromContainer(ctx, "/app/src")
+	if err != nil {
+		t.Fatalf("CopyFromContainer: %v", err)
+	}
+	tr := tar.NewReader(copied)
+	header, err := tr.Next()
+	if err != nil || header.Name != "src/index.js" {
+		t.Fatalf("CopyFromContainer entry = %v, %v", header, err)
+	}
+	if data, _ := io.ReadAll(tr); string(data) != "hello" {
+		t.Errorf("CopyFromContainer content = %q", data)
+	}
+	copied.Close()
+	missing, _ := buildContainer.CopyFromContainer(ctx, "/app/dist")
+	if _, err := io.ReadAll(missing); err == nil {
+		t.Error("CopyFromContainer of a missing path succeeded")
+	}
+
+	if err := buildContainer.RestrictNetwork(ctx); err != nil {
+		t.Fatalf("RestrictNetwork: %v", err)
+	}
+	policies, _ := client.NetworkingV1().NetworkPolicies("builds").List(ctx, metav1.ListOptions{})
+	if len(policies.Items) != 1 {
+		t.Fatalf("expected a no-egress network policy, got %d", len(policies.Items))
+	}
+
+	// Teardown as the pipeline does it
+	if err := buildContainer.Stop(ctx); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if err := buildContainer.Remove(ctx); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	pods, _ = client.CoreV1().Pods("builds").List(ctx, metav1.ListOptions{})
+	policies, _ = client.NetworkingV1().NetworkPolicies("builds").List(ctx, metav1.ListOptions{})
+	if len(pods.Items) != 0 || len(policies.Items) != 0 {
+		t.Errorf("teardown left %d pods and %d network policies", len(pods.Items), len(policies.Items))
+	}
+	if manager.Scheduler().Running() != 0 {
+		t.Errorf("running after remove = %d, want 0", manager.Scheduler().Running())
+	}
+}
+
+func TestKubernetesContainerManagerRemovesPodThatCannotStart(t *testing.T) {
+	ctx := context.Background()
+	client := newFakeClientset(corev1.PodStatus{
+		Phase: corev1.PodPending,
+		ContainerStatuses: []corev1.ContainerStatus{{
+			Name:  buildContainerName,
+			State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ErrImagePull", Message: "not found"}},
+		}},
+	})
+	manager := newTestKubernetesManager(client, newFakePodExecutor())
+
+	_, err := manager.NewBuildContainer(ctx, BuildRequest{BuildType: "node"})
+	if err == nil || !strings.Contains(err.Error(), "ErrImagePull") {
+		t.Fatalf("NewBuildContainer error = %v, want ErrImagePull", err)
+	}
+	pods, _ := client.CoreV1().Pods("builds").List(ctx, metav1.ListOptions{})
+	if len(pods.Items) != 0 {
+		t.Errorf("pod that cannot start was kept")
+	}
+	if manager.Scheduler().Running() != 0 {
+		t.Errorf("capacity of the failed pod was not released")
+	}
+}
+
+func TestKubernetesContainerManagerRejectsRegistryProxy(t *testing.T) {
+	// Payloads can only tighten full egress, so the registry proxy request reaches the backend
+	manager := newTestKubernetesManager(newFakeClientset(runningStatus()), newFakePodExecutor()).WithNetworkPolicy(NetworkFull)
+	_, err := manager.NewBuildContainer(context.Background(), BuildRequest{BuildType: "node", NetworkPolicy: NetworkRegistryProxy})
+	if err == nil {
+		t.Fatal("registry-proxy build was accepted")
+	}
+	if manager.Scheduler().Running() != 0 {
+		t.Errorf("capacity of the rejected build was not released")
+	}
+}
@@ -0,0 +1,44 @@
+package container
+
+import (
+	"bytes"
+	"strings"
+)
+
+// lineWriter splits written output into lines and sends each complete line to a channel.
+// A trailing partial line is held back until more output arrives or Flush is called.
+type lineWriter struct {
+	source  string
+	output  chan<- OutputLine
+	pending bytes.Buffer
+}
+
+func newLineWriter(source string, output chan<- OutputLine) *lineWriter {
+	return &lineWriter{source: source, output: output}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.pending.Write(p)
+	for {
+		line, err := w.pending.ReadString('\n')
+		if err != nil {
+			// No newline left, keep the partial line for the next write
+			w.pending.Reset()
+			w.pending.WriteString(line)
+			return len(p), nil
+		}
+		w.send(line)
+	}
+}
+
+// Flush sends any partial line still buffered.
+func (w *lineWriter) Flush() {
+	if w.pending.Len() > 0 {
+		w.send(w.pending.String())
+		w.pending.Reset()
+	}
+}
+
+func (w *lineWriter) send(line string) {
+	w.output <- OutputLine{Source: w.source, Text: strings.TrimRight(line, "\r\n")}
+}
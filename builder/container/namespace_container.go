@@ -0,0 +1,300 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// namespaceInit prepares the mount namespace of a command and runs it chrooted in the rootfs.
+// It runs as root of a fresh user namespace, which owns the new mount and PID namespaces, so it
+// may mount a private /proc and bind the host /dev. Arguments are the mount and chroot binaries of
+// the host, the rootfs, the working directory and the command.
+const namespaceInit = `set -e
+"$1" --make-rprivate /
+"$1" --rbind /dev "$3/dev"
+"$1" -t proc proc "$3/proc"
+exec "$2" "$3" /bin/sh -c 'cd "$1" && exec /bin/sh -c "$2"' sh "$4" "$5"`
+
+// namespaceWaitDelay bounds how long a killed command may keep its output pipes open
+const namespaceWaitDelay = 5 * time.Second
+
+// namespaceTools are the host binaries a command is started with.
+type namespaceTools struct {
+	shell  string
+	mount  string
+	chroot string
+}
+
+func lookupNamespaceTools() (namespaceTools, error) {
+	var tools namespaceTools
+	for name, target := range map[string]*string{"sh": &tools.shell, "mount": &tools.mount, "chroot": &tools.chroot} {
+		found, err := exec.LookPath(name)
+		if err != nil {
+			return namespaceTools{}, fmt.Errorf("namespace backend needs %s on the host: %w", name, err)
+		}
+		*target = found
+	}
+	return tools, nil
+}
+
+// NamespaceBuildContainer runs every command as a local process in its own Linux user, mount and
+// PID namespaces, chrooted into a rootfs extracted from an OCI image tarball. It lets developers
+// build without a docker daemon. Processes run as root of their user namespace, which is the user
+// running the builder on the host, resource profiles are not enforced and OOMKilled never reports.
+type NamespaceBuildContainer struct {
+	// dir holds the rootfs and is removed with the container
+	dir           string
+	rootfs        string
+	env           []string
+	workingDir    string
+	networkPolicy NetworkPolicy
+	tools         namespaceTools
+	imageDigest   string
+	onRemove      func()
+
+	mu                sync.Mutex
+	started           bool
+	removed           bool
+	networkRestricted bool
+	nextExecID        int
+	running           map[int]context.CancelFunc
+}
+
+func NewNamespaceBuildContainer(dir string) *NamespaceBuildContainer {
+	return &NamespaceBuildContainer{
+		dir:           dir,
+		rootfs:        filepath.Join(dir, "rootfs"),
+		workingDir:    "/",
+		networkPolicy: NetworkFull,
+		running:       make(map[int]context.CancelFunc),
+	}
+}
+
+// WithEnvironment sets the environment variables and working directory of every command.
+func (c *NamespaceBuildContainer) WithEnvironment(env []string, workingDir string) *NamespaceBuildContainer {
+	c.env = env
+	if workingDir != "" {
+		c.workingDir = workingDir
+	}
+	return c
+}
+
+// WithNetworkPolicy sets the network policy, commands share the network of the host until
+// RestrictNetwork is called under NetworkNoneAfterInstall.
+func (c *NamespaceBuildContainer) WithNetworkPolicy(policy NetworkPolicy) *NamespaceBuildContainer {
+	c.networkPolicy = policy
+	return c
+}
+
+func (c *NamespaceBuildContainer) withTools(tools namespaceTools) *NamespaceBuildContainer {
+	c.tools = tools
+	return c
+}
+
+func (c *NamespaceBuildContainer) withImageDigest(digest string) *NamespaceBuildContainer {
+	c.imageDigest = digest
+	return c
+}
+
+// WithOnRemove sets a func called once the container has been removed, or removal was attempted.
+func (c *NamespaceBuildContainer) WithOnRemove(onRemove func()) *NamespaceBuildContainer {
+	c.onRemove = onRemove
+	return c
+}
+
+// BuildContainer interface functions
+
+// CopyToContainer extracts the tar archive into containerPath of the rootfs.
+func (c *NamespaceBuildContainer) CopyToContainer(ctx context.Context, tarFile io.Reader, containerPath string) error {
+	if err := c.checkUsable(ctx); err != nil {
+		return err
+	}
+	return extractTar(tarFile, c.rootfs, containerPath, false)
+}
+
+// CopyFromContainer returns a tar archive of containerPath. Like docker, entries are named
+// relative to the parent of containerPath.
+func (c *NamespaceBuildContainer) CopyFromContainer(ctx context.Context, containerPath string) (io.ReadCloser, error) {
+	if err := c.checkUsable(ctx); err != nil {
+		return nil, err
+	}
+	source, err := secureJoin(c.rootfs, containerPath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Lstat(source); err != nil {
+		return nil, fmt.Errorf("no such file or directory: %s", containerPath)
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(archiveDir(writer, source))
+	}()
+	return reader, nil
+}
+
+// Start prepares the mount points of the rootfs, there is no long running process to start.
+func (c *NamespaceBuildContainer) Start(ctx context.Context) error {
+	if err := c.checkUsable(ctx); err != nil {
+		return err
+	}
+	for _, mountPoint := range []string{"dev", "proc", strings.TrimPrefix(c.workingDir, "/")} {
+		target, err := secureJoin(c.rootfs, mountPoint)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.started = true
+	return nil
+}
+
+// Stop kills the running commands, killing the first process of a PID namespace kills all of it.
+func (c *NamespaceBuildContainer) Stop(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cancel := range c.running {
+		cancel()
+	}
+	c.started = false
+	return nil
+}
+
+func (c *NamespaceBuildContainer) Remove(ctx context.Context) error {
+	if c.onRemove != nil {
+		defer c.onRemove()
+	}
+	c.Stop(ctx)
+	c.mu.Lock()
+	c.removed = true
+	c.mu.Unlock()
+
+	if err := os.RemoveAll(c.dir); err == nil {
+		return nil
+	}
+	// Builds may leave directories without write permission behind
+	filepath.WalkDir(c.dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.IsDir() {
+			os.Chmod(filePath, 0700)
+		}
+		return nil
+	})
+	return os.RemoveAll(c.dir)
+}
+
+func (c *NamespaceBuildContainer) RestrictNetwork(ctx context.Context) error {
+	if c.networkPolicy != NetworkNoneAfterInstall {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.networkRestricted = true
+	return nil
+}
+
+func (c *NamespaceBuildContainer) OOMKilled(ctx context.Context) (bool, error) {
+	return false, nil
+}
+
+// ImageDigest returns the digest of the configuration of the image the rootfs was extracted from.
+func (c *NamespaceBuildContainer) ImageDigest(ctx context.Context) (string, error) {
+	if c.imageDigest == "" {
+		return "", errors.New("rootfs was not extracted from an image")
+	}
+	return c.imageDigest, nil
+}
+
+func (c *NamespaceBuildContainer) ExecCmd(ctx context.Context, cmd string) (ExecResult, error) {
+	return c.ExecCmdStream(ctx, cmd, nil)
+}
+
+func (c *NamespaceBuildContainer) ExecCmdStream(ctx context.Context, cmd string, output chan<- OutputLine) (ExecResult, error) {
+	if err := c.checkUsable(ctx); err != nil {
+		return ExecResult{}, err
+	}
+	execCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c.mu.Lock()
+	if !c.started {
+		c.mu.Unlock()
+		return ExecResult{}, errors.New("container is not running")
+	}
+	execID := c.nextExecID
+	c.nextExecID++
+	c.running[execID] = cancel
+	// A new network namespace only has a loopback interface that is down
+	isolateNetwork := c.networkRestricted
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.running, execID)
+		c.mu.Unlock()
+	}()
+
+	procAttr, err := namespaceProcAttr(isolateNetwork)
+	if err != nil {
+		return ExecResult{}, err
+	}
+	process := exec.CommandContext(execCtx, c.tools.shell, "-c", namespaceInit, "init",
+		c.tools.mount, c.tools.chroot, c.rootfs, c.workingDir, cmd)
+	process.Env = c.env
+	process.SysProcAttr = procAttr
+	process.WaitDelay = namespaceWaitDelay
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+	var stdout, stderr io.Writer = &stdoutBuf, &stderrBuf
+	if output != nil {
+		stdoutLines := newLineWriter(Stdout, output)
+		stderrLines := newLineWriter(Stderr, output)
+		defer stdoutLines.Flush()
+		defer stderrLines.Flush()
+		stdout = io.MultiWriter(&stdoutBuf, stdoutLines)
+		stderr = io.MultiWriter(&stderrBuf, stderrLines)
+	}
+	process.Stdout = stdout
+	process.Stderr = stderr
+
+	startedAt := time.Now()
+	err = process.Run()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ExecResult{}, ctxErr
+	}
+	if execCtx.Err() != nil {
+		return ExecResult{}, errors.New("container was stopped")
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return ExecResult{}, err
+	}
+	return ExecResult{
+		ExitCode: process.ProcessState.ExitCode(),
+		Stdout:   stdoutBuf.String(),
+		Stderr:   stderrBuf.String(),
+		Duration: time.Since(startedAt),
+	}, nil
+}
+
+func (c *NamespaceBuildContainer) checkUsable(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.removed {
+		return errors.New("container has been removed")
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build linux
+
+package container
+
+import (
+	"os"
+	"syscall"
+)
+
+// namespaceProcAttr starts a command in new user, mount, PID, UTS and IPC namespaces, mapping
+// root of the user namespace to the user running the builder. isolateNetwork adds an empty
+// network namespace.
+func namespaceProcAttr(isolateNetwork bool) (*syscall.SysProcAttr, error) {
+	flags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC
+	if isolateNetwork {
+		flags |= syscall.CLONE_NEWNET
+	}
+	return &syscall.SysProcAttr{
+		Cloneflags:  uintptr(flags),
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		// Unprivileged users may only map their group once setgroups is denied
+		GidMappingsEnableSetgroups: false,
+		Pdeathsig:                  syscall.SIGKILL,
+	}, nil
+}
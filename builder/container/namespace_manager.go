@@ -0,0 +1,151 @@
+package container
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NamespaceContainerManager hands out NamespaceBuildContainers. The image of a build environment is
+// read from an OCI image layout tarball in the image directory, named after the image reference with
+// "/", ":" and "@" replaced by "_", e.g. node_20.tar for node:20. Every build extracts a fresh rootfs.
+type NamespaceContainerManager struct {
+	scheduler    *Scheduler
+	environments EnvironmentResolver
+	imageDir     string
+	workDir      string
+
+	networkPolicy            NetworkPolicy
+	buildTypeNetworkPolicies map[string]NetworkPolicy
+}
+
+func NewNamespaceContainerManager() *NamespaceContainerManager {
+	return &NamespaceContainerManager{
+		scheduler:                NewScheduler(0),
+		imageDir:                 "images",
+		workDir:                  filepath.Join(os.TempDir(), "comet-builds"),
+		networkPolicy:            NetworkFull,
+		buildTypeNetworkPolicies: make(map[string]NetworkPolicy),
+	}
+}
+
+// WithCapacity limits the number of builds that run at once, further builds are queued.
+func (nm *NamespaceContainerManager) WithCapacity(capacity int) *NamespaceContainerManager {
+	nm.scheduler = NewScheduler(capacity)
+	return nm
+}
+
+func (nm *NamespaceContainerManager) Scheduler() *Scheduler {
+	return nm.scheduler
+}
+
+func (nm *NamespaceContainerManager) WithEnvironments(environments EnvironmentResolver) *NamespaceContainerManager {
+	nm.environments = environments
+	return nm
+}
+
+// WithImageDir sets the directory holding the image tarballs.
+func (nm *NamespaceContainerManager) WithImageDir(imageDir string) *NamespaceContainerManager {
+	nm.imageDir = imageDir
+	return nm
+}
+
+// WithWorkDir sets the directory the rootfs of every build is extracted in.
+func (nm *NamespaceContainerManager) WithWorkDir(workDir string) *NamespaceContainerManager {
+	nm.workDir = workDir
+	return nm
+}
+
+// WithNetworkPolicy sets the default network policy, NetworkRegistryProxy is not supported.
+func (nm *NamespaceContainerManager) WithNetworkPolicy(policy NetworkPolicy) *NamespaceContainerManager {
+	nm.networkPolicy = policy
+	return nm
+}
+
+func (nm *NamespaceContainerManager) WithBuildTypeNetworkPolicy(buildType string, policy NetworkPolicy) *NamespaceContainerManager {
+	nm.buildTypeNetworkPolicies[buildType] = policy
+	return nm
+}
+
+func (nm *NamespaceContainerManager) networkPolicyFor(req BuildRequest) NetworkPolicy {
+	policy := nm.networkPolicy
+	if buildTypePolicy, ok := nm.buildTypeNetworkPolicies[req.BuildType]; ok {
+		policy = buildTypePolicy
+	}
+	return policy.restrict(req.NetworkPolicy)
+}
+
+// ImageTarball returns the path of the tarball the image is read from.
+func (nm *NamespaceContainerManager) ImageTarball(image Image) string {
+	name := strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(string(image))
+	return filepath.Join(nm.imageDir, name+".tar")
+}
+
+// NewBuildContainer waits for capacity and returns a started container for the build with a freshly
+// extracted rootfs. The capacity is held until the container is removed.
+func (nm *NamespaceContainerManager) NewBuildContainer(ctx context.Context, req BuildRequest) (BuildContainer, error) {
+	if nm.environments == nil {
+		return nil, fmt.Errorf("no build environments configured")
+	}
+	env, err := nm.environments.BuildEnvironment(req.BuildType)
+	if err != nil {
+		return nil, err
+	}
+	policy := nm.networkPolicyFor(req)
+	if policy == NetworkRegistryProxy {
+		return nil, fmt.Errorf("network policy %s is not supported by the namespace backend", policy)
+	}
+	tools, err := lookupNamespaceTools()
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := nm.scheduler.acquire(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	buildContainer, err := nm.createContainer(ctx, env, policy, tools)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return buildContainer.WithOnRemove(release), nil
+}
+
+func (nm *NamespaceContainerManager) createContainer(ctx context.Context, env BuildEnvironment, policy NetworkPolicy, tools namespaceTools) (*NamespaceBuildContainer, error) {
+	if err := os.MkdirAll(nm.workDir, 0700); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(nm.workDir, "build-*")
+	if err != nil {
+		return nil, err
+	}
+	buildContainer := NewNamespaceBuildContainer(dir).
+		WithNetworkPolicy(policy).
+		withTools(tools)
+
+	imageConfig, err := ExtractOCIImage(nm.ImageTarball(env.Image), buildContainer.rootfs)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		// The build environment overrides the defaults of the image
+		workingDir := imageConfig.WorkingDir
+		if env.WorkingDir != "" {
+			workingDir = env.WorkingDir
+		}
+		buildContainer.WithEnvironment(append(append([]string(nil), imageConfig.Env...), env.Env...), workingDir)
+		buildContainer.withImageDigest(imageConfig.Digest)
+		err = buildContainer.Start(ctx)
+	}
+	if err != nil {
+		if removeErr := buildContainer.Remove(context.WithoutCancel(ctx)); removeErr != nil {
+			log.Printf("failed to remove build directory %s: %v", dir, removeErr)
+		}
+		return nil, fmt.Errorf("failed to prepare rootfs of %s: %w", env.Image, err)
+	}
+	return buildContainer, nil
+}
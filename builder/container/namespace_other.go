@@ -0,0 +1,12 @@
+//go:build !linux
+
+package container
+
+import (
+	"errors"
+	"syscall"
+)
+
+func namespaceProcAttr(isolateNetwork bool) (*syscall.SysProcAttr, error) {
+	return nil, errors.New("the namespace backend requires linux")
+}
@@ -0,0 +1,85 @@
+package container
+
+import (
+	"fmt"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// NetworkPolicy decides what a build container can reach over the network.
+type NetworkPolicy string
+
+const (
+	// NetworkFull gives the build unrestricted egress through the default bridge
+	NetworkFull NetworkPolicy = "full"
+	// NetworkRegistryProxy attaches the build to an internal network where only the package registry proxy is reachable
+	NetworkRegistryProxy NetworkPolicy = "registry-proxy"
+	// NetworkNoneAfterInstall gives the build full egress until RestrictNetwork is called after the dependency install
+	NetworkNoneAfterInstall NetworkPolicy = "none-after-install"
+)
+
+// defaultBridgeNetwork is the network docker attaches containers to when no network mode is set
+const defaultBridgeNetwork = "bridge"
+
+// ParseNetworkPolicy validates a network policy name.
+func ParseNetworkPolicy(name string) (NetworkPolicy, error) {
+	switch policy := NetworkPolicy(name); policy {
+	case NetworkFull, NetworkRegistryProxy, NetworkNoneAfterInstall:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown network policy %q", name)
+	}
+}
+
+// restrict returns the policy of a build that asks for requested where p is configured. A build
+// can only tighten the policy: requests are honoured where p gives full egress and ignored otherwise,
+// as registry-proxy and none-after-install each allow traffic the other blocks.
+func (p NetworkPolicy) restrict(requested NetworkPolicy) NetworkPolicy {
+	if requested == "" || (p != "" && p != NetworkFull) {
+		return p
+	}
+	return requested
+}
+
+// RegistryProxy describes the package registry proxy used by the NetworkRegistryProxy policy.
+type RegistryProxy struct {
+	// Network is a docker network created with --internal that only the proxy is attached to besides the builds
+	Network string
+	// RegistryURL is the npm registry served by the proxy, e.g. "http://registry-proxy:4873"
+	RegistryURL string
+	// HTTPProxy is an optional forward proxy for tools that download outside the npm registry
+	HTTPProxy string
+}
+
+// env returns the environment that points package managers at the proxy.
+func (p RegistryProxy) env() []string {
+	env := []string{
+		"npm_config_registry=" + p.RegistryURL,
+		"YARN_REGISTRY=" + p.RegistryURL,
+	}
+	if p.HTTPProxy != "" {
+		env = append(env,
+			"HTTP_PROXY="+p.HTTPProxy,
+			"HTTPS_PROXY="+p.HTTPProxy,
+			"http_proxy="+p.HTTPProxy,
+			"https_proxy="+p.HTTPProxy,
+		)
+	}
+	return env
+}
+
+// networkConfig returns the network mode and environment of a container under the policy,
+// along with the name of the network it is attached to.
+func networkConfig(policy NetworkPolicy, proxy *RegistryProxy) (container.NetworkMode, []string, string, error) {
+	switch policy {
+	case NetworkFull, NetworkNoneAfterInstall, "":
+		return container.NetworkMode(defaultBridgeNetwork), nil, defaultBridgeNetwork, nil
+	case NetworkRegistryProxy:
+		if proxy == nil || proxy.Network == "" {
+			return "", nil, "", fmt.Errorf("network policy %s requires a registry proxy", policy)
+		}
+		return container.NetworkMode(proxy.Network), proxy.env(), proxy.Network, nil
+	default:
+		return "", nil, "", fmt.Errorf("unknown network policy %q", policy)
+	}
+}
@@ -0,0 +1,33 @@
+package container
+
+import "testing"
+
+func TestNetworkPolicyRestrictOnlyTightens(t *testing.T) {
+	tests := []struct {
+		configured NetworkPolicy
+		requested  NetworkPolicy
+		want       NetworkPolicy
+	}{
+		{NetworkFull, "", NetworkFull},
+		{NetworkFull, NetworkNoneAfterInstall, NetworkNoneAfterInstall},
+		{NetworkFull, NetworkRegistryProxy, NetworkRegistryProxy},
+		{NetworkNoneAfterInstall, NetworkFull, NetworkNoneAfterInstall},
+		{NetworkRegistryProxy, NetworkFull, NetworkRegistryProxy},
+		{NetworkRegistryProxy, NetworkNoneAfterInstall, NetworkRegistryProxy},
+		{NetworkNoneAfterInstall, NetworkRegistryProxy, NetworkNoneAfterInstall},
+	}
+	for _, tt := range tests {
+		if got := tt.configured.restrict(tt.requested); got != tt.want {
+			t.Errorf("%s.restrict(%q) = %s, want %s", tt.configured, tt.requested, got, tt.want)
+		}
+	}
+}
+
+func TestDockerContainerManagerIgnoresLooserPayloadPolicy(t *testing.T) {
+	manager := NewDockerContainerManager().
+		WithNetworkPolicy(NetworkFull).
+		WithBuildTypeNetworkPolicy("node", NetworkNoneAfterInstall)
+	if policy := manager.networkPolicyFor(BuildRequest{BuildType: "node", NetworkPolicy: NetworkFull}); policy != NetworkNoneAfterInstall {
+		t.Errorf("policy of a build asking for full egress = %s, want %s", policy, NetworkNoneAfterInstall)
+	}
+}
@@ -0,0 +1,357 @@
+package container
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+	// maxSymlinkHops bounds symlink resolution inside a rootfs
+	maxSymlinkHops = 40
+)
+
+// OCIImageConfig is the part of an OCI image configuration a build needs.
+type OCIImageConfig struct {
+	Env        []string
+	WorkingDir string
+	User       string
+	// Digest is the digest of the configuration, which docker reports as the image ID
+	Digest string `json:"-"`
+}
+
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+}
+
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	Config ociDescriptor   `json:"config"`
+	Layers []ociDescriptor `json:"layers"`
+}
+
+type ociImage struct {
+	Config OCIImageConfig `json:"config"`
+}
+
+// ExtractOCIImage unpacks the image in an OCI image layout tarball, as written by
+// "skopeo copy docker://node:20 oci-archive:node_20.tar", into rootfs and returns its configuration.
+// Layers are applied in order with whiteouts honoured. Ownership is not preserved since the
+// extraction runs unprivileged, every file belongs to the user running the builder.
+func ExtractOCIImage(tarballPath string, rootfs string) (OCIImageConfig, error) {
+	layoutDir, err := os.MkdirTemp(filepath.Dir(rootfs), ".oci-layout-*")
+	if err != nil {
+		return OCIImageConfig{}, err
+	}
+	defer os.RemoveAll(layoutDir)
+
+	tarball, err := os.Open(tarballPath)
+	if err != nil {
+		return OCIImageConfig{}, err
+	}
+	err = extractTar(tarball, layoutDir, "/", false)
+	tarball.Close()
+	if err != nil {
+		return OCIImageConfig{}, fmt.Errorf("failed to unpack %s: %w", tarballPath, err)
+	}
+
+	var index ociIndex
+	if err := readOCIJSON(layoutDir, "index.json", &index); err != nil {
+		return OCIImageConfig{}, err
+	}
+	if len(index.Manifests) == 0 {
+		return OCIImageConfig{}, fmt.Errorf("%s contains no image", tarballPath)
+	}
+	var manifest ociManifest
+	if err := readOCIJSON(layoutDir, blobPath(index.Manifests[0].Digest), &manifest); err != nil {
+		return OCIImageConfig{}, err
+	}
+	var image ociImage
+	if err := readOCIJSON(layoutDir, blobPath(manifest.Config.Digest), &image); err != nil {
+		return OCIImageConfig{}, err
+	}
+
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return OCIImageConfig{}, err
+	}
+	for _, layer := range manifest.Layers {
+		if err := applyLayer(layoutDir, layer, rootfs); err != nil {
+			return OCIImageConfig{}, fmt.Errorf("failed to apply layer %s: %w", layer.Digest, err)
+		}
+	}
+	image.Config.Digest = manifest.Config.Digest
+	return image.Config, nil
+}
+
+func blobPath(digest string) string {
+	algorithm, hex, _ := strings.Cut(digest, ":")
+	return path.Join("blobs", algorithm, hex)
+}
+
+func readOCIJSON(layoutDir string, name string, v interface{}) error {
+	target, err := secureJoin(layoutDir, name)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(target)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", name, err)
+	}
+	return nil
+}
+
+func applyLayer(layoutDir string, layer ociDescriptor, rootfs string) error {
+	blob, err := secureJoin(layoutDir, blobPath(layer.Digest))
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(blob)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	switch {
+	case strings.HasSuffix(layer.MediaType, "+gzip"), strings.HasSuffix(layer.MediaType, ".gzip"):
+		gzipReader, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	case strings.HasSuffix(layer.MediaType, "+zstd"):
+		return fmt.Errorf("unsupported layer media type %s", layer.MediaType)
+	}
+	return extractTar(reader, rootfs, "/", true)
+}
+
+// extractTar unpacks a tar stream into dir of root. No entry can be written outside root, symlinks
+// are resolved as if root was the filesystem root. With layer set, whiteout entries delete files.
+func extractTar(r io.Reader, root string, dir string, layer bool) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		entryDir, base := path.Split(path.Join("/", dir, header.Name))
+		if layer && base == whiteoutOpaque {
+			if err := clearDir(root, entryDir); err != nil {
+				return err
+			}
+			continue
+		}
+		if layer && strings.HasPrefix(base, whiteoutPrefix) {
+			target, err := secureJoin(root, path.Join(entryDir, strings.TrimPrefix(base, whiteoutPrefix)))
+			if err != nil {
+				return err
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if base == "" {
+			continue
+		}
+		parent, err := secureJoin(root, entryDir)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+		// The entry itself is not resolved, an existing symlink in its place is replaced
+		target := filepath.Join(parent, base)
+		if err := extractEntry(tr, header, root, path.Join("/", dir), target); err != nil {
+			return fmt.Errorf("%s: %w", header.Name, err)
+		}
+	}
+}
+
+func extractEntry(tr *tar.Reader, header *tar.Header, root string, dir string, target string) error {
+	mode := os.FileMode(header.Mode).Perm() | 0200
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		return os.Chmod(target, mode|0700)
+	case tar.TypeReg:
+		if err := removeExisting(target); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, tr); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	case tar.TypeSymlink:
+		if err := removeExisting(target); err != nil {
+			return err
+		}
+		return os.Symlink(header.Linkname, target)
+	case tar.TypeLink:
+		// Hard link targets are named like entries, relative to the root of the archive
+		source, err := secureJoin(root, path.Join(dir, header.Linkname))
+		if err != nil {
+			return err
+		}
+		if err := removeExisting(target); err != nil {
+			return err
+		}
+		return os.Link(source, target)
+	default:
+		// Device nodes and fifos cannot be created unprivileged, builds do not need them
+		return nil
+	}
+}
+
+func removeExisting(target string) error {
+	info, err := os.Lstat(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return os.RemoveAll(target)
+	}
+	return os.Remove(target)
+}
+
+func clearDir(root string, dir string) error {
+	target, err := secureJoin(root, dir)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(target, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// secureJoin joins name to root, resolving symlinks along the way as if root was the filesystem
+// root, so the result never points outside root. Missing components are joined as they are.
+func secureJoin(root string, name string) (string, error) {
+	resolved := ""
+	remaining := strings.Split(path.Clean("/"+name), "/")
+	hops := 0
+	for len(remaining) > 0 {
+		component := remaining[0]
+		remaining = remaining[1:]
+		if component == "" || component == "." {
+			continue
+		}
+		if component == ".." {
+			resolved = path.Dir("/" + resolved)
+			continue
+		}
+
+		next := path.Join("/", resolved, component)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		hops++
+		if hops > maxSymlinkHops {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", name)
+		}
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if !path.IsAbs(link) {
+			link = path.Join("/", resolved, link)
+		}
+		remaining = append(strings.Split(path.Clean(link), "/"), remaining...)
+		resolved = ""
+	}
+	return filepath.Join(root, path.Clean("/"+resolved)), nil
+}
+
+// archiveDir writes source as a tar stream, entries are named relative to the parent of source.
+// Symlinks are archived as links and never followed.
+func archiveDir(w io.Writer, source string) error {
+	tw := tar.NewWriter(w)
+	parent := filepath.Dir(source)
+	err := filepath.Walk(source, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(filePath); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(parent, filePath)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
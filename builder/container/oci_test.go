@@ -0,0 +1,495 @@
+package container
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// tarEntry is an entry of a test archive, a regular file unless typeflag says otherwise.
+type tarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+}
+
+func buildTar(t *testing.T, entries ...tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Typeflag: entry.typeflag, Linkname: entry.linkname, Mode: 0644}
+		switch entry.typeflag {
+		case 0:
+			header.Typeflag = tar.TypeReg
+			header.Size = int64(len(entry.body))
+		case tar.TypeDir:
+			header.Mode = 0755
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, entry.body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// listTree returns the paths under root, symlinks are not followed.
+func listTree(t *testing.T, root string) []string {
+	t.Helper()
+	var paths []string
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if filePath == root {
+			return nil
+		}
+		name, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, filepath.ToSlash(name))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestSecureJoinStaysInsideRoot(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"abs":       "/etc",
+		"rel":       "../../../etc",
+		"host":      filepath.Dir(root),
+		"loop":      "loop",
+		"etc/up":    "..",
+		"etc/alias": "passwd",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{name: "usr/bin/node", want: "usr/bin/node"},
+		{name: "/etc/passwd", want: "etc/passwd"},
+		{name: "../../etc/passwd", want: "etc/passwd"},
+		{name: "usr/../../../etc/passwd", want: "etc/passwd"},
+		{name: "abs/passwd", want: "etc/passwd"},
+		{name: "rel/passwd", want: "etc/passwd"},
+		{name: "etc/up/etc/up/abs", want: "etc"},
+		{name: "etc/alias", want: "etc/passwd"},
+		{name: "host/secret", want: strings.TrimPrefix(filepath.Join(filepath.Dir(root), "secret"), "/")},
+		{name: "", want: ""},
+		{name: "loop/passwd", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := secureJoin(root, tt.name)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("secureJoin(%q) = %s, want an error", tt.name, got)
+				}
+				return
+			}
+			if want := filepath.Join(root, tt.want); err != nil || got != want {
+				t.Errorf("secureJoin(%q) = %s, %v, want %s", tt.name, got, err, want)
+			}
+		})
+	}
+}
+
+func TestExtractTarKeepsEntriesInsideRoot(t *testing.T) {
+	tests := []struct {
+		name    string
+		layer   bool
+		entries func(outside string) []tarEntry
+		wantErr bool
+	}{
+		{
+			name: "parent path",
+			entries: func(outside string) []tarEntry {
+				return []tarEntry{{name: "../../secret", body: "overwritten"}}
+			},
+		},
+		{
+			name: "relative symlink",
+			entries: func(outside string) []tarEntry {
+				return []tarEntry{
+					{name: "escape", typeflag: tar.TypeSymlink, linkname: "../../.."},
+					{name: "escape/secret", body: "overwritten"},
+				}
+			},
+		},
+		{
+			name: "absolute symlink",
+			entries: func(outside string) []tarEntry {
+				return []tarEntry{
+					{name: "escape", typeflag: tar.TypeSymlink, linkname: outside},
+					{name: "escape/secret", body: "overwritten"},
+				}
+			},
+		},
+		{
+			name: "file replacing a symlink",
+			entries: func(outside string) []tarEntry {
+				return []tarEntry{
+					{name: "config", typeflag: tar.TypeSymlink, linkname: filepath.Join(outside, "secret")},
+					{name: "config", body: "overwritten"},
+				}
+			},
+		},
+		{
+			name: "directory replacing a symlink",
+			entries: func(outside string) []tarEntry {
+				return []tarEntry{
+					{name: "escape", typeflag: tar.TypeSymlink, linkname: outside},
+					{name: "escape", typeflag: tar.TypeDir},
+					{name: "escape/secret", body: "overwritten"},
+				}
+			},
+		},
+		{
+			name: "hard link to a parent path",
+			entries: func(outside string) []tarEntry {
+				return []tarEntry{{name: "secret", typeflag: tar.TypeLink, linkname: "../secret"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "hard link through a symlink",
+			entries: func(outside string) []tarEntry {
+				return []tarEntry{
+					{name: "escape", typeflag: tar.TypeSymlink, linkname: outside},
+					{name: "secret", typeflag: tar.TypeLink, linkname: "escape/secret"},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name:  "whiteout through a symlink",
+			layer: true,
+			entries: func(outside string) []tarEntry {
+				return []tarEntry{
+					{name: "escape", typeflag: tar.TypeSymlink, linkname: outside},
+					{name: "escape/.wh.secret"},
+					{name: "../.wh.secret"},
+				}
+			},
+		},
+		{
+			name:  "opaque whiteout through a symlink",
+			layer: true,
+			entries: func(outside string) []tarEntry {
+				return []tarEntry{
+					{name: "escape", typeflag: tar.TypeSymlink, linkname: "../../.."},
+					{name: "escape/.wh..wh..opq"},
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outside := t.TempDir()
+			secret := filepath.Join(outside, "secret")
+			if err := os.WriteFile(secret, []byte("secret"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			root := filepath.Join(outside, "rootfs")
+			if err := os.Mkdir(root, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			err := extractTar(bytes.NewReader(buildTar(t, tt.entries(outside)...)), root, "/", tt.layer)
+			if tt.wantErr && err == nil {
+				t.Error("extractTar succeeded, want an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("extractTar: %v", err)
+			}
+			if data, err := os.ReadFile(secret); err != nil || string(data) != "secret" {
+				t.Errorf("file outside the root = %q, %v", data, err)
+			}
+			if info, err := os.Stat(secret); err == nil && !info.Mode().IsRegular() {
+				t.Errorf("file outside the root was replaced by %s", info.Mode())
+			}
+			entries, err := os.ReadDir(outside)
+			if err != nil || len(entries) != 2 {
+				t.Errorf("entries outside the root = %v, %v, want only the root and the secret", entries, err)
+			}
+		})
+	}
+}
+
+func TestExtractTarLinksHardLinksInsideRoot(t *testing.T) {
+	root := t.TempDir()
+	archive := buildTar(t,
+		tarEntry{name: "usr/local/bin/node", body: "#!node"},
+		tarEntry{name: "usr/bin/node", typeflag: tar.TypeLink, linkname: "usr/local/bin/node"},
+		tarEntry{name: "usr/bin/nodejs", typeflag: tar.TypeLink, linkname: "/usr/local/bin/node"},
+	)
+	if err := extractTar(bytes.NewReader(archive), root, "/", true); err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+
+	source, err := os.Stat(filepath.Join(root, "usr/local/bin/node"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"usr/bin/node", "usr/bin/nodejs"} {
+		link, err := os.Lstat(filepath.Join(root, name))
+		if err != nil || !os.SameFile(source, link) {
+			t.Errorf("%s is not a hard link of usr/local/bin/node: %v", name, err)
+		}
+	}
+
+	// Link targets are named from the root of the archive, not from the directory it is unpacked into
+	archive = buildTar(t,
+		tarEntry{name: "index.html", body: "<html>"},
+		tarEntry{name: "latest.html", typeflag: tar.TypeLink, linkname: "index.html"},
+	)
+	if err := extractTar(bytes.NewReader(archive), root, "/srv/site", false); err != nil {
+		t.Fatalf("extractTar into a directory: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "srv/site/latest.html")); err != nil || string(data) != "<html>" {
+		t.Errorf("srv/site/latest.html = %q, %v", data, err)
+	}
+}
+
+func TestExtractTarAppliesWhiteoutsAcrossLayers(t *testing.T) {
+	root := t.TempDir()
+	layers := [][]tarEntry{
+		{
+			{name: "app/", typeflag: tar.TypeDir},
+			{name: "app/index.js", body: "v1"},
+			{name: "app/old.js", body: "old"},
+			{name: "app/node_modules/left-pad/index.js", body: "pad"},
+			{name: "cache/", typeflag: tar.TypeDir},
+			{name: "cache/a", body: "a"},
+			{name: "cache/sub/b", body: "b"},
+			{name: "etc/hosts", body: "localhost"},
+		},
+		{
+			{name: "app/.wh.old.js"},
+			{name: "app/.wh.node_modules"},
+			{name: "app/index.js", body: "v2"},
+			{name: "cache/.wh..wh..opq"},
+			{name: "cache/c", body: "c"},
+			{name: "missing/.wh.file"},
+		},
+		{
+			{name: "app/old.js", body: "restored"},
+		},
+	}
+	for i, layer := range layers {
+		if err := extractTar(bytes.NewReader(buildTar(t, layer...)), root, "/", true); err != nil {
+			t.Fatalf("layer %d: %v", i, err)
+		}
+	}
+
+	want := []string{"app", "app/index.js", "app/old.js", "cache", "cache/c", "etc", "etc/hosts"}
+	if got := listTree(t, root); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("rootfs = %v, want %v", got, want)
+	}
+	for name, body := range map[string]string{"app/index.js": "v2", "app/old.js": "restored", "cache/c": "c"} {
+		if data, err := os.ReadFile(filepath.Join(root, name)); err != nil || string(data) != body {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, body)
+		}
+	}
+
+	// Outside of image layers whiteouts are ordinary files
+	plain := t.TempDir()
+	if err := extractTar(bytes.NewReader(buildTar(t, layers[1]...)), plain, "/", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(plain, "cache/.wh..wh..opq")); err != nil {
+		t.Errorf("whiteout outside a layer was not extracted: %v", err)
+	}
+}
+
+func TestExtractOCIImage(t *testing.T) {
+	dir := t.TempDir()
+	var blobs []tarEntry
+	addBlob := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		blobs = append(blobs, tarEntry{name: "blobs/sha256/" + hex.EncodeToString(sum[:]), body: string(data)})
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+	addJSON := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addBlob(data)
+	}
+
+	var gzipped bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	gzipWriter.Write(buildTar(t,
+		tarEntry{name: "usr/local/bin/node", body: "#!node"},
+		tarEntry{name: "tmp/build.log", body: "log"},
+	))
+	gzipWriter.Close()
+	baseLayer := addBlob(gzipped.Bytes())
+	topLayer := addBlob(buildTar(t,
+		tarEntry{name: "tmp/.wh..wh..opq"},
+		tarEntry{name: "app/package.json", body: "{}"},
+	))
+	config := addJSON(map[string]interface{}{"config": map[string]interface{}{
+		"Env":        []string{"PATH=/usr/local/bin:/usr/bin", "NODE_VERSION=20"},
+		"WorkingDir": "/app",
+		"User":       "node",
+	}})
+	manifest := addJSON(ociManifest{
+		Config: ociDescriptor{MediaType: "application/vnd.oci.image.config.v1+json", Digest: config},
+		Layers: []ociDescriptor{
+			{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: baseLayer},
+			{MediaType: "application/vnd.oci.image.layer.v1.tar", Digest: topLayer},
+		},
+	})
+	index, err := json.Marshal(ociIndex{Manifests: []ociDescriptor{
+		{MediaType: "application/vnd.oci.image.manifest.v1+json", Digest: manifest},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs = append(blobs, tarEntry{name: "index.json", body: string(index)})
+
+	tarballPath := filepath.Join(dir, "node_20.tar")
+	if err := os.WriteFile(tarballPath, buildTar(t, blobs...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rootfs := filepath.Join(dir, "rootfs")
+	got, err := ExtractOCIImage(tarballPath, rootfs)
+	if err != nil {
+		t.Fatalf("ExtractOCIImage: %v", err)
+	}
+
+	if got.Digest != config || got.WorkingDir != "/app" || got.User != "node" || len(got.Env) != 2 {
+		t.Errorf("image configuration = %+v", got)
+	}
+	want := []string{"app", "app/package.json", "tmp", "usr", "usr/local", "usr/local/bin", "usr/local/bin/node"}
+	if tree := listTree(t, rootfs); strings.Join(tree, ",") != strings.Join(want, ",") {
+		t.Errorf("rootfs = %v, want %v", tree, want)
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 2 {
+		t.Errorf("entries next to the rootfs = %v, %v, want the layout directory removed", entries, err)
+	}
+}
+
+func TestExtractOCIImageRejectsUnsupportedLayers(t *testing.T) {
+	dir := t.TempDir()
+	layer := []byte("zstd")
+	sum := sha256.Sum256(layer)
+	layerDigest := "sha256:" + hex.EncodeToString(sum[:])
+	manifest, _ := json.Marshal(ociManifest{
+		Config: ociDescriptor{Digest: "sha256:config"},
+		Layers: []ociDescriptor{{MediaType: "application/vnd.oci.image.layer.v1.tar+zstd", Digest: layerDigest}},
+	})
+	index, _ := json.Marshal(ociIndex{Manifests: []ociDescriptor{{Digest: "sha256:manifest"}}})
+	tarballPath := filepath.Join(dir, "image.tar")
+	err := os.WriteFile(tarballPath, buildTar(t,
+		tarEntry{name: "index.json", body: string(index)},
+		tarEntry{name: "blobs/sha256/manifest", body: string(manifest)},
+		tarEntry{name: "blobs/sha256/config", body: "{}"},
+		tarEntry{name: "blobs/sha256/" + hex.EncodeToString(sum[:]), body: string(layer)},
+	), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ExtractOCIImage(tarballPath, filepath.Join(dir, "rootfs")); err == nil || !strings.Contains(err.Error(), "unsupported layer media type") {
+		t.Errorf("ExtractOCIImage error = %v, want an unsupported media type", err)
+	}
+}
+
+func TestArchiveDirKeepsSymlinks(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "dist")
+	files := map[string]string{"index.html": "<html>", "assets/app.js": "app()"}
+	for name, body := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(source, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(source, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("assets", filepath.Join(source, "static")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc/passwd", filepath.Join(source, "passwd")); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if err := archiveDir(&archive, source); err != nil {
+		t.Fatalf("archiveDir: %v", err)
+	}
+
+	links := map[string]string{}
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, header.Name)
+		if header.Typeflag == tar.TypeSymlink {
+			links[header.Name] = header.Linkname
+		}
+	}
+	sort.Strings(names)
+	want := []string{"dist", "dist/assets", "dist/assets/app.js", "dist/index.html", "dist/passwd", "dist/static"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("archived %v, want %v", names, want)
+	}
+	if links["dist/static"] != "assets" || links["dist/passwd"] != "/etc/passwd" {
+		t.Errorf("archived symlinks = %v", links)
+	}
+
+	// The archive unpacks to the same tree
+	root := t.TempDir()
+	if err := extractTar(bytes.NewReader(archive.Bytes()), root, "/", false); err != nil {
+		t.Fatalf("extractTar: %v", err)
+	}
+	for name, body := range files {
+		if data, err := os.ReadFile(filepath.Join(root, "dist", name)); err != nil || string(data) != body {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, body)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(root, "dist/static")); err != nil || link != "assets" {
+		t.Errorf("dist/static links to %q, %v", link, err)
+	}
+}
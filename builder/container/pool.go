@@ -0,0 +1,149 @@
+package container
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	poolRetryInterval  = 10 * time.Second
+	poolDrainTimeout   = 30 * time.Second
+	poolRefillRequests = 64
+)
+
+// warmPool keeps pre-created, started containers per build type so a build does not wait for a
+// cold start. A container leaves the pool when it is handed to a build and is never returned,
+// the build removes it and the pool creates a fresh one in its place.
+type warmPool struct {
+	sizes  map[string]int
+	create func(ctx context.Context, buildType string) (*DockerBuildContainer, error)
+	refill chan string
+
+	mu   sync.Mutex
+	idle map[string][]*DockerBuildContainer
+	// leased holds containers taken from the pool that are not yet owned by a build
+	leased map[string]bool
+}
+
+func newWarmPool(create func(ctx context.Context, buildType string) (*DockerBuildContainer, error)) *warmPool {
+	return &warmPool{
+		sizes:  make(map[string]int),
+		create: create,
+		refill: make(chan string, poolRefillRequests),
+		idle:   make(map[string][]*DockerBuildContainer),
+		leased: make(map[string]bool),
+	}
+}
+
+// take hands out an idle container of the build type, if any, and asks for a replacement.
+// The container counts as part of the pool until it is returned to endLease.
+func (p *warmPool) take(buildType string) *DockerBuildContainer {
+	p.mu.Lock()
+	idle := p.idle[buildType]
+	if len(idle) == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	buildContainer := idle[0]
+	p.idle[buildType] = idle[1:]
+	p.leased[buildContainer.id] = true
+	p.mu.Unlock()
+
+	select {
+	case p.refill <- buildType:
+	default:
+		// A refill is already pending, the periodic pass catches up otherwise
+	}
+	return buildContainer
+}
+
+// endLease is called once a taken container is owned by a build or discarded.
+func (p *warmPool) endLease(containerID string) {
+	p.mu.Lock()
+	delete(p.leased, containerID)
+	p.mu.Unlock()
+}
+
+// contains reports whether the container is idle in the pool or being handed to a build.
+func (p *warmPool) contains(containerID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.leased[containerID] {
+		return true
+	}
+	for _, containers := range p.idle {
+		for _, buildContainer := range containers {
+			if buildContainer.id == containerID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// run fills the pool and keeps it filled until ctx is done, then removes the idle containers.
+func (p *warmPool) run(ctx context.Context) {
+	ticker := time.NewTicker(poolRetryInterval)
+	defer ticker.Stop()
+	defer p.drain(context.WithoutCancel(ctx))
+
+	for buildType := range p.sizes {
+		p.fill(ctx, buildType)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case buildType := <-p.refill:
+			p.fill(ctx, buildType)
+		case <-ticker.C:
+			// Retries build types whose fill failed, e.g. while the docker daemon was unavailable
+			for buildType := range p.sizes {
+				p.fill(ctx, buildType)
+			}
+		}
+	}
+}
+
+func (p *warmPool) fill(ctx context.Context, buildType string) {
+	for ctx.Err() == nil {
+		p.mu.Lock()
+		missing := p.sizes[buildType] - len(p.idle[buildType])
+		p.mu.Unlock()
+		if missing <= 0 {
+			return
+		}
+
+		buildContainer, err := p.create(ctx, buildType)
+		if err != nil {
+			log.Printf("warm pool: failed to create container for %s: %v", buildType, err)
+			return
+		}
+		p.mu.Lock()
+		p.idle[buildType] = append(p.idle[buildType], buildContainer)
+		p.mu.Unlock()
+	}
+}
+
+func (p *warmPool) drain(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, poolDrainTimeout)
+	defer cancel()
+
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = make(map[string][]*DockerBuildContainer)
+	p.mu.Unlock()
+
+	for _, containers := range idle {
+		for _, buildContainer := range containers {
+			if err := buildContainer.Stop(ctx); err != nil {
+				log.Printf("warm pool: %v", err)
+			}
+			if err := buildContainer.Remove(ctx); err != nil {
+				log.Printf("warm pool: failed to remove container %s: %v", buildContainer.id, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// Labels set on every container created by the builder.
+const (
+	LabelManaged       = "comet.managed"
+	LabelBuildType     = "comet.build-type"
+	LabelBuildID       = "comet.build-id"
+	LabelCorrelationID = "comet.correlation-id"
+	LabelCreatedAt     = "comet.created-at"
+	// LabelPool marks containers created for the warm pool, their build is only known in memory
+	// since docker cannot relabel a container once it is handed to a build
+	LabelPool = "comet.pool"
+)
+
+const (
+	defaultReapInterval = time.Minute
+	// defaultReapGrace protects containers between their creation and the start of their build
+	defaultReapGrace = 2 * time.Minute
+	reapStopTimeout  = 10
+)
+
+// Reaper removes build containers that no build owns anymore: containers left behind by a previous
+// run of the builder, containers whose build is no longer tracked and containers whose build exceeds
+// the maximum build duration.
+type Reaper struct {
+	manager          *DockerContainerManager
+	interval         time.Duration
+	grace            time.Duration
+	maxBuildDuration time.Duration
+	isBuildActive    func(correlationID string) bool
+}
+
+func NewReaper(manager *DockerContainerManager) *Reaper {
+	return &Reaper{
+		manager:  manager,
+		interval: defaultReapInterval,
+		grace:    defaultReapGrace,
+	}
+}
+
+func (r *Reaper) WithInterval(interval time.Duration) *Reaper {
+	r.interval = interval
+	return r
+}
+
+// WithMaxBuildDuration removes containers handed to a build longer than maxBuildDuration ago, zero disables it.
+func (r *Reaper) WithMaxBuildDuration(maxBuildDuration time.Duration) *Reaper {
+	r.maxBuildDuration = maxBuildDuration
+	return r
+}
+
+// WithBuildTracker removes containers whose build isActive no longer reports as running.
+func (r *Reaper) WithBuildTracker(isActive func(correlationID string) bool) *Reaper {
+	r.isBuildActive = isActive
+	return r
+}
+
+// Run sweeps every interval until ctx is done.
+func (r *Reaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if removed, err := r.Sweep(ctx); err != nil {
+			log.Printf("reaper: sweep failed: %v", err)
+		} else if removed > 0 {
+			log.Printf("reaper: removed %d build containers", removed)
+		}
+	}
+}
+
+// Sweep removes the orphaned and expired build containers once and returns how many it removed.
+// Run at startup it cleans up after a crash, when no container is owned by a build yet.
+func (r *Reaper) Sweep(ctx context.Context) (int, error) {
+	containers, err := r.manager.client.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", LabelManaged+"=true")),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	var errs []error
+	for _, summary := range containers {
+		reason := r.reapReason(summary.ID, summary.Labels)
+		if reason == "" {
+			continue
+		}
+		log.Printf("reaper: removing container %s (build %s): %s", summary.ID, summary.Labels[LabelBuildID], reason)
+		if err := r.remove(ctx, summary.ID); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed++
+	}
+	return removed, errors.Join(errs...)
+}
+
+// reapReason returns why a container must be removed, or an empty string to keep it.
+func (r *Reaper) reapReason(containerID string, labels map[string]string) string {
+	if r.manager.pool.contains(containerID) {
+		return ""
+	}
+	live, ok := r.manager.liveContainer(containerID)
+	if !ok {
+		if createdAt, err := time.Parse(time.RFC3339, labels[LabelCreatedAt]); err == nil && time.Since(createdAt) < r.grace {
+			return ""
+		}
+		return "not owned by a build"
+	}
+	age := time.Since(live.assignedAt)
+	if r.maxBuildDuration > 0 && age > r.maxBuildDuration {
+		return "build exceeded the maximum build duration"
+	}
+	if r.isBuildActive != nil && age > r.grace && !r.isBuildActive(live.correlationID) {
+		return "build is no longer tracked"
+	}
+	return ""
+}
+
+func (r *Reaper) remove(ctx context.Context, containerID string) error {
+	// Builds still holding the container release their capacity through its usual removal path
+	if live, ok := r.manager.liveContainer(containerID); ok {
+		if err := live.container.Stop(ctx); err != nil {
+			log.Printf("reaper: %v", err)
+		}
+		return live.container.Remove(ctx)
+	}
+	timeout := reapStopTimeout
+	if err := r.manager.client.ContainerStop(ctx, containerID, container.StopOptions{Timeout: &timeout}); err != nil {
+		log.Printf("reaper: failed to stop container %s: %v", containerID, err)
+	}
+	return r.manager.client.ContainerRemove(ctx, containerID, container.RemoveOptions{Force: true})
+}
+
+// buildLabels returns the labels of a container created for req, requests without a build are for the warm pool.
+func buildLabels(req BuildRequest) map[string]string {
+	labels := map[string]string{
+		LabelManaged:   "true",
+		LabelBuildType: req.BuildType,
+		LabelCreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	if req.BuildID == "" && req.CorrelationID == "" {
+		labels[LabelPool] = "true"
+		return labels
+	}
+	labels[LabelBuildID] = req.BuildID
+	labels[LabelCorrelationID] = req.CorrelationID
+	return labels
+}
@@ -0,0 +1,158 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/docker/docker/api/types/container"
+	units "github.com/docker/go-units"
+)
+
+// Ulimit is a per-process limit applied inside a build container, e.g. "nofile".
+type Ulimit struct {
+	Name string `json:"name"`
+	Soft int64  `json:"soft"`
+	Hard int64  `json:"hard"`
+}
+
+// ResourceProfile describes the resources a build container may use. Zero fields are unlimited.
+type ResourceProfile struct {
+	// CPUs is the number of CPUs the build may use, fractions are allowed
+	CPUs float64 `json:"cpus"`
+	// MemoryBytes is the hard memory limit, exceeding it gets the build OOM killed. Swap is disabled.
+	MemoryBytes int64 `json:"memoryBytes"`
+	// PidsLimit caps the number of processes, which stops fork bombs
+	PidsLimit int64 `json:"pidsLimit"`
+	// StorageSize limits the writable layer, e.g. "10G". Only supported by some storage drivers.
+	StorageSize string   `json:"storageSize"`
+	Ulimits     []Ulimit `json:"ulimits"`
+}
+
+const gib = 1024 * 1024 * 1024
+
+// DefaultResourceProfile applies to builds whose build type and plan have no profile of their own.
+var DefaultResourceProfile = ResourceProfile{
+	CPUs:        1,
+	MemoryBytes: 2 * gib,
+	PidsLimit:   512,
+	Ulimits: []Ulimit{
+		{Name: "nofile", Soft: 4096, Hard: 8192},
+	},
+}
+
+// merge returns p with every field set in override replacing its own.
+func (p ResourceProfile) merge(override ResourceProfile) ResourceProfile {
+	if override.CPUs > 0 {
+		p.CPUs = override.CPUs
+	}
+	if override.MemoryBytes > 0 {
+		p.MemoryBytes = override.MemoryBytes
+	}
+	if override.PidsLimit > 0 {
+		p.PidsLimit = override.PidsLimit
+	}
+	if override.StorageSize != "" {
+		p.StorageSize = override.StorageSize
+	}
+	if len(override.Ulimits) > 0 {
+		p.Ulimits = override.Ulimits
+	}
+	return p
+}
+
+// hostConfig translates the profile into the docker host configuration of a container.
+func (p ResourceProfile) hostConfig() *container.HostConfig {
+	hostConfig := &container.HostConfig{}
+	if p.CPUs > 0 {
+		hostConfig.NanoCPUs = int64(p.CPUs * 1e9)
+	}
+	if p.MemoryBytes > 0 {
+		hostConfig.Memory = p.MemoryBytes
+		hostConfig.MemorySwap = p.MemoryBytes
+	}
+	if p.PidsLimit > 0 {
+		pidsLimit := p.PidsLimit
+		hostConfig.PidsLimit = &pidsLimit
+	}
+	if p.StorageSize != "" {
+		hostConfig.StorageOpt = map[string]string{"size": p.StorageSize}
+	}
+	for _, ulimit := range p.Ulimits {
+		hostConfig.Ulimits = append(hostConfig.Ulimits, &units.Ulimit{Name: ulimit.Name, Soft: ulimit.Soft, Hard: ulimit.Hard})
+	}
+	return hostConfig
+}
+
+// ResourceProfiles resolves the resource profile of a build from its build type and plan.
+// A plan profile is applied on top of the build type profile, so a plan only needs to set
+// the limits it changes.
+type ResourceProfiles struct {
+	defaultProfile ResourceProfile
+	buildTypes     map[string]ResourceProfile
+	plans          map[string]ResourceProfile
+}
+
+func NewResourceProfiles() *ResourceProfiles {
+	return &ResourceProfiles{
+		defaultProfile: DefaultResourceProfile,
+		buildTypes:     make(map[string]ResourceProfile),
+		plans:          make(map[string]ResourceProfile),
+	}
+}
+
+func (rp *ResourceProfiles) WithDefault(profile ResourceProfile) *ResourceProfiles {
+	rp.defaultProfile = profile
+	return rp
+}
+
+func (rp *ResourceProfiles) WithBuildType(buildType string, profile ResourceProfile) *ResourceProfiles {
+	rp.buildTypes[buildType] = profile
+	return rp
+}
+
+func (rp *ResourceProfiles) WithPlan(plan string, profile ResourceProfile) *ResourceProfiles {
+	rp.plans[plan] = profile
+	return rp
+}
+
+// LoadPlanProfiles reads the profiles of billing plans from a JSON file keyed by plan, e.g.
+// {"pro": {"cpus": 4, "memoryBytes": 8589934592}}, on top of the default profile.
+func LoadPlanProfiles(path string) (*ResourceProfiles, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var plans map[string]ResourceProfile
+	if err := json.Unmarshal(data, &plans); err != nil {
+		return nil, fmt.Errorf("failed to parse plan profiles %s: %w", path, err)
+	}
+	profiles := NewResourceProfiles()
+	for plan, profile := range plans {
+		if profile.MemoryBytes < 0 || profile.CPUs < 0 || profile.PidsLimit < 0 {
+			return nil, fmt.Errorf("%s: negative limit in plan %q", path, plan)
+		}
+		profiles.WithPlan(plan, profile)
+	}
+	return profiles, nil
+}
+
+// Resolve returns the profile for a build. Unknown build types and plans fall back to the default.
+func (rp *ResourceProfiles) Resolve(buildType string, plan string) ResourceProfile {
+	return rp.resolve(buildType, nil, plan)
+}
+
+// resolve applies, in order, the default, the build type, the build environment and the plan profile.
+func (rp *ResourceProfiles) resolve(buildType string, environment *ResourceProfile, plan string) ResourceProfile {
+	profile := rp.defaultProfile
+	if buildTypeProfile, ok := rp.buildTypes[buildType]; ok {
+		profile = profile.merge(buildTypeProfile)
+	}
+	if environment != nil {
+		profile = profile.merge(*environment)
+	}
+	if planProfile, ok := rp.plans[plan]; ok {
+		profile = profile.merge(planProfile)
+	}
+	return profile
+}
@@ -0,0 +1,23 @@
+package container
+
+import "testing"
+
+func TestLoadPlanProfilesOfShippedConfig(t *testing.T) {
+	profiles, err := LoadPlanProfiles("../plans.json")
+	if err != nil {
+		t.Fatalf("LoadPlanProfiles: %v", err)
+	}
+	profiles.WithBuildType("node", ResourceProfile{CPUs: 2, PidsLimit: 1024})
+
+	free := profiles.Resolve("node", "free")
+	if free.CPUs != 1 || free.MemoryBytes != 2*gib || free.PidsLimit != 1024 {
+		t.Errorf("free profile = %+v", free)
+	}
+	pro := profiles.Resolve("node", "pro")
+	if pro.CPUs != 4 || pro.MemoryBytes != 8*gib || pro.PidsLimit != 2048 {
+		t.Errorf("pro profile = %+v", pro)
+	}
+	if unknown := profiles.Resolve("node", "enterprise"); unknown.CPUs != 2 || unknown.MemoryBytes != DefaultResourceProfile.MemoryBytes {
+		t.Errorf("profile of an unknown plan = %+v", unknown)
+	}
+}
@@ -0,0 +1,223 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// TrustLevel is how far the code of a project is trusted, it selects the sandbox of its builds.
+type TrustLevel string
+
+const (
+	// TrustTrusted is for projects of the operator, builds get the docker defaults
+	TrustTrusted TrustLevel = "trusted"
+	// TrustStandard runs builds as an unprivileged user without capabilities
+	TrustStandard TrustLevel = "standard"
+	// TrustUntrusted additionally makes the root filesystem read-only, with tmpfs scratch space,
+	// and runs the build under the sandboxed runtime when one is configured
+	TrustUntrusted TrustLevel = "untrusted"
+)
+
+// DefaultTrustLevel applies to projects that have no trust level of their own.
+const DefaultTrustLevel = TrustUntrusted
+
+// sandboxUser is the unprivileged user builds run as, the "node" user of the node images
+const sandboxUser = "1000:1000"
+
+const defaultScratchSize = "4g"
+
+// ParseTrustLevel validates a trust level name.
+func ParseTrustLevel(name string) (TrustLevel, error) {
+	switch level := TrustLevel(name); level {
+	case TrustTrusted, TrustStandard, TrustUntrusted:
+		return level, nil
+	default:
+		return "", fmt.Errorf("unknown trust level %q", name)
+	}
+}
+
+// SandboxProfile describes how a build container is isolated from its host.
+type SandboxProfile struct {
+	// Runtime is an OCI runtime registered with the docker daemon, e.g. "runsc" for gVisor or
+	// "kata-runtime". Empty uses the default runtime of the daemon.
+	Runtime string `json:"runtime,omitempty"`
+	// RuntimeClass is the RuntimeClass of build pods on kubernetes, e.g. "gvisor"
+	RuntimeClass string `json:"runtimeClass,omitempty"`
+	// SeccompProfile is the path of a seccomp profile on the builder host, empty keeps the default profile
+	SeccompProfile string   `json:"seccompProfile,omitempty"`
+	CapDrop        []string `json:"capDrop,omitempty"`
+	CapAdd         []string `json:"capAdd,omitempty"`
+	// NoNewPrivileges stops setuid binaries from gaining privileges
+	NoNewPrivileges bool `json:"noNewPrivileges,omitempty"`
+	// ReadOnlyRootfs leaves tmpfs scratch space on /tmp and the working directory as the only writable paths
+	ReadOnlyRootfs bool `json:"readOnlyRootfs,omitempty"`
+	// ScratchSize bounds every scratch tmpfs, e.g. "4g". Scratch space counts against the memory limit.
+	ScratchSize string `json:"scratchSize,omitempty"`
+	// User runs every process of the build as "uid:gid", overriding the user of the build environment.
+	// The working directory becomes a tmpfs owned by the user, docker would create it owned by root.
+	User string `json:"user,omitempty"`
+}
+
+// DefaultSandboxProfiles are the sandboxes of every trust level unless configured otherwise.
+var DefaultSandboxProfiles = map[TrustLevel]SandboxProfile{
+	TrustTrusted: {},
+	TrustStandard: {
+		CapDrop:         []string{"ALL"},
+		NoNewPrivileges: true,
+		ScratchSize:     defaultScratchSize,
+		User:            sandboxUser,
+	},
+	TrustUntrusted: {
+		CapDrop:         []string{"ALL"},
+		NoNewPrivileges: true,
+		ReadOnlyRootfs:  true,
+		ScratchSize:     defaultScratchSize,
+		User:            sandboxUser,
+	},
+}
+
+// isolated reports whether the files of the build must be written by the build user itself,
+// docker cannot copy into a read-only root and copies as root otherwise.
+func (s SandboxProfile) isolated() bool {
+	return s.ReadOnlyRootfs || s.User != ""
+}
+
+// userIDs returns the numeric uid and gid of User, ok is false for names.
+func (s SandboxProfile) userIDs() (uid int64, gid int64, ok bool) {
+	uidRaw, gidRaw, _ := strings.Cut(s.User, ":")
+	uid, err := strconv.ParseInt(uidRaw, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	gid = uid
+	if gidRaw != "" {
+		if gid, err = strconv.ParseInt(gidRaw, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	return uid, gid, true
+}
+
+// env returns the environment the sandbox needs, tools write their caches to HOME.
+func (s SandboxProfile) env() []string {
+	if s.ReadOnlyRootfs {
+		return []string{"HOME=/tmp"}
+	}
+	return nil
+}
+
+// apply adds the sandbox to the docker host configuration of a container.
+func (s SandboxProfile) apply(hostConfig *container.HostConfig, workingDir string) error {
+	hostConfig.Runtime = s.Runtime
+	hostConfig.CapDrop = s.CapDrop
+	hostConfig.CapAdd = s.CapAdd
+	if s.NoNewPrivileges {
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "no-new-privileges")
+	}
+	if s.SeccompProfile != "" {
+		// The daemon takes the profile itself rather than a path, like docker run does
+		profile, err := os.ReadFile(s.SeccompProfile)
+		if err != nil {
+			return fmt.Errorf("failed to read seccomp profile: %w", err)
+		}
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "seccomp="+string(profile))
+	}
+	hostConfig.ReadonlyRootfs = s.ReadOnlyRootfs
+	hostConfig.Tmpfs = s.tmpfs(workingDir)
+	return nil
+}
+
+// tmpfs returns the scratch mounts of the sandbox and their mount options.
+func (s SandboxProfile) tmpfs(workingDir string) map[string]string {
+	mounts := make(map[string]string)
+	if s.ReadOnlyRootfs {
+		mounts["/tmp"] = s.tmpfsOptions("mode=1777")
+	}
+	if s.isolated() && workingDir != "" && workingDir != "/" && workingDir != "/tmp" {
+		if uid, gid, ok := s.userIDs(); ok {
+			mounts[workingDir] = s.tmpfsOptions("mode=0755", fmt.Sprintf("uid=%d", uid), fmt.Sprintf("gid=%d", gid))
+		} else {
+			mounts[workingDir] = s.tmpfsOptions("mode=1777")
+		}
+	}
+	if len(mounts) == 0 {
+		return nil
+	}
+	return mounts
+}
+
+func (s SandboxProfile) tmpfsOptions(options ...string) string {
+	// Docker mounts tmpfs noexec by default, which breaks the binaries npm installs
+	options = append([]string{"rw", "exec", "nosuid", "nodev"}, options...)
+	if s.ScratchSize != "" {
+		options = append(options, "size="+s.ScratchSize)
+	}
+	return strings.Join(options, ",")
+}
+
+// Sandbox is the effective sandbox of a build, reported to the server with the build.
+type Sandbox struct {
+	TrustLevel TrustLevel `json:"trustLevel"`
+	SandboxProfile
+}
+
+// SandboxProfiles resolves the sandbox of a build from the trust level of its project.
+type SandboxProfiles struct {
+	defaultLevel TrustLevel
+	profiles     map[TrustLevel]SandboxProfile
+}
+
+func NewSandboxProfiles() *SandboxProfiles {
+	profiles := make(map[TrustLevel]SandboxProfile, len(DefaultSandboxProfiles))
+	for level, profile := range DefaultSandboxProfiles {
+		profiles[level] = profile
+	}
+	return &SandboxProfiles{defaultLevel: DefaultTrustLevel, profiles: profiles}
+}
+
+// LoadSandboxProfiles reads profiles per trust level from a JSON file, e.g.
+// {"untrusted": {"runtime": "runsc", ...}}. Levels missing from the file keep their default profile.
+func LoadSandboxProfiles(path string) (*SandboxProfiles, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var loaded map[TrustLevel]SandboxProfile
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("failed to parse sandbox profiles %s: %w", path, err)
+	}
+	profiles := NewSandboxProfiles()
+	for level, profile := range loaded {
+		if _, err := ParseTrustLevel(string(level)); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		profiles.WithTrustLevel(level, profile)
+	}
+	return profiles, nil
+}
+
+func (sp *SandboxProfiles) WithTrustLevel(level TrustLevel, profile SandboxProfile) *SandboxProfiles {
+	sp.profiles[level] = profile
+	return sp
+}
+
+// WithDefaultTrustLevel sets the level of builds whose project has none.
+func (sp *SandboxProfiles) WithDefaultTrustLevel(level TrustLevel) *SandboxProfiles {
+	sp.defaultLevel = level
+	return sp
+}
+
+// Resolve returns the sandbox for a trust level, empty and unknown levels get the default level.
+func (sp *SandboxProfiles) Resolve(level TrustLevel) Sandbox {
+	profile, ok := sp.profiles[level]
+	if !ok {
+		level = sp.defaultLevel
+		profile = sp.profiles[level]
+	}
+	return Sandbox{TrustLevel: level, SandboxProfile: profile}
+}
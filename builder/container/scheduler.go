@@ -0,0 +1,205 @@
+package container
+
+import (
+	"context"
+	"sync"
+)
+
+// Scheduler admits at most capacity builds at a time. Builds beyond capacity wait in a queue per
+// user and free slots are handed out round-robin across users, so an account submitting many
+// builds at once only delays its own builds.
+type Scheduler struct {
+	capacity int
+
+	mu      sync.Mutex
+	running int
+	queues  map[string][]*waiter
+	// users holds the users with queued builds, in the order they are served next
+	users []string
+}
+
+type waiter struct {
+	userID string
+	ready  chan struct{}
+	// positions holds the latest queue position not reported yet, a newer position replaces it
+	positions    chan int
+	lastPosition int
+}
+
+// NewScheduler creates a scheduler running at most capacity builds, zero or less means unlimited.
+func NewScheduler(capacity int) *Scheduler {
+	return &Scheduler{
+		capacity: capacity,
+		queues:   make(map[string][]*waiter),
+	}
+}
+
+// Acquire blocks until a slot is free for a build of userID or ctx is done. While the build waits,
+// onPosition, if not nil, is called with its 1-based queue position every time it changes. It is
+// called from a goroutine of its own, so a slow onPosition delays neither the scheduler nor other
+// builds, and positions it could not keep up with are skipped.
+// The returned release func frees the slot, it is safe to call more than once.
+func (s *Scheduler) Acquire(ctx context.Context, userID string, onPosition func(position int)) (func(), error) {
+	s.mu.Lock()
+	if s.capacity <= 0 || (s.running < s.capacity && len(s.users) == 0) {
+		s.running++
+		s.mu.Unlock()
+		return s.releaseFunc(), nil
+	}
+
+	w := &waiter{userID: userID, ready: make(chan struct{})}
+	if onPosition != nil {
+		w.positions = make(chan int, 1)
+		reported := make(chan struct{})
+		defer close(reported)
+		go reportPositions(w.positions, reported, onPosition)
+	}
+	if len(s.queues[userID]) == 0 {
+		s.users = append(s.users, userID)
+	}
+	s.queues[userID] = append(s.queues[userID], w)
+	s.updatePositions()
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return s.releaseFunc(), nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	select {
+	case <-w.ready:
+		// The slot was handed over while ctx was being cancelled, give it to the next build
+		s.mu.Unlock()
+		s.release()
+		return nil, ctx.Err()
+	default:
+	}
+	s.removeWaiter(w)
+	s.updatePositions()
+	s.mu.Unlock()
+	return nil, ctx.Err()
+}
+
+// acquire acquires a slot for the build of req and hands its release func to req.OnAcquired.
+func (s *Scheduler) acquire(ctx context.Context, req BuildRequest) (func(), error) {
+	release, err := s.Acquire(ctx, req.UserID, req.OnQueued)
+	if err != nil {
+		return nil, err
+	}
+	if req.OnAcquired != nil {
+		req.OnAcquired(release)
+	}
+	return release, nil
+}
+
+// Running returns the number of admitted builds.
+func (s *Scheduler) Running() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
+// Queued returns the number of builds waiting for a slot.
+func (s *Scheduler) Queued() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queued := 0
+	for _, queue := range s.queues {
+		queued += len(queue)
+	}
+	return queued
+}
+
+func (s *Scheduler) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(s.release)
+	}
+}
+
+func (s *Scheduler) release() {
+	s.mu.Lock()
+	s.running--
+	for s.running < s.capacity && len(s.users) > 0 {
+		userID := s.users[0]
+		queue := s.queues[userID]
+		w := queue[0]
+		s.queues[userID] = queue[1:]
+		s.users = s.users[1:]
+		if len(s.queues[userID]) > 0 {
+			s.users = append(s.users, userID)
+		} else {
+			delete(s.queues, userID)
+		}
+		s.running++
+		close(w.ready)
+	}
+	s.updatePositions()
+	s.mu.Unlock()
+}
+
+func (s *Scheduler) removeWaiter(w *waiter) {
+	queue := s.queues[w.userID]
+	for i, queued := range queue {
+		if queued == w {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) > 0 {
+		s.queues[w.userID] = queue
+		return
+	}
+	delete(s.queues, w.userID)
+	for i, userID := range s.users {
+		if userID == w.userID {
+			s.users = append(s.users[:i], s.users[i+1:]...)
+			break
+		}
+	}
+}
+
+// updatePositions computes the position of every waiter in the order slots will be handed out
+// and hands the ones that changed since they were last reported to their reporter. It must be
+// called with s.mu held.
+func (s *Scheduler) updatePositions() {
+	position := 0
+	for round := 0; ; round++ {
+		served := false
+		for _, userID := range s.users {
+			queue := s.queues[userID]
+			if round >= len(queue) {
+				continue
+			}
+			served = true
+			position++
+			w := queue[round]
+			if w.positions != nil && w.lastPosition != position {
+				w.lastPosition = position
+				// Replace the position the reporter has not picked up yet
+				select {
+				case <-w.positions:
+				default:
+				}
+				w.positions <- position
+			}
+		}
+		if !served {
+			return
+		}
+	}
+}
+
+// reportPositions calls onPosition with the positions of a waiter until done is closed.
+func reportPositions(positions <-chan int, done <-chan struct{}, onPosition func(position int)) {
+	for {
+		select {
+		case position := <-positions:
+			onPosition(position)
+		case <-done:
+			return
+		}
+	}
+}
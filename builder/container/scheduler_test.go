@@ -0,0 +1,164 @@
+package container
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// queueBuild starts a build of userID waiting on s and returns once it is queued. The build sends
+// its name to admitted once it gets a slot, and keeps the slot.
+func queueBuild(t *testing.T, s *Scheduler, userID string, name string, admitted chan<- string) {
+	t.Helper()
+	queued := s.Queued()
+	go func() {
+		if _, err := s.Acquire(context.Background(), userID, nil); err != nil {
+			t.Errorf("Acquire %s: %v", name, err)
+			return
+		}
+		admitted <- name
+	}()
+	waitFor(t, func() bool { return s.Queued() == queued+1 })
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedulerServesUsersRoundRobin(t *testing.T) {
+	s := NewScheduler(1)
+	release, err := s.Acquire(context.Background(), "busy", nil)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	admitted := make(chan string, 4)
+	queueBuild(t, s, "alice", "alice-1", admitted)
+	queueBuild(t, s, "alice", "alice-2", admitted)
+	queueBuild(t, s, "alice", "alice-3", admitted)
+	queueBuild(t, s, "bob", "bob-1", admitted)
+
+	// Every admitted build holds its slot, so releasing one slot at a time admits exactly one build
+	var order []string
+	for i := 0; i < 4; i++ {
+		s.release()
+		order = append(order, <-admitted)
+	}
+	release()
+
+	want := []string{"alice-1", "bob-1", "alice-2", "alice-3"}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("admission order = %v, want %v", order, want)
+		}
+	}
+}
+
+func TestSchedulerReportsPositionsWithoutBlocking(t *testing.T) {
+	s := NewScheduler(1)
+	release, err := s.Acquire(context.Background(), "busy", nil)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	unblock := make(chan struct{})
+	var mu sync.Mutex
+	var positions []int
+	onPosition := func(position int) {
+		<-unblock
+		mu.Lock()
+		positions = append(positions, position)
+		mu.Unlock()
+	}
+	admitted := make(chan func(), 2)
+	for _, userID := range []string{"alice", "bob"} {
+		userID := userID
+		queued := s.Queued()
+		go func() {
+			release, err := s.Acquire(context.Background(), userID, onPosition)
+			if err != nil {
+				t.Errorf("Acquire %s: %v", userID, err)
+				return
+			}
+			admitted <- release
+		}()
+		waitFor(t, func() bool { return s.Queued() == queued+1 })
+	}
+
+	// onPosition hangs, yet slots are still handed out
+	release()
+	next := <-admitted
+	next()
+	(<-admitted)()
+	if s.Running() != 0 || s.Queued() != 0 {
+		t.Errorf("running = %d, queued = %d, want both 0", s.Running(), s.Queued())
+	}
+	close(unblock)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, position := range positions {
+		if position != 1 && position != 2 {
+			t.Errorf("reported position %d of a queue of two", position)
+		}
+	}
+}
+
+func TestSchedulerDropsCancelledWaiter(t *testing.T) {
+	s := NewScheduler(1)
+	release, err := s.Acquire(context.Background(), "busy", nil)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := s.Acquire(ctx, "alice", nil)
+		errs <- err
+	}()
+	waitFor(t, func() bool { return s.Queued() == 1 })
+	cancel()
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("Acquire error = %v, want context.Canceled", err)
+	}
+	if s.Queued() != 0 {
+		t.Errorf("cancelled build is still queued")
+	}
+
+	release()
+	release()
+	if s.Running() != 0 {
+		t.Errorf("running = %d after release, want 0", s.Running())
+	}
+}
+
+func TestSchedulerHandsReleaseToBuild(t *testing.T) {
+	s := NewScheduler(1)
+	var release func()
+	_, err := s.acquire(context.Background(), BuildRequest{
+		UserID:     "alice",
+		OnAcquired: func(r func()) { release = r },
+	})
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	if release == nil || s.Running() != 1 {
+		t.Fatalf("build was not handed the release of its slot")
+	}
+
+	// The build frees its slot without a container being removed
+	release()
+	if s.Running() != 0 {
+		t.Errorf("running = %d after the build released its slot, want 0", s.Running())
+	}
+}
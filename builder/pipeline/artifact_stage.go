@@ -0,0 +1,56 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hari134/comet/builder/stream"
+	"github.com/hari134/comet/builder/util"
+)
+
+// ArtifactOutput is the stream source of the messages of UploadArtifactsStage.
+const ArtifactOutput = "artifacts"
+
+// UploadArtifactsStage stores the build output found at containerPath in the artifact store of
+// the context, under a manifest named after the build ID. Files already stored by another build
+// are not uploaded again. Builds without an artifact store keep their output in the container.
+type UploadArtifactsStage struct {
+	containerPath string
+}
+
+func NewUploadArtifactsStage(containerPath string) *UploadArtifactsStage {
+	return &UploadArtifactsStage{containerPath: containerPath}
+}
+
+func (s *UploadArtifactsStage) Execute(ctx context.Context, pctx *PipelineContext) error {
+	if pctx.artifactStore == nil {
+		return nil
+	}
+	buildIDRaw, err := pctx.Get("buildID")
+	if err != nil {
+		return errors.New("build ID not set in pipeline context")
+	}
+	buildID, err := util.TypeAssert[string](buildIDRaw, "string")
+	if err != nil {
+		return err
+	}
+	container, err := pctx.GetContainer()
+	if err != nil {
+		return err
+	}
+
+	output, err := container.CopyFromContainer(ctx, s.containerPath)
+	if err != nil {
+		return fmt.Errorf("failed to copy build output: %w", err)
+	}
+	defer output.Close()
+	manifest, err := pctx.artifactStore.PutTar(ctx, buildID, output)
+	if err != nil {
+		return fmt.Errorf("failed to upload build output: %w", err)
+	}
+	if pctx.outputStream != nil {
+		pctx.outputStream <- stream.NewStream(pctx.correlationID, ArtifactOutput, fmt.Sprintf("uploaded %d files", len(manifest.Files)))
+	}
+	return nil
+}
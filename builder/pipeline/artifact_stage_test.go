@@ -0,0 +1,45 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hari134/comet/builder/container/containertest"
+	"github.com/hari134/comet/core/storage"
+)
+
+func TestUploadArtifactsStageStoresBuildOutput(t *testing.T) {
+	ctx := context.Background()
+	store, err := storage.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifacts := storage.NewContentStore(store, "artifacts")
+	buildContainer := containertest.NewBuildContainer()
+	buildContainer.WriteFile("/app/dist/index.html", []byte("<html>"))
+	buildContainer.WriteFile("/app/dist/assets/app.js", []byte("render()"))
+	buildContainer.WriteFile("/app/src/main.tsx", []byte("source"))
+	pctx := NewPipelineContext().WithContainer(buildContainer).WithArtifactStore(artifacts)
+	pctx.Set("buildID", "42")
+
+	if err := NewUploadArtifactsStage("/app/dist").Execute(ctx, pctx); err != nil {
+		t.Fatalf("Execute: %v", err)
+	}
+	manifest, err := artifacts.GetManifest(ctx, "42")
+	if err != nil {
+		t.Fatalf("GetManifest: %v", err)
+	}
+	if len(manifest.Files) != 2 {
+		t.Errorf("manifest files = %v, want the two files of /app/dist", manifest.Files)
+	}
+	if got, err := artifacts.OpenFile(ctx, manifest, "assets/app.js"); err != nil || got.String() != "render()" {
+		t.Errorf("assets/app.js = %q, %v", got, err)
+	}
+}
+
+func TestUploadArtifactsStageWithoutArtifactStore(t *testing.T) {
+	pctx := NewPipelineContext().WithContainer(containertest.NewBuildContainer())
+	if err := NewUploadArtifactsStage("/app/dist").Execute(context.Background(), pctx); err != nil {
+		t.Errorf("Execute without an artifact store: %v", err)
+	}
+}
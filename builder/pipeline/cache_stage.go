@@ -0,0 +1,127 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/hari134/comet/builder/cache"
+	"github.com/hari134/comet/builder/stream"
+	"github.com/hari134/comet/builder/util"
+	"github.com/hari134/comet/core/transport"
+)
+
+// Context keys the cache stages pass the entry of the build on with
+const (
+	dependencyCacheKey  = "dependencyCacheKey"
+	dependencyCacheSave = "dependencyCacheSave"
+)
+
+// RestoreCacheStage restores the dependencies of the project from the dependency cache before they are
+// installed. Builds without a dependency cache or project ID run uncached, a failing cache never
+// fails the build.
+type RestoreCacheStage struct {
+	spec cache.Spec
+}
+
+func NewRestoreCacheStage(spec cache.Spec) *RestoreCacheStage {
+	return &RestoreCacheStage{spec: spec}
+}
+
+func (s *RestoreCacheStage) Execute(ctx context.Context, pctx *PipelineContext) error {
+	if pctx.dependencyCache == nil {
+		return nil
+	}
+	container, err := pctx.GetContainer()
+	if err != nil {
+		return err
+	}
+	key, err := pctx.dependencyCache.Key(ctx, container, s.spec, projectID(pctx))
+	if err != nil {
+		return cacheFailure(ctx, pctx, "failed to key dependency cache", err)
+	}
+	if key == "" {
+		return nil
+	}
+	pctx.Set(dependencyCacheKey, key)
+	fresh, err := pctx.dependencyCache.Restore(ctx, container, s.spec, key)
+	if err != nil {
+		pctx.Set(dependencyCacheSave, true)
+		return cacheFailure(ctx, pctx, "failed to restore dependency cache", err)
+	}
+	pctx.Set(dependencyCacheSave, !fresh)
+	if fresh {
+		pctx.reportCache("restored dependencies from cache")
+	} else {
+		pctx.reportCache("dependency cache missed, dependencies are saved after the build")
+	}
+	return nil
+}
+
+// SaveCacheStage saves the dependencies of the project to the dependency cache when RestoreCacheStage
+// found no fresh entry. It belongs directly after the install command, so only a successful install
+// is cached and the build scripts of the project that run later cannot change what is cached.
+type SaveCacheStage struct {
+	spec cache.Spec
+}
+
+func NewSaveCacheStage(spec cache.Spec) *SaveCacheStage {
+	return &SaveCacheStage{spec: spec}
+}
+
+func (s *SaveCacheStage) Execute(ctx context.Context, pctx *PipelineContext) error {
+	if pctx.dependencyCache == nil {
+		return nil
+	}
+	save, err := pctx.Get(dependencyCacheSave)
+	if err != nil || save != true {
+		return nil
+	}
+	keyRaw, err := pctx.Get(dependencyCacheKey)
+	if err != nil {
+		return nil
+	}
+	container, err := pctx.GetContainer()
+	if err != nil {
+		return err
+	}
+	if err := pctx.dependencyCache.Save(ctx, container, s.spec, keyRaw.(string)); err != nil {
+		return cacheFailure(ctx, pctx, "failed to save dependency cache", err)
+	}
+	pctx.reportCache("saved dependencies to cache")
+	return nil
+}
+
+// cacheFailure reports a cache error to the user and lets the build go on, unless the build itself
+// ended.
+func cacheFailure(ctx context.Context, pctx *PipelineContext, message string, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	pctx.reportCache(fmt.Sprintf("%s: %v", message, err))
+	if correlationID, getErr := pctx.Get("correlationId"); getErr == nil {
+		if id, ok := correlationID.(transport.CorrelationID); ok {
+			message = fmt.Sprintf("%s for build %s", message, id.ToString())
+		}
+	}
+	log.Printf("%s: %v", message, err)
+	return nil
+}
+
+func projectID(pctx *PipelineContext) string {
+	projectIDRaw, err := pctx.Get("projectID")
+	if err != nil {
+		return ""
+	}
+	projectID, err := util.TypeAssert[string](projectIDRaw, "string")
+	if err != nil {
+		return ""
+	}
+	return projectID
+}
+
+func (ctx *PipelineContext) reportCache(text string) {
+	if ctx.outputStream != nil {
+		ctx.outputStream <- stream.NewStream(ctx.correlationID, cache.CacheOutput, text)
+	}
+}
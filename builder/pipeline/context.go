@@ -5,8 +5,11 @@ import (
 	"errors"
 	"fmt"
 
+	"github.com/hari134/comet/builder/cache"
 	"github.com/hari134/comet/builder/container"
+	"github.com/hari134/comet/builder/stream"
 	"github.com/hari134/comet/core/storage"
+	"github.com/hari134/comet/core/transport"
 )
 
 // PipelineContext holds shared data for stages
@@ -15,6 +18,10 @@ type PipelineContext struct {
 	container      container.BuildContainer
 	projectTarFile *bytes.Buffer
 	store 					storage.Store
+	correlationID  transport.CorrelationID
+	outputStream   chan<- stream.Stream
+	dependencyCache *cache.DependencyCache
+	artifactStore  *storage.ContentStore
 	data           map[string]interface{}
 }
 
@@ -31,11 +38,33 @@ func (ctx *PipelineContext) WithContainer(buildContainer container.BuildContaine
 }
 
 
+// WithOutputStream makes command stages send their output, line by line, to outputStream
+// as it is produced, tagged with the correlation ID of the build.
+func (ctx *PipelineContext) WithOutputStream(correlationID transport.CorrelationID, outputStream chan<- stream.Stream) *PipelineContext {
+	ctx.correlationID = correlationID
+	ctx.outputStream = outputStream
+	return ctx
+}
+
 func (ctx *PipelineContext) WithStore(store storage.Store) *PipelineContext {
 	ctx.store= store
 	return ctx
 }
 
+// WithDependencyCache lets the cache stages restore and save the dependencies of the project,
+// the project is identified by the "projectID" value of the context.
+func (ctx *PipelineContext) WithDependencyCache(dependencyCache *cache.DependencyCache) *PipelineContext {
+	ctx.dependencyCache = dependencyCache
+	return ctx
+}
+
+// WithArtifactStore lets UploadArtifactsStage store the build output, the manifest of the
+// build is named after the "buildID" value of the context.
+func (ctx *PipelineContext) WithArtifactStore(artifactStore *storage.ContentStore) *PipelineContext {
+	ctx.artifactStore = artifactStore
+	return ctx
+}
+
 func (ctx *PipelineContext) GetStore() (storage.Store,error) {
 	if ctx.store == nil {
 		return nil, errors.New("store not set in pipeline context")
@@ -12,6 +12,12 @@ type DefaultPipelineFactory struct {
 	registry map[string]func() Pipeline
 }
 
+func NewDefaultPipelineFactory() *DefaultPipelineFactory {
+	return &DefaultPipelineFactory{
+		registry: make(map[string]func() Pipeline),
+	}
+}
+
 func (pf *DefaultPipelineFactory) Register(name string ,factory func() Pipeline){
 	pf.registry[name] = factory
 }
@@ -0,0 +1,35 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrOOMKilled is matched by the error of a build killed for exceeding its memory limit.
+var ErrOOMKilled = errors.New("build exceeded its memory limit")
+
+// Failure reasons reported to users when a build fails.
+const (
+	FailureCancelled     = "cancelled"
+	FailureTimeout       = "timeout"
+	FailureOOMKilled     = "oom_killed"
+	FailureCommandFailed = "command_failed"
+	FailureInternal      = "internal_error"
+)
+
+// FailureReason classifies the error returned by a pipeline run.
+func FailureReason(err error) string {
+	var commandErr *CommandError
+	switch {
+	case errors.Is(err, ErrBuildCancelled):
+		return FailureCancelled
+	case errors.Is(err, ErrOOMKilled):
+		return FailureOOMKilled
+	case errors.Is(err, context.DeadlineExceeded):
+		return FailureTimeout
+	case errors.As(err, &commandErr):
+		return FailureCommandFailed
+	default:
+		return FailureInternal
+	}
+}
@@ -1,9 +1,19 @@
 package pipeline
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// teardownTimeout bounds stopping and removing the container once the build is over
+const teardownTimeout = 30 * time.Second
+
 // Pipeline interface defines function signatures for a build pipeline.
 // The build pipeline will take a container instance to execute for all stages.
 type Pipeline interface {
-	Run(ctx *PipelineContext) error
+	Run(ctx context.Context, pctx *PipelineContext) error
 	AddStage(stage Stage) Pipeline
 }
 
@@ -24,26 +34,32 @@ func (pipeline *SerialPipeline) AddStage(stage Stage) Pipeline{
 	return pipeline
 }
 
-// Run executes all stages in sequence. If a stage fails, the execution stops.
-func (pipeline *SerialPipeline) Run(ctx *PipelineContext) error {
-	for _, stage := range pipeline.stages {
-		if err := stage.Execute(ctx); err != nil {
-			return err
-		}
-	}
-
-	// Cleanup the container after all stages are executed
-	container, err := ctx.GetContainer()
-	if err != nil{
+// Run executes all stages in sequence. If a stage fails or ctx is cancelled, the execution stops.
+// The container is stopped and removed however the run ends.
+func (pipeline *SerialPipeline) Run(ctx context.Context, pctx *PipelineContext) (err error) {
+	container, err := pctx.GetContainer()
+	if err != nil {
 		return err
 	}
 
-	if err := container.Stop(); err != nil {
-		return err
-	}
-	if err := container.Remove(); err != nil {
-		return err
-	}
+	defer func() {
+		// Teardown must still happen when ctx is what ended the build
+		teardownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), teardownTimeout)
+		defer cancel()
+		stopErr := container.Stop(teardownCtx)
+		removeErr := container.Remove(teardownCtx)
+		if teardownErr := errors.Join(stopErr, removeErr); teardownErr != nil {
+			err = errors.Join(err, fmt.Errorf("container teardown failed: %w", teardownErr))
+		}
+	}()
 
+	for _, stage := range pipeline.stages {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := stage.Execute(ctx, pctx); err != nil {
+			return err
+		}
+	}
 	return nil
 }
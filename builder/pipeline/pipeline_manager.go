@@ -1,5 +1,144 @@
 package pipeline
 
-type PipelineManager struct{
-	
-}
\ No newline at end of file
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hari134/comet/core/transport"
+)
+
+var (
+	ErrBuildNotFound = errors.New("no running build with this correlation id")
+	ErrBuildRunning  = errors.New("a build with this correlation id is already running")
+	// ErrBuildCancelled is the cause of a build context cancelled through Cancel
+	ErrBuildCancelled = errors.New("build cancelled")
+)
+
+// PipelineManager runs pipelines and keeps track of the running builds by correlation ID
+// so they can be cancelled while in progress.
+type PipelineManager struct {
+	buildTimeout time.Duration
+
+	mu     sync.Mutex
+	builds map[transport.CorrelationID]context.CancelCauseFunc
+}
+
+func NewPipelineManager() *PipelineManager {
+	return &PipelineManager{
+		builds: make(map[transport.CorrelationID]context.CancelCauseFunc),
+	}
+}
+
+// WithBuildTimeout limits how long a whole build may run, zero means no limit.
+func (pm *PipelineManager) WithBuildTimeout(timeout time.Duration) *PipelineManager {
+	pm.buildTimeout = timeout
+	return pm
+}
+
+// Build is a build registered with the PipelineManager. It can be cancelled from the moment it is
+// registered, so also while it waits for capacity or its container is created.
+type Build struct {
+	manager       *PipelineManager
+	correlationID transport.CorrelationID
+	ctx           context.Context
+	cancel        context.CancelCauseFunc
+
+	endOnce sync.Once
+	onEnd   []func()
+}
+
+// Begin registers the build identified by correlationID before any resources are spent on it.
+// The caller must call End once the build is over.
+func (pm *PipelineManager) Begin(ctx context.Context, correlationID transport.CorrelationID) (*Build, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if _, ok := pm.builds[correlationID]; ok {
+		cancel(nil)
+		return nil, ErrBuildRunning
+	}
+	pm.builds[correlationID] = cancel
+	return &Build{manager: pm, correlationID: correlationID, ctx: ctx, cancel: cancel}, nil
+}
+
+// Context is cancelled when the build is cancelled or ends, the container of the build is created with it.
+func (b *Build) Context() context.Context {
+	return b.ctx
+}
+
+// OnEnd registers fn to be called by End, such as releasing the capacity held by the build.
+func (b *Build) OnEnd(fn func()) {
+	b.manager.mu.Lock()
+	defer b.manager.mu.Unlock()
+	b.onEnd = append(b.onEnd, fn)
+}
+
+// Run runs the pipeline of the build and blocks until it finishes, is cancelled or times out.
+func (b *Build) Run(buildPipeline Pipeline, pctx *PipelineContext) error {
+	ctx := b.ctx
+	if b.manager.buildTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, b.manager.buildTimeout)
+		defer cancelTimeout()
+	}
+	return b.Err(buildPipeline.Run(ctx, pctx))
+}
+
+// Err returns ErrBuildCancelled for an error caused by cancelling the build, err otherwise.
+func (b *Build) Err(err error) error {
+	if err != nil && errors.Is(context.Cause(b.ctx), ErrBuildCancelled) {
+		return ErrBuildCancelled
+	}
+	return err
+}
+
+// End deregisters the build and calls the functions registered with OnEnd. Calling it again is a no-op.
+func (b *Build) End() {
+	b.endOnce.Do(func() {
+		b.cancel(nil)
+		b.manager.mu.Lock()
+		delete(b.manager.builds, b.correlationID)
+		onEnd := b.onEnd
+		b.manager.mu.Unlock()
+		for _, fn := range onEnd {
+			fn()
+		}
+	})
+}
+
+// Run runs the pipeline as the build identified by correlationID and blocks until it finishes,
+// is cancelled or times out.
+func (pm *PipelineManager) Run(ctx context.Context, correlationID transport.CorrelationID, buildPipeline Pipeline, pctx *PipelineContext) error {
+	build, err := pm.Begin(ctx, correlationID)
+	if err != nil {
+		return err
+	}
+	defer build.End()
+	return build.Run(buildPipeline, pctx)
+}
+
+// Cancel stops the build identified by correlationID, whether it waits for capacity, has its container
+// created or runs its pipeline. The build returns ErrBuildCancelled.
+func (pm *PipelineManager) Cancel(correlationID transport.CorrelationID) error {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	cancel, ok := pm.builds[correlationID]
+	if !ok {
+		return ErrBuildNotFound
+	}
+	cancel(ErrBuildCancelled)
+	return nil
+}
+
+// Running returns the correlation IDs of the builds in progress.
+func (pm *PipelineManager) Running() []transport.CorrelationID {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	ids := make([]transport.CorrelationID, 0, len(pm.builds))
+	for id := range pm.builds {
+		ids = append(ids, id)
+	}
+	return ids
+}
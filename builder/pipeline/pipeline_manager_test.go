@@ -0,0 +1,46 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/hari134/comet/core/transport"
+)
+
+func TestPipelineManagerCancelsBuildBeforeItRuns(t *testing.T) {
+	pm := NewPipelineManager()
+	correlationID := transport.CorrelationID(uuid.New())
+
+	build, err := pm.Begin(context.Background(), correlationID)
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	if _, err := pm.Begin(context.Background(), correlationID); !errors.Is(err, ErrBuildRunning) {
+		t.Errorf("second Begin error = %v, want ErrBuildRunning", err)
+	}
+	ended := false
+	build.OnEnd(func() { ended = true })
+
+	// A build waiting for capacity is cancelled through the context its container is created with
+	if err := pm.Cancel(correlationID); err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+	<-build.Context().Done()
+	if err := build.Err(build.Context().Err()); !errors.Is(err, ErrBuildCancelled) {
+		t.Errorf("Err = %v, want ErrBuildCancelled", err)
+	}
+
+	build.End()
+	build.End()
+	if !ended {
+		t.Error("OnEnd func was not called")
+	}
+	if running := pm.Running(); len(running) != 0 {
+		t.Errorf("Running after End = %v", running)
+	}
+	if err := pm.Cancel(correlationID); !errors.Is(err, ErrBuildNotFound) {
+		t.Errorf("Cancel after End error = %v, want ErrBuildNotFound", err)
+	}
+}
@@ -0,0 +1,143 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hari134/comet/builder/container"
+	"github.com/hari134/comet/builder/container/containertest"
+	"github.com/hari134/comet/builder/stream"
+	"github.com/hari134/comet/core/transport"
+)
+
+func TestSerialPipelineRunsStagesInOrder(t *testing.T) {
+	buildContainer := containertest.NewBuildContainer()
+	var ran []string
+	buildPipeline := NewSerialPipeline().
+		AddStage(NewCommandStage("npm install")).
+		AddStage(NewFunctionStage(func(ctx context.Context, pctx *PipelineContext) error {
+			ran = append(ran, "function")
+			return nil
+		})).
+		AddStage(NewRestrictNetworkStage()).
+		AddStage(NewCommandStage("npm run build"))
+
+	if err := buildPipeline.Run(context.Background(), NewPipelineContext().WithContainer(buildContainer)); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if commands := buildContainer.Commands(); len(commands) != 2 || commands[0] != "npm install" || commands[1] != "npm run build" {
+		t.Errorf("commands = %v, want npm install then npm run build", commands)
+	}
+	if len(ran) != 1 || !buildContainer.NetworkRestricted() {
+		t.Errorf("function stage ran %v times, network restricted %v", ran, buildContainer.NetworkRestricted())
+	}
+	if !buildContainer.Stopped() || !buildContainer.Removed() {
+		t.Error("container was not stopped and removed")
+	}
+}
+
+func TestSerialPipelineStopsAtFailingStage(t *testing.T) {
+	buildContainer := containertest.NewBuildContainer().
+		WithExecResult("npm install", container.ExecResult{ExitCode: 1, Stderr: "npm ERR! missing script\n"})
+	buildPipeline := NewSerialPipeline().
+		AddStage(NewCommandStage("npm install")).
+		AddStage(NewCommandStage("npm run build"))
+
+	err := buildPipeline.Run(context.Background(), NewPipelineContext().WithContainer(buildContainer))
+	var commandErr *CommandError
+	if !errors.As(err, &commandErr) || commandErr.Result.ExitCode != 1 {
+		t.Fatalf("Run error = %v, want a CommandError with exit code 1", err)
+	}
+	if reason := FailureReason(err); reason != FailureCommandFailed {
+		t.Errorf("FailureReason = %s, want %s", reason, FailureCommandFailed)
+	}
+	if commands := buildContainer.Commands(); len(commands) != 1 {
+		t.Errorf("commands = %v, want the build to stop after npm install", commands)
+	}
+	if !buildContainer.Removed() {
+		t.Error("container of the failed build was not removed")
+	}
+}
+
+func TestSerialPipelineStopsWhenCancelled(t *testing.T) {
+	buildContainer := containertest.NewBuildContainer()
+	ctx, cancel := context.WithCancel(context.Background())
+	buildPipeline := NewSerialPipeline().
+		AddStage(NewFunctionStage(func(ctx context.Context, pctx *PipelineContext) error {
+			cancel()
+			return nil
+		})).
+		AddStage(NewCommandStage("npm run build"))
+
+	if err := buildPipeline.Run(ctx, NewPipelineContext().WithContainer(buildContainer)); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run error = %v, want context.Canceled", err)
+	}
+	if commands := buildContainer.Commands(); len(commands) != 0 {
+		t.Errorf("commands run after cancellation: %v", commands)
+	}
+	// Teardown does not depend on the cancelled context
+	if !buildContainer.Removed() {
+		t.Error("container of the cancelled build was not removed")
+	}
+}
+
+func TestCommandStageStreamsOutput(t *testing.T) {
+	buildContainer := containertest.NewBuildContainer().
+		WithExecResult("npm run build", container.ExecResult{Stdout: "vite building\nbuilt in 1s\n", Stderr: "warning\n"})
+	correlationID := transport.CorrelationID(uuid.New())
+	outputStream := make(chan stream.Stream, 10)
+	pctx := NewPipelineContext().WithContainer(buildContainer).WithOutputStream(correlationID, outputStream)
+
+	if err := NewCommandStage("npm run build").Execute(context.Background(), pctx); err != nil {
+		t.Fatalf("Execute: %v", err)
+	}
+	close(outputStream)
+	var lines []stream.Stream
+	for line := range outputStream {
+		lines = append(lines, line)
+	}
+	want := []stream.Stream{
+		stream.NewStream(correlationID, container.Stdout, "vite building"),
+		stream.NewStream(correlationID, container.Stdout, "built in 1s"),
+		stream.NewStream(correlationID, container.Stderr, "warning"),
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("streamed %v, want %v", lines, want)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("line %d = %+v, want %+v", i, lines[i], want[i])
+		}
+	}
+}
+
+func TestCommandStageTimeout(t *testing.T) {
+	buildContainer := containertest.NewBuildContainer().
+		OnExec("npm install", func(ctx context.Context, fc *containertest.BuildContainer, cmd string) (container.ExecResult, error) {
+			<-ctx.Done()
+			return container.ExecResult{}, ctx.Err()
+		})
+	stage := NewCommandStage("npm install").WithTimeout(10 * time.Millisecond)
+
+	err := stage.Execute(context.Background(), NewPipelineContext().WithContainer(buildContainer))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Execute error = %v, want context.DeadlineExceeded", err)
+	}
+	if reason := FailureReason(err); reason != FailureTimeout {
+		t.Errorf("FailureReason = %s, want %s", reason, FailureTimeout)
+	}
+}
+
+func TestCommandStageReportsOOMKill(t *testing.T) {
+	buildContainer := containertest.NewBuildContainer().
+		WithExecResult("npm run build", container.ExecResult{ExitCode: 137}).
+		WithOOMKilled(true)
+
+	err := NewCommandStage("npm run build").Execute(context.Background(), NewPipelineContext().WithContainer(buildContainer))
+	if !errors.Is(err, ErrOOMKilled) {
+		t.Errorf("Execute error = %v, want ErrOOMKilled", err)
+	}
+}
@@ -0,0 +1,20 @@
+package pipelines
+
+import (
+	"github.com/hari134/comet/builder/pipeline"
+	"github.com/hari134/comet/builder/pipeline/react_vite_node20"
+)
+
+// factory maps the pipeline names used by build environments to pipelines
+var factory = pipeline.NewDefaultPipelineFactory()
+
+// InitializePipelines registers every pipeline a build environment can refer to.
+func InitializePipelines() {
+	react_vite_node20.InitializePipelines()
+	factory.Register("react-vite", func() pipeline.Pipeline { return react_vite_node20.ReactViteNode20 })
+}
+
+// PipelineFactory returns the pipeline registered under name.
+func PipelineFactory(name string) (pipeline.Pipeline, error) {
+	return factory.Get(name)
+}
@@ -1,19 +1,22 @@
 package react_vite_node20
 
 import (
+	"time"
+
+	"github.com/hari134/comet/builder/cache"
 	"github.com/hari134/comet/builder/pipeline"
+	"github.com/hari134/comet/builder/pipeline/util"
 )
 
 var ReactViteNode20 pipeline.Pipeline
 
 func InitializePipelines() {
 	ReactViteNode20 = pipeline.NewSerialPipeline().
-		// AddStage(pipeline.NewFunctionStage(copyTarToContainer)).
-		AddStage(pipeline.NewCommandStage("tar -xvf /app/full.tar -C /app")).
-		AddStage(pipeline.NewCommandStage("cd /app && npm install")).
-		AddStage(pipeline.NewCommandStage("cd /app && npm run build"))
-		// AddStage(pipeline.NewFunctionStage(copyDistFromContainer))
-		// Add another stage to upload dist to s3, cdn
+		AddStage(pipeline.NewFunctionStage(util.CopyTarToContainer)).
+		AddStage(pipeline.NewRestoreCacheStage(cache.NodeDependencies)).
+		AddStage(pipeline.NewCommandStage("cd /app && npm install").WithTimeout(15 * time.Minute)).
+		AddStage(pipeline.NewSaveCacheStage(cache.NodeDependencies)).
+		AddStage(pipeline.NewRestrictNetworkStage()).
+		AddStage(pipeline.NewCommandStage("cd /app && npm run build").WithTimeout(10 * time.Minute)).
+		AddStage(pipeline.NewUploadArtifactsStage("/app/dist"))
 }
-
-
@@ -1,45 +1,131 @@
 package pipeline
 
 import (
+	"context"
 	"fmt"
+	"time"
+
 	cont "github.com/hari134/comet/builder/container"
+	"github.com/hari134/comet/builder/stream"
 )
 
 // Stage defines an interface for pipeline stages
+// Execute must return once ctx is done, the pipeline tears the container down afterwards.
 type Stage interface {
-	Execute(ctx *PipelineContext) error
+	Execute(ctx context.Context, pctx *PipelineContext) error
 }
 
 // CommandStage is a stage that runs a command inside a container
 type CommandStage struct {
 	command string
+	timeout time.Duration
 }
 
 func NewCommandStage(command string) *CommandStage {
 	return &CommandStage{command: command}
 }
 
-func (s *CommandStage) Execute(ctx *PipelineContext) error {
-	container, err := ctx.Get("container")
+// WithTimeout limits how long the command may run, zero means it is only bound by the build.
+func (s *CommandStage) WithTimeout(timeout time.Duration) *CommandStage {
+	s.timeout = timeout
+	return s
+}
+
+// stderrTailLines is how much of stderr a failed command reports back
+const stderrTailLines = 20
+
+// CommandError is returned by CommandStage when its command exits with a non-zero code.
+type CommandError struct {
+	Command string
+	Result  cont.ExecResult
+	// OOMKilled is set when the command was killed for exceeding the memory limit of the container
+	OOMKilled bool
+}
+
+func (e *CommandError) Error() string {
+	if e.OOMKilled {
+		return fmt.Sprintf("command %q was killed for exceeding the memory limit: %s", e.Command, e.Result.StderrTail(stderrTailLines))
+	}
+	return fmt.Sprintf("command %q exited with code %d: %s", e.Command, e.Result.ExitCode, e.Result.StderrTail(stderrTailLines))
+}
+
+func (e *CommandError) Unwrap() error {
+	if e.OOMKilled {
+		return ErrOOMKilled
+	}
+	return nil
+}
+
+func (s *CommandStage) Execute(ctx context.Context, pctx *PipelineContext) error {
+	container, err := pctx.GetContainer()
 	if err != nil {
 		return err
 	}
-	_, err = container.(cont.BuildContainer).ExecCmd(s.command)
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	result, err := s.exec(ctx, pctx, container)
 	if err != nil {
-		return fmt.Errorf("command stage failed: %w", err)
+		return fmt.Errorf("command stage %q failed: %w", s.command, err)
+	}
+	if result.ExitCode != 0 {
+		oomKilled, err := container.OOMKilled(ctx)
+		if err != nil {
+			return fmt.Errorf("command stage %q failed: %w", s.command, err)
+		}
+		return &CommandError{Command: s.command, Result: result, OOMKilled: oomKilled}
 	}
 	return nil
 }
 
+// exec runs the command, streaming its output when the context has an output stream.
+func (s *CommandStage) exec(ctx context.Context, pctx *PipelineContext, container cont.BuildContainer) (cont.ExecResult, error) {
+	if pctx.outputStream == nil {
+		return container.ExecCmd(ctx, s.command)
+	}
+
+	lines := make(chan cont.OutputLine)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for line := range lines {
+			pctx.outputStream <- stream.NewStream(pctx.correlationID, line.Source, line.Text)
+		}
+	}()
+
+	result, err := container.ExecCmdStream(ctx, s.command, lines)
+	close(lines)
+	<-done
+	return result, err
+}
+
+// RestrictNetworkStage cuts the network access of the container once dependencies are installed,
+// so the build scripts that follow cannot reach out. See container.NetworkNoneAfterInstall.
+type RestrictNetworkStage struct{}
+
+func NewRestrictNetworkStage() *RestrictNetworkStage {
+	return &RestrictNetworkStage{}
+}
+
+func (s *RestrictNetworkStage) Execute(ctx context.Context, pctx *PipelineContext) error {
+	container, err := pctx.GetContainer()
+	if err != nil {
+		return err
+	}
+	return container.RestrictNetwork(ctx)
+}
+
 // FunctionStage is a stage that runs a custom function
 type FunctionStage struct {
-	fn func(ctx *PipelineContext) error
+	fn func(ctx context.Context, pctx *PipelineContext) error
 }
 
-func NewFunctionStage(fn func(ctx *PipelineContext) error) *FunctionStage {
+func NewFunctionStage(fn func(ctx context.Context, pctx *PipelineContext) error) *FunctionStage {
 	return &FunctionStage{fn: fn}
 }
 
-func (s *FunctionStage) Execute(ctx *PipelineContext) error {
-	return s.fn(ctx)
+func (s *FunctionStage) Execute(ctx context.Context, pctx *PipelineContext) error {
+	return s.fn(ctx, pctx)
 }
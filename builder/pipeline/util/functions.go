@@ -1,59 +1,141 @@
 package util
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
 
 	"github.com/hari134/comet/builder/pipeline"
 	"github.com/hari134/comet/builder/util"
+	"github.com/hari134/comet/core/storage"
 )
 
-
-func copyTarToContainer(ctx *pipeline.PipelineContext) error {
-	buildContainer, err := ctx.GetContainer()
+// CopyTarToContainer extracts the project tarball uploaded to the store into /app of the build container.
+// The tarball is verified against the checksum sent by the uploader before anything is extracted.
+func CopyTarToContainer(ctx context.Context, pctx *pipeline.PipelineContext) error {
+	buildContainer, err := pctx.GetContainer()
 	if err != nil {
 		return err
 	}
-	tarFile, err := ctx.GetProjectTarFile()
+	tarFile, err := openProjectTarFile(ctx, pctx)
 	if err != nil {
 		return err
 	}
-	return buildContainer.CopyToContainer(tarFile, "/app")
+	defer tarFile.Close()
+	return buildContainer.CopyToContainer(ctx, tarFile, "/app")
 }
 
-func pullProjectFromStore(ctx *pipeline.PipelineContext) error{
-	store ,err := ctx.GetStore()
-	if err != nil{
-		return err
+// openProjectTarFile returns the verified project tarball. Stores that support streaming are spooled
+// to a temporary file while the tarball is hashed, so it never sits fully in memory.
+func openProjectTarFile(ctx context.Context, pctx *pipeline.PipelineContext) (io.ReadCloser, error) {
+	store, err := pctx.GetStore()
+	if err != nil {
+		return nil, err
 	}
-	projectStorageKeyRaw ,err := ctx.Get("projectStorageKey")
-	if err != nil{
-		return err
+	projectStorageBucket, projectStorageKey, err := projectStorageLocation(pctx)
+	if err != nil {
+		return nil, err
 	}
-	projectStorageKey,err := util.TypeAssert[string](projectStorageKeyRaw,"string")
-	if err != nil{
-		return err
+	if streamStore, ok := store.(storage.StreamStore); ok {
+		return spoolProjectTarFile(ctx, pctx, streamStore, projectStorageBucket, projectStorageKey)
 	}
-	projectStorageBucketRaw ,err := ctx.Get("projectStorageBucket")
-	if err != nil{
-		return err
+	projectTarFile, err := store.Get(ctx, projectStorageBucket, projectStorageKey)
+	if err != nil {
+		return nil, err
 	}
-	projectStorageBucket,err := util.TypeAssert[string](projectStorageBucketRaw,"string")
-	if err != nil{
-		return err
+	if err := verifyProjectTarFile(pctx, projectTarFile, projectStorageBucket, projectStorageKey); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(projectTarFile), nil
+}
+
+// spoolProjectTarFile copies the tarball into a temporary file, which is removed once it is closed.
+// A tarball that does not match the checksum of the uploader is rejected before it is returned.
+func spoolProjectTarFile(ctx context.Context, pctx *pipeline.PipelineContext, store storage.StreamStore, bucket, key string) (io.ReadCloser, error) {
+	checksum, err := projectChecksum(pctx)
+	if err != nil {
+		return nil, err
+	}
+	body, err := store.Open(ctx, bucket, key)
+	if err != nil {
+		return nil, err
 	}
-	projectTarFile , err := store.Get(context.Background(),projectStorageBucket,projectStorageKey)
-	if err != nil{
+	body = storage.NewVerifyingReader(body, bucket, key, checksum)
+	defer body.Close()
+
+	spooled, err := os.CreateTemp("", "comet-project-*.tar")
+	if err != nil {
+		return nil, err
+	}
+	tarFile := &tempFile{File: spooled}
+	if _, err := io.Copy(spooled, body); err != nil {
+		tarFile.Close()
+		return nil, err
+	}
+	if _, err := spooled.Seek(0, io.SeekStart); err != nil {
+		tarFile.Close()
+		return nil, err
+	}
+	return tarFile, nil
+}
+
+// tempFile is a temporary file removed when it is closed.
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	closeErr := f.File.Close()
+	return errors.Join(closeErr, os.Remove(f.File.Name()))
+}
+
+func verifyProjectTarFile(ctx *pipeline.PipelineContext, tarFile *bytes.Buffer, bucket, key string) error {
+	expected, err := projectChecksum(ctx)
+	if err != nil {
 		return err
 	}
-	ctx.SetProjectTarFile(projectTarFile)
+	if actual := storage.ChecksumSHA256(tarFile.Bytes()); !strings.EqualFold(actual, expected) {
+		return &storage.IntegrityError{Bucket: bucket, Key: key, Expected: expected, Actual: actual}
+	}
 	return nil
 }
 
-func copyDistFromContainer(ctx *pipeline.PipelineContext) error {
-	buildContainer, err := ctx.GetContainer()
+// projectChecksum returns the SHA-256 of the project tarball sent with the project.uploaded event.
+// Every upload carries one, a project without it is never built.
+func projectChecksum(ctx *pipeline.PipelineContext) (string, error) {
+	checksumRaw, err := ctx.Get("projectSHA256")
 	if err != nil {
-		return err
+		return "", err
+	}
+	checksum, err := util.TypeAssert[string](checksumRaw, "string")
+	if err != nil {
+		return "", err
 	}
-	_, err = buildContainer.CopyFromContainer("/app/dist")
-	return err
-}
\ No newline at end of file
+	if checksum == "" {
+		return "", errors.New("project.uploaded carried an empty ProjectSHA256")
+	}
+	return checksum, nil
+}
+
+func projectStorageLocation(ctx *pipeline.PipelineContext) (string, string, error) {
+	projectStorageKeyRaw, err := ctx.Get("projectStorageKey")
+	if err != nil {
+		return "", "", err
+	}
+	projectStorageKey, err := util.TypeAssert[string](projectStorageKeyRaw, "string")
+	if err != nil {
+		return "", "", err
+	}
+	projectStorageBucketRaw, err := ctx.Get("projectStorageBucket")
+	if err != nil {
+		return "", "", err
+	}
+	projectStorageBucket, err := util.TypeAssert[string](projectStorageBucketRaw, "string")
+	if err != nil {
+		return "", "", err
+	}
+	return projectStorageBucket, projectStorageKey, nil
+}
@@ -0,0 +1,85 @@
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/hari134/comet/builder/container/containertest"
+	"github.com/hari134/comet/builder/pipeline"
+	"github.com/hari134/comet/core/storage"
+)
+
+func projectTarball(t *testing.T, files map[string]string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func uploadedProject(t *testing.T, tarball *bytes.Buffer, checksum string) (*pipeline.PipelineContext, *containertest.BuildContainer) {
+	t.Helper()
+	store, err := storage.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(context.Background(), bytes.NewBuffer(tarball.Bytes()), "projects", "p1/full.tar"); err != nil {
+		t.Fatal(err)
+	}
+	buildContainer := containertest.NewBuildContainer()
+	pctx := pipeline.NewPipelineContext().WithContainer(buildContainer).WithStore(store)
+	pctx.Set("projectStorageBucket", "projects")
+	pctx.Set("projectStorageKey", "p1/full.tar")
+	pctx.Set("projectSHA256", checksum)
+	return pctx, buildContainer
+}
+
+func TestCopyTarToContainerExtractsProjectIntoApp(t *testing.T) {
+	tarball := projectTarball(t, map[string]string{"package.json": "{}", "src/main.tsx": "render()"})
+	pctx, buildContainer := uploadedProject(t, tarball, storage.ChecksumSHA256(tarball.Bytes()))
+
+	if err := CopyTarToContainer(context.Background(), pctx); err != nil {
+		t.Fatalf("CopyTarToContainer: %v", err)
+	}
+	if data, ok := buildContainer.ReadFile("/app/src/main.tsx"); !ok || string(data) != "render()" {
+		t.Errorf("/app/src/main.tsx = %q, %v", data, ok)
+	}
+}
+
+func TestCopyTarToContainerRejectsTamperedProject(t *testing.T) {
+	tarball := projectTarball(t, map[string]string{"package.json": "{}"})
+	pctx, buildContainer := uploadedProject(t, tarball, storage.ChecksumSHA256([]byte("another upload")))
+
+	var integrityErr *storage.IntegrityError
+	if err := CopyTarToContainer(context.Background(), pctx); !errors.As(err, &integrityErr) {
+		t.Errorf("CopyTarToContainer error = %v, want an IntegrityError", err)
+	}
+	if files := buildContainer.Files(); len(files) != 0 {
+		t.Errorf("files of a tampered project were extracted: %v", files)
+	}
+}
+
+func TestCopyTarToContainerRequiresChecksum(t *testing.T) {
+	tarball := projectTarball(t, map[string]string{"package.json": "{}"})
+	pctx, buildContainer := uploadedProject(t, tarball, "")
+
+	if err := CopyTarToContainer(context.Background(), pctx); err == nil {
+		t.Error("project without a checksum was copied")
+	}
+	if files := buildContainer.Files(); len(files) != 0 {
+		t.Errorf("files copied without a checksum: %v", files)
+	}
+}
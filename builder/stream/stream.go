@@ -7,12 +7,14 @@ import (
 
 type Stream struct {
 	CorrelationID transport.CorrelationID
+	Source        string
 	Data          string
 }
 
-func NewStream(correlationID transport.CorrelationID, data string) Stream {
+func NewStream(correlationID transport.CorrelationID, source string, data string) Stream {
 	return Stream{
 		correlationID,
+		source,
 		data,
 	}
 }
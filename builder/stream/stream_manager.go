@@ -3,29 +3,129 @@ package stream
 import (
 	"context"
 	"log"
+	"time"
 
 	"github.com/hari134/comet/core/transport"
 )
 
-type StreamManager struct{
-	Sender transport.Sender
+const (
+	// DefaultFlushInterval is how long lines are collected before they are sent as one event
+	DefaultFlushInterval = 250 * time.Millisecond
+	// DefaultBatchSize is the number of lines sent early, without waiting for the flush interval
+	DefaultBatchSize = 100
+	// DefaultMaxPending is the number of lines kept while an event is being sent, further lines are dropped
+	DefaultMaxPending = 1000
+)
+
+type StreamManager struct {
+	Sender        transport.Sender
+	flushInterval time.Duration
+	batchSize     int
+	maxPending    int
+}
+
+func NewStreamManager(sender transport.Sender) *StreamManager {
+	return &StreamManager{
+		Sender:        sender,
+		flushInterval: DefaultFlushInterval,
+		batchSize:     DefaultBatchSize,
+		maxPending:    DefaultMaxPending,
+	}
+}
+
+func (sm *StreamManager) WithFlushInterval(flushInterval time.Duration) *StreamManager {
+	sm.flushInterval = flushInterval
+	return sm
+}
+
+func (sm *StreamManager) WithBatchSize(batchSize int) *StreamManager {
+	sm.batchSize = batchSize
+	return sm
+}
+
+func (sm *StreamManager) WithMaxPending(maxPending int) *StreamManager {
+	sm.maxPending = maxPending
+	return sm
 }
 
-func NewStreamManager(sender transport.Sender) *StreamManager{
-	return &StreamManager{sender}
+// batch is a run of lines sent together, along with the number of lines dropped before them.
+type batch struct {
+	lines   []Stream
+	dropped int
 }
 
+// SendStream sends the Streams received on dataChan as builder.stream events until the channel is closed.
+// Lines are collected into batches, and each batch is sent as one event per correlation ID with the
+// lines in its "lines" payload. dataChan is drained while an event is being sent, so a slow receiver
+// never blocks the build. When more than the maximum of pending lines pile up the newest ones are
+// dropped, and the next event carries their number in its "dropped" payload.
+func (sm *StreamManager) SendStream(ctx context.Context, dataChan <-chan Stream) {
+	batches := make(chan batch)
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for b := range batches {
+			sm.send(b)
+		}
+	}()
 
-func (sm *StreamManager) SendStream(ctx context.Context, dataChan <- chan Stream){
-	correlationID := ctx.Value("correlationID").(transport.CorrelationID)
+	ticker := time.NewTicker(sm.flushInterval)
+	defer ticker.Stop()
+	var pending batch
+	// flush hands the pending lines to the sender unless it is still busy with the previous batch
+	flush := func() {
+		if len(pending.lines) == 0 && pending.dropped == 0 {
+			return
+		}
+		select {
+		case batches <- pending:
+			pending = batch{}
+		default:
+		}
+	}
+	for {
+		select {
+		case data, ok := <-dataChan:
+			if !ok {
+				if len(pending.lines) > 0 || pending.dropped > 0 {
+					batches <- pending
+				}
+				close(batches)
+				<-sent
+				return
+			}
+			if len(pending.lines) >= sm.maxPending {
+				pending.dropped++
+				continue
+			}
+			pending.lines = append(pending.lines, data)
+			if len(pending.lines) >= sm.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
 
-	for data := range dataChan{
+func (sm *StreamManager) send(b batch) {
+	var order []transport.CorrelationID
+	lines := make(map[transport.CorrelationID][]map[string]string)
+	for _, data := range b.lines {
+		if _, ok := lines[data.CorrelationID]; !ok {
+			order = append(order, data.CorrelationID)
+		}
+		lines[data.CorrelationID] = append(lines[data.CorrelationID], map[string]string{"source": data.Source, "data": data.Data})
+	}
+	for i, correlationID := range order {
 		payload := transport.NewPayload()
-		payload.SetData("data",data.Data)
-		event := transport.NewEvent("builder.stream",correlationID,payload)
-		err := sm.Sender.Send(event)
-		if err != nil{
-			log.Printf("Failed to send stream with correlationID : %s",correlationID.ToString())
+		payload.SetData("lines", lines[correlationID])
+		// Dropped lines are reported once, with the first event of the batch
+		if i == 0 && b.dropped > 0 {
+			payload.SetData("dropped", b.dropped)
+		}
+		if err := sm.Sender.Send(transport.NewEvent("builder.stream", correlationID, payload)); err != nil {
+			log.Printf("Failed to send stream with correlationID : %s", correlationID.ToString())
 		}
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,105 @@
+package stream
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hari134/comet/core/transport"
+)
+
+// recordingSender records events, waiting for release before returning from Send.
+type recordingSender struct {
+	mu      sync.Mutex
+	events  []transport.Event
+	release chan struct{}
+}
+
+func (s *recordingSender) Send(event transport.Event) error {
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+// counts returns the number of lines and of dropped lines of the recorded events.
+func (s *recordingSender) counts(t *testing.T) (int, int) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var lines, dropped int
+	for _, event := range s.events {
+		if event.Type != "builder.stream" {
+			t.Errorf("event type = %s, want builder.stream", event.Type)
+		}
+		batch, err := event.Payload.GetData("lines")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines += len(batch.([]map[string]string))
+		if n, err := event.Payload.GetData("dropped"); err == nil {
+			dropped += n.(int)
+		}
+	}
+	return lines, dropped
+}
+
+func TestSendStreamBatchesLines(t *testing.T) {
+	released := make(chan struct{})
+	close(released)
+	sender := &recordingSender{release: released}
+	sm := NewStreamManager(sender).WithFlushInterval(time.Hour)
+	correlationID := transport.CorrelationID(uuid.New())
+
+	dataChan := make(chan Stream, 10)
+	for i := 0; i < 5; i++ {
+		dataChan <- NewStream(correlationID, "npm", "line")
+	}
+	close(dataChan)
+	sm.SendStream(context.Background(), dataChan)
+
+	if len(sender.events) != 1 {
+		t.Fatalf("sent %d events, want the 5 lines in one", len(sender.events))
+	}
+	if lines, _ := sender.counts(t); lines != 5 {
+		t.Errorf("event carries %d lines, want 5", lines)
+	}
+}
+
+func TestSendStreamDropsLinesWhileTheReceiverIsSlow(t *testing.T) {
+	sender := &recordingSender{release: make(chan struct{})}
+	sm := NewStreamManager(sender).WithBatchSize(1).WithMaxPending(10)
+	correlationID := transport.CorrelationID(uuid.New())
+
+	dataChan := make(chan Stream)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sm.SendStream(context.Background(), dataChan)
+	}()
+
+	// The receiver does not answer, the build still writes all of its output
+	produced := make(chan struct{})
+	go func() {
+		defer close(produced)
+		for i := 0; i < 100; i++ {
+			dataChan <- NewStream(correlationID, "npm", "line")
+		}
+		close(dataChan)
+	}()
+	select {
+	case <-produced:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writing output blocked on the receiver")
+	}
+
+	close(sender.release)
+	<-done
+	lines, dropped := sender.counts(t)
+	if dropped == 0 || lines+dropped != 100 {
+		t.Errorf("sent %d lines and reported %d dropped, want some dropped and 100 in total", lines, dropped)
+	}
+}
@@ -2,14 +2,22 @@ package transport
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 
+	"github.com/hari134/comet/builder/buildenv"
+	"github.com/hari134/comet/builder/cache"
 	"github.com/hari134/comet/builder/container"
 	"github.com/hari134/comet/builder/pipeline"
+	"github.com/hari134/comet/builder/pipeline/pipelines"
+	"github.com/hari134/comet/builder/stream"
+	"github.com/hari134/comet/builder/util"
 	"github.com/hari134/comet/core/storage"
 	"github.com/hari134/comet/core/transport"
 )
@@ -17,6 +25,8 @@ import (
 // RestSender implements the Sender interface, allowing events to be sent via REST.
 type RestSender struct {
 	Endpoint string
+	// Token authenticates the events with the token shared with the server
+	Token string
 }
 
 // Send sends an event via an HTTP POST request to the specified REST endpoint.
@@ -27,7 +37,15 @@ func (r *RestSender) Send(event transport.Event) error {
 		return transport.NewTransportError("failed to marshal event", err)
 	}
 
-	resp, err := http.Post(r.Endpoint, "application/json", bytes.NewBuffer(eventJSON))
+	req, err := http.NewRequest(http.MethodPost, r.Endpoint, bytes.NewBuffer(eventJSON))
+	if err != nil {
+		return transport.NewTransportError("failed to create request", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return transport.NewTransportError("failed to send event", err)
 	}
@@ -44,6 +62,7 @@ func (r *RestSender) Send(event transport.Event) error {
 // RestReceiver implements the Receiver interface, allowing events to be received via REST.
 type RestReceiver struct {
 	Endpoint string       // REST endpoint where this service listens for incoming events
+	token    string       // Bearer token incoming events must carry, empty accepts every event
 	server   *http.Server // HTTP server for handling incoming requests
 }
 
@@ -56,6 +75,12 @@ func (r *RestReceiver) WithEndpoint(endpoint string) *RestReceiver{
 	return r
 }
 
+// WithToken only accepts events carrying token as their bearer token, the token shared with the server.
+func (r *RestReceiver) WithToken(token string) *RestReceiver{
+	r.token = token
+	return r
+}
+
 // StartReceiving listens for incoming events on the specified endpoint and executes the provided handler.
 func (r *RestReceiver) StartReceiving(eventHandler transport.EventHandler) error {
 	if r.Endpoint == "" {
@@ -67,6 +92,10 @@ func (r *RestReceiver) StartReceiving(eventHandler transport.EventHandler) error
 			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 			return
 		}
+		if r.token != "" && subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+r.token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
 
 		// Read the request body
 		body, err := io.ReadAll(req.Body)
@@ -110,13 +139,23 @@ func (r *RestReceiver) StopReceiving() error {
 	return nil
 }
 
+// outputStreamBuffer lets a build keep running while stream events are being sent
+const outputStreamBuffer = 256
+
 type RestReceiverEventHandler struct {
 	containerManager container.ContainerManager
 	store storage.Store
+	streamManager *stream.StreamManager
+	pipelineManager *pipeline.PipelineManager
+	eventSender transport.Sender
+	environments *buildenv.Registry
+	dependencyCache *cache.DependencyCache
 }
 
 func NewRestReceiverEventHandler() *RestReceiverEventHandler {
-	return &RestReceiverEventHandler{}
+	return &RestReceiverEventHandler{
+		pipelineManager: pipeline.NewPipelineManager(),
+	}
 }
 
 func (restReceiverEH *RestReceiverEventHandler) WithContainerManager(containerManager container.ContainerManager) *RestReceiverEventHandler{
@@ -129,6 +168,71 @@ func (restReceiverEH *RestReceiverEventHandler) WithStorage(store storage.Store)
 	return restReceiverEH
 }
 
+func (restReceiverEH *RestReceiverEventHandler) WithStreamManager(streamManager *stream.StreamManager) *RestReceiverEventHandler{
+	restReceiverEH.streamManager = streamManager
+	return restReceiverEH
+}
+
+func (restReceiverEH *RestReceiverEventHandler) WithPipelineManager(pipelineManager *pipeline.PipelineManager) *RestReceiverEventHandler{
+	restReceiverEH.pipelineManager = pipelineManager
+	return restReceiverEH
+}
+
+// WithEnvironments sets the registry that maps build types to their pipeline.
+func (restReceiverEH *RestReceiverEventHandler) WithEnvironments(environments *buildenv.Registry) *RestReceiverEventHandler{
+	restReceiverEH.environments = environments
+	return restReceiverEH
+}
+
+// WithDependencyCache caches the dependencies of builds that carry a ProjectID.
+func (restReceiverEH *RestReceiverEventHandler) WithDependencyCache(dependencyCache *cache.DependencyCache) *RestReceiverEventHandler{
+	restReceiverEH.dependencyCache = dependencyCache
+	return restReceiverEH
+}
+
+// WithEventSender reports build failures, with their reason, as builder.failed events.
+func (restReceiverEH *RestReceiverEventHandler) WithEventSender(eventSender transport.Sender) *RestReceiverEventHandler{
+	restReceiverEH.eventSender = eventSender
+	return restReceiverEH
+}
+
+// reportQueued sends a builder.queued event telling the user their build waits for capacity.
+func (rh *RestReceiverEventHandler) reportQueued(correlationId transport.CorrelationID, position int) {
+	if rh.eventSender == nil {
+		return
+	}
+	payload := transport.NewPayload()
+	payload.SetData("position", position)
+	if err := rh.eventSender.Send(transport.NewEvent("builder.queued", correlationId, payload)); err != nil {
+		log.Printf("Failed to report queue position with correlationID : %s", correlationId.ToString())
+	}
+}
+
+// reportSandbox sends a builder.sandbox event recording how the build is isolated.
+func (rh *RestReceiverEventHandler) reportSandbox(correlationId transport.CorrelationID, sandbox container.Sandbox) {
+	if rh.eventSender == nil {
+		return
+	}
+	payload := transport.NewPayload()
+	payload.SetData("sandbox", sandbox)
+	if err := rh.eventSender.Send(transport.NewEvent("builder.sandbox", correlationId, payload)); err != nil {
+		log.Printf("Failed to report build sandbox with correlationID : %s", correlationId.ToString())
+	}
+}
+
+// reportFailure sends a builder.failed event telling the user why the build failed.
+func (rh *RestReceiverEventHandler) reportFailure(correlationId transport.CorrelationID, buildErr error) {
+	if rh.eventSender == nil {
+		return
+	}
+	payload := transport.NewPayload()
+	payload.SetData("reason", pipeline.FailureReason(buildErr))
+	payload.SetData("error", buildErr.Error())
+	if err := rh.eventSender.Send(transport.NewEvent("builder.failed", correlationId, payload)); err != nil {
+		log.Printf("Failed to report build failure with correlationID : %s", correlationId.ToString())
+	}
+}
+
 func (rh *RestReceiverEventHandler) HandleEvent(event transport.Event) error {
 	correlationId := event.CorrelationID
 	payload := event.Payload
@@ -136,29 +240,167 @@ func (rh *RestReceiverEventHandler) HandleEvent(event transport.Event) error {
 
 	switch eventType {
 	case "project.uploaded":
-		buildType, err := payload.GetData("BuildEnvType")
+		buildTypeRaw, err := payload.GetData("BuildEnvType")
+		if err != nil {
+			return err
+		}
+		buildType, err := util.TypeAssert[string](buildTypeRaw, "BuildEnvType")
+		if err != nil {
+			return err
+		}
+
+		projectStorageBucketRaw, err := payload.GetData("ProjectStorageBucket")
+		if err != nil {
+			return err
+		}
+		projectStorageBucket, err := util.TypeAssert[string](projectStorageBucketRaw, "ProjectStorageBucket")
+		if err != nil {
+			return err
+		}
+		projectStorageKeyRaw, err := payload.GetData("ProjectStorageKey")
+		if err != nil {
+			return err
+		}
+		projectStorageKey, err := util.TypeAssert[string](projectStorageKeyRaw, "ProjectStorageKey")
+		if err != nil {
+			return err
+		}
+		projectSHA256Raw, err := payload.GetData("ProjectSHA256")
+		if err != nil {
+			return err
+		}
+		projectSHA256, err := util.TypeAssert[string](projectSHA256Raw, "string")
+		if err != nil {
+			return err
+		}
+
+		// Reject uploads whose recorded checksum disagrees with the uploader before spending a container on them,
+		// the content itself is verified before it is copied into the container
+		err = storage.VerifyChecksum(context.Background(), rh.store, projectStorageBucket, projectStorageKey, projectSHA256)
 		if err != nil {
 			return err
 		}
 
-		buildPipeline, err := pipelines.PipelineFactory(buildType.(string))
+		if rh.environments == nil {
+			return errors.New("no build environments configured")
+		}
+		buildEnv, err := rh.environments.Lookup(buildType)
+		if err != nil {
+			return err
+		}
+		buildPipeline, err := pipelines.PipelineFactory(buildEnv.Pipeline)
 		if err != nil {
 			return err
 		}
 
-		buildContainer, err := rh.containerManager.NewBuildContainer(buildType.(string))
+		// The plan is optional, builds without one get the resource profile of their build type
+		buildRequest := container.BuildRequest{
+			BuildID:       correlationId.ToString(),
+			CorrelationID: correlationId.ToString(),
+			BuildType:     buildType,
+		}
+		if buildID, err := payload.GetData("BuildID"); err == nil {
+			buildRequest.BuildID = fmt.Sprint(buildID)
+		}
+		if plan, err := payload.GetData("Plan"); err == nil {
+			buildRequest.Plan, _ = plan.(string)
+		}
+		if userID, err := payload.GetData("UserID"); err == nil {
+			buildRequest.UserID = fmt.Sprint(userID)
+		}
+		buildRequest.OnQueued = func(position int) {
+			rh.reportQueued(correlationId, position)
+		}
+		// The payload can only tighten the network policy the builder is configured with
+		if networkPolicyRaw, err := payload.GetData("NetworkPolicy"); err == nil {
+			networkPolicy, err := util.TypeAssert[string](networkPolicyRaw, "NetworkPolicy")
+			if err != nil {
+				return err
+			}
+			buildRequest.NetworkPolicy, err = container.ParseNetworkPolicy(networkPolicy)
+			if err != nil {
+				return err
+			}
+		}
+		// Projects without a trust level get the default sandbox of the builder
+		if trustLevel, err := payload.GetData("TrustLevel"); err == nil && trustLevel != "" {
+			buildRequest.TrustLevel, err = container.ParseTrustLevel(fmt.Sprint(trustLevel))
+			if err != nil {
+				return err
+			}
+		}
+		buildRequest.OnSandbox = func(sandbox container.Sandbox) {
+			rh.reportSandbox(correlationId, sandbox)
+		}
+
+		// Register the build before it waits for capacity, so it can be cancelled while queued
+		build, err := rh.pipelineManager.Begin(context.Background(), correlationId)
 		if err != nil {
 			return err
 		}
+		defer build.End()
+		// The capacity of the build is released when it ends, even if its container is never removed
+		buildRequest.OnAcquired = build.OnEnd
+
+		// Forward image pull progress and command output to the user as builder.stream events while the build runs
+		var outputStream chan stream.Stream
+		if rh.streamManager != nil {
+			outputStream = make(chan stream.Stream, outputStreamBuffer)
+			streamDone := make(chan struct{})
+			go func() {
+				defer close(streamDone)
+				rh.streamManager.SendStream(context.Background(), outputStream)
+			}()
+			defer func() {
+				close(outputStream)
+				<-streamDone
+			}()
+			// Pull progress is called by the pull shared with other builds waiting for the image,
+			// so lines are dropped rather than stalling it while the stream of this build is full
+			buildRequest.OnPullProgress = func(line string) {
+				select {
+				case outputStream <- stream.NewStream(correlationId, container.PullOutput, line):
+				default:
+				}
+			}
+		}
+
+		buildContainer, err := rh.containerManager.NewBuildContainer(build.Context(), buildRequest)
+		if err != nil {
+			return build.Err(err)
+		}
 
-		ctx := pipeline.NewPipelineContext().WithContainer(buildContainer)
+		ctx := pipeline.NewPipelineContext().WithContainer(buildContainer).WithStore(rh.store)
 		ctx.Set("correlationId", correlationId)
+		ctx.Set("projectStorageBucket", projectStorageBucket)
+		ctx.Set("projectStorageKey", projectStorageKey)
+		ctx.Set("projectSHA256", projectSHA256)
+		// Dependencies are only cached per project, builds without a project ID run uncached
+		if projectID, err := payload.GetData("ProjectID"); err == nil && rh.dependencyCache != nil {
+			ctx.WithDependencyCache(rh.dependencyCache)
+			ctx.Set("projectID", fmt.Sprint(projectID))
+		}
+		// The build output is stored content addressed in the artifact bucket picked by the server
+		ctx.Set("buildID", buildRequest.BuildID)
+		if artifactBucketRaw, err := payload.GetData("ArtifactBucket"); err == nil {
+			artifactBucket, err := util.TypeAssert[string](artifactBucketRaw, "ArtifactBucket")
+			if err != nil {
+				return build.Err(err)
+			}
+			ctx.WithArtifactStore(storage.NewContentStore(rh.store, artifactBucket))
+		}
+		if outputStream != nil {
+			ctx.WithOutputStream(correlationId, outputStream)
+		}
 
-		err = buildPipeline.Run(ctx)
+		err = build.Run(buildPipeline, ctx)
 		if err != nil {
+			rh.reportFailure(correlationId, err)
 			return err
 		}
 		return nil
+	case "build.cancel":
+		return rh.pipelineManager.Cancel(correlationId)
 	default:
 		return errors.New("invalid event type")
 	}
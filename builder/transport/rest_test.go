@@ -0,0 +1,248 @@
+package transport
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hari134/comet/builder/buildenv"
+	"github.com/hari134/comet/builder/container"
+	"github.com/hari134/comet/builder/container/containertest"
+	"github.com/hari134/comet/builder/pipeline"
+	"github.com/hari134/comet/builder/pipeline/pipelines"
+	"github.com/hari134/comet/builder/stream"
+	"github.com/hari134/comet/core/storage"
+	"github.com/hari134/comet/core/transport"
+)
+
+const testBuildEnvironments = `{
+  "environments": {
+    "ReactViteNode20": {"image": "node:20", "workingDir": "/app", "pipeline": "react-vite"}
+  }
+}`
+
+// recordingSender records the events the builder reports.
+type recordingSender struct {
+	mu     sync.Mutex
+	events []transport.Event
+}
+
+func (s *recordingSender) Send(event transport.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+	return nil
+}
+
+// ofType returns the recorded events of eventType.
+func (s *recordingSender) ofType(eventType string) []transport.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var events []transport.Event
+	for _, event := range s.events {
+		if event.Type == eventType {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// testBuilder is a RestReceiverEventHandler building on fake containers, with the project
+// archive uploaded to an FSStore.
+type testBuilder struct {
+	handler  *RestReceiverEventHandler
+	manager  *containertest.ContainerManager
+	store    *storage.FSStore
+	sender   *recordingSender
+	checksum string
+}
+
+func newTestBuilder(t *testing.T, manager *containertest.ContainerManager) *testBuilder {
+	t.Helper()
+	pipelines.InitializePipelines()
+	envPath := filepath.Join(t.TempDir(), "buildenv.json")
+	if err := os.WriteFile(envPath, []byte(testBuildEnvironments), 0644); err != nil {
+		t.Fatal(err)
+	}
+	environments, err := buildenv.NewRegistry(envPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tarball bytes.Buffer
+	tw := tar.NewWriter(&tarball)
+	packageJSON := `{"scripts": {"build": "vite build"}}`
+	if err := tw.WriteHeader(&tar.Header{Name: "package.json", Mode: 0644, Size: int64(len(packageJSON))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(packageJSON)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checksum := storage.ChecksumSHA256(tarball.Bytes())
+	if err := store.Put(context.Background(), &tarball, "projects", "1/project.tar"); err != nil {
+		t.Fatal(err)
+	}
+
+	sender := &recordingSender{}
+	handler := NewRestReceiverEventHandler().
+		WithContainerManager(manager).
+		WithStorage(store).
+		WithEnvironments(environments).
+		WithEventSender(sender).
+		WithStreamManager(stream.NewStreamManager(sender).WithFlushInterval(time.Millisecond))
+	return &testBuilder{handler: handler, manager: manager, store: store, sender: sender, checksum: checksum}
+}
+
+// uploaded returns the project.uploaded event of the uploaded project archive.
+func (b *testBuilder) uploaded(checksum string) transport.Event {
+	payload := transport.NewPayload()
+	payload.SetData("BuildEnvType", "ReactViteNode20")
+	payload.SetData("ProjectStorageBucket", "projects")
+	payload.SetData("ProjectStorageKey", "1/project.tar")
+	payload.SetData("ProjectSHA256", checksum)
+	payload.SetData("BuildID", "7")
+	payload.SetData("UserID", "3")
+	payload.SetData("ArtifactBucket", "artifacts")
+	return transport.NewEvent("project.uploaded", transport.CorrelationID(uuid.New()), payload)
+}
+
+// viteContainer returns a container whose build command writes the build output to /app/dist.
+func viteContainer(req container.BuildRequest) (*containertest.BuildContainer, error) {
+	return containertest.NewBuildContainer().
+		OnExec("cd /app && npm run build", func(ctx context.Context, fc *containertest.BuildContainer, cmd string) (container.ExecResult, error) {
+			fc.WriteFile("/app/dist/index.html", []byte("<html>"))
+			return container.ExecResult{Stdout: "built in 1s\n"}, nil
+		}), nil
+}
+
+func TestHandleEventBuildsUploadedProject(t *testing.T) {
+	builder := newTestBuilder(t, containertest.NewContainerManager(viteContainer))
+
+	if err := builder.handler.HandleEvent(builder.uploaded(builder.checksum)); err != nil {
+		t.Fatalf("HandleEvent: %v", err)
+	}
+	requests := builder.manager.Requests()
+	if len(requests) != 1 || requests[0].BuildID != "7" || requests[0].UserID != "3" || requests[0].BuildType != "ReactViteNode20" {
+		t.Fatalf("build requests = %+v", requests)
+	}
+	buildContainer := builder.manager.Containers()[0]
+	if data, ok := buildContainer.ReadFile("/app/package.json"); !ok || !strings.Contains(string(data), "vite build") {
+		t.Errorf("/app/package.json = %q, %v", data, ok)
+	}
+	commands := buildContainer.Commands()
+	if len(commands) != 2 || commands[0] != "cd /app && npm install" || commands[1] != "cd /app && npm run build" {
+		t.Errorf("commands = %v", commands)
+	}
+	if !buildContainer.NetworkRestricted() || !buildContainer.Removed() {
+		t.Error("container was not restricted before the build and removed after it")
+	}
+
+	manifest, err := storage.NewContentStore(builder.store, "artifacts").GetManifest(context.Background(), "7")
+	if err != nil || len(manifest.Files) != 1 {
+		t.Fatalf("artifact manifest = %+v, %v, want index.html", manifest, err)
+	}
+	if streams := builder.sender.ofType("builder.stream"); len(streams) == 0 {
+		t.Error("command output was not streamed")
+	}
+	if failures := builder.sender.ofType("builder.failed"); len(failures) != 0 {
+		t.Errorf("successful build reported failures: %v", failures)
+	}
+}
+
+func TestHandleEventRejectsChecksumMismatch(t *testing.T) {
+	builder := newTestBuilder(t, containertest.NewContainerManager(viteContainer))
+
+	err := builder.handler.HandleEvent(builder.uploaded(storage.ChecksumSHA256([]byte("another upload"))))
+	var integrityErr *storage.IntegrityError
+	if !errors.As(err, &integrityErr) {
+		t.Fatalf("HandleEvent error = %v, want an IntegrityError", err)
+	}
+	if requests := builder.manager.Requests(); len(requests) != 0 {
+		t.Errorf("container created for a tampered upload: %+v", requests)
+	}
+}
+
+func TestHandleEventRejectsMalformedPayload(t *testing.T) {
+	builder := newTestBuilder(t, containertest.NewContainerManager(viteContainer))
+
+	for _, key := range []string{"BuildEnvType", "ProjectStorageBucket", "ProjectStorageKey", "ProjectSHA256"} {
+		event := builder.uploaded(builder.checksum)
+		event.Payload.SetData(key, 42)
+		if err := builder.handler.HandleEvent(event); err == nil {
+			t.Errorf("HandleEvent accepted a non-string %s", key)
+		}
+	}
+	if requests := builder.manager.Requests(); len(requests) != 0 {
+		t.Errorf("containers created for malformed events: %+v", requests)
+	}
+}
+
+func TestHandleEventReportsFailedBuild(t *testing.T) {
+	builder := newTestBuilder(t, containertest.NewContainerManager(func(req container.BuildRequest) (*containertest.BuildContainer, error) {
+		return containertest.NewBuildContainer().
+			WithExecResult("cd /app && npm run build", container.ExecResult{ExitCode: 2, Stderr: "error TS2304\n"}), nil
+	}))
+
+	var commandErr *pipeline.CommandError
+	if err := builder.handler.HandleEvent(builder.uploaded(builder.checksum)); !errors.As(err, &commandErr) {
+		t.Fatalf("HandleEvent error = %v, want a CommandError", err)
+	}
+	failures := builder.sender.ofType("builder.failed")
+	if len(failures) != 1 {
+		t.Fatalf("builder.failed events = %v, want 1", failures)
+	}
+	if reason, _ := failures[0].Payload.GetData("reason"); reason != pipeline.FailureCommandFailed {
+		t.Errorf("failure reason = %v, want %s", reason, pipeline.FailureCommandFailed)
+	}
+}
+
+func TestHandleEventCancelsQueuedBuild(t *testing.T) {
+	scheduler := container.NewScheduler(1)
+	release, err := scheduler.Acquire(context.Background(), "other", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	builder := newTestBuilder(t, containertest.NewContainerManager(viteContainer).WithScheduler(scheduler))
+
+	event := builder.uploaded(builder.checksum)
+	buildErr := make(chan error, 1)
+	go func() {
+		buildErr <- builder.handler.HandleEvent(event)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(builder.sender.ofType("builder.queued")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("build was not queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := builder.handler.HandleEvent(transport.NewEvent("build.cancel", event.CorrelationID, transport.NewPayload())); err != nil {
+		t.Fatalf("cancel: %v", err)
+	}
+	if err := <-buildErr; !errors.Is(err, pipeline.ErrBuildCancelled) {
+		t.Errorf("HandleEvent error = %v, want ErrBuildCancelled", err)
+	}
+	if containers := builder.manager.Containers(); len(containers) != 0 {
+		t.Errorf("containers created for a cancelled build: %d", len(containers))
+	}
+	if scheduler.Queued() != 0 {
+		t.Errorf("cancelled build is still queued")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/hari134/comet/core/db"
+	"github.com/hari134/comet/core/repository"
+	"github.com/hari134/comet/core/retention"
+	"github.com/hari134/comet/core/storage"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "report what would be deleted without deleting anything")
+	interval := flag.Duration("interval", 0, "run periodically with this interval instead of once")
+	keepLast := flag.Int("keep-last", retention.DefaultPolicy.KeepLast, "default number of recent deployments kept per project")
+	deleteSources := flag.Bool("delete-sources-after-build", retention.DefaultPolicy.DeleteSourcesAfterBuild, "default for deleting project tarballs once their build succeeded")
+	flag.Parse()
+
+	database := db.NewDB()
+	store, err := storage.NewStoreFromEnv("")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	runner := retention.NewRunner(repository.NewDeploymentRepository(database), store).
+		WithDefaultPolicy(retention.Policy{
+			KeepLast:                *keepLast,
+			DeleteSourcesAfterBuild: *deleteSources,
+		})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if *interval > 0 {
+		log.Printf("Running retention every %s...", *interval)
+		if err := runner.RunPeriodically(ctx, *interval); err != nil && ctx.Err() == nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	report, err := runner.Run(ctx, *dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, action := range report.Actions {
+		log.Printf("%s deployment %d of project %d: %s", action.Kind, action.Deployment.ID, action.Deployment.ProjectID, action.Reason)
+	}
+	verb := "Deleted"
+	if report.DryRun {
+		verb = "Would delete"
+	}
+	log.Printf("%s %d objects (%s), %d of them unreferenced artifact blobs", verb, report.DeletedKeys, formatBytes(report.DeletedBytes), report.CollectedBlobs)
+}
+
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/hari134/comet/core/storage"
+)
+
+// storage-migrate copies all objects of a bucket between two stores. The source store is
+// configured by SRC_ prefixed storage variables and the destination by DST_ prefixed ones,
+// for example SRC_STORAGE_BACKEND=s3 and DST_STORAGE_BACKEND=fs with DST_STORAGE_FS_ROOT.
+func main() {
+	srcBucket := flag.String("src-bucket", "", "bucket to copy from")
+	dstBucket := flag.String("dst-bucket", "", "bucket to copy to, defaults to the source bucket")
+	prefix := flag.String("prefix", "", "only copy keys starting with this prefix")
+	checkpoint := flag.String("checkpoint", "", "file recording progress so an interrupted run can resume")
+	verify := flag.Bool("verify", true, "verify size and checksum of every copied object")
+	flag.Parse()
+
+	if *srcBucket == "" {
+		log.Fatal("-src-bucket is required")
+	}
+	if *dstBucket == "" {
+		*dstBucket = *srcBucket
+	}
+
+	src, err := storage.NewStoreFromEnv("SRC_")
+	if err != nil {
+		log.Fatalf("Failed to configure source store: %v", err)
+	}
+	dst, err := storage.NewStoreFromEnv("DST_")
+	if err != nil {
+		log.Fatalf("Failed to configure destination store: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report, err := storage.Migrate(ctx, src, *srcBucket, dst, *dstBucket, storage.MigrateOptions{
+		Prefix:         *prefix,
+		CheckpointPath: *checkpoint,
+		Verify:         *verify,
+	})
+	log.Printf("Copied %d objects (%d bytes), skipped %d already present", report.Copied, report.Bytes, report.Skipped)
+	if err != nil {
+		log.Fatalf("Migration stopped: %v", err)
+	}
+}
@@ -34,7 +34,6 @@ func NewDB() *bun.DB{
 	if err != nil {
 		log.Fatalf("Failed to connect to the database: %v", err)
 	}
-	defer pool.Close()
 	sqldb := stdlib.OpenDBFromPool(pool)
 
 	db := bun.NewDB(sqldb, pgdialect.New())
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+const (
+	DeploymentStatusPending   = "pending"
+	DeploymentStatusBuilding  = "building"
+	DeploymentStatusSucceeded = "succeeded"
+	DeploymentStatusFailed    = "failed"
+)
+
+type Deployment struct {
+	bun.BaseModel `bun:"table:deployments"`
+
+	ID                 int64     `bun:",pk,autoincrement"`
+	ProjectID          int64     `bun:"notnull"` // Foreign key to projects table
+	Status             string    `bun:",notnull"`
+	IsProduction       bool      `bun:",notnull"`
+	Alias              string    `bun:",nullzero"`
+	SourceBucket       string    `bun:",notnull"`
+	SourceKey          string    `bun:",notnull"`
+	ArtifactBucket     string    `bun:",nullzero"` // Build output, stored in a storage.ContentStore under a manifest named after the ID
+	CreatedAt          time.Time `bun:"default:current_timestamp,notnull"`
+	SourcesDeletedAt   time.Time `bun:",nullzero"`
+	ArtifactsDeletedAt time.Time `bun:",nullzero"`
+	// CorrelationID ties the events exchanged with the builder to the deployment
+	CorrelationID string `bun:",nullzero"`
+	// Sandbox is how the build was isolated, as reported by the builder
+	Sandbox *BuildSandbox `bun:"type:jsonb"`
+}
+
+// BuildSandbox is the effective sandbox of a build, the fields follow the builder.sandbox event.
+type BuildSandbox struct {
+	TrustLevel      string   `json:"trustLevel"`
+	Runtime         string   `json:"runtime,omitempty"`
+	RuntimeClass    string   `json:"runtimeClass,omitempty"`
+	SeccompProfile  string   `json:"seccompProfile,omitempty"`
+	CapDrop         []string `json:"capDrop,omitempty"`
+	CapAdd          []string `json:"capAdd,omitempty"`
+	NoNewPrivileges bool     `json:"noNewPrivileges,omitempty"`
+	ReadOnlyRootfs  bool     `json:"readOnlyRootfs,omitempty"`
+	ScratchSize     string   `json:"scratchSize,omitempty"`
+	User            string   `json:"user,omitempty"`
+}
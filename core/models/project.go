@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+type Project struct {
+	bun.BaseModel `bun:"table:projects"`
+
+	ID                     int64     `bun:",pk,autoincrement"`
+	UserID                 int64     `bun:"notnull"` // Foreign key to users table
+	Name                   string    `bun:",notnull"`
+	CreatedAt              time.Time `bun:"default:current_timestamp,notnull"`
+	RetentionKeepLast      *int      `bun:"retention_keep_last"`      // nil uses the default retention policy
+	RetentionDeleteSources *bool     `bun:"retention_delete_sources"` // nil uses the default retention policy
+	TrustLevel             string    `bun:",nullzero"`                // trusted, standard or untrusted, empty uses the default of the builder
+}
@@ -0,0 +1,126 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/hari134/comet/core/models"
+	"github.com/uptrace/bun"
+)
+
+type DeploymentRepository struct {
+	db *bun.DB
+}
+
+func NewDeploymentRepository(db *bun.DB) *DeploymentRepository {
+	return &DeploymentRepository{db: db}
+}
+
+func (r *DeploymentRepository) ListProjects(ctx context.Context) ([]models.Project, error) {
+	var projects []models.Project
+	err := r.db.NewSelect().Model(&projects).Order("id ASC").Scan(ctx)
+	return projects, err
+}
+
+func (r *DeploymentRepository) GetProject(ctx context.Context, projectID int64) (models.Project, error) {
+	var project models.Project
+	err := r.db.NewSelect().Model(&project).Where("id = ?", projectID).Scan(ctx)
+	return project, err
+}
+
+// ListDeployments returns the deployments of a project, newest first.
+func (r *DeploymentRepository) ListDeployments(ctx context.Context, projectID int64) ([]models.Deployment, error) {
+	var deployments []models.Deployment
+	err := r.db.NewSelect().
+		Model(&deployments).
+		Where("project_id = ?", projectID).
+		Order("created_at DESC", "id DESC").
+		Scan(ctx)
+	return deployments, err
+}
+
+func (r *DeploymentRepository) MarkSourcesDeleted(ctx context.Context, deploymentID int64, deletedAt time.Time) error {
+	_, err := r.db.NewUpdate().
+		Model((*models.Deployment)(nil)).
+		Set("sources_deleted_at = ?", deletedAt).
+		Where("id = ?", deploymentID).
+		Exec(ctx)
+	return err
+}
+
+func (r *DeploymentRepository) MarkArtifactsDeleted(ctx context.Context, deploymentID int64, deletedAt time.Time) error {
+	_, err := r.db.NewUpdate().
+		Model((*models.Deployment)(nil)).
+		Set("artifacts_deleted_at = ?", deletedAt).
+		Where("id = ?", deploymentID).
+		Exec(ctx)
+	return err
+}
+
+// RecordSandbox stores the sandbox the builder ran the build of the deployment in.
+func (r *DeploymentRepository) RecordSandbox(ctx context.Context, deploymentID int64, sandbox models.BuildSandbox) error {
+	_, err := r.db.NewUpdate().
+		Model((*models.Deployment)(nil)).
+		Set("sandbox = ?", &sandbox).
+		Where("id = ?", deploymentID).
+		Exec(ctx)
+	return err
+}
+
+func (r *DeploymentRepository) CreateDeployment(ctx context.Context, deployment *models.Deployment) error {
+	_, err := r.db.NewInsert().Model(deployment).Returning("*").Exec(ctx)
+	return err
+}
+
+func (r *DeploymentRepository) GetDeployment(ctx context.Context, deploymentID int64) (models.Deployment, error) {
+	var deployment models.Deployment
+	err := r.db.NewSelect().Model(&deployment).Where("id = ?", deploymentID).Scan(ctx)
+	return deployment, err
+}
+
+// GetDeploymentByCorrelationID returns the deployment whose build events carry correlationID.
+func (r *DeploymentRepository) GetDeploymentByCorrelationID(ctx context.Context, correlationID string) (models.Deployment, error) {
+	var deployment models.Deployment
+	err := r.db.NewSelect().Model(&deployment).Where("correlation_id = ?", correlationID).Scan(ctx)
+	return deployment, err
+}
+
+// StartBuild moves a pending deployment to building. It returns sql.ErrNoRows when the
+// deployment is not pending, so a build is only ever started once.
+func (r *DeploymentRepository) StartBuild(ctx context.Context, deploymentID int64, correlationID string) error {
+	result, err := r.db.NewUpdate().
+		Model((*models.Deployment)(nil)).
+		Set("status = ?", models.DeploymentStatusBuilding).
+		Set("correlation_id = ?", correlationID).
+		Where("id = ?", deploymentID).
+		Where("status = ?", models.DeploymentStatusPending).
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return sql.ErrNoRows
+	}
+	return err
+}
+
+func (r *DeploymentRepository) SetStatus(ctx context.Context, deploymentID int64, status string) error {
+	_, err := r.db.NewUpdate().
+		Model((*models.Deployment)(nil)).
+		Set("status = ?", status).
+		Where("id = ?", deploymentID).
+		Exec(ctx)
+	return err
+}
+
+// MarkSucceeded records that the build of the deployment succeeded and stored its output in artifactBucket.
+func (r *DeploymentRepository) MarkSucceeded(ctx context.Context, deploymentID int64, artifactBucket string) error {
+	_, err := r.db.NewUpdate().
+		Model((*models.Deployment)(nil)).
+		Set("status = ?", models.DeploymentStatusSucceeded).
+		Set("artifact_bucket = ?", artifactBucket).
+		Where("id = ?", deploymentID).
+		Exec(ctx)
+	return err
+}
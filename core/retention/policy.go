@@ -0,0 +1,93 @@
+package retention
+
+import (
+	"sort"
+
+	"github.com/hari134/comet/core/models"
+)
+
+// Policy decides which deployments of a project keep their stored objects.
+// Production and aliased deployments are always kept regardless of the policy.
+type Policy struct {
+	// KeepLast is the number of most recent deployments whose sources and artifacts are kept
+	KeepLast int
+	// DeleteSourcesAfterBuild removes the project tarball of kept deployments once their build succeeded
+	DeleteSourcesAfterBuild bool
+}
+
+var DefaultPolicy = Policy{
+	KeepLast:                10,
+	DeleteSourcesAfterBuild: false,
+}
+
+// PolicyFor applies the overrides stored on a project on top of the default policy.
+func PolicyFor(project models.Project, defaults Policy) Policy {
+	policy := defaults
+	if project.RetentionKeepLast != nil {
+		policy.KeepLast = *project.RetentionKeepLast
+	}
+	if project.RetentionDeleteSources != nil {
+		policy.DeleteSourcesAfterBuild = *project.RetentionDeleteSources
+	}
+	return policy
+}
+
+type ActionKind string
+
+const (
+	DeleteSources   ActionKind = "delete-sources"
+	DeleteArtifacts ActionKind = "delete-artifacts"
+)
+
+// Action is a single deletion the retention policy asks for.
+type Action struct {
+	Kind       ActionKind
+	Deployment models.Deployment
+	Reason     string
+}
+
+// Plan returns the deletions the policy requires for the deployments of one project.
+// Deployments whose build has not finished are never touched and do not count toward KeepLast.
+func Plan(deployments []models.Deployment, policy Policy) []Action {
+	sorted := make([]models.Deployment, len(deployments))
+	copy(sorted, deployments)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].CreatedAt.After(sorted[j].CreatedAt)
+	})
+
+	var actions []Action
+	finished := 0
+	for _, deployment := range sorted {
+		if !isFinished(deployment) {
+			continue
+		}
+		recent := finished < policy.KeepLast
+		finished++
+		sourcesDeleted := !deployment.SourcesDeletedAt.IsZero()
+		artifactsDeleted := !deployment.ArtifactsDeletedAt.IsZero() || deployment.ArtifactBucket == ""
+
+		if isPinned(deployment) || recent {
+			if policy.DeleteSourcesAfterBuild && deployment.Status == models.DeploymentStatusSucceeded && !sourcesDeleted {
+				actions = append(actions, Action{Kind: DeleteSources, Deployment: deployment, Reason: "build succeeded"})
+			}
+			continue
+		}
+
+		if !artifactsDeleted {
+			actions = append(actions, Action{Kind: DeleteArtifacts, Deployment: deployment, Reason: "older than the last kept deployments"})
+		}
+		if !sourcesDeleted {
+			actions = append(actions, Action{Kind: DeleteSources, Deployment: deployment, Reason: "older than the last kept deployments"})
+		}
+	}
+	return actions
+}
+
+// isPinned reports whether a deployment must be kept forever.
+func isPinned(deployment models.Deployment) bool {
+	return deployment.IsProduction || deployment.Alias != ""
+}
+
+func isFinished(deployment models.Deployment) bool {
+	return deployment.Status == models.DeploymentStatusSucceeded || deployment.Status == models.DeploymentStatusFailed
+}
@@ -0,0 +1,76 @@
+package retention
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hari134/comet/core/models"
+)
+
+func deploymentsByAge(statuses ...string) []models.Deployment {
+	now := time.Now()
+	deployments := make([]models.Deployment, len(statuses))
+	for i, status := range statuses {
+		deployments[i] = models.Deployment{
+			ID:             int64(i + 1),
+			Status:         status,
+			SourceBucket:   "projects",
+			SourceKey:      "p1/full.tar",
+			ArtifactBucket: "artifacts",
+			CreatedAt:      now.Add(-time.Duration(i) * time.Hour),
+		}
+	}
+	return deployments
+}
+
+func actionsByDeployment(actions []Action) map[int64][]ActionKind {
+	byDeployment := make(map[int64][]ActionKind)
+	for _, action := range actions {
+		byDeployment[action.Deployment.ID] = append(byDeployment[action.Deployment.ID], action.Kind)
+	}
+	return byDeployment
+}
+
+func TestPlanKeepsTheLastFinishedDeployments(t *testing.T) {
+	// Deployment 1 is the newest, the running builds do not take up the kept slots
+	deployments := deploymentsByAge(
+		models.DeploymentStatusBuilding,
+		models.DeploymentStatusPending,
+		models.DeploymentStatusSucceeded,
+		models.DeploymentStatusFailed,
+		models.DeploymentStatusSucceeded,
+	)
+
+	actions := actionsByDeployment(Plan(deployments, Policy{KeepLast: 2}))
+	for _, id := range []int64{1, 2, 3, 4} {
+		if len(actions[id]) != 0 {
+			t.Errorf("deployment %d: %v, want it kept", id, actions[id])
+		}
+	}
+	if len(actions[5]) != 2 {
+		t.Errorf("deployment 5: %v, want its artifacts and sources deleted", actions[5])
+	}
+}
+
+func TestPlanKeepsPinnedDeployments(t *testing.T) {
+	deployments := deploymentsByAge(models.DeploymentStatusSucceeded, models.DeploymentStatusSucceeded, models.DeploymentStatusSucceeded)
+	deployments[1].IsProduction = true
+	deployments[2].Alias = "launch"
+
+	if actions := Plan(deployments, Policy{KeepLast: 1}); len(actions) != 0 {
+		t.Errorf("Plan = %+v, want production and aliased deployments kept", actions)
+	}
+}
+
+func TestPlanDeletesSourcesAfterBuild(t *testing.T) {
+	deployments := deploymentsByAge(models.DeploymentStatusSucceeded, models.DeploymentStatusFailed, models.DeploymentStatusSucceeded)
+	deployments[0].SourcesDeletedAt = time.Now()
+
+	actions := actionsByDeployment(Plan(deployments, Policy{KeepLast: 5, DeleteSourcesAfterBuild: true}))
+	if len(actions[1]) != 0 || len(actions[2]) != 0 {
+		t.Errorf("Plan = %v, want sources kept for failed builds and deleted only once", actions)
+	}
+	if len(actions[3]) != 1 || actions[3][0] != DeleteSources {
+		t.Errorf("deployment 3: %v, want its sources deleted", actions[3])
+	}
+}
@@ -0,0 +1,162 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/hari134/comet/core/models"
+	"github.com/hari134/comet/core/storage"
+)
+
+// DeploymentSource provides the deployments retention works on and records what it deleted.
+type DeploymentSource interface {
+	ListProjects(ctx context.Context) ([]models.Project, error)
+	ListDeployments(ctx context.Context, projectID int64) ([]models.Deployment, error)
+	MarkSourcesDeleted(ctx context.Context, deploymentID int64, deletedAt time.Time) error
+	MarkArtifactsDeleted(ctx context.Context, deploymentID int64, deletedAt time.Time) error
+}
+
+// Report describes the outcome of a retention run. In a dry run it lists what would be deleted.
+type Report struct {
+	DryRun       bool
+	Actions      []Action
+	DeletedKeys  int
+	DeletedBytes int64
+	// CollectedBlobs is the number of the deleted keys that were artifact blobs no manifest referenced
+	CollectedBlobs int
+}
+
+// Runner applies retention policies to every project and deletes expired objects through the Store.
+type Runner struct {
+	source        DeploymentSource
+	store         storage.Store
+	defaultPolicy Policy
+}
+
+func NewRunner(source DeploymentSource, store storage.Store) *Runner {
+	return &Runner{
+		source:        source,
+		store:         store,
+		defaultPolicy: DefaultPolicy,
+	}
+}
+
+func (r *Runner) WithDefaultPolicy(policy Policy) *Runner {
+	r.defaultPolicy = policy
+	return r
+}
+
+// Run plans and, unless dryRun is set, executes the deletions for every project.
+// A failing deployment is logged and skipped so one broken object does not block the rest.
+// The run ends with a garbage collection of every artifact bucket, which deletes the blobs no
+// remaining manifest references. A dry run cannot tell which blobs the manifests it would delete
+// free, so it only reports the blobs that are unreferenced already.
+func (r *Runner) Run(ctx context.Context, dryRun bool) (Report, error) {
+	report := Report{DryRun: dryRun}
+
+	projects, err := r.source.ListProjects(ctx)
+	if err != nil {
+		return report, err
+	}
+	artifactBuckets := make(map[string]struct{})
+	for _, project := range projects {
+		deployments, err := r.source.ListDeployments(ctx, project.ID)
+		if err != nil {
+			return report, err
+		}
+		for _, deployment := range deployments {
+			if deployment.ArtifactBucket != "" {
+				artifactBuckets[deployment.ArtifactBucket] = struct{}{}
+			}
+		}
+		for _, action := range Plan(deployments, PolicyFor(project, r.defaultPolicy)) {
+			keys, bytes, err := r.apply(ctx, action, dryRun)
+			if err != nil {
+				log.Printf("retention: %s for deployment %d failed: %v", action.Kind, action.Deployment.ID, err)
+				continue
+			}
+			report.Actions = append(report.Actions, action)
+			report.DeletedKeys += keys
+			report.DeletedBytes += bytes
+		}
+	}
+
+	for bucket := range artifactBuckets {
+		gcReport, err := storage.NewContentStore(r.store, bucket).CollectGarbage(ctx, storage.GCOptions{DryRun: dryRun})
+		if err != nil {
+			log.Printf("retention: garbage collection of %s failed: %v", bucket, err)
+			continue
+		}
+		report.CollectedBlobs += len(gcReport.DeletedBlobs)
+		report.DeletedKeys += len(gcReport.DeletedBlobs)
+		report.DeletedBytes += gcReport.DeletedBytes
+	}
+	return report, nil
+}
+
+// RunPeriodically runs retention every interval until ctx is cancelled.
+func (r *Runner) RunPeriodically(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		report, err := r.Run(ctx, false)
+		if err != nil {
+			log.Printf("retention: run failed: %v", err)
+		} else {
+			log.Printf("retention: %d actions, %d objects, %d bytes deleted", len(report.Actions), report.DeletedKeys, report.DeletedBytes)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Runner) apply(ctx context.Context, action Action, dryRun bool) (int, int64, error) {
+	deployment := action.Deployment
+	switch action.Kind {
+	case DeleteSources:
+		info, err := r.store.Stat(ctx, deployment.SourceBucket, deployment.SourceKey)
+		if err != nil && !errors.Is(err, storage.ErrObjectNotFound) {
+			return 0, 0, err
+		}
+		if dryRun {
+			return 1, info.Size, nil
+		}
+		if err := r.store.Delete(ctx, deployment.SourceBucket, deployment.SourceKey); err != nil {
+			return 0, 0, err
+		}
+		return 1, info.Size, r.source.MarkSourcesDeleted(ctx, deployment.ID, time.Now().UTC())
+	case DeleteArtifacts:
+		// Only the manifest of the deployment is deleted, its blobs may be shared with other
+		// deployments and are left to the garbage collection at the end of the run
+		artifacts := storage.NewContentStore(r.store, deployment.ArtifactBucket)
+		manifestID := strconv.FormatInt(deployment.ID, 10)
+		info, err := artifacts.StatManifest(ctx, manifestID)
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			// The build stored no output, e.g. because it failed before its upload stage
+			if dryRun {
+				return 0, 0, nil
+			}
+			return 0, 0, r.source.MarkArtifactsDeleted(ctx, deployment.ID, time.Now().UTC())
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if dryRun {
+			return 1, info.Size, nil
+		}
+		if err := artifacts.DeleteManifest(ctx, manifestID); err != nil {
+			return 0, 0, err
+		}
+		return 1, info.Size, r.source.MarkArtifactsDeleted(ctx, deployment.ID, time.Now().UTC())
+	default:
+		return 0, 0, fmt.Errorf("unknown retention action %s", action.Kind)
+	}
+}
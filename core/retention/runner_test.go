@@ -0,0 +1,159 @@
+package retention
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hari134/comet/core/models"
+	"github.com/hari134/comet/core/storage"
+)
+
+// fakeSource serves the deployments of a single project from memory.
+type fakeSource struct {
+	project     models.Project
+	deployments []models.Deployment
+}
+
+func (f *fakeSource) ListProjects(ctx context.Context) ([]models.Project, error) {
+	return []models.Project{f.project}, nil
+}
+
+func (f *fakeSource) ListDeployments(ctx context.Context, projectID int64) ([]models.Deployment, error) {
+	return f.deployments, nil
+}
+
+func (f *fakeSource) MarkSourcesDeleted(ctx context.Context, deploymentID int64, deletedAt time.Time) error {
+	f.deployment(deploymentID).SourcesDeletedAt = deletedAt
+	return nil
+}
+
+func (f *fakeSource) MarkArtifactsDeleted(ctx context.Context, deploymentID int64, deletedAt time.Time) error {
+	f.deployment(deploymentID).ArtifactsDeletedAt = deletedAt
+	return nil
+}
+
+func (f *fakeSource) deployment(deploymentID int64) *models.Deployment {
+	for i := range f.deployments {
+		if f.deployments[i].ID == deploymentID {
+			return &f.deployments[i]
+		}
+	}
+	return nil
+}
+
+func putDist(t *testing.T, artifacts *storage.ContentStore, deploymentID string, files map[string]string) *storage.Manifest {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: "dist/" + name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := artifacts.PutTar(context.Background(), deploymentID, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+func blobExists(store storage.Store, digest string) bool {
+	_, err := store.Stat(context.Background(), "artifacts", "blobs/sha256/"+digest[:2]+"/"+digest)
+	return err == nil
+}
+
+func TestRunnerDeletesManifestsAndCollectsTheirBlobs(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	store, err := storage.NewFSStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifacts := storage.NewContentStore(store, "artifacts")
+	old := putDist(t, artifacts, "1", map[string]string{"index.html": "<html>", "app.js": "app v1"})
+	putDist(t, artifacts, "2", map[string]string{"index.html": "<html>", "app.js": "app v2"})
+	// The blobs of deployment 1 were uploaded long before the run
+	longAgo := time.Now().Add(-2 * storage.DefaultGCGracePeriod)
+	for _, entry := range old.Files {
+		blobPath := filepath.Join(root, "artifacts", "blobs", "sha256", entry.Digest[:2], entry.Digest)
+		if err := os.Chtimes(blobPath, longAgo, longAgo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Put(ctx, bytes.NewBufferString("project archive"), "projects", "p1/1.tar"); err != nil {
+		t.Fatal(err)
+	}
+
+	source := &fakeSource{
+		project: models.Project{ID: 1},
+		deployments: []models.Deployment{
+			{ID: 2, Status: models.DeploymentStatusSucceeded, SourceBucket: "projects", SourceKey: "p1/2.tar", ArtifactBucket: "artifacts", CreatedAt: time.Now()},
+			{ID: 1, Status: models.DeploymentStatusSucceeded, SourceBucket: "projects", SourceKey: "p1/1.tar", ArtifactBucket: "artifacts", CreatedAt: time.Now().Add(-time.Hour)},
+		},
+	}
+	runner := NewRunner(source, store).WithDefaultPolicy(Policy{KeepLast: 1})
+
+	report, err := runner.Run(ctx, true)
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if len(report.Actions) != 2 || !source.deployment(1).ArtifactsDeletedAt.IsZero() {
+		t.Errorf("dry run = %+v, want two actions and nothing marked", report)
+	}
+	if _, err := artifacts.GetManifest(ctx, "1"); err != nil {
+		t.Errorf("dry run deleted the manifest: %v", err)
+	}
+
+	report, err = runner.Run(ctx, false)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if _, err := artifacts.GetManifest(ctx, "1"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Errorf("manifest of deployment 1 after the run: %v", err)
+	}
+	if report.CollectedBlobs != 1 || blobExists(store, old.Files["app.js"].Digest) {
+		t.Errorf("report = %+v, want the blob only deployment 1 used collected", report)
+	}
+	if !blobExists(store, old.Files["index.html"].Digest) {
+		t.Error("blob shared with deployment 2 was collected")
+	}
+	if source.deployment(1).ArtifactsDeletedAt.IsZero() || source.deployment(1).SourcesDeletedAt.IsZero() {
+		t.Errorf("deployment 1 = %+v, want its artifacts and sources marked deleted", source.deployment(1))
+	}
+	if _, err := artifacts.GetManifest(ctx, "2"); err != nil {
+		t.Errorf("manifest of kept deployment 2: %v", err)
+	}
+}
+
+func TestRunnerMarksBuildsWithoutOutput(t *testing.T) {
+	store, err := storage.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &fakeSource{
+		project: models.Project{ID: 1},
+		deployments: []models.Deployment{
+			{ID: 2, Status: models.DeploymentStatusSucceeded, SourceBucket: "projects", SourceKey: "p1/2.tar", ArtifactBucket: "artifacts", CreatedAt: time.Now()},
+			{ID: 1, Status: models.DeploymentStatusFailed, SourceBucket: "projects", SourceKey: "p1/1.tar", ArtifactBucket: "artifacts", CreatedAt: time.Now().Add(-time.Hour)},
+		},
+	}
+
+	if _, err := NewRunner(source, store).WithDefaultPolicy(Policy{KeepLast: 1}).Run(context.Background(), false); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if source.deployment(1).ArtifactsDeletedAt.IsZero() {
+		t.Error("failed build without a manifest was not marked, it would be planned again on every run")
+	}
+}
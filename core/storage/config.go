@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// NewStoreFromEnv creates the Store selected by the STORAGE_BACKEND environment variable,
+// S3 being used when it is not set. Every variable name is looked up with prefix prepended,
+// so commands working with two stores can configure them side by side (for example SRC_ and DST_).
+//
+// When STORAGE_REPLICAS lists further prefixes (comma separated, for example "REPLICA_"),
+// the store built from each of them receives a background copy of every write.
+// STORAGE_REPLICATION_PENDING_FILE keeps the keys waiting for repair across restarts.
+//
+// When STORAGE_ENCRYPTION_KEYS is set, the store is wrapped in an EncryptedStore
+// using the master keys it lists and STORAGE_ENCRYPTION_KEY_ID as the current key.
+// STORAGE_ENCRYPTION_PLAINTEXT_FALLBACK=true keeps objects written before encryption readable.
+func NewStoreFromEnv(prefix string) (Store, error) {
+	getenv := func(name string) string {
+		return os.Getenv(prefix + name)
+	}
+
+	store, err := newBackendStoreFromEnv(prefix, getenv)
+	if err != nil {
+		return nil, err
+	}
+	if replicas := getenv("STORAGE_REPLICAS"); replicas != "" {
+		var secondaries []Store
+		for _, replicaPrefix := range strings.Split(replicas, ",") {
+			secondary, err := newBackendStoreFromEnv(replicaPrefix, func(name string) string {
+				return os.Getenv(replicaPrefix + name)
+			})
+			if err != nil {
+				return nil, err
+			}
+			secondaries = append(secondaries, secondary)
+		}
+		// Replication lives as long as the process using the store
+		replicated := NewReplicatedStore(store, secondaries...).
+			WithPendingFile(getenv("STORAGE_REPLICATION_PENDING_FILE"))
+		replicated.Start(context.Background(), len(secondaries))
+		store = replicated
+	}
+	encryptionKeys := getenv("STORAGE_ENCRYPTION_KEYS")
+	if encryptionKeys == "" {
+		return store, nil
+	}
+	keyRing, err := ParseKeyRing(encryptionKeys, getenv("STORAGE_ENCRYPTION_KEY_ID"))
+	if err != nil {
+		return nil, err
+	}
+	return NewEncryptedStore(store, keyRing).
+		WithPlaintextFallback(getenv("STORAGE_ENCRYPTION_PLAINTEXT_FALLBACK") == "true"), nil
+}
+
+func newBackendStoreFromEnv(prefix string, getenv func(string) string) (Store, error) {
+	switch backend := getenv("STORAGE_BACKEND"); backend {
+	case "", "s3":
+		// Create AWS credentials from environment variables
+		awsCreds := AWSCredentials{
+			AccessKey:       getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    getenv("AWS_SESSION_TOKEN"),
+			Region:          getenv("AWS_REGION"),
+		}
+		// S3_ENDPOINT points the store at an S3 compatible service such as MinIO
+		return NewS3StoreWithConfig(S3Config{
+			Credentials:    awsCreds,
+			Endpoint:       getenv("S3_ENDPOINT"),
+			ForcePathStyle: getenv("S3_FORCE_PATH_STYLE") == "true",
+			DisableSSL:     getenv("S3_DISABLE_SSL") == "true",
+		})
+	case "fs":
+		root := getenv("STORAGE_FS_ROOT")
+		if root == "" {
+			return nil, errors.New(prefix + "STORAGE_FS_ROOT must be set for the fs storage backend")
+		}
+		return NewFSStore(root)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
@@ -0,0 +1,267 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	blobPrefix     = "blobs/sha256/"
+	manifestPrefix = "manifests/"
+	manifestSuffix = ".json"
+)
+
+// DefaultGCGracePeriod protects recently uploaded blobs from garbage collection.
+// A deployment uploads its blobs before writing its manifest, so blobs younger than this
+// may belong to a manifest that does not exist yet.
+const DefaultGCGracePeriod = time.Hour
+
+// ContentStore stores files by the SHA-256 of their content on top of any Store.
+// Each deployment is described by a manifest mapping file paths to blob digests,
+// so identical files across deployments and projects are stored only once.
+//
+// Layout inside the bucket:
+//
+//	blobs/sha256/<first two hex chars>/<digest>
+//	manifests/<deployment id>.json
+type ContentStore struct {
+	store  Store
+	bucket string
+}
+
+// Manifest maps every file of a deployment to the blob holding its content.
+type Manifest struct {
+	DeploymentID string                   `json:"deploymentId"`
+	CreatedAt    time.Time                `json:"createdAt"`
+	Files        map[string]ManifestEntry `json:"files"`
+}
+
+type ManifestEntry struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// GCOptions controls a garbage collection run.
+type GCOptions struct {
+	GracePeriod time.Duration
+	DryRun      bool
+}
+
+// GCReport summarises a garbage collection run.
+type GCReport struct {
+	Manifests       int
+	ReferencedBlobs int
+	DeletedBlobs    []string
+	DeletedBytes    int64
+}
+
+func NewContentStore(store Store, bucket string) *ContentStore {
+	return &ContentStore{store: store, bucket: bucket}
+}
+
+func NewManifest(deploymentID string) *Manifest {
+	return &Manifest{
+		DeploymentID: deploymentID,
+		CreatedAt:    time.Now().UTC(),
+		Files:        make(map[string]ManifestEntry),
+	}
+}
+
+// PutBlob stores data under its digest and returns the digest.
+// Blobs that already exist are never uploaded again. Their modification time is refreshed with a
+// copy onto themselves instead, which restarts their grace period so CollectGarbage keeps them
+// until the manifest referencing them is written.
+func (cs *ContentStore) PutBlob(ctx context.Context, data *bytes.Buffer) (string, error) {
+	sum := sha256.Sum256(data.Bytes())
+	digest := hex.EncodeToString(sum[:])
+
+	info, err := cs.store.Stat(ctx, cs.bucket, blobKey(digest))
+	if err == nil {
+		if time.Since(info.LastModified) >= DefaultGCGracePeriod/2 {
+			if err := cs.store.Copy(ctx, cs.bucket, blobKey(digest), cs.bucket, blobKey(digest)); err != nil {
+				return "", err
+			}
+		}
+		return digest, nil
+	}
+	if !errors.Is(err, ErrObjectNotFound) {
+		return "", err
+	}
+	if err := cs.store.Put(ctx, data, cs.bucket, blobKey(digest)); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+// GetBlob returns the content of the blob with the given digest.
+func (cs *ContentStore) GetBlob(ctx context.Context, digest string) (*bytes.Buffer, error) {
+	if !isDigest(digest) {
+		return nil, fmt.Errorf("invalid blob digest %q", digest)
+	}
+	return cs.store.Get(ctx, cs.bucket, blobKey(digest))
+}
+
+// AddFile stores the content of body and records it in the manifest under filePath.
+func (cs *ContentStore) AddFile(ctx context.Context, manifest *Manifest, filePath string, body io.Reader) error {
+	data := new(bytes.Buffer)
+	size, err := io.Copy(data, body)
+	if err != nil {
+		return err
+	}
+	digest, err := cs.PutBlob(ctx, data)
+	if err != nil {
+		return err
+	}
+	manifest.Files[path.Clean("/" + filePath)[1:]] = ManifestEntry{Digest: digest, Size: size}
+	return nil
+}
+
+// PutTar stores every regular file of a tar stream, such as the one returned by
+// BuildContainer.CopyFromContainer, and writes the resulting manifest.
+// The leading directory of the archive is stripped, so "dist/index.html" is recorded as "index.html".
+func (cs *ContentStore) PutTar(ctx context.Context, deploymentID string, tarStream io.Reader) (*Manifest, error) {
+	manifest := NewManifest(deploymentID)
+	tarReader := tar.NewReader(tarStream)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		filePath := header.Name
+		if _, rest, found := strings.Cut(strings.TrimPrefix(filePath, "/"), "/"); found {
+			filePath = rest
+		}
+		if err := cs.AddFile(ctx, manifest, filePath, tarReader); err != nil {
+			return nil, err
+		}
+	}
+	if err := cs.PutManifest(ctx, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// OpenFile returns the content recorded for filePath in the manifest.
+func (cs *ContentStore) OpenFile(ctx context.Context, manifest *Manifest, filePath string) (*bytes.Buffer, error) {
+	entry, ok := manifest.Files[path.Clean("/" + filePath)[1:]]
+	if !ok {
+		return nil, ErrObjectNotFound
+	}
+	return cs.GetBlob(ctx, entry.Digest)
+}
+
+func (cs *ContentStore) PutManifest(ctx context.Context, manifest *Manifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return cs.store.Put(ctx, bytes.NewBuffer(data), cs.bucket, manifestKey(manifest.DeploymentID))
+}
+
+func (cs *ContentStore) GetManifest(ctx context.Context, deploymentID string) (*Manifest, error) {
+	data, err := cs.store.Get(ctx, cs.bucket, manifestKey(deploymentID))
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(data.Bytes(), manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest for deployment %s: %w", deploymentID, err)
+	}
+	return manifest, nil
+}
+
+// StatManifest returns the object info of a deployment's manifest.
+func (cs *ContentStore) StatManifest(ctx context.Context, deploymentID string) (ObjectInfo, error) {
+	return cs.store.Stat(ctx, cs.bucket, manifestKey(deploymentID))
+}
+
+// DeleteManifest removes a deployment's manifest. Its blobs are left in place
+// until CollectGarbage finds that no other manifest references them.
+func (cs *ContentStore) DeleteManifest(ctx context.Context, deploymentID string) error {
+	return cs.store.Delete(ctx, cs.bucket, manifestKey(deploymentID))
+}
+
+// CollectGarbage deletes blobs that no manifest references using mark and sweep.
+// Blobs modified within the grace period are always kept because their manifest may
+// still be in the middle of being uploaded. PutBlob rewrites blobs older than half of
+// DefaultGCGracePeriod instead of deduplicating against them, so with the default grace
+// period every blob of an upload taking less than 30 minutes is kept until its manifest exists.
+func (cs *ContentStore) CollectGarbage(ctx context.Context, opts GCOptions) (GCReport, error) {
+	gracePeriod := opts.GracePeriod
+	if gracePeriod <= 0 {
+		gracePeriod = DefaultGCGracePeriod
+	}
+	cutoff := time.Now().Add(-gracePeriod)
+	report := GCReport{}
+
+	// Mark every digest referenced by a manifest
+	referenced := make(map[string]struct{})
+	err := WalkPrefix(ctx, cs.store, cs.bucket, manifestPrefix, func(object ObjectInfo) error {
+		if !strings.HasSuffix(object.Key, manifestSuffix) {
+			return nil
+		}
+		deploymentID := strings.TrimSuffix(strings.TrimPrefix(object.Key, manifestPrefix), manifestSuffix)
+		manifest, err := cs.GetManifest(ctx, deploymentID)
+		if err != nil {
+			return err
+		}
+		report.Manifests++
+		for _, entry := range manifest.Files {
+			referenced[entry.Digest] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	report.ReferencedBlobs = len(referenced)
+
+	// Sweep blobs that are neither referenced nor recent
+	err = WalkPrefix(ctx, cs.store, cs.bucket, blobPrefix, func(object ObjectInfo) error {
+		digest := path.Base(object.Key)
+		if _, ok := referenced[digest]; ok || object.LastModified.After(cutoff) {
+			return nil
+		}
+		if !opts.DryRun {
+			if err := cs.store.Delete(ctx, cs.bucket, object.Key); err != nil {
+				return err
+			}
+		}
+		report.DeletedBlobs = append(report.DeletedBlobs, digest)
+		report.DeletedBytes += object.Size
+		return nil
+	})
+	return report, err
+}
+
+func blobKey(digest string) string {
+	return blobPrefix + digest[:2] + "/" + digest
+}
+
+func manifestKey(deploymentID string) string {
+	return manifestPrefix + deploymentID + manifestSuffix
+}
+
+func isDigest(digest string) bool {
+	if len(digest) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(digest)
+	return err == nil
+}
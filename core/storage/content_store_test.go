@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func distTarball(t *testing.T, files map[string]string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: "dist/" + name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// ageBlob moves the modification time of a blob age into the past.
+func ageBlob(t *testing.T, store *FSStore, digest string, age time.Duration) {
+	t.Helper()
+	objectPath, _, err := store.objectPath("artifacts", blobKey(digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(objectPath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countingStore counts the objects written through Put.
+type countingStore struct {
+	*FSStore
+	puts int
+}
+
+func (cs *countingStore) Put(ctx context.Context, data *bytes.Buffer, bucket string, key string) error {
+	cs.puts++
+	return cs.FSStore.Put(ctx, data, bucket, key)
+}
+
+func TestContentStoreStoresIdenticalFilesOnce(t *testing.T) {
+	ctx := context.Background()
+	store := newTestFSStore(t)
+	cs := NewContentStore(store, "artifacts")
+
+	first, err := cs.PutTar(ctx, "1", distTarball(t, map[string]string{"index.html": "<html>", "assets/app.js": "app v1"}))
+	if err != nil {
+		t.Fatalf("PutTar: %v", err)
+	}
+	second, err := cs.PutTar(ctx, "2", distTarball(t, map[string]string{"index.html": "<html>", "assets/app.js": "app v2"}))
+	if err != nil {
+		t.Fatalf("PutTar: %v", err)
+	}
+	if first.Files["index.html"].Digest != second.Files["index.html"].Digest {
+		t.Error("identical files got different digests")
+	}
+	var blobs int
+	if err := WalkPrefix(ctx, store, "artifacts", blobPrefix, func(ObjectInfo) error { blobs++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if blobs != 3 {
+		t.Errorf("stored %d blobs, want 3", blobs)
+	}
+
+	manifest, err := cs.GetManifest(ctx, "2")
+	if err != nil {
+		t.Fatalf("GetManifest: %v", err)
+	}
+	if got, err := cs.OpenFile(ctx, manifest, "assets/app.js"); err != nil || got.String() != "app v2" {
+		t.Errorf("OpenFile = %q, %v", got, err)
+	}
+}
+
+func TestCollectGarbageSweepsUnreferencedBlobs(t *testing.T) {
+	ctx := context.Background()
+	store := newTestFSStore(t)
+	cs := NewContentStore(store, "artifacts")
+	first, err := cs.PutTar(ctx, "1", distTarball(t, map[string]string{"index.html": "<html>", "app.js": "app v1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.PutTar(ctx, "2", distTarball(t, map[string]string{"index.html": "<html>", "app.js": "app v2"})); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range first.Files {
+		ageBlob(t, store, entry.Digest, 2*DefaultGCGracePeriod)
+	}
+	if err := cs.DeleteManifest(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := cs.CollectGarbage(ctx, GCOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if len(report.DeletedBlobs) != 1 || !objectExists(store, "artifacts", blobKey(first.Files["app.js"].Digest)) {
+		t.Errorf("dry run = %+v, want one blob reported and kept", report)
+	}
+
+	report, err = cs.CollectGarbage(ctx, GCOptions{})
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if report.Manifests != 1 || len(report.DeletedBlobs) != 1 || report.DeletedBlobs[0] != first.Files["app.js"].Digest {
+		t.Errorf("report = %+v, want only the blob of app v1 deleted", report)
+	}
+	if !objectExists(store, "artifacts", blobKey(first.Files["index.html"].Digest)) {
+		t.Error("blob still referenced by deployment 2 was deleted")
+	}
+}
+
+func TestCollectGarbageKeepsBlobsReusedByAnUploadInProgress(t *testing.T) {
+	ctx := context.Background()
+	store := newTestFSStore(t)
+	counting := &countingStore{FSStore: store}
+	cs := NewContentStore(counting, "artifacts")
+	digest, err := cs.PutBlob(ctx, bytes.NewBufferString("app v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ageBlob(t, store, digest, 2*DefaultGCGracePeriod)
+
+	// A new upload reuses the unreferenced blob before writing its manifest
+	if _, err := cs.PutBlob(ctx, bytes.NewBufferString("app v1")); err != nil {
+		t.Fatal(err)
+	}
+	if counting.puts != 1 {
+		t.Errorf("blob was uploaded %d times, want once", counting.puts)
+	}
+	report, err := cs.CollectGarbage(ctx, GCOptions{})
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if len(report.DeletedBlobs) != 0 || !objectExists(store, "artifacts", blobKey(digest)) {
+		t.Errorf("report = %+v, want the reused blob kept", report)
+	}
+}
@@ -0,0 +1,615 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// encryptedMagic prefixes every object written by EncryptedStore, followed by a format version
+	encryptedMagic = "CMTE"
+	// encryptedChunkedVersion is the only format version, objects are sealed in chunks
+	encryptedChunkedVersion = 2
+	dataKeySize             = 32
+	encryptedChunkSize      = 64 * 1024
+	gcmNonceSize            = 12
+	gcmOverhead             = 16
+	// maxEnvelopeHeaderSize covers the longest key id and wrapped key
+	maxEnvelopeHeaderSize = len(encryptedMagic) + 2 + 255 + 1 + 255 + gcmNonceSize
+)
+
+var (
+	ErrNotEncrypted = errors.New("object is not encrypted")
+	ErrUnknownKeyID = errors.New("unknown master key id")
+)
+
+// KeyRing holds the master keys used to wrap per-object data keys.
+// New objects are always wrapped with the current key, older keys are kept
+// so objects written before a rotation can still be read.
+type KeyRing struct {
+	currentID string
+	keys      map[string][]byte
+}
+
+func NewKeyRing(currentID string, keys map[string][]byte) (*KeyRing, error) {
+	if _, ok := keys[currentID]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKeyID, currentID)
+	}
+	for id, key := range keys {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("invalid master key id %q", id)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("master key %s must be 32 bytes, got %d", id, len(key))
+		}
+	}
+	return &KeyRing{currentID: currentID, keys: keys}, nil
+}
+
+// ParseKeyRing parses master keys given as comma separated "id:base64key" pairs,
+// which is how they are passed through environment variables.
+func ParseKeyRing(spec string, currentID string) (*KeyRing, error) {
+	keys := make(map[string][]byte)
+	for _, pair := range strings.Split(spec, ",") {
+		id, encodedKey, found := strings.Cut(strings.TrimSpace(pair), ":")
+		if !found {
+			return nil, fmt.Errorf("invalid master key entry %q, expected id:base64key", pair)
+		}
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key %s: %w", id, err)
+		}
+		keys[id] = key
+	}
+	return NewKeyRing(currentID, keys)
+}
+
+// EncryptedStore wraps a Store with client side envelope encryption.
+// Every object is encrypted with AES-GCM under a fresh data key, and the data key is
+// stored next to the ciphertext wrapped by a master key from the KeyRing. The content is
+// sealed in chunks of 64 KiB so objects can be streamed, and every chunk is bound to the
+// bucket and key of its object, its position and whether it is the last one, so chunks
+// cannot be swapped between objects, reordered or cut off.
+//
+// Object layout:
+//
+//	magic | version | key id length | key id | wrapped key length | wrapped key | nonce | sealed chunks
+//
+// Stat and List report the size of the stored ciphertext and never a checksum,
+// since the stored checksum covers the ciphertext and not the content callers put.
+type EncryptedStore struct {
+	store             Store
+	keys              *KeyRing
+	plaintextFallback bool
+}
+
+func NewEncryptedStore(store Store, keys *KeyRing) *EncryptedStore {
+	return &EncryptedStore{store: store, keys: keys}
+}
+
+// WithPlaintextFallback serves objects written before encryption was turned on as they are
+// instead of failing with ErrNotEncrypted. Writes are encrypted either way.
+func (es *EncryptedStore) WithPlaintextFallback(enabled bool) *EncryptedStore {
+	es.plaintextFallback = enabled
+	return es
+}
+
+func (es *EncryptedStore) Get(ctx context.Context, bucket string, key string) (*bytes.Buffer, error) {
+	body, err := es.Open(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewBuffer(data), nil
+}
+
+func (es *EncryptedStore) Put(ctx context.Context, fileData *bytes.Buffer, bucket string, key string) error {
+	return es.PutStream(ctx, bytes.NewReader(fileData.Bytes()), int64(fileData.Len()), bucket, key)
+}
+
+func (es *EncryptedStore) Open(ctx context.Context, bucket string, key string) (io.ReadCloser, error) {
+	return es.OpenRange(ctx, bucket, key, 0, -1)
+}
+
+// OpenRange decrypts only the chunks covering the range when the wrapped store can read ranges.
+func (es *EncryptedStore) OpenRange(ctx context.Context, bucket string, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("invalid range offset %d", offset)
+	}
+	body, err := es.openFrom(ctx, bucket, key, offset)
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		return body, nil
+	}
+	return &limitedReadCloser{Reader: io.LimitReader(body, length), Closer: body}, nil
+}
+
+// PutStream encrypts body while it is written, a size of -1 is passed on to the wrapped store.
+func (es *EncryptedStore) PutStream(ctx context.Context, body io.Reader, size int64, bucket string, key string) error {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return err
+	}
+	envelope, err := es.wrapDataKey(dataKey)
+	if err != nil {
+		return err
+	}
+	envelope.version = encryptedChunkedVersion
+	envelope.nonce = make([]byte, gcmNonceSize)
+	if _, err := io.ReadFull(rand.Reader, envelope.nonce); err != nil {
+		return err
+	}
+	chunks, err := newChunkCipher(dataKey, envelope.nonce, bucket, key)
+	if err != nil {
+		return err
+	}
+
+	header := envelope.marshal()
+	sealedSize := int64(-1)
+	if size >= 0 {
+		sealedSize = int64(len(header)) + sealedContentSize(size)
+	}
+	sealed := io.MultiReader(bytes.NewReader(header), newSealingReader(body, chunks))
+	return putObject(ctx, es.store, sealed, sealedSize, bucket, key)
+}
+
+func (es *EncryptedStore) List(ctx context.Context, bucket string, prefix string, opts ListOptions) (ListResult, error) {
+	result, err := es.store.List(ctx, bucket, prefix, opts)
+	for i := range result.Objects {
+		result.Objects[i].SHA256 = ""
+	}
+	return result, err
+}
+
+func (es *EncryptedStore) Stat(ctx context.Context, bucket string, key string) (ObjectInfo, error) {
+	info, err := es.store.Stat(ctx, bucket, key)
+	info.SHA256 = ""
+	return info, err
+}
+
+func (es *EncryptedStore) Delete(ctx context.Context, bucket string, key string) error {
+	return es.store.Delete(ctx, bucket, key)
+}
+
+// Copy re-encrypts the object, since its chunks are bound to the bucket and key they were written to.
+func (es *EncryptedStore) Copy(ctx context.Context, srcBucket string, srcKey string, dstBucket string, dstKey string) error {
+	// The ciphertext stays bound to the same bucket and key, so it is copied as is
+	if srcBucket == dstBucket && srcKey == dstKey {
+		return es.store.Copy(ctx, srcBucket, srcKey, dstBucket, dstKey)
+	}
+	body, err := es.Open(ctx, srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return es.PutStream(ctx, body, -1, dstBucket, dstKey)
+}
+
+// Rewrap re-encrypts the data key of an object with the current master key after a rotation.
+// The object content is not re-encrypted, unless the object was written before encryption and
+// the plaintext fallback is on, in which case it is encrypted. It reports whether the object
+// was rewritten.
+func (es *EncryptedStore) Rewrap(ctx context.Context, bucket string, key string) (bool, error) {
+	stored, err := es.store.Get(ctx, bucket, key)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.HasPrefix(stored.Bytes(), []byte(encryptedMagic)) {
+		if !es.plaintextFallback {
+			return false, fmt.Errorf("%s/%s: %w", bucket, key, ErrNotEncrypted)
+		}
+		return true, es.Put(ctx, stored, bucket, key)
+	}
+	sealed := bytes.NewReader(stored.Bytes())
+	envelope, err := readEnvelope(sealed)
+	if err != nil {
+		return false, fmt.Errorf("%s/%s: %w", bucket, key, err)
+	}
+	if envelope.keyID == es.keys.currentID {
+		return false, nil
+	}
+	dataKey, err := es.unwrapDataKey(envelope)
+	if err != nil {
+		return false, fmt.Errorf("%s/%s: %w", bucket, key, err)
+	}
+	rewrapped, err := es.wrapDataKey(dataKey)
+	if err != nil {
+		return false, err
+	}
+	rewrapped.version = envelope.version
+	rewrapped.nonce = envelope.nonce
+	ciphertext := stored.Bytes()[stored.Len()-sealed.Len():]
+	if err := es.store.Put(ctx, bytes.NewBuffer(append(rewrapped.marshal(), ciphertext...)), bucket, key); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// openFrom returns the content of an object from offset on. Chunks before offset are not
+// downloaded when the wrapped store can read ranges.
+func (es *EncryptedStore) openFrom(ctx context.Context, bucket string, key string, offset int64) (io.ReadCloser, error) {
+	firstChunk := offset / encryptedChunkSize
+	if streamStore, ok := es.store.(StreamStore); ok && firstChunk > 0 {
+		header, err := streamStore.OpenRange(ctx, bucket, key, 0, int64(maxEnvelopeHeaderSize))
+		if err != nil {
+			return nil, err
+		}
+		envelope, err := readEnvelope(header)
+		header.Close()
+		// Plaintext objects are read from the start below
+		if err == nil {
+			sealedOffset := int64(len(envelope.marshal())) + firstChunk*(encryptedChunkSize+gcmOverhead)
+			sealed, err := streamStore.OpenRange(ctx, bucket, key, sealedOffset, -1)
+			if err != nil {
+				return nil, err
+			}
+			body, err := es.decryptChunks(bufio.NewReader(sealed), sealed, envelope, bucket, key, uint64(firstChunk))
+			if err != nil {
+				sealed.Close()
+				return nil, err
+			}
+			return skip(body, offset-firstChunk*encryptedChunkSize)
+		}
+	}
+
+	sealed, err := openObjectRange(ctx, es.store, bucket, key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	body, err := es.decrypt(sealed, bucket, key)
+	if err != nil {
+		sealed.Close()
+		return nil, err
+	}
+	return skip(body, offset)
+}
+
+// decrypt reads the envelope of a stored object and returns its content.
+func (es *EncryptedStore) decrypt(sealed io.ReadCloser, bucket string, key string) (io.ReadCloser, error) {
+	r := bufio.NewReader(sealed)
+	magic, err := r.Peek(len(encryptedMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(magic) != encryptedMagic {
+		if !es.plaintextFallback {
+			return nil, fmt.Errorf("%s/%s: %w", bucket, key, ErrNotEncrypted)
+		}
+		return &limitedReadCloser{Reader: r, Closer: sealed}, nil
+	}
+	envelope, err := readEnvelope(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s/%s: %w", bucket, key, err)
+	}
+	return es.decryptChunks(r, sealed, envelope, bucket, key, 0)
+}
+
+func (es *EncryptedStore) decryptChunks(r *bufio.Reader, sealed io.Closer, envelope *envelope, bucket string, key string, firstChunk uint64) (io.ReadCloser, error) {
+	dataKey, err := es.unwrapDataKey(envelope)
+	if err != nil {
+		return nil, fmt.Errorf("%s/%s: %w", bucket, key, err)
+	}
+	chunks, err := newChunkCipher(dataKey, envelope.nonce, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	return &openingReader{
+		src:    r,
+		body:   sealed,
+		chunks: chunks,
+		index:  firstChunk,
+		bucket: bucket,
+		key:    key,
+		sealed: make([]byte, encryptedChunkSize+gcmOverhead),
+	}, nil
+}
+
+func (es *EncryptedStore) wrapDataKey(dataKey []byte) (*envelope, error) {
+	keyID := es.keys.currentID
+	wrappedKey, err := sealGCM(es.keys.keys[keyID], dataKey, []byte(keyID))
+	if err != nil {
+		return nil, err
+	}
+	return &envelope{keyID: keyID, wrappedKey: wrappedKey}, nil
+}
+
+func (es *EncryptedStore) unwrapDataKey(envelope *envelope) ([]byte, error) {
+	masterKey, ok := es.keys.keys[envelope.keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKeyID, envelope.keyID)
+	}
+	dataKey, err := openGCM(masterKey, envelope.wrappedKey, []byte(envelope.keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+// skip discards the first n bytes of body.
+func skip(body io.ReadCloser, n int64) (io.ReadCloser, error) {
+	if _, err := io.CopyN(io.Discard, body, n); err != nil && err != io.EOF {
+		body.Close()
+		return nil, err
+	}
+	return body, nil
+}
+
+type envelope struct {
+	version    byte
+	keyID      string
+	wrappedKey []byte
+	// nonce is the base nonce of the chunks
+	nonce []byte
+}
+
+func (e *envelope) marshal() []byte {
+	buf := bytes.NewBufferString(encryptedMagic)
+	buf.WriteByte(e.version)
+	buf.WriteByte(byte(len(e.keyID)))
+	buf.WriteString(e.keyID)
+	buf.WriteByte(byte(len(e.wrappedKey)))
+	buf.Write(e.wrappedKey)
+	buf.Write(e.nonce)
+	return buf.Bytes()
+}
+
+// readEnvelope reads the header of a stored object and leaves r at the start of its ciphertext.
+func readEnvelope(r io.Reader) (*envelope, error) {
+	head := make([]byte, len(encryptedMagic)+2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, headerError(err)
+	}
+	if string(head[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, ErrNotEncrypted
+	}
+	e := &envelope{version: head[len(encryptedMagic)]}
+	if e.version != encryptedChunkedVersion {
+		return nil, errors.New("unsupported encrypted object version")
+	}
+
+	keyID := make([]byte, head[len(encryptedMagic)+1])
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return nil, headerError(err)
+	}
+	e.keyID = string(keyID)
+
+	wrappedKeyLen := make([]byte, 1)
+	if _, err := io.ReadFull(r, wrappedKeyLen); err != nil {
+		return nil, headerError(err)
+	}
+	e.wrappedKey = make([]byte, wrappedKeyLen[0])
+	if _, err := io.ReadFull(r, e.wrappedKey); err != nil {
+		return nil, headerError(err)
+	}
+
+	e.nonce = make([]byte, gcmNonceSize)
+	if _, err := io.ReadFull(r, e.nonce); err != nil {
+		return nil, headerError(err)
+	}
+	return e, nil
+}
+
+func headerError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("truncated encrypted object header")
+	}
+	return err
+}
+
+// sealedContentSize returns the size of content once sealed in chunks. Empty content still
+// takes a final chunk.
+func sealedContentSize(size int64) int64 {
+	chunks := (size + encryptedChunkSize - 1) / encryptedChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return size + chunks*gcmOverhead
+}
+
+// chunkCipher seals the chunks of one object. Every chunk gets its own nonce, derived from the
+// base nonce and the chunk index, and is bound to the object, its index and whether it is the last.
+type chunkCipher struct {
+	aead      cipher.AEAD
+	baseNonce []byte
+	object    []byte
+}
+
+func newChunkCipher(dataKey []byte, baseNonce []byte, bucket string, key string) (*chunkCipher, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	object := append([]byte(encryptedMagic), encryptedChunkedVersion)
+	object = binary.AppendUvarint(object, uint64(len(bucket)))
+	object = append(object, bucket...)
+	object = append(object, key...)
+	return &chunkCipher{aead: aead, baseNonce: baseNonce, object: object}, nil
+}
+
+func (c *chunkCipher) seal(dst []byte, index uint64, plaintext []byte, final bool) []byte {
+	return c.aead.Seal(dst, c.nonce(index), plaintext, c.additionalData(index, final))
+}
+
+func (c *chunkCipher) open(dst []byte, index uint64, sealed []byte, final bool) ([]byte, error) {
+	return c.aead.Open(dst, c.nonce(index), sealed, c.additionalData(index, final))
+}
+
+func (c *chunkCipher) nonce(index uint64) []byte {
+	nonce := append([]byte(nil), c.baseNonce...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(index >> (8 * i))
+	}
+	return nonce
+}
+
+func (c *chunkCipher) additionalData(index uint64, final bool) []byte {
+	additionalData := binary.BigEndian.AppendUint64(append([]byte(nil), c.object...), index)
+	if final {
+		return append(additionalData, 1)
+	}
+	return append(additionalData, 0)
+}
+
+// sealingReader reads content from src and returns it sealed in chunks.
+type sealingReader struct {
+	src    *bufio.Reader
+	chunks *chunkCipher
+	index  uint64
+	plain  []byte
+	sealed []byte
+	out    []byte
+	done   bool
+}
+
+func newSealingReader(src io.Reader, chunks *chunkCipher) *sealingReader {
+	return &sealingReader{
+		src:    bufio.NewReader(src),
+		chunks: chunks,
+		plain:  make([]byte, encryptedChunkSize),
+		sealed: make([]byte, 0, encryptedChunkSize+gcmOverhead),
+	}
+}
+
+func (r *sealingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *sealingReader) next() error {
+	n, err := io.ReadFull(r.src, r.plain)
+	final := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !final {
+		return err
+	}
+	if !final {
+		// A full chunk is the last one when nothing follows it
+		if _, err := r.src.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+	r.out = r.chunks.seal(r.sealed[:0], r.index, r.plain[:n], final)
+	r.index++
+	r.done = final
+	return nil
+}
+
+// openingReader reads sealed chunks from src and returns their content. An object cut off
+// before its final chunk fails to decrypt.
+type openingReader struct {
+	src    *bufio.Reader
+	body   io.Closer
+	chunks *chunkCipher
+	index  uint64
+	bucket string
+	key    string
+	sealed []byte
+	plain  []byte
+	out    []byte
+	done   bool
+	err    error
+}
+
+func (r *openingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.next()
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *openingReader) next() error {
+	n, err := io.ReadFull(r.src, r.sealed)
+	final := err == io.ErrUnexpectedEOF
+	switch {
+	case err == io.EOF:
+		return fmt.Errorf("%s/%s: encrypted object is truncated", r.bucket, r.key)
+	case err != nil && !final:
+		return err
+	case !final:
+		if _, err := r.src.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+	plain, err := r.chunks.open(r.plain[:0], r.index, r.sealed[:n], final)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s/%s: %w", r.bucket, r.key, err)
+	}
+	r.plain = plain
+	r.out = plain
+	r.index++
+	r.done = final
+	return nil
+}
+
+func (r *openingReader) Close() error {
+	return r.body.Close()
+}
+
+// sealGCM encrypts plaintext with AES-GCM and prepends the random nonce to the result.
+func sealGCM(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func openGCM(key, sealed, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+var (
+	_ StreamStore = (*EncryptedStore)(nil)
+	_ StreamStore = (*ReplicatedStore)(nil)
+)
+
+func randomContent(t *testing.T, size int) []byte {
+	t.Helper()
+	content := make([]byte, size)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestEncryptedStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	inner := newTestFSStore(t)
+	store := NewEncryptedStore(inner, newTestKeyRing(t))
+
+	for _, size := range []int{0, 1, encryptedChunkSize, encryptedChunkSize + 1, 3 * encryptedChunkSize} {
+		content := randomContent(t, size)
+		if err := store.Put(ctx, bytes.NewBuffer(content), "projects", "p1.tar"); err != nil {
+			t.Fatalf("Put %d bytes: %v", size, err)
+		}
+		got, err := store.Get(ctx, "projects", "p1.tar")
+		if err != nil {
+			t.Fatalf("Get %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got.Bytes(), content) {
+			t.Errorf("Get of %d bytes returned other content", size)
+		}
+		sealed, err := inner.Get(ctx, "projects", "p1.tar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size >= 16 && bytes.Contains(sealed.Bytes(), content) {
+			t.Errorf("content of %d bytes is stored in plaintext", size)
+		}
+		if want := int64(len(envelopeHeader(t, sealed.Bytes()))) + sealedContentSize(int64(size)); int64(sealed.Len()) != want {
+			t.Errorf("sealed size of %d bytes = %d, want %d", size, sealed.Len(), want)
+		}
+	}
+}
+
+func envelopeHeader(t *testing.T, sealed []byte) []byte {
+	t.Helper()
+	r := bytes.NewReader(sealed)
+	if _, err := readEnvelope(r); err != nil {
+		t.Fatal(err)
+	}
+	return sealed[:len(sealed)-r.Len()]
+}
+
+func TestEncryptedStoreStreamsRanges(t *testing.T) {
+	ctx := context.Background()
+	store := NewEncryptedStore(newTestFSStore(t), newTestKeyRing(t))
+	content := randomContent(t, 3*encryptedChunkSize+100)
+	if err := store.PutStream(ctx, io.MultiReader(bytes.NewReader(content)), -1, "projects", "p1.tar"); err != nil {
+		t.Fatalf("PutStream: %v", err)
+	}
+
+	tests := []struct{ offset, length int64 }{
+		{0, -1},
+		{10, 20},
+		{encryptedChunkSize - 5, 10},
+		{2*encryptedChunkSize + 7, -1},
+		{3 * encryptedChunkSize, 100},
+	}
+	for _, tt := range tests {
+		body, err := store.OpenRange(ctx, "projects", "p1.tar", tt.offset, tt.length)
+		if err != nil {
+			t.Fatalf("OpenRange(%d, %d): %v", tt.offset, tt.length, err)
+		}
+		got, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			t.Fatalf("reading range (%d, %d): %v", tt.offset, tt.length, err)
+		}
+		want := content[tt.offset:]
+		if tt.length >= 0 {
+			want = want[:tt.length]
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("OpenRange(%d, %d) returned %d bytes of other content", tt.offset, tt.length, len(got))
+		}
+	}
+}
+
+func TestEncryptedStoreBindsObjectsToTheirKey(t *testing.T) {
+	ctx := context.Background()
+	inner := newTestFSStore(t)
+	store := NewEncryptedStore(inner, newTestKeyRing(t))
+	if err := store.Put(ctx, bytes.NewBufferString("project of alice"), "projects", "alice.tar"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Moving the ciphertext under another key makes it unreadable, copying through the store does not
+	if err := inner.Copy(ctx, "projects", "alice.tar", "projects", "mallory.tar"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "projects", "mallory.tar"); err == nil {
+		t.Error("ciphertext moved to another key was decrypted")
+	}
+	if err := store.Copy(ctx, "projects", "alice.tar", "projects", "copy.tar"); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	if got, err := store.Get(ctx, "projects", "copy.tar"); err != nil || got.String() != "project of alice" {
+		t.Errorf("Get of copy = %q, %v", got, err)
+	}
+}
+
+func TestEncryptedStoreDetectsTruncation(t *testing.T) {
+	ctx := context.Background()
+	inner := newTestFSStore(t)
+	store := NewEncryptedStore(inner, newTestKeyRing(t))
+	if err := store.Put(ctx, bytes.NewBuffer(randomContent(t, 2*encryptedChunkSize+10)), "projects", "p1.tar"); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := inner.Get(ctx, "projects", "p1.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cutting off the last chunk leaves only complete chunks, none of them sealed as the last one
+	truncated := sealed.Bytes()[:sealed.Len()-10-gcmOverhead]
+	if err := inner.Put(ctx, bytes.NewBuffer(truncated), "projects", "p1.tar"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "projects", "p1.tar"); err == nil {
+		t.Error("truncated object was decrypted")
+	}
+}
+
+func TestEncryptedStorePlaintextFallback(t *testing.T) {
+	ctx := context.Background()
+	inner := newTestFSStore(t)
+	if err := inner.Put(ctx, bytes.NewBufferString("written before encryption"), "projects", "old.tar"); err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewEncryptedStore(inner, newTestKeyRing(t))
+	if _, err := store.Get(ctx, "projects", "old.tar"); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("Get of plaintext object error = %v, want ErrNotEncrypted", err)
+	}
+	store.WithPlaintextFallback(true)
+	if got, err := store.Get(ctx, "projects", "old.tar"); err != nil || got.String() != "written before encryption" {
+		t.Errorf("Get with plaintext fallback = %q, %v", got, err)
+	}
+
+	// Rewrap encrypts the plaintext object, which then no longer needs the fallback
+	if rewritten, err := store.Rewrap(ctx, "projects", "old.tar"); err != nil || !rewritten {
+		t.Fatalf("Rewrap = %v, %v", rewritten, err)
+	}
+	store.WithPlaintextFallback(false)
+	if got, err := store.Get(ctx, "projects", "old.tar"); err != nil || got.String() != "written before encryption" {
+		t.Errorf("Get after Rewrap = %q, %v", got, err)
+	}
+}
+
+func TestEncryptedStoreRejectsUnchunkedObjects(t *testing.T) {
+	ctx := context.Background()
+	inner := newTestFSStore(t)
+	store := NewEncryptedStore(inner, newTestKeyRing(t))
+
+	dataKey := randomContent(t, dataKeySize)
+	envelope, err := store.wrapDataKey(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope.version = 1
+	ciphertext, err := sealGCM(dataKey, []byte("sealed in one piece"), []byte(encryptedMagic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inner.Put(ctx, bytes.NewBuffer(append(envelope.marshal(), ciphertext...)), "projects", "v1.tar"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Version 1 objects were not bound to their bucket and key, so they could be swapped between keys
+	if got, err := store.Get(ctx, "projects", "v1.tar"); err == nil {
+		t.Errorf("Get of version 1 object = %q, want an error", got)
+	}
+}
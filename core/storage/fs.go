@@ -0,0 +1,409 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tmpDirName is the directory under the store root that holds in-flight writes.
+	// It lives on the same filesystem as the buckets so the final rename is atomic.
+	tmpDirName = ".tmp"
+	// checksumDirName mirrors the bucket layout with one file per object holding its SHA-256.
+	checksumDirName = ".sha256"
+)
+
+// FSStore implements the Store interface on top of a local directory.
+// Every bucket is a directory directly below root and keys map to file paths
+// inside it, which makes it suitable for development machines, CI runs and
+// single node deployments where no object store is available.
+type FSStore struct {
+	root string
+	mu   sync.RWMutex
+}
+
+// NewFSStore creates an FSStore rooted at the given directory, creating it if needed.
+func NewFSStore(root string) (*FSStore, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(absRoot, tmpDirName), 0o755); err != nil {
+		return nil, err
+	}
+	return &FSStore{root: absRoot}, nil
+}
+
+func (fsStore *FSStore) Get(ctx context.Context, bucket string, key string) (*bytes.Buffer, error) {
+	objectPath, checksumPath, err := fsStore.objectPath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	fsStore.mu.RLock()
+	defer fsStore.mu.RUnlock()
+
+	data, err := os.ReadFile(objectPath)
+	if err != nil {
+		return nil, fsError(err)
+	}
+	if expected := readChecksum(checksumPath); expected != "" {
+		if actual := ChecksumSHA256(data); actual != expected {
+			return nil, &IntegrityError{Bucket: bucket, Key: key, Expected: expected, Actual: actual}
+		}
+	}
+	return bytes.NewBuffer(data), nil
+}
+
+func (fsStore *FSStore) Put(ctx context.Context, fileData *bytes.Buffer, bucket, key string) error {
+	objectPath, checksumPath, err := fsStore.objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	return fsStore.write(bytes.NewReader(fileData.Bytes()), objectPath, checksumPath)
+}
+
+// Open returns a reader for the object. Writers replace objects by renaming,
+// so an open reader keeps seeing the version that existed when it was opened.
+func (fsStore *FSStore) Open(ctx context.Context, bucket string, key string) (io.ReadCloser, error) {
+	return fsStore.OpenRange(ctx, bucket, key, 0, -1)
+}
+
+func (fsStore *FSStore) OpenRange(ctx context.Context, bucket string, key string, offset int64, length int64) (io.ReadCloser, error) {
+	objectPath, checksumPath, err := fsStore.objectPath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	fsStore.mu.RLock()
+	file, err := os.Open(objectPath)
+	checksum := readChecksum(checksumPath)
+	fsStore.mu.RUnlock()
+	if err != nil {
+		return nil, fsError(err)
+	}
+
+	if offset > 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if length < 0 {
+		if offset > 0 {
+			return file, nil
+		}
+		return NewVerifyingReader(file, bucket, key, checksum), nil
+	}
+	return &limitedReadCloser{Reader: io.LimitReader(file, length), Closer: file}, nil
+}
+
+func (fsStore *FSStore) PutStream(ctx context.Context, body io.Reader, size int64, bucket string, key string) error {
+	objectPath, checksumPath, err := fsStore.objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	return fsStore.write(body, objectPath, checksumPath)
+}
+
+func (fsStore *FSStore) List(ctx context.Context, bucket string, prefix string, opts ListOptions) (ListResult, error) {
+	if err := validateBucket(bucket); err != nil {
+		return ListResult{}, err
+	}
+	maxKeys := opts.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = DefaultListMaxKeys
+	}
+
+	fsStore.mu.RLock()
+	objects, err := fsStore.walkBucket(bucket, prefix)
+	fsStore.mu.RUnlock()
+	if err != nil {
+		return ListResult{}, err
+	}
+
+	// The continuation token is the last key of the previous page
+	start := 0
+	if opts.ContinuationToken != "" {
+		start = sort.Search(len(objects), func(i int) bool {
+			return objects[i].Key > opts.ContinuationToken
+		})
+	}
+	objects = objects[start:]
+
+	result := ListResult{Objects: objects}
+	if len(objects) > maxKeys {
+		result.Objects = objects[:maxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = result.Objects[maxKeys-1].Key
+	}
+	return result, nil
+}
+
+// walkBucket returns every object in bucket whose key starts with prefix, sorted by key.
+func (fsStore *FSStore) walkBucket(bucket, prefix string) ([]ObjectInfo, error) {
+	bucketPath := filepath.Join(fsStore.root, bucket)
+
+	// Only walk the directory that can contain matching keys
+	walkRoot := bucketPath
+	if dir := path.Dir(prefix); strings.Contains(prefix, "/") && dir != "." {
+		cleanDir, err := cleanObjectKey(dir)
+		if err != nil {
+			return nil, nil
+		}
+		walkRoot = filepath.Join(bucketPath, filepath.FromSlash(cleanDir))
+	}
+
+	var objects []ObjectInfo
+	err := filepath.WalkDir(walkRoot, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(bucketPath, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relPath)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return fsError(err)
+		}
+		objects = append(objects, fileObjectInfo(key, info))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+func (fsStore *FSStore) Stat(ctx context.Context, bucket string, key string) (ObjectInfo, error) {
+	objectPath, checksumPath, err := fsStore.objectPath(bucket, key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	fsStore.mu.RLock()
+	defer fsStore.mu.RUnlock()
+
+	info, err := os.Stat(objectPath)
+	if err != nil {
+		return ObjectInfo{}, fsError(err)
+	}
+	if info.IsDir() {
+		return ObjectInfo{}, ErrObjectNotFound
+	}
+	cleanKey, _ := cleanObjectKey(key)
+	objectInfo := fileObjectInfo(cleanKey, info)
+	objectInfo.SHA256 = readChecksum(checksumPath)
+	return objectInfo, nil
+}
+
+func (fsStore *FSStore) Delete(ctx context.Context, bucket string, key string) error {
+	objectPath, checksumPath, err := fsStore.objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	fsStore.mu.Lock()
+	defer fsStore.mu.Unlock()
+
+	if err := os.Remove(objectPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(checksumPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	pruneEmptyDirs(filepath.Dir(objectPath), filepath.Join(fsStore.root, bucket))
+	pruneEmptyDirs(filepath.Dir(checksumPath), filepath.Join(fsStore.root, checksumDirName, bucket))
+	return nil
+}
+
+// pruneEmptyDirs removes dir and its parents while they are empty, stopping at stop.
+func pruneEmptyDirs(dir, stop string) {
+	for ; dir != stop && strings.HasPrefix(dir, stop); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
+}
+
+func (fsStore *FSStore) Copy(ctx context.Context, srcBucket string, srcKey string, dstBucket string, dstKey string) error {
+	dstPath, dstChecksumPath, err := fsStore.objectPath(dstBucket, dstKey)
+	if err != nil {
+		return err
+	}
+	if srcPath, _, err := fsStore.objectPath(srcBucket, srcKey); err == nil && srcPath == dstPath {
+		return fsStore.touch(dstPath)
+	}
+	// The source is verified while it is read, so a corrupted object is not copied
+	src, err := fsStore.Open(ctx, srcBucket, srcKey)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return fsStore.write(src, dstPath, dstChecksumPath)
+}
+
+// touch sets the modification time of an object to now without rewriting it.
+func (fsStore *FSStore) touch(objectPath string) error {
+	fsStore.mu.Lock()
+	defer fsStore.mu.Unlock()
+	info, err := os.Stat(objectPath)
+	if err != nil {
+		return fsError(err)
+	}
+	if info.IsDir() {
+		return ErrObjectNotFound
+	}
+	now := time.Now()
+	return os.Chtimes(objectPath, now, now)
+}
+
+func (fsStore *FSStore) write(body io.Reader, objectPath string, checksumPath string) error {
+	// Write into a temp file first so readers never observe a partially written object
+	tmpPath, checksum, err := fsStore.writeTemp(body)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	tmpChecksumPath, _, err := fsStore.writeTemp(strings.NewReader(checksum))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpChecksumPath)
+
+	fsStore.mu.Lock()
+	defer fsStore.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0o755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(checksumPath), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, objectPath); err != nil {
+		return err
+	}
+	return os.Rename(tmpChecksumPath, checksumPath)
+}
+
+// writeTemp copies body into a new temp file and returns its path and SHA-256.
+func (fsStore *FSStore) writeTemp(body io.Reader) (string, string, error) {
+	tmpFile, err := os.CreateTemp(filepath.Join(fsStore.root, tmpDirName), "object-*")
+	if err != nil {
+		return "", "", err
+	}
+	tmpPath := tmpFile.Name()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmpFile, hash), body); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return "", "", err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpPath)
+		return "", "", err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return "", "", err
+	}
+	return tmpPath, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// objectPath resolves bucket and key to the object path and its checksum path inside the store root.
+// Keys are treated as slash separated paths and rejected if they would escape the bucket.
+func (fsStore *FSStore) objectPath(bucket, key string) (string, string, error) {
+	if err := validateBucket(bucket); err != nil {
+		return "", "", err
+	}
+	cleanKey, err := cleanObjectKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	objectPath := filepath.Join(fsStore.root, bucket, filepath.FromSlash(cleanKey))
+	checksumPath := filepath.Join(fsStore.root, checksumDirName, bucket, filepath.FromSlash(cleanKey))
+	return objectPath, checksumPath, nil
+}
+
+// readChecksum returns the recorded SHA-256 of an object, or an empty string if there is none.
+func readChecksum(checksumPath string) string {
+	checksum, err := os.ReadFile(checksumPath)
+	if err != nil {
+		return ""
+	}
+	return string(checksum)
+}
+
+func validateBucket(bucket string) error {
+	if bucket == "" || strings.HasPrefix(bucket, ".") || strings.ContainsAny(bucket, `/\`+"\x00") {
+		return ErrInvalidBucket
+	}
+	return nil
+}
+
+func cleanObjectKey(key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, `\`+"\x00") {
+		return "", ErrInvalidKey
+	}
+	cleanKey := path.Clean("/" + key)[1:]
+	if cleanKey == "" || cleanKey != strings.TrimSuffix(strings.TrimPrefix(key, "/"), "/") {
+		// Keys containing ".." or "." segments are ambiguous, reject them instead of guessing
+		return "", ErrInvalidKey
+	}
+	return cleanKey, nil
+}
+
+// fileObjectInfo builds ObjectInfo from a file. The filesystem has no content hash to offer cheaply,
+// so the ETag is derived from the modification time and size, which change on every write.
+func fileObjectInfo(key string, info fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          key,
+		Size:         info.Size(),
+		ETag:         strconv.FormatInt(info.ModTime().UnixNano(), 16) + "-" + strconv.FormatInt(info.Size(), 16),
+		LastModified: info.ModTime(),
+	}
+}
+
+func fsError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrObjectNotFound
+	}
+	return err
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFSStoreRejectsPathsOutsideTheBucket(t *testing.T) {
+	ctx := context.Background()
+	store := newTestFSStore(t)
+	if err := store.Put(ctx, bytes.NewBufferString("secret"), "other", "secret.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		bucket string
+		key    string
+		want   error
+	}{
+		{"empty bucket", "", "index.html", ErrInvalidBucket},
+		{"bucket with a slash", "projects/../other", "secret.txt", ErrInvalidBucket},
+		{"bucket with a backslash", `projects\..`, "secret.txt", ErrInvalidBucket},
+		{"dot bucket", "..", "other/secret.txt", ErrInvalidBucket},
+		{"temp directory", tmpDirName, "object", ErrInvalidBucket},
+		{"checksum directory", checksumDirName, "other/secret.txt", ErrInvalidBucket},
+		{"empty key", "projects", "", ErrInvalidKey},
+		{"parent segment", "projects", "../other/secret.txt", ErrInvalidKey},
+		{"nested parent segment", "projects", "a/../../other/secret.txt", ErrInvalidKey},
+		{"dot segment", "projects", "a/./index.html", ErrInvalidKey},
+		{"double slash", "projects", "a//index.html", ErrInvalidKey},
+		{"backslash", "projects", `..\other\secret.txt`, ErrInvalidKey},
+		{"nul byte", "projects", "index.html\x00.png", ErrInvalidKey},
+		{"root key", "projects", "/", ErrInvalidKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := store.Get(ctx, tt.bucket, tt.key); !errors.Is(err, tt.want) {
+				t.Errorf("Get error = %v, want %v", err, tt.want)
+			}
+			if err := store.Put(ctx, bytes.NewBufferString("overwritten"), tt.bucket, tt.key); !errors.Is(err, tt.want) {
+				t.Errorf("Put error = %v, want %v", err, tt.want)
+			}
+			if err := store.Delete(ctx, tt.bucket, tt.key); !errors.Is(err, tt.want) {
+				t.Errorf("Delete error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+	if got, err := store.Get(ctx, "other", "secret.txt"); err != nil || got.String() != "secret" {
+		t.Errorf("object outside the bucket = %q, %v", got, err)
+	}
+}
+
+func TestCleanObjectKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"index.html", "index.html"},
+		{"/index.html", "index.html"},
+		{"assets/app.js", "assets/app.js"},
+		{"assets/", "assets"},
+		{"1/project.tar", "1/project.tar"},
+	}
+	for _, tt := range tests {
+		if got, err := cleanObjectKey(tt.key); err != nil || got != tt.want {
+			t.Errorf("cleanObjectKey(%q) = %q, %v, want %q", tt.key, got, err, tt.want)
+		}
+	}
+}
+
+// failingReader returns data and then fails, like an upload cut off halfway.
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestFSStoreWritesAtomically(t *testing.T) {
+	ctx := context.Background()
+	store := newTestFSStore(t)
+	if err := store.Put(ctx, bytes.NewBufferString("v1"), "projects", "p1.tar"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := store.PutStream(ctx, &failingReader{data: []byte("v2, cut off")}, -1, "projects", "p1.tar")
+	if err == nil {
+		t.Fatal("PutStream of a failing body succeeded")
+	}
+	if got, err := store.Get(ctx, "projects", "p1.tar"); err != nil || got.String() != "v1" {
+		t.Errorf("object after failed write = %q, %v, want the previous version", got, err)
+	}
+	if info, err := store.Stat(ctx, "projects", "p1.tar"); err != nil || info.SHA256 != ChecksumSHA256([]byte("v1")) {
+		t.Errorf("Stat after failed write = %+v, %v, want the checksum of the previous version", info, err)
+	}
+	if entries, err := os.ReadDir(filepath.Join(store.root, tmpDirName)); err != nil || len(entries) != 0 {
+		t.Errorf("temp files left after failed write: %v, %v", entries, err)
+	}
+
+	// An open reader keeps the version it opened while the object is replaced
+	body, err := store.Open(ctx, "projects", "p1.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	if err := store.Put(ctx, bytes.NewBufferString("v2"), "projects", "p1.tar"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(body); err != nil || string(got) != "v1" {
+		t.Errorf("reader opened before the write read %q, %v", got, err)
+	}
+}
+
+func TestFSStoreListPagesThroughPrefix(t *testing.T) {
+	ctx := context.Background()
+	store := newTestFSStore(t)
+	for _, key := range []string{"a/1", "a/2", "a/3", "a/sub/4", "ab/5", "b/6"} {
+		if err := store.Put(ctx, bytes.NewBufferString(key), "artifacts", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		prefix  string
+		maxKeys int
+		want    []string
+	}{
+		{"", 0, []string{"a/1", "a/2", "a/3", "a/sub/4", "ab/5", "b/6"}},
+		{"a/", 2, []string{"a/1", "a/2", "a/3", "a/sub/4"}},
+		{"a", 4, []string{"a/1", "a/2", "a/3", "a/sub/4", "ab/5"}},
+		{"a/sub/", 1, []string{"a/sub/4"}},
+		{"a/s", 1, []string{"a/sub/4"}},
+		{"c/", 1, nil},
+		{"../", 1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			var keys []string
+			pages := 0
+			opts := ListOptions{MaxKeys: tt.maxKeys}
+			for {
+				result, err := store.List(ctx, "artifacts", tt.prefix, opts)
+				if err != nil {
+					t.Fatalf("List: %v", err)
+				}
+				pages++
+				if tt.maxKeys > 0 && len(result.Objects) > tt.maxKeys {
+					t.Errorf("page of %d objects, want at most %d", len(result.Objects), tt.maxKeys)
+				}
+				for _, object := range result.Objects {
+					keys = append(keys, object.Key)
+				}
+				if !result.IsTruncated {
+					break
+				}
+				opts.ContinuationToken = result.NextContinuationToken
+			}
+			if strings.Join(keys, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("listed %v in %d pages, want %v", keys, pages, tt.want)
+			}
+		})
+	}
+}
+
+func TestFSStoreDeletePrunesEmptyDirectories(t *testing.T) {
+	ctx := context.Background()
+	store := newTestFSStore(t)
+	for _, key := range []string{"1/assets/app.js", "1/index.html"} {
+		if err := store.Put(ctx, bytes.NewBufferString(key), "artifacts", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.Delete(ctx, "artifacts", "1/assets/app.js"); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{
+		filepath.Join(store.root, "artifacts", "1", "assets"),
+		filepath.Join(store.root, checksumDirName, "artifacts", "1", "assets"),
+	} {
+		if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("empty directory %s was kept: %v", dir, err)
+		}
+	}
+	if !objectExists(store, "artifacts", "1/index.html") {
+		t.Error("sibling object was deleted")
+	}
+
+	if err := store.Delete(ctx, "artifacts", "1/index.html"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(store.root, "artifacts", "1")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("empty directory of the deployment was kept: %v", err)
+	}
+	// The bucket itself stays
+	if _, err := os.Stat(filepath.Join(store.root, "artifacts")); err != nil {
+		t.Errorf("bucket directory was removed: %v", err)
+	}
+	if err := store.Delete(ctx, "artifacts", "1/index.html"); err != nil {
+		t.Errorf("Delete of a missing object: %v", err)
+	}
+}
+
+func TestFSStoreCopyKeepsChecksum(t *testing.T) {
+	ctx := context.Background()
+	store := newTestFSStore(t)
+	content := randomContent(t, 1024)
+	if err := store.Put(ctx, bytes.NewBuffer(content), "projects", "p1.tar"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Copy(ctx, "projects", "p1.tar", "archive", "1/p1.tar"); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	info, err := store.Stat(ctx, "archive", "1/p1.tar")
+	if err != nil || info.SHA256 != ChecksumSHA256(content) || info.Size != int64(len(content)) {
+		t.Errorf("Stat of copy = %+v, %v, want the size and checksum of the source", info, err)
+	}
+	sidecar, err := os.ReadFile(filepath.Join(store.root, checksumDirName, "archive", "1", "p1.tar"))
+	if err != nil || string(sidecar) != ChecksumSHA256(content) {
+		t.Errorf("checksum sidecar of copy = %q, %v", sidecar, err)
+	}
+
+	// A corrupted source fails its checksum and is not copied
+	objectPath, _, _ := store.objectPath("projects", "p1.tar")
+	if err := os.WriteFile(objectPath, []byte("corrupted"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var integrityErr *IntegrityError
+	if err := store.Copy(ctx, "projects", "p1.tar", "archive", "2/p1.tar"); !errors.As(err, &integrityErr) {
+		t.Errorf("Copy of corrupted object error = %v, want an IntegrityError", err)
+	}
+	if objectExists(store, "archive", "2/p1.tar") {
+		t.Error("corrupted object was copied")
+	}
+	if err := store.Copy(ctx, "projects", "missing.tar", "archive", "3/p1.tar"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Copy of missing object error = %v, want ErrObjectNotFound", err)
+	}
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// MetadataSHA256 is the object metadata key holding the hex encoded SHA-256 of the object.
+const MetadataSHA256 = "Sha256"
+
+// IntegrityError is returned when the content of an object does not match its recorded checksum.
+type IntegrityError struct {
+	Bucket   string
+	Key      string
+	Expected string
+	Actual   string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("integrity check failed for %s/%s: expected sha256 %s, got %s", e.Bucket, e.Key, e.Expected, e.Actual)
+}
+
+// ChecksumSHA256 returns the hex encoded SHA-256 of data.
+func ChecksumSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyChecksum compares the checksum recorded for an object with the expected one without
+// downloading it. Objects stored without a checksum, such as every object behind an EncryptedStore,
+// are read and hashed instead.
+func VerifyChecksum(ctx context.Context, store Store, bucket string, key string, expected string) error {
+	if expected == "" {
+		return fmt.Errorf("no expected checksum given for %s/%s", bucket, key)
+	}
+	info, err := store.Stat(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	actual := info.SHA256
+	if actual == "" {
+		if actual, err = hashObject(ctx, store, bucket, key); err != nil {
+			return err
+		}
+	}
+	if !strings.EqualFold(actual, expected) {
+		return &IntegrityError{Bucket: bucket, Key: key, Expected: expected, Actual: actual}
+	}
+	return nil
+}
+
+// hashObject returns the hex encoded SHA-256 of the content of an object, streaming it when the
+// store supports it.
+func hashObject(ctx context.Context, store Store, bucket string, key string) (string, error) {
+	streamStore, ok := store.(StreamStore)
+	if !ok {
+		data, err := store.Get(ctx, bucket, key)
+		if err != nil {
+			return "", err
+		}
+		return ChecksumSHA256(data.Bytes()), nil
+	}
+	body, err := streamStore.Open(ctx, bucket, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// NewVerifyingReader wraps body so that reaching the end of it checks the content against
+// the expected checksum. A mismatch is returned as an *IntegrityError in place of io.EOF.
+// An empty expected checksum disables verification.
+func NewVerifyingReader(body io.ReadCloser, bucket string, key string, expected string) io.ReadCloser {
+	if expected == "" {
+		return body
+	}
+	return &verifyingReader{
+		body:     body,
+		hash:     sha256.New(),
+		bucket:   bucket,
+		key:      key,
+		expected: strings.ToLower(expected),
+	}
+}
+
+type verifyingReader struct {
+	body     io.ReadCloser
+	hash     hash.Hash
+	bucket   string
+	key      string
+	expected string
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF {
+		if actual := hex.EncodeToString(r.hash.Sum(nil)); actual != r.expected {
+			return n, &IntegrityError{Bucket: r.bucket, Key: r.key, Expected: r.expected, Actual: actual}
+		}
+	}
+	return n, err
+}
+
+func (r *verifyingReader) Close() error {
+	return r.body.Close()
+}
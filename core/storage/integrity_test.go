@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func newTestKeyRing(t *testing.T) *KeyRing {
+	t.Helper()
+	keys, err := NewKeyRing("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func newTestFSStore(t *testing.T) *FSStore {
+	t.Helper()
+	store, err := NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestVerifyChecksumHashesObjectsWithoutRecordedChecksum(t *testing.T) {
+	ctx := context.Background()
+	store := NewEncryptedStore(newTestFSStore(t), newTestKeyRing(t))
+	content := []byte("project tarball")
+	if err := store.Put(ctx, bytes.NewBuffer(content), "projects", "p1.tar"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := store.Stat(ctx, "projects", "p1.tar"); err != nil || info.SHA256 != "" {
+		t.Fatalf("Stat = %+v, %v, want no checksum", info, err)
+	}
+
+	if err := VerifyChecksum(ctx, store, "projects", "p1.tar", ChecksumSHA256(content)); err != nil {
+		t.Errorf("VerifyChecksum of intact object: %v", err)
+	}
+	var integrityErr *IntegrityError
+	err := VerifyChecksum(ctx, store, "projects", "p1.tar", ChecksumSHA256([]byte("another upload")))
+	if !errors.As(err, &integrityErr) {
+		t.Errorf("VerifyChecksum error = %v, want an IntegrityError", err)
+	}
+	if err := VerifyChecksum(ctx, store, "projects", "p1.tar", ""); err == nil {
+		t.Error("VerifyChecksum without an expected checksum passed")
+	}
+}
+
+func TestVerifyChecksumUsesRecordedChecksum(t *testing.T) {
+	ctx := context.Background()
+	store := newTestFSStore(t)
+	if err := store.Put(ctx, bytes.NewBufferString("project tarball"), "projects", "p1.tar"); err != nil {
+		t.Fatal(err)
+	}
+	var integrityErr *IntegrityError
+	err := VerifyChecksum(ctx, store, "projects", "p1.tar", ChecksumSHA256([]byte("another upload")))
+	if !errors.As(err, &integrityErr) {
+		t.Errorf("VerifyChecksum error = %v, want an IntegrityError", err)
+	}
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MigrateOptions controls a Migrate run.
+type MigrateOptions struct {
+	// Prefix limits the migration to keys starting with it
+	Prefix string
+	// CheckpointPath records the last migrated key so an interrupted run can resume after it
+	CheckpointPath string
+	// Verify compares size and checksum of every copied object with its source
+	Verify bool
+}
+
+// MigrateReport summarises a Migrate run.
+type MigrateReport struct {
+	Copied  int
+	Skipped int
+	Bytes   int64
+}
+
+// Migrate copies every object of srcBucket in src to dstBucket in dst. Objects already present
+// in dst with the same size and checksum are skipped, which together with the checkpoint makes
+// it safe to run again after a failure.
+func Migrate(ctx context.Context, src Store, srcBucket string, dst Store, dstBucket string, opts MigrateOptions) (MigrateReport, error) {
+	report := MigrateReport{}
+	checkpoint, err := readCheckpoint(opts.CheckpointPath)
+	if err != nil {
+		return report, err
+	}
+
+	err = WalkPrefix(ctx, src, srcBucket, opts.Prefix, func(object ObjectInfo) error {
+		// Listings are ordered by key, so everything up to the checkpoint was handled by a previous run
+		if checkpoint != "" && object.Key <= checkpoint {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		copied, err := migrateObject(ctx, src, srcBucket, dst, dstBucket, object, opts.Verify)
+		if err != nil {
+			return fmt.Errorf("failed to migrate %s: %w", object.Key, err)
+		}
+		if copied {
+			report.Copied++
+			report.Bytes += object.Size
+		} else {
+			report.Skipped++
+		}
+		return writeCheckpoint(opts.CheckpointPath, object.Key)
+	})
+	return report, err
+}
+
+func migrateObject(ctx context.Context, src Store, srcBucket string, dst Store, dstBucket string, object ObjectInfo, verify bool) (bool, error) {
+	srcInfo, err := src.Stat(ctx, srcBucket, object.Key)
+	if err != nil {
+		return false, err
+	}
+	dstInfo, err := dst.Stat(ctx, dstBucket, object.Key)
+	if err == nil && sameObject(srcInfo, dstInfo) {
+		return false, nil
+	}
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return false, err
+	}
+
+	if err := copyObject(ctx, src, srcBucket, dst, dstBucket, object.Key, srcInfo.Size); err != nil {
+		return false, err
+	}
+	if !verify {
+		return true, nil
+	}
+
+	dstInfo, err = dst.Stat(ctx, dstBucket, object.Key)
+	if err != nil {
+		return false, err
+	}
+	if dstInfo.Size != srcInfo.Size {
+		return false, fmt.Errorf("size mismatch after copy: source %d bytes, destination %d bytes", srcInfo.Size, dstInfo.Size)
+	}
+	if srcInfo.SHA256 != "" && dstInfo.SHA256 != "" && !strings.EqualFold(srcInfo.SHA256, dstInfo.SHA256) {
+		return false, &IntegrityError{Bucket: dstBucket, Key: object.Key, Expected: srcInfo.SHA256, Actual: dstInfo.SHA256}
+	}
+	return true, nil
+}
+
+// copyObject streams the object when both stores support it and buffers it otherwise.
+func copyObject(ctx context.Context, src Store, srcBucket string, dst Store, dstBucket string, key string, size int64) error {
+	body, err := openObjectRange(ctx, src, srcBucket, key, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return putObject(ctx, dst, body, size, dstBucket, key)
+}
+
+// sameObject reports whether two objects can be considered identical without reading them.
+func sameObject(a, b ObjectInfo) bool {
+	if a.Size != b.Size {
+		return false
+	}
+	if a.SHA256 != "" && b.SHA256 != "" {
+		return strings.EqualFold(a.SHA256, b.SHA256)
+	}
+	return false
+}
+
+func readCheckpoint(checkpointPath string) (string, error) {
+	if checkpointPath == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(checkpointPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// writeCheckpoint replaces the checkpoint atomically so a crash never leaves it half written.
+func writeCheckpoint(checkpointPath string, key string) error {
+	if checkpointPath == "" {
+		return nil
+	}
+	return writeFileAtomic(checkpointPath, []byte(key+"\n"))
+}
+
+// writeFileAtomic replaces the file at path by renaming a fully written temporary file over it.
+func writeFileAtomic(path string, data []byte) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateCopiesAndSkipsUnchangedObjects(t *testing.T) {
+	ctx := context.Background()
+	src := newTestFSStore(t)
+	dst := newTestFSStore(t)
+	for i := 0; i < 5; i++ {
+		if err := src.Put(ctx, bytes.NewBufferString(fmt.Sprintf("object %d", i)), "projects", fmt.Sprintf("p%d.tar", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := Migrate(ctx, src, "projects", dst, "projects", MigrateOptions{Verify: true})
+	if err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if report.Copied != 5 || report.Skipped != 0 {
+		t.Errorf("first run = %+v, want 5 copied", report)
+	}
+	info, err := dst.Stat(ctx, "projects", "p3.tar")
+	if err != nil || info.SHA256 != ChecksumSHA256([]byte("object 3")) {
+		t.Errorf("migrated object = %+v, %v, want its checksum recorded", info, err)
+	}
+
+	report, err = Migrate(ctx, src, "projects", dst, "projects", MigrateOptions{Verify: true})
+	if err != nil {
+		t.Fatalf("second Migrate: %v", err)
+	}
+	if report.Copied != 0 || report.Skipped != 5 {
+		t.Errorf("second run = %+v, want 5 skipped", report)
+	}
+}
+
+func TestMigrateResumesAfterCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	src := newTestFSStore(t)
+	dst := newTestFSStore(t)
+	for _, key := range []string{"a.tar", "b.tar", "c.tar"} {
+		if err := src.Put(ctx, bytes.NewBufferString(key), "projects", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	if err := writeCheckpoint(checkpoint, "b.tar"); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Migrate(ctx, src, "projects", dst, "projects", MigrateOptions{CheckpointPath: checkpoint})
+	if err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if report.Copied != 1 || objectExists(dst, "projects", "a.tar") || !objectExists(dst, "projects", "c.tar") {
+		t.Errorf("resumed run = %+v, want only c.tar copied", report)
+	}
+	if key, err := readCheckpoint(checkpoint); err != nil || key != "c.tar" {
+		t.Errorf("checkpoint = %q, %v", key, err)
+	}
+}
+
+func TestMigrateIntoEncryptedStore(t *testing.T) {
+	ctx := context.Background()
+	src := newTestFSStore(t)
+	dst := NewEncryptedStore(newTestFSStore(t), newTestKeyRing(t))
+	content := randomContent(t, 2*encryptedChunkSize)
+	if err := src.Put(ctx, bytes.NewBuffer(content), "projects", "p1.tar"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Migrate(ctx, src, "projects", dst, "projects", MigrateOptions{}); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if got, err := dst.Get(ctx, "projects", "p1.tar"); err != nil || !bytes.Equal(got.Bytes(), content) {
+		t.Errorf("Get of migrated object: %v", err)
+	}
+}
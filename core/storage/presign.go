@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+var (
+	ErrPresignNotConfigured = errors.New("presigned urls are not configured for this store")
+	ErrInvalidSignature     = errors.New("invalid or expired signature")
+)
+
+// Presigner hands out time limited URLs, letting clients upload or download objects
+// without going through comet services. S3Store presigns its own URLs, PresignServer
+// signs and serves them for every other store.
+type Presigner interface {
+	PresignPut(ctx context.Context, bucket string, key string, expires time.Duration) (string, error)
+	PresignGet(ctx context.Context, bucket string, key string, expires time.Duration) (string, error)
+}
+
+func (s3Store S3Store) PresignPut(ctx context.Context, bucket string, key string, expires time.Duration) (string, error) {
+	req, _ := s3Store.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	req.SetContext(ctx)
+	return req.Presign(expires)
+}
+
+func (s3Store S3Store) PresignGet(ctx context.Context, bucket string, key string, expires time.Duration) (string, error) {
+	req, _ := s3Store.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	req.SetContext(ctx)
+	return req.Presign(expires)
+}
+
+// PresignServer hands out signed URLs for stores that cannot presign them themselves and serves
+// those URLs. Objects are read and written through store, so a store wrapped in an EncryptedStore
+// or a ReplicatedStore keeps encrypting and replicating uploads made with a presigned URL.
+// URLs point at baseURL and carry an HMAC-SHA256 signature made with secret.
+type PresignServer struct {
+	store   StreamStore
+	baseURL string
+	secret  []byte
+}
+
+func NewPresignServer(store StreamStore, baseURL string, secret []byte) *PresignServer {
+	return &PresignServer{
+		store:   store,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		secret:  secret,
+	}
+}
+
+func (ps *PresignServer) PresignPut(ctx context.Context, bucket string, key string, expires time.Duration) (string, error) {
+	return ps.presign(http.MethodPut, bucket, key, expires)
+}
+
+func (ps *PresignServer) PresignGet(ctx context.Context, bucket string, key string, expires time.Duration) (string, error) {
+	return ps.presign(http.MethodGet, bucket, key, expires)
+}
+
+func (ps *PresignServer) presign(method, bucket, key string, expires time.Duration) (string, error) {
+	if len(ps.secret) == 0 {
+		return "", ErrPresignNotConfigured
+	}
+	if err := validateBucket(bucket); err != nil {
+		return "", err
+	}
+	if _, err := cleanObjectKey(key); err != nil {
+		return "", err
+	}
+
+	expiresAt := strconv.FormatInt(time.Now().Add(expires).Unix(), 10)
+	query := url.Values{}
+	query.Set("expires", expiresAt)
+	query.Set("signature", ps.signature(method, bucket, key, expiresAt))
+	return ps.baseURL + "/" + url.PathEscape(bucket) + "/" + escapeKey(key) + "?" + query.Encode(), nil
+}
+
+// Handler serves the URLs created by PresignGet and PresignPut.
+// Request paths must have the form /<bucket>/<key>, so mount it with http.StripPrefix
+// when the base URL contains a path.
+func (ps *PresignServer) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodPut {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		bucket, key, found := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+		if !found {
+			http.Error(w, "Invalid object path", http.StatusBadRequest)
+			return
+		}
+		if err := ps.verifySignature(req.Method, bucket, key, req.URL.Query()); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		switch req.Method {
+		case http.MethodGet:
+			ps.serveObject(w, req, bucket, key)
+		case http.MethodPut:
+			if err := ps.store.PutStream(req.Context(), req.Body, req.ContentLength, bucket, key); err != nil {
+				http.Error(w, "Failed to store object", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+}
+
+// serveObject reads the whole object into a temporary file before answering, so an object that fails
+// its integrity check is reported as an error instead of being cut off after the headers were sent.
+func (ps *PresignServer) serveObject(w http.ResponseWriter, req *http.Request, bucket string, key string) {
+	info, err := ps.store.Stat(req.Context(), bucket, key)
+	if errors.Is(err, ErrObjectNotFound) {
+		http.Error(w, "Object not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to open object", http.StatusInternalServerError)
+		return
+	}
+	body, err := ps.store.Open(req.Context(), bucket, key)
+	if err != nil {
+		http.Error(w, "Failed to open object", http.StatusInternalServerError)
+		return
+	}
+	body = NewVerifyingReader(body, bucket, key, info.SHA256)
+	defer body.Close()
+
+	spooled, err := os.CreateTemp("", "comet-presign-*")
+	if err != nil {
+		http.Error(w, "Failed to read object", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(spooled.Name())
+	defer spooled.Close()
+	if _, err := io.Copy(spooled, body); err != nil {
+		var integrityErr *IntegrityError
+		if errors.As(err, &integrityErr) {
+			http.Error(w, "Object failed its integrity check", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "Failed to read object", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, req, "", info.LastModified, spooled)
+}
+
+func (ps *PresignServer) verifySignature(method, bucket, key string, query url.Values) error {
+	if len(ps.secret) == 0 {
+		return ErrPresignNotConfigured
+	}
+	expiresAt := query.Get("expires")
+	expiresUnix, err := strconv.ParseInt(expiresAt, 10, 64)
+	if err != nil || time.Now().Unix() > expiresUnix {
+		return ErrInvalidSignature
+	}
+	signature, err := hex.DecodeString(query.Get("signature"))
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	expected, _ := hex.DecodeString(ps.signature(method, bucket, key, expiresAt))
+	if !hmac.Equal(signature, expected) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (ps *PresignServer) signature(method, bucket, key, expiresAt string) string {
+	mac := hmac.New(sha256.New, ps.secret)
+	mac.Write([]byte(method + "\n" + bucket + "\n" + key + "\n" + expiresAt))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// escapeKey escapes every segment of a key while keeping the slashes between them.
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
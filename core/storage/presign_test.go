@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestPresignServer(t *testing.T, store StreamStore) *PresignServer {
+	t.Helper()
+	server := httptest.NewServer(nil)
+	t.Cleanup(server.Close)
+	presign := NewPresignServer(store, server.URL+"/storage", []byte("test secret"))
+	server.Config.Handler = http.StripPrefix("/storage", presign.Handler())
+	return presign
+}
+
+func doRequest(t *testing.T, method string, url string, body io.Reader) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+func TestPresignServerUploadsThroughTheWrappedStore(t *testing.T) {
+	ctx := context.Background()
+	inner := newTestFSStore(t)
+	store := NewEncryptedStore(inner, newTestKeyRing(t))
+	presign := newTestPresignServer(t, store)
+
+	putURL, err := presign.PresignPut(ctx, "projects", "p1/full.tar", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := doRequest(t, http.MethodPut, putURL, strings.NewReader("project archive")); status != http.StatusOK {
+		t.Fatalf("PUT = %d %s", status, body)
+	}
+	if sealed, err := inner.Get(ctx, "projects", "p1/full.tar"); err != nil || bytes.Contains(sealed.Bytes(), []byte("project archive")) {
+		t.Errorf("uploaded object was not encrypted: %v", err)
+	}
+
+	getURL, err := presign.PresignGet(ctx, "projects", "p1/full.tar", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, body := doRequest(t, http.MethodGet, getURL, nil); status != http.StatusOK || body != "project archive" {
+		t.Errorf("GET = %d %q", status, body)
+	}
+}
+
+func TestPresignServerRejectsInvalidSignatures(t *testing.T) {
+	presign := newTestPresignServer(t, newTestFSStore(t))
+	getURL, err := presign.PresignGet(context.Background(), "projects", "p1/full.tar", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A URL signed for one key does not give access to another
+	otherKey := strings.Replace(getURL, "p1/full.tar", "p2/full.tar", 1)
+	if status, _ := doRequest(t, http.MethodGet, otherKey, nil); status != http.StatusForbidden {
+		t.Errorf("GET of another key = %d, want %d", status, http.StatusForbidden)
+	}
+	if status, _ := doRequest(t, http.MethodPut, getURL, strings.NewReader("overwrite")); status != http.StatusForbidden {
+		t.Errorf("PUT with a GET signature = %d, want %d", status, http.StatusForbidden)
+	}
+	expired, err := presign.PresignGet(context.Background(), "projects", "p1/full.tar", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := doRequest(t, http.MethodGet, expired, nil); status != http.StatusForbidden {
+		t.Errorf("GET with an expired signature = %d, want %d", status, http.StatusForbidden)
+	}
+}
+
+func TestPresignServerVerifiesObjectsBeforeSendingThem(t *testing.T) {
+	ctx := context.Background()
+	store := newTestFSStore(t)
+	presign := newTestPresignServer(t, store)
+	if err := store.Put(ctx, bytes.NewBufferString("project archive"), "projects", "p1/full.tar"); err != nil {
+		t.Fatal(err)
+	}
+	objectPath, _, err := store.objectPath("projects", "p1/full.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(objectPath, []byte("tampered archive")); err != nil {
+		t.Fatal(err)
+	}
+
+	getURL, err := presign.PresignGet(ctx, "projects", "p1/full.tar", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, body := doRequest(t, http.MethodGet, getURL, nil)
+	if status != http.StatusInternalServerError || strings.Contains(body, "tampered") {
+		t.Errorf("GET of tampered object = %d %q, want an error without its content", status, body)
+	}
+}
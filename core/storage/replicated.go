@@ -0,0 +1,370 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReplicationQueueSize = 1024
+	defaultRepairInterval       = time.Minute
+)
+
+// ReplicatedStore writes to a primary store and mirrors every change to secondary stores in
+// the background. Reads are served by the primary and fall back to the secondaries when the
+// primary fails, so a secondary can stand in during an outage.
+//
+// Replication works per key: a worker copies the current primary state of a key to every
+// secondary, deleting it there if it no longer exists on the primary. Every key is handled by
+// the same worker, so writes of a key reach the secondaries in the order they were made. Keys
+// that fail to replicate are retried by a repair loop until they succeed.
+//
+// With WithPendingFile the keys waiting for repair survive a restart. Keys still queued when the
+// process stops are not recorded, run storage-migrate from the primary to every secondary after
+// an unclean shutdown to catch them up.
+type ReplicatedStore struct {
+	primary        Store
+	secondaries    []Store
+	queueSize      int
+	repairInterval time.Duration
+	pendingFile    string
+
+	mu      sync.Mutex
+	queues  []chan replicationKey
+	pending map[replicationKey]struct{}
+	// saveMu orders writes of the pending file
+	saveMu sync.Mutex
+}
+
+type replicationKey struct {
+	bucket string
+	key    string
+}
+
+// pendingEntry is a replicationKey as stored in the pending file.
+type pendingEntry struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+func NewReplicatedStore(primary Store, secondaries ...Store) *ReplicatedStore {
+	return &ReplicatedStore{
+		primary:        primary,
+		secondaries:    secondaries,
+		queueSize:      defaultReplicationQueueSize,
+		repairInterval: defaultRepairInterval,
+		pending:        make(map[replicationKey]struct{}),
+	}
+}
+
+func (rs *ReplicatedStore) WithRepairInterval(interval time.Duration) *ReplicatedStore {
+	rs.repairInterval = interval
+	return rs
+}
+
+// WithPendingFile records the keys waiting for repair in path, Start picks them up again.
+func (rs *ReplicatedStore) WithPendingFile(path string) *ReplicatedStore {
+	rs.pendingFile = path
+	return rs
+}
+
+// Start runs the replication workers and the repair loop until ctx is cancelled. It must be
+// called once, writes made before are left to the repair loop.
+func (rs *ReplicatedStore) Start(ctx context.Context, workers int) {
+	if workers <= 0 {
+		workers = 1
+	}
+	if err := rs.loadPending(); err != nil {
+		log.Printf("replicated store: failed to load pending keys from %s: %v", rs.pendingFile, err)
+	}
+
+	queues := make([]chan replicationKey, workers)
+	for i := range queues {
+		queues[i] = make(chan replicationKey, rs.queueSize/workers+1)
+		go func(queue chan replicationKey) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case item := <-queue:
+					rs.replicate(ctx, item)
+				}
+			}
+		}(queues[i])
+	}
+	rs.mu.Lock()
+	rs.queues = queues
+	rs.mu.Unlock()
+	go rs.repairLoop(ctx)
+}
+
+// Pending returns the number of keys waiting to be repaired on at least one secondary.
+func (rs *ReplicatedStore) Pending() int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return len(rs.pending)
+}
+
+func (rs *ReplicatedStore) Get(ctx context.Context, bucket string, key string) (*bytes.Buffer, error) {
+	data, err := rs.primary.Get(ctx, bucket, key)
+	if err == nil || errors.Is(err, ErrObjectNotFound) {
+		return data, err
+	}
+	for _, secondary := range rs.secondaries {
+		if data, secondaryErr := secondary.Get(ctx, bucket, key); secondaryErr == nil {
+			log.Printf("replicated store: served %s/%s from a secondary after primary failure: %v", bucket, key, err)
+			return data, nil
+		}
+	}
+	return nil, err
+}
+
+func (rs *ReplicatedStore) Put(ctx context.Context, fileData *bytes.Buffer, bucket string, key string) error {
+	if err := rs.primary.Put(ctx, fileData, bucket, key); err != nil {
+		return err
+	}
+	rs.enqueue(replicationKey{bucket: bucket, key: key})
+	return nil
+}
+
+// Open streams the object from the primary and falls back to the secondaries like Get.
+func (rs *ReplicatedStore) Open(ctx context.Context, bucket string, key string) (io.ReadCloser, error) {
+	return rs.OpenRange(ctx, bucket, key, 0, -1)
+}
+
+func (rs *ReplicatedStore) OpenRange(ctx context.Context, bucket string, key string, offset int64, length int64) (io.ReadCloser, error) {
+	body, err := openObjectRange(ctx, rs.primary, bucket, key, offset, length)
+	if err == nil || errors.Is(err, ErrObjectNotFound) {
+		return body, err
+	}
+	for _, secondary := range rs.secondaries {
+		if body, secondaryErr := openObjectRange(ctx, secondary, bucket, key, offset, length); secondaryErr == nil {
+			log.Printf("replicated store: served %s/%s from a secondary after primary failure: %v", bucket, key, err)
+			return body, nil
+		}
+	}
+	return nil, err
+}
+
+func (rs *ReplicatedStore) PutStream(ctx context.Context, body io.Reader, size int64, bucket string, key string) error {
+	if err := putObject(ctx, rs.primary, body, size, bucket, key); err != nil {
+		return err
+	}
+	rs.enqueue(replicationKey{bucket: bucket, key: key})
+	return nil
+}
+
+func (rs *ReplicatedStore) List(ctx context.Context, bucket string, prefix string, opts ListOptions) (ListResult, error) {
+	return rs.primary.List(ctx, bucket, prefix, opts)
+}
+
+func (rs *ReplicatedStore) Stat(ctx context.Context, bucket string, key string) (ObjectInfo, error) {
+	return rs.primary.Stat(ctx, bucket, key)
+}
+
+func (rs *ReplicatedStore) Delete(ctx context.Context, bucket string, key string) error {
+	if err := rs.primary.Delete(ctx, bucket, key); err != nil {
+		return err
+	}
+	rs.enqueue(replicationKey{bucket: bucket, key: key})
+	return nil
+}
+
+func (rs *ReplicatedStore) Copy(ctx context.Context, srcBucket string, srcKey string, dstBucket string, dstKey string) error {
+	if err := rs.primary.Copy(ctx, srcBucket, srcKey, dstBucket, dstKey); err != nil {
+		return err
+	}
+	// Copying an object onto itself leaves its content, and so its replicas, unchanged
+	if srcBucket == dstBucket && srcKey == dstKey {
+		return nil
+	}
+	rs.enqueue(replicationKey{bucket: dstBucket, key: dstKey})
+	return nil
+}
+
+// queueFor returns the queue of the worker handling item, or nil before Start.
+func (rs *ReplicatedStore) queueFor(item replicationKey) chan replicationKey {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if len(rs.queues) == 0 {
+		return nil
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(item.bucket))
+	hash.Write([]byte{0})
+	hash.Write([]byte(item.key))
+	return rs.queues[hash.Sum32()%uint32(len(rs.queues))]
+}
+
+// enqueue never blocks the write path, keys that do not fit in the queue are left to the repair loop.
+func (rs *ReplicatedStore) enqueue(item replicationKey) {
+	queue := rs.queueFor(item)
+	if queue == nil {
+		rs.markPending(item)
+		return
+	}
+	select {
+	case queue <- item:
+	default:
+		rs.markPending(item)
+	}
+}
+
+func (rs *ReplicatedStore) replicate(ctx context.Context, item replicationKey) {
+	if err := rs.syncKey(ctx, item); err != nil {
+		log.Printf("replicated store: failed to replicate %s/%s: %v", item.bucket, item.key, err)
+		rs.markPending(item)
+		return
+	}
+	rs.mu.Lock()
+	_, wasPending := rs.pending[item]
+	delete(rs.pending, item)
+	rs.mu.Unlock()
+	if wasPending {
+		rs.savePending()
+	}
+}
+
+// syncKey makes every secondary match the primary for a single key. Objects are streamed from
+// a primary that supports it, so they are never held in memory as a whole.
+func (rs *ReplicatedStore) syncKey(ctx context.Context, item replicationKey) error {
+	if primary, ok := rs.primary.(StreamStore); ok {
+		var errs []error
+		for _, secondary := range rs.secondaries {
+			errs = append(errs, streamKey(ctx, primary, secondary, item))
+		}
+		return errors.Join(errs...)
+	}
+
+	data, err := rs.primary.Get(ctx, item.bucket, item.key)
+	deleted := errors.Is(err, ErrObjectNotFound)
+	if err != nil && !deleted {
+		return err
+	}
+
+	var errs []error
+	for _, secondary := range rs.secondaries {
+		if deleted {
+			errs = append(errs, secondary.Delete(ctx, item.bucket, item.key))
+			continue
+		}
+		errs = append(errs, secondary.Put(ctx, bytes.NewBuffer(data.Bytes()), item.bucket, item.key))
+	}
+	return errors.Join(errs...)
+}
+
+// streamKey copies a single key from primary to secondary, or deletes it from secondary when the
+// primary no longer has it. Secondaries that cannot stream get the object as a buffer.
+func streamKey(ctx context.Context, primary StreamStore, secondary Store, item replicationKey) error {
+	body, err := primary.Open(ctx, item.bucket, item.key)
+	if errors.Is(err, ErrObjectNotFound) {
+		return secondary.Delete(ctx, item.bucket, item.key)
+	}
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if streamSecondary, ok := secondary.(StreamStore); ok {
+		return streamSecondary.PutStream(ctx, body, -1, item.bucket, item.key)
+	}
+	data := new(bytes.Buffer)
+	if _, err := io.Copy(data, body); err != nil {
+		return err
+	}
+	return secondary.Put(ctx, data, item.bucket, item.key)
+}
+
+func (rs *ReplicatedStore) markPending(item replicationKey) {
+	rs.mu.Lock()
+	_, wasPending := rs.pending[item]
+	rs.pending[item] = struct{}{}
+	rs.mu.Unlock()
+	if !wasPending {
+		rs.savePending()
+	}
+}
+
+// repairLoop hands the pending keys to their workers, so a key is never replicated by two
+// goroutines at once.
+func (rs *ReplicatedStore) repairLoop(ctx context.Context) {
+	ticker := time.NewTicker(rs.repairInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		rs.mu.Lock()
+		items := make([]replicationKey, 0, len(rs.pending))
+		for item := range rs.pending {
+			items = append(items, item)
+		}
+		rs.mu.Unlock()
+
+		for _, item := range items {
+			select {
+			case <-ctx.Done():
+				return
+			case rs.queueFor(item) <- item:
+			}
+		}
+	}
+}
+
+func (rs *ReplicatedStore) loadPending() error {
+	if rs.pendingFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(rs.pendingFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []pendingEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	rs.mu.Lock()
+	for _, entry := range entries {
+		rs.pending[replicationKey{bucket: entry.Bucket, key: entry.Key}] = struct{}{}
+	}
+	rs.mu.Unlock()
+	return nil
+}
+
+// savePending writes the pending keys to the pending file. A failure is only logged, the keys
+// are still retried as long as the process runs.
+func (rs *ReplicatedStore) savePending() {
+	if rs.pendingFile == "" {
+		return
+	}
+	rs.saveMu.Lock()
+	defer rs.saveMu.Unlock()
+
+	rs.mu.Lock()
+	entries := make([]pendingEntry, 0, len(rs.pending))
+	for item := range rs.pending {
+		entries = append(entries, pendingEntry{Bucket: item.bucket, Key: item.key})
+	}
+	rs.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err == nil {
+		err = writeFileAtomic(rs.pendingFile, data)
+	}
+	if err != nil {
+		log.Printf("replicated store: failed to save pending keys to %s: %v", rs.pendingFile, err)
+	}
+}
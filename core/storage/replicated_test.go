@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowStore delays the first Put of a key and can be made to fail every write.
+type slowStore struct {
+	Store
+	mu         sync.Mutex
+	delayed    map[string]bool
+	putStarted chan string
+	failing    bool
+}
+
+func (s *slowStore) Put(ctx context.Context, fileData *bytes.Buffer, bucket string, key string) error {
+	s.mu.Lock()
+	failing := s.failing
+	delay := !s.delayed[key]
+	s.delayed[key] = true
+	s.mu.Unlock()
+	if failing {
+		return errors.New("secondary unavailable")
+	}
+	if delay {
+		s.putStarted <- key
+		time.Sleep(50 * time.Millisecond)
+	}
+	return s.Store.Put(ctx, fileData, bucket, key)
+}
+
+func (s *slowStore) setFailing(failing bool) {
+	s.mu.Lock()
+	s.failing = failing
+	s.mu.Unlock()
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func objectExists(store Store, bucket string, key string) bool {
+	_, err := store.Stat(context.Background(), bucket, key)
+	return err == nil
+}
+
+func TestReplicatedStoreAppliesWritesOfAKeyInOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	secondary := &slowStore{Store: newTestFSStore(t), delayed: map[string]bool{}, putStarted: make(chan string, 8)}
+	store := NewReplicatedStore(newTestFSStore(t), secondary)
+	store.Start(ctx, 8)
+
+	if err := store.Put(ctx, bytes.NewBufferString("v1"), "artifacts", "index.html"); err != nil {
+		t.Fatal(err)
+	}
+	// The delete is made while the put is being copied, it is only replicated once the copy is done
+	<-secondary.putStarted
+	if err := store.Delete(ctx, "artifacts", "index.html"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	waitFor(t, func() bool { return !objectExists(secondary, "artifacts", "index.html") })
+}
+
+func TestReplicatedStoreKeepsPendingKeysAcrossRestarts(t *testing.T) {
+	pendingFile := filepath.Join(t.TempDir(), "pending.json")
+	primary := newTestFSStore(t)
+	secondary := &slowStore{Store: newTestFSStore(t), delayed: map[string]bool{"index.html": true}, putStarted: make(chan string, 8), failing: true}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	store := NewReplicatedStore(primary, secondary).WithPendingFile(pendingFile)
+	store.Start(ctx, 2)
+	if err := store.Put(ctx, bytes.NewBufferString("v1"), "artifacts", "index.html"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return store.Pending() == 1 })
+	cancel()
+	if data, err := os.ReadFile(pendingFile); err != nil || !strings.Contains(string(data), "index.html") {
+		t.Fatalf("pending file = %s, %v", data, err)
+	}
+
+	// A new process repairs the key once the secondary is back
+	secondary.setFailing(false)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	restarted := NewReplicatedStore(primary, secondary).WithPendingFile(pendingFile).WithRepairInterval(10 * time.Millisecond)
+	restarted.Start(ctx, 2)
+	waitFor(t, func() bool { return restarted.Pending() == 0 })
+	if !objectExists(secondary, "artifacts", "index.html") {
+		t.Error("pending key was not repaired after the restart")
+	}
+	if data, err := os.ReadFile(pendingFile); err != nil || strings.Contains(string(data), "index.html") {
+		t.Errorf("pending file after repair = %s, %v", data, err)
+	}
+}
+
+// streamOnlyStore fails every buffered read, so only Open and OpenRange can read its objects.
+type streamOnlyStore struct {
+	*FSStore
+}
+
+func (s streamOnlyStore) Get(ctx context.Context, bucket string, key string) (*bytes.Buffer, error) {
+	return nil, errors.New("objects must be streamed")
+}
+
+func TestReplicatedStoreStreamsObjectsToSecondaries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	primary := streamOnlyStore{newTestFSStore(t)}
+	streaming := newTestFSStore(t)
+	buffered := &slowStore{Store: newTestFSStore(t), delayed: map[string]bool{"index.html": true}}
+	store := NewReplicatedStore(primary, streaming, buffered)
+	store.Start(ctx, 2)
+
+	content := randomContent(t, 3*encryptedChunkSize)
+	if err := store.PutStream(ctx, bytes.NewReader(content), int64(len(content)), "artifacts", "index.html"); err != nil {
+		t.Fatal(err)
+	}
+	for _, secondary := range []Store{streaming, buffered} {
+		waitFor(t, func() bool { return objectExists(secondary, "artifacts", "index.html") })
+		if err := VerifyChecksum(ctx, secondary, "artifacts", "index.html", ChecksumSHA256(content)); err != nil {
+			t.Errorf("replicated object: %v", err)
+		}
+	}
+
+	if err := store.Delete(ctx, "artifacts", "index.html"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		return !objectExists(streaming, "artifacts", "index.html") && !objectExists(buffered, "artifacts", "index.html")
+	})
+}
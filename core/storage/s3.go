@@ -3,22 +3,49 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"net/url"
+	"os"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 type AWSCredentials struct {
 	AccessKey       string
 	SecretAccessKey string
-	Region          string
+	// SessionToken is only needed for temporary credentials
+	SessionToken string
+	Region       string
 }
 
+// S3Config configures S3Store for AWS or any S3 compatible service such as MinIO.
+// Leaving Endpoint empty targets AWS S3 itself.
+type S3Config struct {
+	Credentials    AWSCredentials
+	Endpoint       string
+	ForcePathStyle bool
+	DisableSSL     bool
+}
+
+// defaultS3CompatibleRegion is used when a custom endpoint is configured without a region,
+// S3 compatible services generally accept any region but the SDK refuses to sign without one.
+const defaultS3CompatibleRegion = "us-east-1"
+
 type S3Store struct {
-	client *s3.S3
+	client   *s3.S3
+	uploader *s3manager.Uploader
 }
 
 func (s3Store S3Store) Get(ctx context.Context, bucket string, key string) (*bytes.Buffer, error) {
@@ -27,7 +54,7 @@ func (s3Store S3Store) Get(ctx context.Context, bucket string, key string) (*byt
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		return nil, err
+		return nil, s3Error(err)
 	}
 	// Ensure the response body is closed after reading
 	defer resp.Body.Close()
@@ -37,16 +64,27 @@ func (s3Store S3Store) Get(ctx context.Context, bucket string, key string) (*byt
 	if err != nil {
 		return nil, err
 	}
+	if expected := metadataSHA256(resp.Metadata); expected != "" {
+		if actual := ChecksumSHA256(data); !strings.EqualFold(actual, expected) {
+			return nil, &IntegrityError{Bucket: bucket, Key: key, Expected: expected, Actual: actual}
+		}
+	}
 	buffer := bytes.NewBuffer(data)
 
 	return buffer, nil
 }
 
 func (s3Store S3Store) Put(ctx context.Context, fileData *bytes.Buffer, bucket, key string) error {
+	// Content-MD5 lets S3 reject bodies corrupted in transit, the SHA-256 is kept for reads
+	md5Sum := md5.Sum(fileData.Bytes())
 	_, err := s3Store.client.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader(fileData.Bytes()),
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(key),
+		Body:       bytes.NewReader(fileData.Bytes()),
+		ContentMD5: aws.String(base64.StdEncoding.EncodeToString(md5Sum[:])),
+		Metadata: map[string]*string{
+			MetadataSHA256: aws.String(ChecksumSHA256(fileData.Bytes())),
+		},
 	})
 	if err != nil {
 		return err
@@ -54,24 +92,259 @@ func (s3Store S3Store) Put(ctx context.Context, fileData *bytes.Buffer, bucket,
 	return nil
 }
 
+// Open returns the object body without reading it into memory.
+// The caller is responsible for closing the returned reader.
+func (s3Store S3Store) Open(ctx context.Context, bucket string, key string) (io.ReadCloser, error) {
+	return s3Store.OpenRange(ctx, bucket, key, 0, -1)
+}
+
+// OpenRange returns length bytes of the object starting at offset using a ranged GET.
+func (s3Store S3Store) OpenRange(ctx context.Context, bucket string, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if offset > 0 || length >= 0 {
+		input.Range = aws.String(byteRange(offset, length))
+	}
+	resp, err := s3Store.client.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	if input.Range != nil {
+		return resp.Body, nil
+	}
+	return NewVerifyingReader(resp.Body, bucket, key, metadataSHA256(resp.Metadata)), nil
+}
+
+// PutStream uploads body using S3 multipart uploads, so only a few parts are held in memory at a time.
+// The SHA-256 has to be known before the upload starts, so a body that cannot be rewound after
+// hashing it, such as a stream from another store, is spooled to a temporary file first.
+func (s3Store S3Store) PutStream(ctx context.Context, body io.Reader, size int64, bucket string, key string) error {
+	seeker, ok := body.(io.ReadSeeker)
+	if !ok {
+		spooled, err := spool(body)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			spooled.Close()
+			os.Remove(spooled.Name())
+		}()
+		seeker = spooled
+	}
+	checksum, err := seekableSHA256(seeker)
+	if err != nil {
+		return err
+	}
+	input := &s3manager.UploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(key),
+		Body:     seeker,
+		Metadata: map[string]*string{MetadataSHA256: aws.String(checksum)},
+	}
+	_, err = s3Store.uploader.UploadWithContext(ctx, input, func(u *s3manager.Uploader) {
+		u.PartSize = partSizeFor(size)
+	})
+	return err
+}
+
+func (s3Store S3Store) List(ctx context.Context, bucket string, prefix string, opts ListOptions) (ListResult, error) {
+	maxKeys := opts.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = DefaultListMaxKeys
+	}
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucket),
+		Prefix:  aws.String(prefix),
+		MaxKeys: aws.Int64(int64(maxKeys)),
+	}
+	if opts.ContinuationToken != "" {
+		input.ContinuationToken = aws.String(opts.ContinuationToken)
+	}
+	resp, err := s3Store.client.ListObjectsV2WithContext(ctx, input)
+	if err != nil {
+		return ListResult{}, s3Error(err)
+	}
+
+	result := ListResult{
+		Objects:               make([]ObjectInfo, 0, len(resp.Contents)),
+		NextContinuationToken: aws.StringValue(resp.NextContinuationToken),
+		IsTruncated:           aws.BoolValue(resp.IsTruncated),
+	}
+	for _, object := range resp.Contents {
+		result.Objects = append(result.Objects, ObjectInfo{
+			Key:          aws.StringValue(object.Key),
+			Size:         aws.Int64Value(object.Size),
+			ETag:         strings.Trim(aws.StringValue(object.ETag), `"`),
+			LastModified: aws.TimeValue(object.LastModified),
+		})
+	}
+	return result, nil
+}
+
+func (s3Store S3Store) Stat(ctx context.Context, bucket string, key string) (ObjectInfo, error) {
+	resp, err := s3Store.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return ObjectInfo{}, s3Error(err)
+	}
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.Int64Value(resp.ContentLength),
+		ETag:         strings.Trim(aws.StringValue(resp.ETag), `"`),
+		LastModified: aws.TimeValue(resp.LastModified),
+		SHA256:       metadataSHA256(resp.Metadata),
+	}, nil
+}
+
+func (s3Store S3Store) Delete(ctx context.Context, bucket string, key string) error {
+	_, err := s3Store.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	return s3Error(err)
+}
+
+// Copy uses a server side CopyObject, so the object data never leaves S3.
+func (s3Store S3Store) Copy(ctx context.Context, srcBucket string, srcKey string, dstBucket string, dstKey string) error {
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(dstBucket),
+		Key:        aws.String(dstKey),
+		CopySource: aws.String(url.PathEscape(srcBucket + "/" + srcKey)),
+	}
+	// S3 only copies an object onto itself when its metadata is replaced, the current metadata
+	// is passed on so only the modification time changes
+	if srcBucket == dstBucket && srcKey == dstKey {
+		head, err := s3Store.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(srcBucket),
+			Key:    aws.String(srcKey),
+		})
+		if err != nil {
+			return s3Error(err)
+		}
+		input.MetadataDirective = aws.String(s3.MetadataDirectiveReplace)
+		input.Metadata = head.Metadata
+		input.ContentType = head.ContentType
+	}
+	_, err := s3Store.client.CopyObjectWithContext(ctx, input)
+	return s3Error(err)
+}
+
+// metadataSHA256 looks up the recorded checksum, S3 compatible services differ in how they case metadata keys.
+func metadataSHA256(metadata map[string]*string) string {
+	for name, value := range metadata {
+		if strings.EqualFold(name, MetadataSHA256) {
+			return aws.StringValue(value)
+		}
+	}
+	return ""
+}
+
+// spool copies body to a temporary file and rewinds it, the caller removes the file.
+func spool(body io.Reader) (*os.File, error) {
+	file, err := os.CreateTemp("", "comet-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(file, body)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+// seekableSHA256 hashes the remainder of body and rewinds it to where it started.
+func seekableSHA256(body io.ReadSeeker) (string, error) {
+	start, err := body.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, body); err != nil {
+		return "", err
+	}
+	if _, err := body.Seek(start, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// s3Error maps missing object errors onto ErrObjectNotFound and returns other errors unchanged.
+func s3Error(err error) error {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return ErrObjectNotFound
+		}
+	}
+	return err
+}
+
+// partSizeFor picks the smallest part size that keeps an upload of the given size
+// within the S3 part count limit.
+func partSizeFor(size int64) int64 {
+	partSize := s3manager.DefaultUploadPartSize
+	if size <= 0 {
+		return partSize
+	}
+	for size/partSize >= s3manager.MaxUploadParts {
+		partSize *= 2
+	}
+	return partSize
+}
+
+func byteRange(offset, length int64) string {
+	if length < 0 {
+		return fmt.Sprintf("bytes=%d-", offset)
+	}
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
 func NewS3Store(awsConfig AWSCredentials) (*S3Store, error) {
-	sess, err := newAwsSession(awsConfig)
+	return NewS3StoreWithConfig(S3Config{Credentials: awsConfig})
+}
+
+func NewS3StoreWithConfig(config S3Config) (*S3Store, error) {
+	sess, err := newAwsSession(config)
 	if err != nil {
 		return nil, err
 	}
 	client := s3.New(sess)
-	s3Store := &S3Store{client: client}
+	uploader := s3manager.NewUploaderWithClient(client)
+	s3Store := &S3Store{client: client, uploader: uploader}
 	return s3Store, nil
 }
 
-func newAwsSession(config AWSCredentials) (*session.Session, error) {
-	awsRegion := config.Region
-	accessKey := config.AccessKey
-	secretKey := config.SecretAccessKey
+func newAwsSession(config S3Config) (*session.Session, error) {
+	awsRegion := config.Credentials.Region
+	accessKey := config.Credentials.AccessKey
+	secretKey := config.Credentials.SecretAccessKey
+	sessionToken := config.Credentials.SessionToken
+
+	if awsRegion == "" && config.Endpoint != "" {
+		awsRegion = defaultS3CompatibleRegion
+	}
 
 	awsConfig := &aws.Config{
-		Region:      aws.String(awsRegion),
-		Credentials: credentials.NewStaticCredentials(accessKey, secretKey, ""),
+		Region:           aws.String(awsRegion),
+		Credentials:      credentials.NewStaticCredentials(accessKey, secretKey, sessionToken),
+		S3ForcePathStyle: aws.Bool(config.ForcePathStyle),
+		DisableSSL:       aws.Bool(config.DisableSSL),
+	}
+	if config.Endpoint != "" {
+		awsConfig.Endpoint = aws.String(config.Endpoint)
 	}
 	sess, err := session.NewSession(awsConfig)
 	if err != nil {
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/google/uuid"
+)
+
+// S3_TEST_ENDPOINT points the integration tests at an S3 compatible service, e.g. the MinIO of
+// docker-compose with S3_TEST_ENDPOINT=http://localhost:9000. They are skipped when it is not set.
+const s3TestBucket = "comet-integration-test"
+
+// newTestS3Store returns an S3Store for the test endpoint and a key prefix private to the test,
+// whose objects are deleted when the test ends.
+func newTestS3Store(t *testing.T) (*S3Store, string) {
+	t.Helper()
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT is not set")
+	}
+	getenv := func(name string, fallback string) string {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+		return fallback
+	}
+	store, err := NewS3StoreWithConfig(S3Config{
+		Credentials: AWSCredentials{
+			AccessKey:       getenv("S3_TEST_ACCESS_KEY", "minioadmin"),
+			SecretAccessKey: getenv("S3_TEST_SECRET_KEY", "minioadmin"),
+		},
+		Endpoint:       endpoint,
+		ForcePathStyle: true,
+		DisableSSL:     strings.HasPrefix(endpoint, "http://"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.client.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(s3TestBucket)})
+	var awsErr awserr.Error
+	if err != nil && !(errors.As(err, &awsErr) && (awsErr.Code() == s3.ErrCodeBucketAlreadyOwnedByYou || awsErr.Code() == s3.ErrCodeBucketAlreadyExists)) {
+		t.Fatalf("creating bucket %s: %v", s3TestBucket, err)
+	}
+
+	prefix := uuid.NewString() + "/"
+	t.Cleanup(func() {
+		ctx := context.Background()
+		WalkPrefix(ctx, store, s3TestBucket, prefix, func(object ObjectInfo) error {
+			return store.Delete(ctx, s3TestBucket, object.Key)
+		})
+	})
+	return store, prefix
+}
+
+func TestS3StoreIntegration(t *testing.T) {
+	ctx := context.Background()
+	store, prefix := newTestS3Store(t)
+	content := randomContent(t, 3*1024*1024)
+
+	if err := store.Put(ctx, bytes.NewBuffer(content), s3TestBucket, prefix+"p1.tar"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	info, err := store.Stat(ctx, s3TestBucket, prefix+"p1.tar")
+	if err != nil || info.Size != int64(len(content)) || info.SHA256 != ChecksumSHA256(content) {
+		t.Errorf("Stat = %+v, %v, want the size and checksum of the content", info, err)
+	}
+	if got, err := store.Get(ctx, s3TestBucket, prefix+"p1.tar"); err != nil || !bytes.Equal(got.Bytes(), content) {
+		t.Errorf("Get: %v", err)
+	}
+
+	body, err := store.OpenRange(ctx, s3TestBucket, prefix+"p1.tar", 10, 20)
+	if err != nil {
+		t.Fatalf("OpenRange: %v", err)
+	}
+	got, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || !bytes.Equal(got, content[10:30]) {
+		t.Errorf("OpenRange(10, 20) = %d bytes, %v", len(got), err)
+	}
+
+	if err := store.Copy(ctx, s3TestBucket, prefix+"p1.tar", s3TestBucket, prefix+"copy.tar"); err != nil {
+		t.Fatalf("Copy: %v", err)
+	}
+	result, err := store.List(ctx, s3TestBucket, prefix, ListOptions{})
+	if err != nil || len(result.Objects) != 2 {
+		t.Errorf("List = %+v, %v, want 2 objects", result, err)
+	}
+	if err := store.Delete(ctx, s3TestBucket, prefix+"copy.tar"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Stat(ctx, s3TestBucket, prefix+"copy.tar"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("Stat after Delete error = %v, want ErrObjectNotFound", err)
+	}
+}
+
+func TestS3StorePutStreamRecordsChecksum(t *testing.T) {
+	ctx := context.Background()
+	store, prefix := newTestS3Store(t)
+	content := randomContent(t, 6*1024*1024)
+
+	// A reader that cannot seek, as an HTTP request body
+	if err := store.PutStream(ctx, io.MultiReader(bytes.NewReader(content)), -1, s3TestBucket, prefix+"p1.tar"); err != nil {
+		t.Fatalf("PutStream: %v", err)
+	}
+	if err := VerifyChecksum(ctx, store, s3TestBucket, prefix+"p1.tar", ChecksumSHA256(content)); err != nil {
+		t.Errorf("VerifyChecksum: %v", err)
+	}
+	if info, err := store.Stat(ctx, s3TestBucket, prefix+"p1.tar"); err != nil || info.SHA256 == "" {
+		t.Errorf("Stat = %+v, %v, want the checksum recorded", info, err)
+	}
+}
+
+func TestS3StorePresignedURLs(t *testing.T) {
+	ctx := context.Background()
+	store, prefix := newTestS3Store(t)
+
+	putURL, err := store.PresignPut(ctx, s3TestBucket, prefix+"p1.tar", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(http.MethodPut, putURL, strings.NewReader("project archive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT to presigned URL = %d", resp.StatusCode)
+	}
+
+	getURL, err := store.PresignGet(ctx, s3TestBucket, prefix+"p1.tar", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.Get(getURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if got, err := io.ReadAll(resp.Body); err != nil || string(got) != "project archive" {
+		t.Errorf("GET from presigned URL = %q, %v", got, err)
+	}
+}
+
+func TestMigrateFromFSToS3RecordsChecksums(t *testing.T) {
+	ctx := context.Background()
+	store, prefix := newTestS3Store(t)
+	src := newTestFSStore(t)
+	content := randomContent(t, 1024)
+	if err := src.Put(ctx, bytes.NewBuffer(content), "projects", prefix+"p1.tar"); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Migrate(ctx, src, "projects", store, s3TestBucket, MigrateOptions{Prefix: prefix, Verify: true})
+	if err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if report.Copied != 1 {
+		t.Errorf("report = %+v, want 1 copied", report)
+	}
+	info, err := store.Stat(ctx, s3TestBucket, prefix+"p1.tar")
+	if err != nil || info.SHA256 != ChecksumSHA256(content) {
+		t.Errorf("migrated object = %+v, %v, want its sha256 recorded", info, err)
+	}
+}
+
+func TestS3StoreCopyOntoItselfKeepsContentAndChecksum(t *testing.T) {
+	ctx := context.Background()
+	store, prefix := newTestS3Store(t)
+	content := randomContent(t, 1024)
+	if err := store.Put(ctx, bytes.NewBuffer(content), s3TestBucket, prefix+"blob"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := store.Stat(ctx, s3TestBucket, prefix+"blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// LastModified has a resolution of one second
+	time.Sleep(1100 * time.Millisecond)
+
+	if err := store.Copy(ctx, s3TestBucket, prefix+"blob", s3TestBucket, prefix+"blob"); err != nil {
+		t.Fatalf("Copy onto itself: %v", err)
+	}
+	after, err := store.Stat(ctx, s3TestBucket, prefix+"blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.LastModified.After(before.LastModified) || after.SHA256 != ChecksumSHA256(content) || after.Size != int64(len(content)) {
+		t.Errorf("Stat after Copy onto itself = %+v, was %+v", after, before)
+	}
+}
@@ -3,9 +3,117 @@ package storage
 import (
 	"bytes"
 	"context"
+	"errors"
+	"io"
+	"time"
 )
 
+var (
+	ErrObjectNotFound = errors.New("object not found")
+	ErrInvalidBucket  = errors.New("invalid bucket name")
+	ErrInvalidKey     = errors.New("invalid object key")
+)
+
+// DefaultListMaxKeys is the page size used by List when ListOptions.MaxKeys is not set.
+const DefaultListMaxKeys = 1000
+
+// Stores record a SHA-256 for every object written with Put and verify it on Get,
+// returning an *IntegrityError when the content does not match.
 type Store interface {
 	Get(ctx context.Context, bucket string, key string) (*bytes.Buffer, error)
 	Put(ctx context.Context, fileData *bytes.Buffer, bucket string, key string) error
+	// List returns one page of objects whose key starts with prefix, ordered by key.
+	// Pass ListResult.NextContinuationToken back in ListOptions to fetch the next page.
+	List(ctx context.Context, bucket string, prefix string, opts ListOptions) (ListResult, error)
+	// Stat returns object metadata, or ErrObjectNotFound if the object does not exist.
+	Stat(ctx context.Context, bucket string, key string) (ObjectInfo, error)
+	// Delete removes an object. Deleting an object that does not exist is not an error.
+	Delete(ctx context.Context, bucket string, key string) error
+	// Copy duplicates an object inside the store without moving its data through the caller.
+	// Copying an object onto itself only refreshes its modification time, see ContentStore.PutBlob.
+	Copy(ctx context.Context, srcBucket string, srcKey string, dstBucket string, dstKey string) error
+}
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+	// SHA256 is empty when no checksum was recorded for the object
+	SHA256 string
+}
+
+type ListOptions struct {
+	MaxKeys           int
+	ContinuationToken string
+}
+
+type ListResult struct {
+	Objects               []ObjectInfo
+	NextContinuationToken string
+	IsTruncated           bool
+}
+
+// StreamStore is implemented by stores that can move objects without holding them in memory.
+// A size of -1 passed to PutStream means the size of body is not known in advance.
+// A length of -1 passed to OpenRange reads until the end of the object.
+type StreamStore interface {
+	Store
+	Open(ctx context.Context, bucket string, key string) (io.ReadCloser, error)
+	OpenRange(ctx context.Context, bucket string, key string, offset int64, length int64) (io.ReadCloser, error)
+	PutStream(ctx context.Context, body io.Reader, size int64, bucket string, key string) error
+}
+
+// WalkPrefix calls fn for every object under prefix, following List pagination.
+func WalkPrefix(ctx context.Context, store Store, bucket string, prefix string, fn func(ObjectInfo) error) error {
+	opts := ListOptions{}
+	for {
+		result, err := store.List(ctx, bucket, prefix, opts)
+		if err != nil {
+			return err
+		}
+		for _, object := range result.Objects {
+			if err := fn(object); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		opts.ContinuationToken = result.NextContinuationToken
+	}
+}
+
+// openObjectRange reads a range of an object from any store. Stores that cannot stream are read
+// into memory first.
+func openObjectRange(ctx context.Context, store Store, bucket string, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if streamStore, ok := store.(StreamStore); ok {
+		if offset == 0 && length < 0 {
+			return streamStore.Open(ctx, bucket, key)
+		}
+		return streamStore.OpenRange(ctx, bucket, key, offset, length)
+	}
+	data, err := store.Get(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	content := data.Bytes()
+	content = content[min(offset, int64(len(content))):]
+	if length >= 0 && length < int64(len(content)) {
+		content = content[:length]
+	}
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+// putObject writes body to any store. Stores that cannot stream get it buffered in memory.
+func putObject(ctx context.Context, store Store, body io.Reader, size int64, bucket string, key string) error {
+	if streamStore, ok := store.(StreamStore); ok {
+		return streamStore.PutStream(ctx, body, size, bucket, key)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, bytes.NewBuffer(data), bucket, key)
 }
@@ -23,7 +23,7 @@ type Payload struct {
 }
 
 func NewPayload() Payload {
-	return Payload{}
+	return Payload{Data: make(map[string]interface{})}
 }
 
 func (p Payload) SetData(key string, value interface{}) {
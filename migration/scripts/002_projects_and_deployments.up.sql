@@ -0,0 +1,32 @@
+CREATE TABLE IF NOT EXISTS projects (
+    id SERIAL PRIMARY KEY,                     -- Unique project ID
+    user_id INT REFERENCES users(id) ON DELETE CASCADE,  -- Owner of the project
+    name VARCHAR(255) NOT NULL,                -- Project name, unique per user
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, -- Creation timestamp
+    retention_keep_last INT,                   -- Number of recent deployments to keep, NULL uses the default policy
+    retention_delete_sources BOOLEAN,          -- Delete source tarballs after a successful build, NULL uses the default policy
+    trust_level VARCHAR(20),                   -- trusted, standard or untrusted, NULL uses the default of the builder
+    UNIQUE (user_id, name)
+);
+
+--bun:split
+
+CREATE TABLE IF NOT EXISTS deployments (
+    id SERIAL PRIMARY KEY,                     -- Unique deployment ID
+    project_id INT REFERENCES projects(id) ON DELETE CASCADE,  -- Foreign key to projects table
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',  -- pending, building, succeeded or failed
+    is_production BOOLEAN NOT NULL DEFAULT FALSE,   -- Production deployments are never deleted by retention
+    alias VARCHAR(255) UNIQUE,                 -- Optional alias, aliased deployments are never deleted by retention
+    source_bucket VARCHAR(255) NOT NULL,       -- Location of the uploaded project tarball
+    source_key TEXT NOT NULL,
+    artifact_bucket VARCHAR(255),              -- Content store of the build output, its manifest is named after the deployment ID
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, -- Creation timestamp
+    sources_deleted_at TIMESTAMP,              -- Set once retention deleted the project tarball
+    artifacts_deleted_at TIMESTAMP,            -- Set once retention deleted the build output
+    correlation_id UUID UNIQUE,                -- Correlation ID of the events exchanged with the builder for the build
+    sandbox JSONB                              -- Effective sandbox of the build as reported by the builder
+);
+
+--bun:split
+
+CREATE INDEX IF NOT EXISTS deployments_project_id_created_at_idx ON deployments (project_id, created_at DESC);
@@ -1 +1,46 @@
-package bootstrap
\ No newline at end of file
+package bootstrap
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/hari134/comet/core/storage"
+	"github.com/hari134/comet/server/rest/handlers"
+)
+
+// PresignPath is where the server serves the URLs signed by its PresignServer.
+const PresignPath = "/storage"
+
+// NewPresigner returns the presigner handing out upload and download URLs for store.
+// A bare S3Store presigns its own URLs. Every other store, including every encrypted or
+// replicated one, gets a PresignServer so uploads keep going through the wrapped store.
+// The PresignServer is nil when the store presigns its own URLs.
+func NewPresigner(store storage.Store, publicURL string, secret []byte) (storage.Presigner, *storage.PresignServer, error) {
+	if s3Store, ok := store.(*storage.S3Store); ok {
+		return s3Store, nil, nil
+	}
+	streamStore, ok := store.(storage.StreamStore)
+	if !ok {
+		return nil, nil, errors.New("the storage backend does not support streaming presigned uploads")
+	}
+	if publicURL == "" || len(secret) == 0 {
+		return nil, nil, errors.New("PUBLIC_URL and PRESIGN_SECRET must be set to presign URLs for this storage backend")
+	}
+	presignServer := storage.NewPresignServer(streamStore, strings.TrimSuffix(publicURL, "/")+PresignPath, secret)
+	return presignServer, presignServer, nil
+}
+
+// NewRouter mounts the REST API of the server, the endpoint receiving builder events
+// and, when presignServer is not nil, the presigned URLs. The API requires a session token
+// issued by sessions, builder events require builderToken.
+func NewRouter(deployments *handlers.DeploymentHandler, buildEvents *handlers.BuildEventHandler, presignServer *storage.PresignServer, sessions *handlers.SessionTokens, builderToken string) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/projects/{projectID}/deployments", sessions.RequireUser(deployments.CreateDeployment))
+	mux.HandleFunc("POST /api/deployments/{deploymentID}/uploaded", sessions.RequireUser(deployments.CompleteUpload))
+	mux.HandleFunc("POST /api/event/", handlers.RequireToken(builderToken, buildEvents.HandleEvent))
+	if presignServer != nil {
+		mux.Handle(PresignPath+"/", http.StripPrefix(PresignPath, presignServer.Handler()))
+	}
+	return mux
+}
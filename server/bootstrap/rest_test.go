@@ -0,0 +1,447 @@
+package bootstrap
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hari134/comet/core/models"
+	"github.com/hari134/comet/core/storage"
+	"github.com/hari134/comet/core/transport"
+	"github.com/hari134/comet/server/rest/handlers"
+)
+
+// fakeDeployments keeps projects and deployments in memory.
+type fakeDeployments struct {
+	mu          sync.Mutex
+	projects    map[int64]models.Project
+	deployments map[int64]models.Deployment
+}
+
+func newFakeDeployments(projects ...models.Project) *fakeDeployments {
+	f := &fakeDeployments{projects: map[int64]models.Project{}, deployments: map[int64]models.Deployment{}}
+	for _, project := range projects {
+		f.projects[project.ID] = project
+	}
+	return f
+}
+
+func (f *fakeDeployments) GetProject(ctx context.Context, projectID int64) (models.Project, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	project, ok := f.projects[projectID]
+	if !ok {
+		return models.Project{}, sql.ErrNoRows
+	}
+	return project, nil
+}
+
+func (f *fakeDeployments) CreateDeployment(ctx context.Context, deployment *models.Deployment) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	deployment.ID = int64(len(f.deployments) + 1)
+	f.deployments[deployment.ID] = *deployment
+	return nil
+}
+
+func (f *fakeDeployments) GetDeployment(ctx context.Context, deploymentID int64) (models.Deployment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	deployment, ok := f.deployments[deploymentID]
+	if !ok {
+		return models.Deployment{}, sql.ErrNoRows
+	}
+	return deployment, nil
+}
+
+func (f *fakeDeployments) StartBuild(ctx context.Context, deploymentID int64, correlationID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	deployment, ok := f.deployments[deploymentID]
+	if !ok || deployment.Status != models.DeploymentStatusPending {
+		return sql.ErrNoRows
+	}
+	deployment.Status = models.DeploymentStatusBuilding
+	deployment.CorrelationID = correlationID
+	f.deployments[deploymentID] = deployment
+	return nil
+}
+
+func (f *fakeDeployments) SetStatus(ctx context.Context, deploymentID int64, status string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	deployment := f.deployments[deploymentID]
+	deployment.Status = status
+	f.deployments[deploymentID] = deployment
+	return nil
+}
+
+func (f *fakeDeployments) MarkSucceeded(ctx context.Context, deploymentID int64, artifactBucket string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	deployment := f.deployments[deploymentID]
+	deployment.Status = models.DeploymentStatusSucceeded
+	deployment.ArtifactBucket = artifactBucket
+	f.deployments[deploymentID] = deployment
+	return nil
+}
+
+func (f *fakeDeployments) GetDeploymentByCorrelationID(ctx context.Context, correlationID string) (models.Deployment, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, deployment := range f.deployments {
+		if deployment.CorrelationID == correlationID {
+			return deployment, nil
+		}
+	}
+	return models.Deployment{}, sql.ErrNoRows
+}
+
+func (f *fakeDeployments) RecordSandbox(ctx context.Context, deploymentID int64, sandbox models.BuildSandbox) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	deployment := f.deployments[deploymentID]
+	deployment.Sandbox = &sandbox
+	f.deployments[deploymentID] = deployment
+	return nil
+}
+
+func (f *fakeDeployments) status(deploymentID int64) string {
+	deployment, _ := f.GetDeployment(context.Background(), deploymentID)
+	return deployment.Status
+}
+
+// fakeBuilder records the events sent to the builder.
+type fakeBuilder struct {
+	events chan transport.Event
+}
+
+func (b *fakeBuilder) Send(event transport.Event) error {
+	b.events <- event
+	return nil
+}
+
+const testBuilderToken = "builder token"
+
+type testServer struct {
+	url         string
+	store       storage.Store
+	deployments *fakeDeployments
+	builder     *fakeBuilder
+	sessions    *handlers.SessionTokens
+	// userToken is a session token of the owner of project 1
+	userToken string
+}
+
+func newTestServer(t *testing.T, store storage.Store) *testServer {
+	t.Helper()
+	server := httptest.NewServer(nil)
+	t.Cleanup(server.Close)
+	presigner, presignServer, err := NewPresigner(store, server.URL, []byte("test secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testServer{
+		url:         server.URL,
+		store:       store,
+		deployments: newFakeDeployments(models.Project{ID: 1, UserID: 7, Name: "site", TrustLevel: "untrusted"}),
+		builder:     &fakeBuilder{events: make(chan transport.Event, 1)},
+		sessions:    handlers.NewSessionTokens([]byte("auth secret")),
+	}
+	if ts.userToken, err = ts.sessions.Issue(7, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	deploymentHandler := handlers.NewDeploymentHandler(ts.deployments, store).
+		WithPresigner(presigner).
+		WithBuilder(ts.builder)
+	server.Config.Handler = NewRouter(deploymentHandler, handlers.NewBuildEventHandler(ts.deployments), presignServer, ts.sessions, testBuilderToken)
+	return ts
+}
+
+// do sends a request authenticated as the owner of project 1.
+func (ts *testServer) do(t *testing.T, method string, url string, body string, response interface{}) int {
+	t.Helper()
+	return ts.doAs(t, ts.userToken, method, url, body, response)
+}
+
+// doAs sends a request with token as its bearer token, an empty token sends none.
+func (ts *testServer) doAs(t *testing.T, token string, method string, url string, body string, response interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if response != nil && resp.StatusCode < 300 {
+		if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func (ts *testServer) createDeployment(t *testing.T) (int64, string) {
+	t.Helper()
+	var created struct {
+		DeploymentID int64  `json:"deploymentId"`
+		UploadURL    string `json:"uploadUrl"`
+	}
+	if status := ts.do(t, http.MethodPost, ts.url+"/api/projects/1/deployments", "", &created); status != http.StatusCreated {
+		t.Fatalf("create deployment = %d", status)
+	}
+	return created.DeploymentID, created.UploadURL
+}
+
+func completeUploadBody(checksum string) string {
+	return fmt.Sprintf(`{"buildEnvType": "react-vite-node20", "sha256": %q}`, checksum)
+}
+
+func waitForStatus(t *testing.T, deployments *fakeDeployments, deploymentID int64, status string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for deployments.status(deploymentID) != status {
+		if time.Now().After(deadline) {
+			t.Fatalf("deployment status = %s, want %s", deployments.status(deploymentID), status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestUploadThroughPresignedURLStartsBuild(t *testing.T) {
+	fsStore, err := storage.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServer(t, fsStore)
+
+	deploymentID, uploadURL := ts.createDeployment(t)
+	archive := []byte("project archive")
+	if status := ts.do(t, http.MethodPut, uploadURL, string(archive), nil); status != http.StatusOK {
+		t.Fatalf("upload = %d", status)
+	}
+	checksum := storage.ChecksumSHA256(archive)
+	if status := ts.do(t, http.MethodPost, fmt.Sprintf("%s/api/deployments/%d/uploaded", ts.url, deploymentID), completeUploadBody(checksum), nil); status != http.StatusAccepted {
+		t.Fatalf("complete upload = %d", status)
+	}
+
+	event := <-ts.builder.events
+	deployment, _ := ts.deployments.GetDeployment(context.Background(), deploymentID)
+	if event.Type != "project.uploaded" || event.CorrelationID.ToString() != deployment.CorrelationID {
+		t.Errorf("event = %s %s, want project.uploaded for correlation ID %s", event.Type, event.CorrelationID.ToString(), deployment.CorrelationID)
+	}
+	want := map[string]interface{}{
+		"BuildEnvType":         "react-vite-node20",
+		"ProjectStorageBucket": deployment.SourceBucket,
+		"ProjectStorageKey":    deployment.SourceKey,
+		"ProjectSHA256":        checksum,
+		"BuildID":              fmt.Sprint(deploymentID),
+		"ProjectID":            "1",
+		"UserID":               "7",
+		"TrustLevel":           "untrusted",
+		"ArtifactBucket":       "artifacts",
+	}
+	for key, value := range want {
+		if got, err := event.Payload.GetData(key); err != nil || got != value {
+			t.Errorf("payload %s = %v, want %v", key, got, value)
+		}
+	}
+	if err := storage.VerifyChecksum(context.Background(), ts.store, deployment.SourceBucket, deployment.SourceKey, checksum); err != nil {
+		t.Errorf("uploaded archive: %v", err)
+	}
+	waitForStatus(t, ts.deployments, deploymentID, models.DeploymentStatusSucceeded)
+	if deployment, _ := ts.deployments.GetDeployment(context.Background(), deploymentID); deployment.ArtifactBucket != "artifacts" {
+		t.Errorf("artifact bucket of succeeded deployment = %q", deployment.ArtifactBucket)
+	}
+}
+
+func TestCompleteUploadRequiresUploadedArchive(t *testing.T) {
+	fsStore, err := storage.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServer(t, fsStore)
+	deploymentID, _ := ts.createDeployment(t)
+	completeURL := fmt.Sprintf("%s/api/deployments/%d/uploaded", ts.url, deploymentID)
+	checksum := storage.ChecksumSHA256([]byte("project archive"))
+
+	if status := ts.do(t, http.MethodPost, completeURL, completeUploadBody(checksum), nil); status != http.StatusBadRequest {
+		t.Errorf("complete before upload = %d, want %d", status, http.StatusBadRequest)
+	}
+	if status := ts.do(t, http.MethodPost, completeURL, completeUploadBody("not a checksum"), nil); status != http.StatusBadRequest {
+		t.Errorf("complete with invalid checksum = %d, want %d", status, http.StatusBadRequest)
+	}
+
+	deployment, _ := ts.deployments.GetDeployment(context.Background(), deploymentID)
+	if err := fsStore.Put(context.Background(), bytes.NewBufferString("project archive"), deployment.SourceBucket, deployment.SourceKey); err != nil {
+		t.Fatal(err)
+	}
+	if status := ts.do(t, http.MethodPost, completeURL, completeUploadBody(checksum), nil); status != http.StatusAccepted {
+		t.Fatalf("complete upload = %d", status)
+	}
+	<-ts.builder.events
+	if status := ts.do(t, http.MethodPost, completeURL, completeUploadBody(checksum), nil); status != http.StatusConflict {
+		t.Errorf("second complete upload = %d, want %d", status, http.StatusConflict)
+	}
+}
+
+func TestBuildEventsRecordSandbox(t *testing.T) {
+	fsStore, err := storage.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServer(t, fsStore)
+	deploymentID, _ := ts.createDeployment(t)
+	correlationID := uuid.New()
+	if err := ts.deployments.StartBuild(context.Background(), deploymentID, correlationID.String()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The event is sent the way the builder sends it
+	payload := transport.NewPayload()
+	payload.SetData("sandbox", map[string]interface{}{"trustLevel": "untrusted", "runtime": "runsc", "capDrop": []string{"ALL"}, "readOnlyRootfs": true})
+	event, err := json.Marshal(transport.NewEvent("builder.sandbox", transport.CorrelationID(correlationID), payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := ts.do(t, http.MethodPost, ts.url+"/api/event/", string(event), nil); status != http.StatusUnauthorized {
+		t.Errorf("builder.sandbox sent by a user = %d, want %d", status, http.StatusUnauthorized)
+	}
+	if status := ts.doAs(t, testBuilderToken, http.MethodPost, ts.url+"/api/event/", string(event), nil); status != http.StatusOK {
+		t.Fatalf("builder.sandbox = %d", status)
+	}
+	if status := ts.doAs(t, testBuilderToken, http.MethodPost, ts.url+"/api/event/", string(event), nil); status != http.StatusConflict {
+		t.Errorf("second builder.sandbox = %d, want %d", status, http.StatusConflict)
+	}
+
+	deployment, _ := ts.deployments.GetDeployment(context.Background(), deploymentID)
+	want := models.BuildSandbox{TrustLevel: "untrusted", Runtime: "runsc", CapDrop: []string{"ALL"}, ReadOnlyRootfs: true}
+	if deployment.Sandbox == nil || !reflect.DeepEqual(*deployment.Sandbox, want) {
+		t.Errorf("recorded sandbox = %+v, want %+v", deployment.Sandbox, want)
+	}
+
+	unknown, err := json.Marshal(transport.NewEvent("builder.sandbox", transport.CorrelationID(uuid.New()), payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := ts.doAs(t, testBuilderToken, http.MethodPost, ts.url+"/api/event/", string(unknown), nil); status != http.StatusNotFound {
+		t.Errorf("builder.sandbox of an unknown build = %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestDeploymentsRequireTheProjectOwner(t *testing.T) {
+	fsStore, err := storage.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServer(t, fsStore)
+	otherUser, err := ts.sessions.Issue(8, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := ts.sessions.Issue(7, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := handlers.NewSessionTokens([]byte("another secret")).Issue(7, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createURL := ts.url + "/api/projects/1/deployments"
+	for name, token := range map[string]string{"no token": "", "expired token": expired, "forged token": forged, "builder token": testBuilderToken} {
+		if status := ts.doAs(t, token, http.MethodPost, createURL, "", nil); status != http.StatusUnauthorized {
+			t.Errorf("create deployment with %s = %d, want %d", name, status, http.StatusUnauthorized)
+		}
+	}
+	if status := ts.doAs(t, otherUser, http.MethodPost, createURL, "", nil); status != http.StatusNotFound {
+		t.Errorf("create deployment of another user's project = %d, want %d", status, http.StatusNotFound)
+	}
+
+	deploymentID, _ := ts.createDeployment(t)
+	deployment, _ := ts.deployments.GetDeployment(context.Background(), deploymentID)
+	if err := fsStore.Put(context.Background(), bytes.NewBufferString("project archive"), deployment.SourceBucket, deployment.SourceKey); err != nil {
+		t.Fatal(err)
+	}
+	completeURL := fmt.Sprintf("%s/api/deployments/%d/uploaded", ts.url, deploymentID)
+	body := completeUploadBody(storage.ChecksumSHA256([]byte("project archive")))
+	if status := ts.doAs(t, otherUser, http.MethodPost, completeURL, body, nil); status != http.StatusNotFound {
+		t.Errorf("complete upload of another user's deployment = %d, want %d", status, http.StatusNotFound)
+	}
+	if status := ts.deployments.status(deploymentID); status != models.DeploymentStatusPending {
+		t.Errorf("deployment status after rejected completion = %s", status)
+	}
+}
+
+func TestUploadsToAnEncryptedStoreAreEncrypted(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("STORAGE_BACKEND", "fs")
+	t.Setenv("STORAGE_FS_ROOT", root)
+	t.Setenv("STORAGE_ENCRYPTION_KEYS", "k1:"+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	t.Setenv("STORAGE_ENCRYPTION_KEY_ID", "k1")
+	store, err := storage.NewStoreFromEnv("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServer(t, store)
+
+	deploymentID, uploadURL := ts.createDeployment(t)
+	if status := ts.do(t, http.MethodPut, uploadURL, "project archive", nil); status != http.StatusOK {
+		t.Fatalf("upload = %d", status)
+	}
+	deployment, _ := ts.deployments.GetDeployment(context.Background(), deploymentID)
+	stored, err := os.ReadFile(filepath.Join(root, deployment.SourceBucket, filepath.FromSlash(deployment.SourceKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("project archive")) {
+		t.Error("archive uploaded through a presigned URL was stored in plaintext")
+	}
+	if err := storage.VerifyChecksum(context.Background(), store, deployment.SourceBucket, deployment.SourceKey, storage.ChecksumSHA256([]byte("project archive"))); err != nil {
+		t.Errorf("uploaded archive: %v", err)
+	}
+}
+
+func TestNewPresignerServesWrappedStores(t *testing.T) {
+	s3Store, err := storage.NewS3StoreWithConfig(storage.S3Config{
+		Credentials: storage.AWSCredentials{AccessKey: "access", SecretAccessKey: "secret", Region: "us-east-1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	presigner, presignServer, err := NewPresigner(s3Store, "", nil)
+	if err != nil || presigner != storage.Presigner(s3Store) || presignServer != nil {
+		t.Errorf("NewPresigner(S3Store) = %T, %v, %v, want the S3Store itself", presigner, presignServer, err)
+	}
+
+	keyRing, err := storage.NewKeyRing("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := storage.NewEncryptedStore(s3Store, keyRing)
+	if _, _, err := NewPresigner(encrypted, "", nil); err == nil {
+		t.Error("NewPresigner of an encrypted store without a secret succeeded")
+	}
+	if _, presignServer, err := NewPresigner(encrypted, "https://comet.example", []byte("secret")); err != nil || presignServer == nil {
+		t.Errorf("NewPresigner(EncryptedStore) = %v, %v, want a PresignServer", presignServer, err)
+	}
+}
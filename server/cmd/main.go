@@ -0,0 +1,58 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/hari134/comet/core/db"
+	"github.com/hari134/comet/core/repository"
+	"github.com/hari134/comet/core/storage"
+	"github.com/hari134/comet/server/bootstrap"
+	"github.com/hari134/comet/server/rest/handlers"
+	"github.com/hari134/comet/server/service"
+)
+
+func main() {
+	// NewDB loads the .env file the rest of the configuration is read from
+	database := db.NewDB()
+
+	store, err := storage.NewStoreFromEnv("")
+	if err != nil {
+		log.Fatal(err)
+	}
+	// PUBLIC_URL is the address clients reach the server at, presigned URLs served
+	// by the server point at it and are signed with PRESIGN_SECRET
+	presigner, presignServer, err := bootstrap.NewPresigner(store, os.Getenv("PUBLIC_URL"), []byte(os.Getenv("PRESIGN_SECRET")))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Users authenticate with session tokens signed with AUTH_SECRET, the builder and the
+	// server authenticate each other with the shared BUILDER_TOKEN
+	authSecret := os.Getenv("AUTH_SECRET")
+	builderToken := os.Getenv("BUILDER_TOKEN")
+	if authSecret == "" || builderToken == "" {
+		log.Fatal("AUTH_SECRET and BUILDER_TOKEN must be set")
+	}
+
+	// BUILDER_EVENT_ENDPOINT is the REST receiver of the builder, e.g. http://builder:8080/api/event/
+	deploymentRepository := repository.NewDeploymentRepository(database)
+	deployments := handlers.NewDeploymentHandler(deploymentRepository, store).
+		WithPresigner(presigner).
+		WithBuilder(service.NewBuilderClient(os.Getenv("BUILDER_EVENT_ENDPOINT")).WithToken(builderToken))
+	if bucket := os.Getenv("PROJECT_BUCKET"); bucket != "" {
+		deployments.WithSourceBucket(bucket)
+	}
+	if bucket := os.Getenv("ARTIFACT_BUCKET"); bucket != "" {
+		deployments.WithArtifactBucket(bucket)
+	}
+
+	// The builder posts its events to /api/event/ when its STREAM_ENDPOINT points at the server
+	addr := os.Getenv("SERVER_ADDR")
+	if addr == "" {
+		addr = ":8080"
+	}
+	log.Printf("Starting server on %s...", addr)
+	log.Fatal(http.ListenAndServe(addr, bootstrap.NewRouter(deployments, handlers.NewBuildEventHandler(deploymentRepository), presignServer, handlers.NewSessionTokens([]byte(authSecret)), builderToken)))
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/hari134/comet/server/rest/handlers"
+)
+
+// token prints a session token of a user signed with AUTH_SECRET, for scripts and the CLI.
+func main() {
+	userID := flag.Int64("user", 0, "ID of the user the token is issued to")
+	expires := flag.Duration("expires", 24*time.Hour, "how long the token stays valid")
+	flag.Parse()
+	if *userID == 0 {
+		log.Fatal("-user is required")
+	}
+
+	token, err := handlers.NewSessionTokens([]byte(os.Getenv("AUTH_SECRET"))).Issue(*userID, *expires)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(token)
+}
@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hari134/comet/core/models"
+	"github.com/hari134/comet/core/storage"
+	"github.com/hari134/comet/core/transport"
+)
+
+// DefaultUploadExpiry is how long a presigned upload URL stays valid.
+const DefaultUploadExpiry = 15 * time.Minute
+
+// DeploymentRepository is the part of repository.DeploymentRepository used by the handlers.
+type DeploymentRepository interface {
+	GetProject(ctx context.Context, projectID int64) (models.Project, error)
+	CreateDeployment(ctx context.Context, deployment *models.Deployment) error
+	GetDeployment(ctx context.Context, deploymentID int64) (models.Deployment, error)
+	StartBuild(ctx context.Context, deploymentID int64, correlationID string) error
+	SetStatus(ctx context.Context, deploymentID int64, status string) error
+	MarkSucceeded(ctx context.Context, deploymentID int64, artifactBucket string) error
+}
+
+// DeploymentHandler lets the CLI upload a project archive straight to the store and start its build.
+// The CLI creates a deployment, PUTs the archive to the returned upload URL and then completes
+// the upload, which sends the project.uploaded event to the builder.
+type DeploymentHandler struct {
+	deployments    DeploymentRepository
+	store          storage.Store
+	presigner      storage.Presigner
+	builder        transport.Sender
+	sourceBucket   string
+	artifactBucket string
+	uploadExpiry   time.Duration
+}
+
+func NewDeploymentHandler(deployments DeploymentRepository, store storage.Store) *DeploymentHandler {
+	return &DeploymentHandler{
+		deployments:    deployments,
+		store:          store,
+		sourceBucket:   "projects",
+		artifactBucket: "artifacts",
+		uploadExpiry:   DefaultUploadExpiry,
+	}
+}
+
+func (h *DeploymentHandler) WithPresigner(presigner storage.Presigner) *DeploymentHandler {
+	h.presigner = presigner
+	return h
+}
+
+// WithBuilder sets the sender delivering project.uploaded events to the builder.
+func (h *DeploymentHandler) WithBuilder(builder transport.Sender) *DeploymentHandler {
+	h.builder = builder
+	return h
+}
+
+// WithSourceBucket sets the bucket project archives are uploaded to.
+func (h *DeploymentHandler) WithSourceBucket(bucket string) *DeploymentHandler {
+	h.sourceBucket = bucket
+	return h
+}
+
+// WithArtifactBucket sets the bucket the builder stores build output in, content addressed
+// with one manifest per deployment.
+func (h *DeploymentHandler) WithArtifactBucket(bucket string) *DeploymentHandler {
+	h.artifactBucket = bucket
+	return h
+}
+
+func (h *DeploymentHandler) WithUploadExpiry(expiry time.Duration) *DeploymentHandler {
+	h.uploadExpiry = expiry
+	return h
+}
+
+type createDeploymentResponse struct {
+	DeploymentID int64     `json:"deploymentId"`
+	UploadURL    string    `json:"uploadUrl"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+// CreateDeployment handles POST /api/projects/{projectID}/deployments. It creates a pending
+// deployment and answers with the presigned URL its project archive has to be uploaded to.
+// Like every handler of DeploymentHandler it must be wrapped in SessionTokens.RequireUser.
+func (h *DeploymentHandler) CreateDeployment(w http.ResponseWriter, req *http.Request) {
+	projectID, err := strconv.ParseInt(req.PathValue("projectID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid project ID", http.StatusBadRequest)
+		return
+	}
+	project, err := h.deployments.GetProject(req.Context(), projectID)
+	// Projects of other users are reported as missing, so their IDs cannot be probed
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !ownedBy(req.Context(), project)) {
+		http.Error(w, "Project not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to load project", http.StatusInternalServerError)
+		return
+	}
+
+	deployment := models.Deployment{
+		ProjectID:    project.ID,
+		Status:       models.DeploymentStatusPending,
+		SourceBucket: h.sourceBucket,
+		SourceKey:    fmt.Sprintf("%d/%s.tar", project.ID, uuid.NewString()),
+	}
+	if err := h.deployments.CreateDeployment(req.Context(), &deployment); err != nil {
+		http.Error(w, "Failed to create deployment", http.StatusInternalServerError)
+		return
+	}
+	expiresAt := time.Now().Add(h.uploadExpiry)
+	uploadURL, err := h.presigner.PresignPut(req.Context(), deployment.SourceBucket, deployment.SourceKey, h.uploadExpiry)
+	if err != nil {
+		http.Error(w, "Failed to presign upload", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, createDeploymentResponse{
+		DeploymentID: deployment.ID,
+		UploadURL:    uploadURL,
+		ExpiresAt:    expiresAt,
+	})
+}
+
+type completeUploadRequest struct {
+	BuildEnvType string `json:"buildEnvType"`
+	SHA256       string `json:"sha256"`
+}
+
+type completeUploadResponse struct {
+	DeploymentID  int64  `json:"deploymentId"`
+	CorrelationID string `json:"correlationId"`
+}
+
+// CompleteUpload handles POST /api/deployments/{deploymentID}/uploaded once the project archive
+// was uploaded. It starts the build by sending project.uploaded with the checksum computed by
+// the CLI, which the builder verifies before building.
+func (h *DeploymentHandler) CompleteUpload(w http.ResponseWriter, req *http.Request) {
+	deploymentID, err := strconv.ParseInt(req.PathValue("deploymentID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid deployment ID", http.StatusBadRequest)
+		return
+	}
+	var body completeUploadRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, "Failed to unmarshal request", http.StatusBadRequest)
+		return
+	}
+	if checksum, err := hex.DecodeString(body.SHA256); err != nil || len(checksum) != 32 {
+		http.Error(w, "sha256 must be a hex encoded SHA-256", http.StatusBadRequest)
+		return
+	}
+	if body.BuildEnvType == "" {
+		http.Error(w, "buildEnvType is required", http.StatusBadRequest)
+		return
+	}
+
+	deployment, err := h.deployments.GetDeployment(req.Context(), deploymentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Deployment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to load deployment", http.StatusInternalServerError)
+		return
+	}
+	project, err := h.deployments.GetProject(req.Context(), deployment.ProjectID)
+	if err != nil {
+		http.Error(w, "Failed to load project", http.StatusInternalServerError)
+		return
+	}
+	if !ownedBy(req.Context(), project) {
+		http.Error(w, "Deployment not found", http.StatusNotFound)
+		return
+	}
+	if deployment.Status != models.DeploymentStatusPending {
+		http.Error(w, "Deployment is already being built", http.StatusConflict)
+		return
+	}
+	if _, err := h.store.Stat(req.Context(), deployment.SourceBucket, deployment.SourceKey); errors.Is(err, storage.ErrObjectNotFound) {
+		http.Error(w, "Project archive has not been uploaded", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to check project archive", http.StatusInternalServerError)
+		return
+	}
+
+	correlationID := uuid.New()
+	err = h.deployments.StartBuild(req.Context(), deployment.ID, correlationID.String())
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Deployment is already being built", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to start build", http.StatusInternalServerError)
+		return
+	}
+
+	payload := transport.NewPayload()
+	payload.SetData("BuildEnvType", body.BuildEnvType)
+	payload.SetData("ProjectStorageBucket", deployment.SourceBucket)
+	payload.SetData("ProjectStorageKey", deployment.SourceKey)
+	payload.SetData("ProjectSHA256", body.SHA256)
+	payload.SetData("BuildID", strconv.FormatInt(deployment.ID, 10))
+	payload.SetData("ProjectID", strconv.FormatInt(project.ID, 10))
+	payload.SetData("UserID", strconv.FormatInt(project.UserID, 10))
+	payload.SetData("ArtifactBucket", h.artifactBucket)
+	// Projects without a trust level get the default sandbox of the builder
+	if project.TrustLevel != "" {
+		payload.SetData("TrustLevel", project.TrustLevel)
+	}
+	// The builder answers once the build ended, so the build runs in the background
+	go h.build(deployment.ID, transport.NewEvent("project.uploaded", transport.CorrelationID(correlationID), payload))
+
+	writeJSON(w, http.StatusAccepted, completeUploadResponse{
+		DeploymentID:  deployment.ID,
+		CorrelationID: correlationID.String(),
+	})
+}
+
+// build sends project.uploaded to the builder and records how the build ended. The builder
+// answers with an error for builds it rejected as well as for builds that failed.
+func (h *DeploymentHandler) build(deploymentID int64, event transport.Event) {
+	if err := h.builder.Send(event); err != nil {
+		log.Printf("Build of deployment %d failed: %v", deploymentID, err)
+		if err := h.deployments.SetStatus(context.Background(), deploymentID, models.DeploymentStatusFailed); err != nil {
+			log.Printf("Failed to mark deployment %d failed: %v", deploymentID, err)
+		}
+		return
+	}
+	if err := h.deployments.MarkSucceeded(context.Background(), deploymentID, h.artifactBucket); err != nil {
+		log.Printf("Failed to mark deployment %d succeeded: %v", deploymentID, err)
+	}
+}
+
+// ownedBy reports whether project belongs to the user the request was authenticated as.
+func ownedBy(ctx context.Context, project models.Project) bool {
+	userID, ok := UserID(ctx)
+	return ok && project.UserID == userID
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/hari134/comet/core/models"
+	"github.com/hari134/comet/core/transport"
+)
+
+// BuildEventRepository is the part of repository.DeploymentRepository used by BuildEventHandler.
+type BuildEventRepository interface {
+	GetDeploymentByCorrelationID(ctx context.Context, correlationID string) (models.Deployment, error)
+	RecordSandbox(ctx context.Context, deploymentID int64, sandbox models.BuildSandbox) error
+}
+
+// BuildEventHandler receives the events the builder sends about running builds and records
+// them on the deployment the build belongs to, which is found by the correlation ID of the event.
+type BuildEventHandler struct {
+	deployments BuildEventRepository
+}
+
+func NewBuildEventHandler(deployments BuildEventRepository) *BuildEventHandler {
+	return &BuildEventHandler{deployments: deployments}
+}
+
+// HandleEvent handles POST /api/event/. builder.sandbox is recorded on the deployment,
+// builder.failed is logged and every other event is accepted without being stored.
+// Only the builder may post events, so it must be wrapped in RequireToken.
+func (h *BuildEventHandler) HandleEvent(w http.ResponseWriter, req *http.Request) {
+	var event transport.Event
+	if err := json.NewDecoder(req.Body).Decode(&event); err != nil {
+		http.Error(w, "Failed to unmarshal event", http.StatusBadRequest)
+		return
+	}
+
+	switch event.Type {
+	case "builder.sandbox":
+		var sandbox models.BuildSandbox
+		if err := decodePayload(event.Payload, "sandbox", &sandbox); err != nil {
+			http.Error(w, "Invalid sandbox", http.StatusBadRequest)
+			return
+		}
+		deployment, err := h.deployments.GetDeploymentByCorrelationID(req.Context(), event.CorrelationID.ToString())
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Deployment not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load deployment", http.StatusInternalServerError)
+			return
+		}
+		// The sandbox is reported once the container of the build exists and never changes afterwards
+		if deployment.Status != models.DeploymentStatusBuilding || deployment.Sandbox != nil {
+			http.Error(w, "Deployment is not waiting for its sandbox", http.StatusConflict)
+			return
+		}
+		if err := h.deployments.RecordSandbox(req.Context(), deployment.ID, sandbox); err != nil {
+			http.Error(w, "Failed to record sandbox", http.StatusInternalServerError)
+			return
+		}
+	case "builder.failed":
+		reason, _ := event.Payload.GetData("reason")
+		buildErr, _ := event.Payload.GetData("error")
+		log.Printf("Build with correlationID %s failed (%v): %v", event.CorrelationID.ToString(), reason, buildErr)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// decodePayload decodes the payload value stored under key into v.
+func decodePayload(payload transport.Payload, key string, v interface{}) error {
+	value, err := payload.GetData(key)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
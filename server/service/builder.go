@@ -0,0 +1,61 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/hari134/comet/core/transport"
+)
+
+// BuilderClient implements the Sender interface, posting events to the REST receiver of the builder.
+type BuilderClient struct {
+	endpoint string
+	token    string
+	client   *http.Client
+}
+
+func NewBuilderClient(endpoint string) *BuilderClient {
+	return &BuilderClient{
+		endpoint: endpoint,
+		client:   &http.Client{},
+	}
+}
+
+// WithToken authenticates the events with the token shared with the builder.
+func (b *BuilderClient) WithToken(token string) *BuilderClient {
+	b.token = token
+	return b
+}
+
+// Send posts the event and returns once the builder handled it, which for
+// project.uploaded is when the build ended.
+func (b *BuilderClient) Send(event transport.Event) error {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return transport.NewTransportError("failed to marshal event", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, b.endpoint, bytes.NewReader(eventJSON))
+	if err != nil {
+		return transport.NewTransportError("failed to create request", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return transport.NewTransportError("failed to send event", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return transport.NewTransportError(fmt.Sprintf("failed to send event, status code: %d", resp.StatusCode), errors.New(string(body)))
+	}
+	return nil
+}